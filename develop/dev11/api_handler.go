@@ -0,0 +1,432 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//apiEventsPath путь ресурса событий REST API
+const apiEventsPath = "/api/v1/events"
+
+//maxJSONBodySize максимальный размер JSON тела запроса
+const maxJSONBodySize = 1 << 20 //1 MB
+
+//eventRequest тело POST и PUT запросов к /api/v1/events.
+//Время принимается в RFC 3339 или датой 02-01-2006; окончание задается End или Duration (например 1h30m).
+//ID и Occurrence, если клиент вернул их вместе с событием, игнорируются.
+type eventRequest struct {
+	UserID     int         `json:"UserID"`
+	CalendarID int         `json:"CalendarID"`
+	Text       string      `json:"Text"`
+	Date       *JSONTime   `json:"Date"`
+	End        *JSONTime   `json:"End"`
+	Duration   string      `json:"Duration"`
+	TimeZone   string      `json:"TimeZone"`
+	AllDay     bool        `json:"AllDay"`
+	Recurrence *Recurrence `json:"Recurrence"`
+	Exceptions []Exception `json:"Exceptions"`
+	Reminders  []Offset    `json:"Reminders"`
+	Tags       []string    `json:"Tags"`
+}
+
+//toEvent собирает Event пользователя из тела запроса.
+//Возвращает ошибку, если не передано время начала или окончание задано дважды.
+func (req eventRequest) toEvent(userID int) (Event, error) {
+	if req.Date == nil {
+		return Event{}, errors.New("missing Date")
+	}
+	if req.End != nil && req.Duration != "" {
+		return Event{}, errors.New("End and Duration are mutually exclusive")
+	}
+
+	event := Event{
+		UserID:     userID,
+		CalendarID: req.CalendarID,
+		Text:       req.Text,
+		Date:       *req.Date,
+		TimeZone:   req.TimeZone,
+		AllDay:     req.AllDay,
+		Recurrence: req.Recurrence,
+		Exceptions: req.Exceptions,
+		Reminders:  req.Reminders,
+		Tags:       req.Tags,
+	}
+
+	if req.End != nil {
+		event.End = *req.End
+	}
+	if req.Duration != "" {
+		duration, err := time.ParseDuration(req.Duration)
+		if err != nil || duration < 0 {
+			return Event{}, errors.New("bad Duration")
+		}
+		event.End = JSONTime(time.Time(*req.Date).Add(duration))
+	}
+	return event, nil
+}
+
+//eventPatch тело PATCH запроса к /api/v1/events/{id}.
+//Меняются только переданные поля, как в /update_event.
+type eventPatch struct {
+	CalendarID *int      `json:"CalendarID"`
+	Text       *string   `json:"Text"`
+	Date       *JSONTime `json:"Date"`
+	End        *JSONTime `json:"End"`
+	Duration   *string   `json:"Duration"`
+	TimeZone   *string   `json:"TimeZone"`
+	Reminders  *[]Offset `json:"Reminders"`
+	Tags       *[]string `json:"Tags"`
+}
+
+//toChange переводит тело PATCH запроса в EventChange.
+//Возвращает ошибку, если окончание задано дважды или длительность некорректна.
+func (patch eventPatch) toChange() (EventChange, error) {
+	var change EventChange
+	if patch.End != nil && patch.Duration != nil {
+		return change, errors.New("End and Duration are mutually exclusive")
+	}
+
+	if patch.CalendarID != nil {
+		if *patch.CalendarID <= 0 {
+			return change, errors.New("bad CalendarID")
+		}
+		change.CalendarID = *patch.CalendarID
+	}
+	if patch.Text != nil {
+		change.Text = *patch.Text
+	}
+	if patch.Date != nil {
+		change.Date = time.Time(*patch.Date)
+	}
+	if patch.End != nil {
+		change.End = time.Time(*patch.End)
+	}
+	if patch.Duration != nil {
+		duration, err := time.ParseDuration(*patch.Duration)
+		if err != nil || duration <= 0 {
+			return change, errors.New("bad Duration")
+		}
+		change.Duration = duration
+	}
+	if patch.TimeZone != nil {
+		change.TimeZone = *patch.TimeZone
+	}
+	if patch.Reminders != nil {
+		change.Reminders = append([]Offset{}, *patch.Reminders...)
+	}
+	if patch.Tags != nil {
+		change.Tags = append([]string{}, *patch.Tags...)
+	}
+	return change, nil
+}
+
+//writeJSONEvent записывает в http.ResponseWriter одно Event
+//в JSON формате с соответствующим хедером.
+//Принимает: статус код результата и событие.
+func writeJSONEvent(w http.ResponseWriter, status int, event Event) {
+	w.Header().Set("ETag", eventETag(event))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	data := struct {
+		Event Event `json:"Result"`
+	}{Event: event}
+	json.NewEncoder(w).Encode(data)
+}
+
+//decodeJSONBody разбирает JSON тело запроса в v.
+//Возвращает: статус код ошибки (415 для другого Content-Type, 413 для слишком большого тела,
+//400 для некорректного JSON) и саму ошибку.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) (int, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		return http.StatusUnsupportedMediaType, fmt.Errorf("expect Content-Type application/json, got %q", mediaType)
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxJSONBodySize)
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return http.StatusRequestEntityTooLarge, errors.New("request body too large")
+		}
+		return http.StatusBadRequest, fmt.Errorf("bad JSON body: %s", err)
+	}
+	return 0, nil
+}
+
+//parseEventRange разбирает фильтры списка событий из queryString:
+//from и to в форматах parseEventTime в зоне tz (дата без времени включает весь день)
+//или period=day|week|month с опорной датой date.
+//Возвращает: метод сервиса, выдающий события пользователя, и ошибку разбора.
+//Без фильтров выдаются все события пользователя сериями.
+func (h *Handler) parseEventRange(query url.Values) (func(userID int) ([]Event, error), error) {
+	fromStr, toStr, period := query.Get("from"), query.Get("to"), query.Get("period")
+
+	if fromStr != "" || toStr != "" {
+		if period != "" {
+			return nil, errors.New("period and from/to are mutually exclusive")
+		}
+		loc, ok := parseLocation(query.Get("tz"))
+		if !ok {
+			return nil, errors.New("Bad tz")
+		}
+		from, _, err := parseEventTime(fromStr, loc)
+		if err != nil {
+			return nil, errors.New("Bad from")
+		}
+		to, dateOnly, err := parseEventTime(toStr, loc)
+		if err != nil {
+			return nil, errors.New("Bad to")
+		}
+		if dateOnly {
+			_, to = dayBounds(to)
+		}
+		if to.Before(from) {
+			return nil, errors.New("Bad to")
+		}
+		return func(userID int) ([]Event, error) {
+			return h.service.GetRange(userID, from, to)
+		}, nil
+	}
+
+	date, err := parseAnchor(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var get func(userID int, date time.Time) ([]Event, error)
+	switch period {
+	case "":
+		return h.service.GetAll, nil
+	case "day":
+		get = h.service.GetDay
+	case "week":
+		get = h.service.GetWeek
+	case "month":
+		get = h.service.GetMonth
+	default:
+		return nil, fmt.Errorf("Bad period %q", period)
+	}
+	return func(userID int) ([]Event, error) {
+		return get(userID, date)
+	}, nil
+}
+
+//apiEvents обработчик коллекции /api/v1/events:
+//GET - список событий пользователя с фильтрами parseEventRange,
+//POST - создание события из JSON тела eventRequest, отвечает 201 с созданным Event.
+//Владелец передается параметром user_id, для POST - также полем UserID тела.
+func (h *Handler) apiEvents(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.apiListEvents(w, r)
+	case http.MethodPost:
+		h.apiCreateEvent(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeJSONMessage(w, http.StatusMethodNotAllowed, fmt.Sprintf("expect method GET or POST at %s, got %v", apiEventsPath, r.Method), true)
+	}
+}
+
+//apiListEvents обработчик для GET /api/v1/events
+func (h *Handler) apiListEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	userID, status, err := resolveUserID(r, query.Get("user_id"))
+	if err != nil {
+		writeJSONMessage(w, status, err.Error(), true)
+		return
+	}
+
+	get, err := h.parseEventRange(query)
+	if err != nil {
+		writeJSONMessage(w, http.StatusBadRequest, err.Error(), true)
+		return
+	}
+
+	limit, cursor, err := parsePage(query)
+	if err != nil {
+		writeJSONMessage(w, http.StatusBadRequest, err.Error(), true)
+		return
+	}
+
+	result, err := get(userID)
+	if err != nil {
+		writeJSONMessage(w, http.StatusServiceUnavailable, fmt.Sprintf("Can't get events: %s", err), true)
+		return
+	}
+
+	writeJSONEvents(w, http.StatusOK, paginate(result, limit, cursor))
+}
+
+//apiCreateEvent обработчик для POST /api/v1/events
+func (h *Handler) apiCreateEvent(w http.ResponseWriter, r *http.Request) {
+	var req eventRequest
+	if status, err := decodeJSONBody(w, r, &req); err != nil {
+		writeJSONMessage(w, status, err.Error(), true)
+		return
+	}
+
+	userIDStr := r.URL.Query().Get("user_id")
+	if userIDStr == "" && req.UserID != 0 {
+		userIDStr = strconv.Itoa(req.UserID)
+	}
+	userID, status, err := resolveUserID(r, userIDStr)
+	if err != nil {
+		writeJSONMessage(w, status, err.Error(), true)
+		return
+	}
+
+	event, err := req.toEvent(userID)
+	if err != nil {
+		writeJSONMessage(w, http.StatusBadRequest, err.Error(), true)
+		return
+	}
+
+	event, err = h.service.SaveEvent(event)
+	if err != nil {
+		writeJSONMessage(w, serviceErrorStatus(err), fmt.Sprintf("Can't save event: %s", err), true)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("%s/%d", apiEventsPath, event.ID))
+	writeJSONEvent(w, http.StatusCreated, event)
+}
+
+//apiEvent обработчик ресурса /api/v1/events/{id}:
+//GET - событие сериями, PUT - замена целиком телом eventRequest,
+//PATCH - изменение переданных полей телом eventPatch, DELETE - удаление.
+//PATCH и DELETE принимают параметр occurrence для работы с одним вхождением серии.
+//Ответ с событием несет ETag его версии; PUT, PATCH и DELETE с If-Match
+//выполняются, только если событие не менялось с этой версии, иначе 412.
+//Ресурсы /api/v1/events/{id}/history и /api/v1/events/{id}/restore обрабатывают
+//apiEventHistory и apiEventRestore.
+func (h *Handler) apiEvent(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, apiEventsPath+"/"), "/")
+	id, err := strconv.Atoi(parts[0])
+	if id <= 0 || err != nil || (len(parts) != 1 && (len(parts) != 2 || (parts[1] != "history" && parts[1] != "restore"))) {
+		writeJSONMessage(w, http.StatusNotFound, fmt.Sprintf("Unknown resource %s", r.URL.Path), true)
+		return
+	}
+
+	query := r.URL.Query()
+
+	userID, status, err := resolveUserID(r, query.Get("user_id"))
+	if err != nil {
+		writeJSONMessage(w, status, err.Error(), true)
+		return
+	}
+
+	occurrence, ok := parseOccurrence(query)
+	if !ok {
+		writeJSONMessage(w, http.StatusBadRequest, "Bad occurrence", true)
+		return
+	}
+
+	version, ok := parseIfMatch(r.Header)
+	if !ok {
+		writeJSONMessage(w, http.StatusBadRequest, "Bad If-Match", true)
+		return
+	}
+
+	if len(parts) == 2 {
+		if parts[1] == "history" {
+			h.apiEventHistory(w, r, userID, id)
+		} else {
+			h.apiEventRestore(w, r, userID, id, version)
+		}
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		event, ok := h.service.GetEvent(userID, id)
+		if !ok {
+			writeJSONMessage(w, http.StatusNotFound, fmt.Sprintf("Event with id %d doesn't exists", id), true)
+			return
+		}
+		writeJSONEvent(w, http.StatusOK, event)
+
+	case http.MethodPut:
+		var req eventRequest
+		if status, err := decodeJSONBody(w, r, &req); err != nil {
+			writeJSONMessage(w, status, err.Error(), true)
+			return
+		}
+		event, err := req.toEvent(userID)
+		if err != nil {
+			writeJSONMessage(w, http.StatusBadRequest, err.Error(), true)
+			return
+		}
+		event, isExists, err := h.service.ReplaceEvent(userID, id, event, version)
+		writeAPIResult(w, id, event, isExists, err, "Can't replace event")
+
+	case http.MethodPatch:
+		var patch eventPatch
+		if status, err := decodeJSONBody(w, r, &patch); err != nil {
+			writeJSONMessage(w, status, err.Error(), true)
+			return
+		}
+		change, err := patch.toChange()
+		if err != nil {
+			writeJSONMessage(w, http.StatusBadRequest, err.Error(), true)
+			return
+		}
+		event, isExists, err := h.service.ChangeEvent(userID, id, occurrence, change, version)
+		writeAPIResult(w, id, event, isExists, err, "Can't change event")
+
+	case http.MethodDelete:
+		isExists, err := h.service.DeleteEvent(userID, id, occurrence, version)
+		if err == nil && isExists {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeAPIResult(w, id, Event{}, isExists, err, "Can't delete event")
+
+	default:
+		w.Header().Set("Allow", "GET, PUT, PATCH, DELETE")
+		writeJSONMessage(w, http.StatusMethodNotAllowed, fmt.Sprintf("expect method GET, PUT, PATCH or DELETE at %s/{id}, got %v", apiEventsPath, r.Method), true)
+	}
+}
+
+//writeAPIResult отвечает на изменение события: 409 при пересечении с другими событиями,
+//412 при несовпадении версии из If-Match, 503 при другой ошибке сервиса, 404 для отсутствующего у пользователя события
+//или календаря,
+//иначе 200 с новым состоянием события.
+func writeAPIResult(w http.ResponseWriter, id int, event Event, isExists bool, err error, errPrefix string) {
+	if err != nil {
+		writeJSONMessage(w, serviceErrorStatus(err), fmt.Sprintf("%s: %s", errPrefix, err), true)
+		return
+	}
+
+	if !isExists {
+		writeJSONMessage(w, http.StatusNotFound, fmt.Sprintf("Event with id %d doesn't exists", id), true)
+		return
+	}
+
+	writeJSONEvent(w, http.StatusOK, event)
+}
+
+//serviceErrorStatus выбирает статус ответа REST API на ошибку сервиса:
+//404 для календаря, которого нет или в который нельзя писать, 409 для пересечения событий
+//при политике ConflictReject, 412 при несовпадении версии из If-Match, иначе 503.
+func serviceErrorStatus(err error) int {
+	var conflict *ConflictError
+	if errors.As(err, &conflict) {
+		return http.StatusConflict
+	}
+	if errors.Is(err, ErrVersionMismatch) {
+		return http.StatusPreconditionFailed
+	}
+	if errors.Is(err, ErrCalendarNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusServiceUnavailable
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//apiResult тело ответа REST API с одним событием
+type apiResult struct {
+	Result Event
+	Error  string
+}
+
+//doJSON выполняет запрос к обработчику и разбирает JSON ответ в v
+func doJSON(t *testing.T, handler http.Handler, method string, target string, body string, v interface{}) int {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if v != nil && rec.Body.Len() > 0 {
+		assert.Nil(t, json.NewDecoder(rec.Body).Decode(v))
+	}
+	return rec.Code
+}
+
+func TestAPIEventsLifecycle(t *testing.T) {
+	service, _ := newTestService()
+	handler := NewHandler(service).initRouts()
+
+	var created apiResult
+	code := doJSON(t, handler, http.MethodPost, "/api/v1/events",
+		`{"UserID":1,"Text":"meeting","Date":"2021-12-15T10:00:00+03:00","Duration":"1h","TimeZone":"Europe/Moscow"}`, &created)
+	assert.Equal(t, code, http.StatusCreated)
+	assert.Equal(t, created.Result.ID, 1)
+	assert.Equal(t, created.Result.duration().String(), "1h0m0s")
+
+	var got apiResult
+	code = doJSON(t, handler, http.MethodGet, "/api/v1/events/1?user_id=1", "", &got)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, got.Result.Text, "meeting")
+
+	code = doJSON(t, handler, http.MethodGet, "/api/v1/events/1?user_id=2", "", nil)
+	assert.Equal(t, code, http.StatusNotFound)
+
+	var patched apiResult
+	code = doJSON(t, handler, http.MethodPatch, "/api/v1/events/1?user_id=1", `{"Text":"renamed"}`, &patched)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, patched.Result.Text, "renamed")
+	assert.Equal(t, patched.Result.TimeZone, "Europe/Moscow")
+
+	var replaced apiResult
+	code = doJSON(t, handler, http.MethodPut, "/api/v1/events/1?user_id=1",
+		`{"Text":"replaced","Date":"2021-12-16T09:00:00Z"}`, &replaced)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, replaced.Result.Text, "replaced")
+	assert.Equal(t, replaced.Result.TimeZone, "")
+
+	var list struct{ Result []Event }
+	code = doJSON(t, handler, http.MethodGet, "/api/v1/events?user_id=1&from=16-12-2021&to=16-12-2021", "", &list)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, len(list.Result), 1)
+
+	code = doJSON(t, handler, http.MethodDelete, "/api/v1/events/1?user_id=1", "", nil)
+	assert.Equal(t, code, http.StatusNoContent)
+
+	code = doJSON(t, handler, http.MethodDelete, "/api/v1/events/1?user_id=1", "", nil)
+	assert.Equal(t, code, http.StatusNotFound)
+}
+
+func TestAPIEventsBadRequests(t *testing.T) {
+	service, _ := newTestService()
+	handler := NewHandler(service).initRouts()
+
+	code := doJSON(t, handler, http.MethodPost, "/api/v1/events", `{"UserID":1,"Text":"no date"}`, nil)
+	assert.Equal(t, code, http.StatusBadRequest)
+
+	code = doJSON(t, handler, http.MethodPost, "/api/v1/events", `{"UserID":1,`, nil)
+	assert.Equal(t, code, http.StatusBadRequest)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/events", strings.NewReader("user_id=1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, rec.Code, http.StatusUnsupportedMediaType)
+
+	code = doJSON(t, handler, http.MethodGet, "/api/v1/events/abc?user_id=1", "", nil)
+	assert.Equal(t, code, http.StatusNotFound)
+
+	code = doJSON(t, handler, http.MethodGet, "/api/v1/events?user_id=1&period=year", "", nil)
+	assert.Equal(t, code, http.StatusBadRequest)
+}
+
+func TestAPIEventsIfMatch(t *testing.T) {
+	service, _ := newTestService()
+	handler := NewHandler(service).initRouts()
+
+	doJSON(t, handler, http.MethodPost, "/api/v1/events", `{"UserID":1,"Text":"a","Date":"2021-12-15T10:00:00Z"}`, nil)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/events/1?user_id=1", nil))
+	assert.Equal(t, rec.Header().Get("ETag"), `"1"`)
+
+	patch := func(ifMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, "/api/v1/events/1?user_id=1", strings.NewReader(`{"Text":"b"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("If-Match", ifMatch)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec = patch(`"1"`)
+	assert.Equal(t, rec.Code, http.StatusOK)
+	assert.Equal(t, rec.Header().Get("ETag"), `"2"`)
+
+	//второй клиент правит от прежней версии
+	assert.Equal(t, patch(`"1"`).Code, http.StatusPreconditionFailed)
+	assert.Equal(t, patch(`W/"2"`).Code, http.StatusPreconditionFailed)
+	assert.Equal(t, patch(`2`).Code, http.StatusBadRequest)
+	assert.Equal(t, patch(`*`).Code, http.StatusOK)
+
+	req := httptest.NewRequest(http.MethodPost, "/delete_event", strings.NewReader("user_id=1&id=1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("If-Match", `"2"`)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, rec.Code, http.StatusPreconditionFailed)
+
+	req = httptest.NewRequest(http.MethodDelete, "/api/v1/events/1?user_id=1", nil)
+	req.Header.Set("If-Match", `"3"`)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, rec.Code, http.StatusNoContent)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+//Статусы участника события (PARTSTAT в iTIP)
+const (
+	StatusNeedsAction = "needs-action"
+	StatusAccepted    = "accepted"
+	StatusDeclined    = "declined"
+	StatusTentative   = "tentative"
+)
+
+//Методы сообщений iTIP (RFC 5546)
+const (
+	MethodRequest = "REQUEST"
+	MethodReply   = "REPLY"
+	MethodCancel  = "CANCEL"
+)
+
+//Attendee участник события: приглашенный пользователь и его ответ
+type Attendee struct {
+	UserID int    `json:"UserID"`
+	Status string `json:"Status"`
+}
+
+//ErrNotInvited пользователь не приглашен на событие
+var ErrNotInvited = errors.New("user is not invited to the event")
+
+//ErrInviteOrganizer организатор не может пригласить на событие самого себя
+var ErrInviteOrganizer = errors.New("organizer can't be invited to own event")
+
+//parseResponse разбирает ответ на приглашение: accepted, declined или tentative
+func parseResponse(str string) (string, error) {
+	switch status := strings.ToLower(str); status {
+	case StatusAccepted, StatusDeclined, StatusTentative:
+		return status, nil
+	}
+	return "", fmt.Errorf("unknown response %q: expect accepted, declined or tentative", str)
+}
+
+//attendee ищет пользователя среди участников события
+func (e Event) attendee(userID int) (Attendee, bool) {
+	for _, a := range e.Attendees {
+		if a.UserID == userID {
+			return a, true
+		}
+	}
+	return Attendee{}, false
+}
+
+//attends проверяет, что пользователь приглашен на событие и не отклонил приглашение
+func (e Event) attends(userID int) bool {
+	a, ok := e.attendee(userID)
+	return ok && a.Status != StatusDeclined
+}
+
+//withAttendees возвращает событие с участниками, которых update построил по его текущему состоянию,
+//и следующей версией. Слайс участников копируется, чтобы не менять прежнее состояние.
+func withAttendees(el Event, update func(event Event) ([]Attendee, error)) (Event, error) {
+	attendees, err := update(el)
+	if err != nil {
+		return Event{}, err
+	}
+	el.Attendees = append([]Attendee(nil), attendees...)
+	if len(el.Attendees) == 0 {
+		el.Attendees = nil
+	}
+	el.Version++
+	return el, nil
+}
+
+//Invite приглашает пользователей userIDs на событие организатора organizerID.
+//Новые участники получают статус needs-action и приглашение (iTIP REQUEST),
+//уже приглашенные пропускаются, их ответы не сбрасываются.
+//Возвращает новое состояние события, флаг наличия события у организатора и ошибку приглашения.
+func (s *Service) Invite(organizerID int, id int, userIDs []int) (Event, bool, error) {
+	if _, ok := s.ownEvent(organizerID, id); !ok {
+		return Event{}, false, nil
+	}
+
+	var invited []int
+	event, ok, err := s.storage.updateAttendees(id, func(el Event) ([]Attendee, error) {
+		attendees := append([]Attendee(nil), el.Attendees...)
+		for _, userID := range userIDs {
+			if userID == el.UserID {
+				return nil, ErrInviteOrganizer
+			}
+			if _, ok := (Event{Attendees: attendees}).attendee(userID); ok {
+				continue
+			}
+			attendees = append(attendees, Attendee{UserID: userID, Status: StatusNeedsAction})
+			invited = append(invited, userID)
+		}
+		return attendees, nil
+	}, Author{UserID: organizerID})
+	if !ok || err != nil {
+		return Event{}, ok, err
+	}
+
+	messages := make([]ITIPMessage, 0, len(invited))
+	for _, userID := range invited {
+		messages = append(messages, s.itipMessage(MethodRequest, event, event.UserID, userID))
+	}
+	s.deliver(messages)
+	return event, true, nil
+}
+
+//Respond записывает ответ участника userID на приглашение на событие id
+//и отправляет его организатору (iTIP REPLY).
+//Возвращает новое состояние события, флаг наличия события и ошибку ответа (ErrNotInvited).
+func (s *Service) Respond(userID int, id int, status string) (Event, bool, error) {
+	event, ok, err := s.storage.updateAttendees(id, func(el Event) ([]Attendee, error) {
+		attendees := append([]Attendee(nil), el.Attendees...)
+		for i := range attendees {
+			if attendees[i].UserID == userID {
+				attendees[i].Status = status
+				return attendees, nil
+			}
+		}
+		return nil, ErrNotInvited
+	}, Author{UserID: userID})
+	if !ok || err != nil {
+		return Event{}, ok, err
+	}
+
+	s.deliver([]ITIPMessage{s.itipMessage(MethodReply, event, userID, event.UserID)})
+	return event, true, nil
+}
+
+//Invitations выдает события, на приглашения на которые пользователь еще не ответил,
+//повторяющиеся - сериями, по времени начала
+func (s *Service) Invitations(userID int) ([]Event, error) {
+	events, err := s.storage.getInvited(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make([]Event, 0, len(events))
+	for _, event := range events {
+		if a, ok := event.attendee(userID); ok && a.Status == StatusNeedsAction {
+			pending = append(pending, event)
+		}
+	}
+	sortEvents(pending)
+	return pending, nil
+}
+
+//cancelInvitations сообщает участникам удаленного события об отмене (iTIP CANCEL)
+func (s *Service) cancelInvitations(event Event) {
+	messages := make([]ITIPMessage, 0, len(event.Attendees))
+	for _, a := range event.Attendees {
+		if a.Status != StatusDeclined {
+			messages = append(messages, s.itipMessage(MethodCancel, event, event.UserID, a.UserID))
+		}
+	}
+	s.deliver(messages)
+}
+
+//ITIPMessage сообщение iTIP о событии для одного получателя.
+//Key однозначно определяет сообщение: id и версия события, метод и получатель.
+//Calendar - VCALENDAR с METHOD, готовый к отправке как text/calendar.
+type ITIPMessage struct {
+	Key       string `json:"Key"`
+	Method    string `json:"Method"`
+	EventID   int    `json:"EventID"`
+	From      string `json:"From"`
+	To        string `json:"To"`
+	Recipient int    `json:"Recipient"`
+	Calendar  string `json:"Calendar"`
+}
+
+//itipMessage строит сообщение iTIP о событии от пользователя from пользователю to.
+//Ответ (REPLY) содержит только ответившего участника, как требует RFC 5546.
+func (s *Service) itipMessage(method string, event Event, from int, to int) ITIPMessage {
+	if method == MethodReply {
+		a, _ := event.attendee(from)
+		event.Attendees = []Attendee{a}
+	}
+
+	var b strings.Builder
+	encodeITIP(&b, method, event, s.now())
+	return ITIPMessage{
+		Key:       fmt.Sprintf("%d-%d-%s-%d", event.ID, event.Version, method, to),
+		Method:    method,
+		EventID:   event.ID,
+		From:      userAddress(from),
+		To:        userAddress(to),
+		Recipient: to,
+		Calendar:  b.String(),
+	}
+}
+
+//deliver ставит сообщения в очередь доставки во все ящики исходящих s.outbox.
+//Доставка идет в фоне и не задерживает и не отменяет изменение события.
+func (s *Service) deliver(messages []ITIPMessage) {
+	if s.outbox == nil {
+		return
+	}
+	s.outbox.Enqueue(messages)
+}
+
+//userAddress адрес пользователя календаря в ORGANIZER и ATTENDEE
+func userAddress(userID int) string {
+	return fmt.Sprintf("urn:x-dev11:user:%d", userID)
+}
+
+//partStat значение PARTSTAT для статуса участника
+func partStat(status string) string {
+	return strings.ToUpper(status)
+}
+
+//encodeITIP сериализует сообщение iTIP: VCALENDAR с METHOD и одним VEVENT события.
+//SEQUENCE считается от версии события; отмена помечается STATUS:CANCELLED.
+func encodeITIP(w io.Writer, method string, event Event, stamp time.Time) error {
+	iw := &icalWriter{w: bufio.NewWriter(w)}
+
+	iw.line("BEGIN", "VCALENDAR")
+	iw.line("VERSION", "2.0")
+	iw.line("PRODID", "-//dev11//calendar//RU")
+	iw.line("METHOD", method)
+
+	iw.line("BEGIN", "VEVENT")
+	writeEventProps(iw, event, stamp, nil, true)
+	iw.line("SEQUENCE", fmt.Sprint(event.Version-1))
+	if method == MethodCancel {
+		iw.line("STATUS", "CANCELLED")
+	}
+	iw.line("END", "VEVENT")
+
+	iw.line("END", "VCALENDAR")
+	if iw.err != nil {
+		return iw.err
+	}
+	return iw.w.Flush()
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//memoryOutbox ящик исходящих, запоминающий сообщения для проверки.
+//Пока задано fail, доставка возвращает эту ошибку.
+type memoryOutbox struct {
+	mutex    sync.Mutex
+	messages []ITIPMessage
+	fail     error
+	queue    *OutboxQueue
+}
+
+func (o *memoryOutbox) Name() string {
+	return "memory"
+}
+
+func (o *memoryOutbox) Post(ctx context.Context, m ITIPMessage) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.fail != nil {
+		return o.fail
+	}
+	o.messages = append(o.messages, m)
+	return nil
+}
+
+//take доставляет все, что ждет в очереди, и забирает доставленное
+func (o *memoryOutbox) take() []ITIPMessage {
+	if o.queue != nil {
+		o.queue.deliverDue(context.Background())
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	messages := o.messages
+	o.messages = nil
+	return messages
+}
+
+func newInvitationService() (*Service, *memoryOutbox) {
+	service, _ := newTestService()
+	outbox := &memoryOutbox{}
+	service.outbox, _ = NewOutboxQueue([]Outbox{outbox}, "")
+	outbox.queue = service.outbox
+	return service, outbox
+}
+
+func TestInvite(t *testing.T) {
+	service, outbox := newInvitationService()
+	event, err := service.SaveEvent(newEvent(1, "planning", fixedNow))
+	assert.Nil(t, err)
+
+	invited, ok, err := service.Invite(1, event.ID, []int{2, 3})
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	assert.Equal(t, invited.Version, 2)
+	assert.Equal(t, invited.Attendees, []Attendee{{UserID: 2, Status: StatusNeedsAction}, {UserID: 3, Status: StatusNeedsAction}})
+
+	messages := outbox.take()
+	assert.Equal(t, len(messages), 2)
+	assert.Equal(t, messages[0].Method, MethodRequest)
+	assert.Equal(t, messages[0].Recipient, 2)
+	assert.Equal(t, messages[0].From, "urn:x-dev11:user:1")
+	assert.Equal(t, messages[0].Key, "1-2-REQUEST-2")
+	assert.Contains(t, messages[0].Calendar, "METHOD:REQUEST\r\n")
+	assert.Contains(t, messages[0].Calendar, "ORGANIZER:urn:x-dev11:user:1\r\n")
+	assert.Contains(t, messages[0].Calendar, "ATTENDEE;PARTSTAT=NEEDS-ACTION:urn:x-dev11:user:3\r\n")
+	assert.Contains(t, messages[0].Calendar, "SEQUENCE:1\r\n")
+
+	//повторное приглашение не сбрасывает ответ и не шлет сообщение
+	_, _, err = service.Respond(2, event.ID, StatusAccepted)
+	assert.Nil(t, err)
+	outbox.take()
+	invited, _, err = service.Invite(1, event.ID, []int{2})
+	assert.Nil(t, err)
+	assert.Equal(t, invited.Attendees[0].Status, StatusAccepted)
+	assert.Empty(t, outbox.take())
+
+	_, _, err = service.Invite(1, event.ID, []int{4, 1})
+	assert.ErrorIs(t, err, ErrInviteOrganizer)
+	stored, _ := service.GetEvent(1, event.ID)
+	assert.Equal(t, len(stored.Attendees), 2)
+
+	//пригласить на чужое событие нельзя
+	_, ok, err = service.Invite(2, event.ID, []int{5})
+	assert.False(t, ok)
+	assert.Nil(t, err)
+}
+
+func TestRespond(t *testing.T) {
+	service, outbox := newInvitationService()
+	event, _ := service.SaveEvent(newEvent(1, "planning", fixedNow))
+	service.Invite(1, event.ID, []int{2, 3})
+	outbox.take()
+
+	responded, ok, err := service.Respond(3, event.ID, StatusTentative)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	assert.Equal(t, responded.Attendees[1], Attendee{UserID: 3, Status: StatusTentative})
+
+	messages := outbox.take()
+	assert.Equal(t, len(messages), 1)
+	assert.Equal(t, messages[0].Method, MethodReply)
+	assert.Equal(t, messages[0].Recipient, 1)
+	assert.Contains(t, messages[0].Calendar, "ATTENDEE;PARTSTAT=TENTATIVE:urn:x-dev11:user:3\r\n")
+	assert.NotContains(t, messages[0].Calendar, "user:2\r\n")
+
+	_, ok, err = service.Respond(4, event.ID, StatusAccepted)
+	assert.True(t, ok)
+	assert.ErrorIs(t, err, ErrNotInvited)
+
+	_, ok, _ = service.Respond(3, 99, StatusAccepted)
+	assert.False(t, ok)
+}
+
+func TestAttendedListings(t *testing.T) {
+	service, _ := newInvitationService()
+	meeting, _ := service.SaveEvent(Event{UserID: 1, Text: "meeting", Date: JSONTime(fixedNow.Add(-time.Hour)), End: JSONTime(fixedNow)})
+	service.SaveEvent(Event{UserID: 2, Text: "own", Date: JSONTime(fixedNow.Add(time.Hour)), End: JSONTime(fixedNow.Add(2 * time.Hour))})
+	service.Invite(1, meeting.ID, []int{2})
+
+	result, err := service.GetDay(2, time.Time{})
+	assert.Nil(t, err)
+	assert.Equal(t, len(result), 2)
+	assert.Equal(t, result[0].ID, meeting.ID)
+	assert.Equal(t, result[1].Text, "own")
+
+	fb, err := service.FreeBusy(2, day(2021, 12, 15), day(2021, 12, 16), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, len(fb.Busy), 2)
+
+	pending, err := service.Invitations(2)
+	assert.Nil(t, err)
+	assert.Equal(t, len(pending), 1)
+
+	service.Respond(2, meeting.ID, StatusDeclined)
+	result, _ = service.GetWeek(2, time.Time{})
+	assert.Equal(t, len(result), 1)
+	pending, _ = service.Invitations(2)
+	assert.Empty(t, pending)
+
+	//организатор видит событие как раньше
+	result, _ = service.GetDay(1, time.Time{})
+	assert.Equal(t, len(result), 1)
+}
+
+func TestAttendeesKept(t *testing.T) {
+	service, outbox := newInvitationService()
+	event, _ := service.SaveEvent(newEvent(1, "planning", fixedNow))
+	service.Invite(1, event.ID, []int{2, 3})
+	service.Respond(3, event.ID, StatusDeclined)
+
+	//участники задаются только приглашениями: замена и изменение их не трогают
+	replacement := newEvent(1, "review", fixedNow)
+	replacement.Attendees = []Attendee{{UserID: 9, Status: StatusAccepted}}
+	replaced, _, err := service.ReplaceEvent(1, event.ID, replacement, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, len(replaced.Attendees), 2)
+	changed, _, err := service.ChangeEvent(1, event.ID, time.Time{}, EventChange{Text: "retro"}, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, len(changed.Attendees), 2)
+
+	created, _ := service.SaveEvent(replacement)
+	assert.Nil(t, created.Attendees)
+
+	//отмена уходит только не отказавшимся участникам
+	outbox.take()
+	ok, err := service.DeleteEvent(1, event.ID, time.Time{}, 0)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	messages := outbox.take()
+	assert.Equal(t, len(messages), 1)
+	assert.Equal(t, messages[0].Method, MethodCancel)
+	assert.Equal(t, messages[0].Recipient, 2)
+	assert.Contains(t, messages[0].Calendar, "STATUS:CANCELLED\r\n")
+
+	pending, _ := service.Invitations(2)
+	assert.Empty(t, pending)
+}
+
+func TestParseResponse(t *testing.T) {
+	status, err := parseResponse("Accepted")
+	assert.Nil(t, err)
+	assert.Equal(t, status, StatusAccepted)
+
+	_, err = parseResponse(StatusNeedsAction)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+//Действия журнала аудита в дополнение к видам изменений ленты
+const (
+	//ChangeRestored событие восстановлено или возвращено к прежней ревизии
+	ChangeRestored = "restored"
+	//ChangeArchived закончившееся событие перенесено в архив фоновой уборкой
+	ChangeArchived = "archived"
+)
+
+//ErrRevisionNotFound в журнале аудита нет запрошенной ревизии события
+var ErrRevisionNotFound = errors.New("revision not found")
+
+//ErrEventExists событие с таким id уже есть в хранилище
+var ErrEventExists = errors.New("event already exists")
+
+//AuditEntry запись журнала аудита об изменении события.
+//Action - ChangeCreated, ChangeUpdated, ChangeDeleted, ChangeRestored или ChangeArchived; Actor - пользователь,
+//от имени которого шел запрос (не обязательно владелец события, 0 - фоновая уборка). Before и After - состояние
+//события до и после изменения (у созданного нет Before, у удаленного и архивированного - After).
+//Revision - версия события после изменения, для удаления - версия удаленного события.
+type AuditEntry struct {
+	Seq      int      `json:"Seq"`
+	Time     JSONTime `json:"Time"`
+	Actor    int      `json:"Actor"`
+	Action   string   `json:"Action"`
+	EventID  int      `json:"EventID"`
+	Revision int      `json:"Revision"`
+	Before   *Event   `json:"Before,omitempty"`
+	After    *Event   `json:"After,omitempty"`
+}
+
+//state последнее известное по записи состояние события
+func (e AuditEntry) state() Event {
+	if e.After != nil {
+		return *e.After
+	}
+	return *e.Before
+}
+
+//AuditLog журнал аудита: записи дописываются в память и, при path, JSON строками в файл.
+//Записи старше срока хранения удаляет Prune, так что журнал не растет без предела.
+type AuditLog struct {
+	mutex   sync.RWMutex
+	entries []AuditEntry
+	byEvent map[int][]int
+	seq     int
+	path    string
+}
+
+//NewAuditLog конструктор для AuditLog.
+//Принимает путь к файлу журнала (пусто - только в памяти) и загружает записи из него.
+//Недописанная последняя строка (падение во время записи) пропускается.
+//Возвращает: ссылку на AuditLog и ошибку загрузки.
+func NewAuditLog(path string) (*AuditLog, error) {
+	l := &AuditLog{byEvent: make(map[int][]int), path: path}
+	if path == "" {
+		return l, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var entry AuditEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, fmt.Errorf("bad audit log %s at line %d: %w", path, n, err)
+		}
+		l.add(entry)
+	}
+	return l, nil
+}
+
+//add кладет запись в память. Вызывается под l.mutex.
+func (l *AuditLog) add(entry AuditEntry) {
+	l.byEvent[entry.EventID] = append(l.byEvent[entry.EventID], len(l.entries))
+	l.entries = append(l.entries, entry)
+	if entry.Seq > l.seq {
+		l.seq = entry.Seq
+	}
+}
+
+//Append присваивает записи следующий номер и дописывает ее в журнал.
+//Запись остается в памяти, даже если не удалось дописать ее в файл.
+//Конкурентно безопасный метод.
+func (l *AuditLog) Append(entry AuditEntry) (AuditEntry, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	entry.Seq = l.seq + 1
+	l.add(entry)
+	if l.path == "" {
+		return entry, nil
+	}
+	return entry, appendJSONLine(l.path, entry)
+}
+
+//History выдает записи журнала о событии id по порядку.
+//Конкурентно безопасный метод.
+func (l *AuditLog) History(id int) []AuditEntry {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	result := make([]AuditEntry, 0, len(l.byEvent[id]))
+	for _, i := range l.byEvent[id] {
+		result = append(result, l.entries[i])
+	}
+	return result
+}
+
+//Prune удаляет записи, сделанные раньше before, и переписывает файл журнала оставшимися.
+//Номера следующих записей продолжают прежние.
+//Возвращает число удаленных записей.
+//Конкурентно безопасный метод.
+func (l *AuditLog) Prune(before time.Time) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	kept := make([]AuditEntry, 0, len(l.entries))
+	for _, entry := range l.entries {
+		if !time.Time(entry.Time).Before(before) {
+			kept = append(kept, entry)
+		}
+	}
+	pruned := len(l.entries) - len(kept)
+	if pruned == 0 {
+		return 0, nil
+	}
+
+	if l.path != "" {
+		var data bytes.Buffer
+		encoder := json.NewEncoder(&data)
+		for _, entry := range kept {
+			if err := encoder.Encode(entry); err != nil {
+				return 0, err
+			}
+		}
+		if err := writeFileAtomic(l.path, data.Bytes()); err != nil {
+			return 0, err
+		}
+	}
+
+	l.entries, l.byEvent = nil, make(map[int][]int)
+	for _, entry := range kept {
+		l.add(entry)
+	}
+	return pruned, nil
+}
+
+//revisionState ищет в истории события его состояние в ревизии revision
+func revisionState(history []AuditEntry, revision int) (Event, bool) {
+	for _, entry := range history {
+		for _, state := range []*Event{entry.After, entry.Before} {
+			if state != nil && state.Version == revision {
+				return *state, true
+			}
+		}
+	}
+	return Event{}, false
+}
+
+//record дописывает изменение хранилища в журнал аудита от имени автора by.
+//Вызывается наблюдателем хранилища под его блокировкой, поэтому состояние "до" - ровно то,
+//которое заменило изменение, и записи идут в порядке изменений.
+//Действие - by.Action или, если оно не задано, вид изменения kind.
+//Ошибка записи в файл журнала не отменяет изменения и только пишется в лог.
+func (s *Service) record(kind string, event Event, previous *Event, by Author) {
+	if s.audit == nil {
+		return
+	}
+	action := by.Action
+	if action == "" {
+		action = kind
+	}
+	entry := AuditEntry{Time: JSONTime(s.now().UTC()), Actor: by.UserID, Action: action,
+		EventID: event.ID, Revision: event.Version}
+	if kind == ChangeDeleted {
+		entry.Before = auditState(&event)
+	} else {
+		entry.Before, entry.After = auditState(previous), auditState(&event)
+	}
+	if _, err := s.audit.Append(entry); err != nil {
+		log.Printf("audit: %s event %d: %s", action, entry.EventID, err)
+	}
+}
+
+//auditState копия состояния события для журнала без пересечений,
+//которые относятся к ответу на сохранение, а не к событию
+func auditState(event *Event) *Event {
+	if event == nil {
+		return nil
+	}
+	state := *event
+	state.Conflicts = nil
+	return &state
+}
+
+//canAccess проверяет, что пользователь может работать с событием на уровне level:
+//это его событие или событие календаря, открытого ему на этом уровне
+func (s *Service) canAccess(userID int, event Event, level string) bool {
+	if event.UserID == userID {
+		return true
+	}
+	if event.CalendarID == 0 {
+		return false
+	}
+	cal, ok := s.calendars.Load(event.CalendarID)
+	return ok && cal.OwnerID == event.UserID && cal.allows(userID, level)
+}
+
+//History выдает историю изменений события id по журналу аудита, в том числе удаленного.
+//Историю видят владелец события и пользователи, которым открыт его календарь.
+//Возвращает записи по порядку и флаг наличия истории, доступной пользователю.
+func (s *Service) History(userID int, id int) ([]AuditEntry, bool) {
+	history := s.audit.History(id)
+	if len(history) == 0 || !s.canAccess(userID, history[len(history)-1].state(), ShareRead) {
+		return nil, false
+	}
+	return history, true
+}
+
+//RestoreEvent возвращает событие id к состоянию ревизии revision из журнала аудита.
+//Удаленное событие создается заново под тем же id, существующее заменяется состоянием ревизии
+//(участники сохраняются, версия version из If-Match проверяется как в ReplaceEvent).
+//Ревизия 0 - отмена последнего действия: для удаленного события - состояние перед удалением,
+//для существующего - предыдущая версия. Восстановленное событие получает новую версию.
+//Восстанавливать может владелец и пользователь, которому календарь события открыт на запись.
+//Возвращает новое состояние события, флаг наличия истории события у пользователя
+//и ошибку восстановления (ErrRevisionNotFound, если ревизии нет в журнале).
+func (s *Service) RestoreEvent(userID int, id int, revision int, version int) (Event, bool, error) {
+	s.calendarWrites.RLock()
+	defer s.calendarWrites.RUnlock()
+
+	history := s.audit.History(id)
+	if len(history) == 0 {
+		return Event{}, false, nil
+	}
+	last := history[len(history)-1].state()
+	if !s.canAccess(userID, last, ShareWrite) {
+		return Event{}, false, nil
+	}
+
+	current, exists := s.storage.Load(id)
+	if revision == 0 {
+		revision = last.Version
+		if exists {
+			revision = current.Version - 1
+		}
+	}
+	event, ok := revisionState(history, revision)
+	if !ok {
+		return Event{}, true, ErrRevisionNotFound
+	}
+	if exists {
+		if err := matchVersion(current, version); err != nil {
+			return Event{}, true, err
+		}
+		last = current
+	}
+
+	if err := prepareEvent(&event); err != nil {
+		return Event{}, true, err
+	}
+	event.ID, event.UserID = id, last.UserID
+	//событие в календаре по умолчанию может восстановить только владелец
+	if event.CalendarID != 0 {
+		if err := s.checkCalendar(userID, event.UserID, event.CalendarID); err != nil {
+			return Event{}, true, err
+		}
+	} else if userID != event.UserID {
+		return Event{}, true, ErrCalendarNotFound
+	}
+	conflicts, err := s.checkConflicts(event)
+	if err != nil {
+		return Event{}, true, err
+	}
+
+	by := Author{UserID: userID, Action: ChangeRestored}
+	if exists {
+		event, ok, err = s.storage.Replace(event.UserID, event, version, by)
+		if !ok || err != nil {
+			return Event{}, true, err
+		}
+	} else {
+		event.Version = last.Version + 1
+		if event, err = s.storage.Restore(event, by); err != nil {
+			return Event{}, true, err
+		}
+	}
+	event.Conflicts = conflicts
+	return event, true, nil
+}
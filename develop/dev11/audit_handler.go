@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+//apiEventHistory обработчик ресурса /api/v1/events/{id}/history:
+//GET - записи журнала аудита о событии по порядку, в том числе об удаленном.
+func (h *Handler) apiEventHistory(w http.ResponseWriter, r *http.Request, userID int, id int) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeJSONMessage(w, http.StatusMethodNotAllowed, fmt.Sprintf("expect method GET at %s/{id}/history, got %v", apiEventsPath, r.Method), true)
+		return
+	}
+
+	history, ok := h.service.History(userID, id)
+	if !ok {
+		writeJSONMessage(w, http.StatusNotFound, fmt.Sprintf("No history of event with id %d", id), true)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		History []AuditEntry `json:"Result"`
+	}{History: history})
+}
+
+//apiEventRestore обработчик ресурса /api/v1/events/{id}/restore:
+//POST - восстановление удаленного события или возврат существующего к ревизии из параметра revision
+//(без него - отмена последнего действия). Существующее событие с If-Match возвращается,
+//только если не менялось с этой версии. Отвечает восстановленным событием.
+func (h *Handler) apiEventRestore(w http.ResponseWriter, r *http.Request, userID int, id int, version int) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeJSONMessage(w, http.StatusMethodNotAllowed, fmt.Sprintf("expect method POST at %s/{id}/restore, got %v", apiEventsPath, r.Method), true)
+		return
+	}
+
+	var revision int
+	if str := r.URL.Query().Get("revision"); str != "" {
+		var err error
+		if revision, err = strconv.Atoi(str); revision <= 0 || err != nil {
+			writeJSONMessage(w, http.StatusBadRequest, "Bad revision", true)
+			return
+		}
+	}
+
+	event, isExists, err := h.service.RestoreEvent(userID, id, revision, version)
+	if errors.Is(err, ErrRevisionNotFound) {
+		writeJSONMessage(w, http.StatusNotFound, fmt.Sprintf("Can't restore event: %s", err), true)
+		return
+	}
+	writeAPIResult(w, id, event, isExists, err, "Can't restore event")
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit", "audit.jsonl")
+	l, err := NewAuditLog(path)
+	assert.Nil(t, err)
+
+	event := newEvent(1, "standup", fixedNow)
+	event.ID, event.Version = 1, 1
+	first, err := l.Append(AuditEntry{Actor: 1, Action: ChangeCreated, EventID: 1, Revision: 1, After: &event})
+	assert.Nil(t, err)
+	assert.Equal(t, first.Seq, 1)
+	l.Append(AuditEntry{Actor: 2, Action: ChangeCreated, EventID: 2, Revision: 1})
+	l.Append(AuditEntry{Actor: 3, Action: ChangeDeleted, EventID: 1, Revision: 1, Before: &event})
+	assert.Equal(t, len(l.History(1)), 2)
+	assert.Empty(t, l.History(3))
+
+	//записи переживают перезапуск, недописанная последняя строка пропускается
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString(`{"Seq":4,"Act`)
+	f.Close()
+	reopened, err := NewAuditLog(path)
+	assert.Nil(t, err)
+	history := reopened.History(1)
+	assert.Equal(t, len(history), 2)
+	assert.Equal(t, history[1].Actor, 3)
+	assert.Equal(t, history[1].Before.Text, "standup")
+	last, _ := reopened.Append(AuditEntry{EventID: 2})
+	assert.Equal(t, last.Seq, 4)
+}
+
+func TestAuditLogPrune(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, _ := NewAuditLog(path)
+	l.Append(AuditEntry{Time: JSONTime(day(2021, 11, 1)), EventID: 1, Revision: 1})
+	l.Append(AuditEntry{Time: JSONTime(day(2021, 12, 1)), EventID: 2, Revision: 1})
+	l.Append(AuditEntry{Time: JSONTime(day(2021, 12, 15)), EventID: 1, Revision: 2})
+
+	pruned, err := l.Prune(day(2021, 12, 1))
+	assert.Nil(t, err)
+	assert.Equal(t, pruned, 1)
+	assert.Equal(t, len(l.History(1)), 1)
+	assert.Equal(t, l.History(1)[0].Revision, 2)
+	pruned, _ = l.Prune(day(2021, 12, 1))
+	assert.Equal(t, pruned, 0)
+
+	//файл переписан без удаленных записей, номера продолжаются
+	reopened, err := NewAuditLog(path)
+	assert.Nil(t, err)
+	assert.Equal(t, len(reopened.History(1)), 1)
+	assert.Equal(t, len(reopened.History(2)), 1)
+	next, _ := reopened.Append(AuditEntry{EventID: 2})
+	assert.Equal(t, next.Seq, 4)
+}
+
+func TestAuditRestart(t *testing.T) {
+	dir := t.TempDir()
+	start := func() *Service {
+		store, err := NewFileStore(filepath.Join(dir, "events"), 0)
+		assert.Nil(t, err)
+		service := NewService(store)
+		service.now = func() time.Time { return fixedNow }
+		service.audit, err = NewAuditLog(filepath.Join(dir, "audit.jsonl"))
+		assert.Nil(t, err)
+		return service
+	}
+
+	service := start()
+	old, _ := service.SaveEvent(newEvent(1, "salary review", fixedNow))
+	service.DeleteEvent(1, old.ID, time.Time{}, 0)
+	service.PurgeTrash(fixedNow.Add(time.Hour))
+
+	//после перезапуска номера не переиспользуются: новый владелец не видит и не восстанавливает чужую историю
+	service = start()
+	saved, _ := service.SaveEvent(newEvent(2, "standup", fixedNow))
+	assert.NotEqual(t, saved.ID, old.ID)
+	history, ok := service.History(2, saved.ID)
+	assert.True(t, ok)
+	assert.Equal(t, len(history), 1)
+	_, ok = service.History(2, old.ID)
+	assert.False(t, ok)
+	_, ok, _ = service.RestoreEvent(2, old.ID, 0, 0)
+	assert.False(t, ok)
+
+	//в памяти номера начинаются заново, поэтому файловый журнал с ней не настраивается
+	_, err := decodeConfig(testConfigViper(t, `
+storage:
+  type: "memory"
+audit:
+  path: "audit.jsonl"
+`))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "config audit.path:")
+	}
+}
+
+func TestAuditConcurrentChanges(t *testing.T) {
+	service, _ := newTestService()
+	saved, _ := service.SaveEvent(newEvent(1, "standup", fixedNow))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			service.ChangeEvent(1, saved.ID, time.Time{}, EventChange{Text: strconv.Itoa(i)}, 0)
+		}(i)
+	}
+	wg.Wait()
+
+	//записи идут в порядке изменений хранилища, и состояние "до" каждой - состояние "после" предыдущей
+	history, _ := service.History(1, saved.ID)
+	assert.Equal(t, len(history), 21)
+	for i := 1; i < len(history); i++ {
+		assert.Equal(t, history[i].Revision, i+1)
+		assert.Equal(t, *history[i].Before, *history[i-1].After)
+	}
+}
+
+func TestEventHistory(t *testing.T) {
+	service, _ := newTestService()
+	work, _ := service.CreateCalendar(1, "work")
+	service.ShareCalendar(1, work.ID, 2, ShareRead)
+	service.ShareCalendar(1, work.ID, 3, ShareWrite)
+
+	event := newEvent(1, "standup", fixedNow)
+	event.CalendarID = work.ID
+	saved, _ := service.SaveEvent(event)
+	service.ChangeEvent(3, saved.ID, time.Time{}, EventChange{Text: "daily"}, 0)
+	service.Invite(1, saved.ID, []int{4})
+	service.DeleteEvent(3, saved.ID, time.Time{}, 0)
+
+	//историю удаленного события видят все, кому открыт календарь, а действия записаны от имени автора запроса
+	history, ok := service.History(2, saved.ID)
+	assert.True(t, ok)
+	assert.Equal(t, len(history), 4)
+	actions := []string{}
+	actors := []int{}
+	for _, entry := range history {
+		actions = append(actions, entry.Action)
+		actors = append(actors, entry.Actor)
+	}
+	assert.Equal(t, actions, []string{ChangeCreated, ChangeUpdated, ChangeUpdated, ChangeDeleted})
+	assert.Equal(t, actors, []int{1, 3, 1, 3})
+	assert.Nil(t, history[0].Before)
+	assert.Equal(t, history[1].Before.Text, "standup")
+	assert.Equal(t, history[1].After.Text, "daily")
+	assert.Equal(t, history[1].Revision, 2)
+	assert.Equal(t, history[3].Before.Version, 3)
+	assert.Nil(t, history[3].After)
+	assert.Equal(t, history[3].Time, JSONTime(fixedNow))
+
+	_, ok = service.History(4, saved.ID)
+	assert.False(t, ok)
+	_, ok = service.History(1, 100)
+	assert.False(t, ok)
+
+	//атомарный пакет записывает изменения с id хранилища
+	other, _ := service.SaveEvent(newEvent(1, "dentist", fixedNow))
+	outcomes, applied, err := service.Batch(1, []BatchCommand{
+		{Kind: BatchCreate, Event: newEvent(1, "lunch", fixedNow)},
+		{Kind: BatchDelete, ID: other.ID},
+	}, true)
+	assert.Nil(t, err)
+	assert.True(t, applied)
+	history, _ = service.History(1, outcomes[0].Event.ID)
+	assert.Equal(t, len(history), 1)
+	assert.Equal(t, history[0].After.Text, "lunch")
+	history, _ = service.History(1, other.ID)
+	assert.Equal(t, history[len(history)-1].Action, ChangeDeleted)
+}
+
+func TestRestoreEvent(t *testing.T) {
+	service, _ := newTestService()
+	saved, _ := service.SaveEvent(newEvent(1, "standup", fixedNow))
+	service.ChangeEvent(1, saved.ID, time.Time{}, EventChange{Text: "daily", Tags: []string{"work"}}, 0)
+
+	//отмена изменения возвращает предыдущую ревизию новой версией
+	restored, ok, err := service.RestoreEvent(1, saved.ID, 0, 0)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	assert.Equal(t, restored.Text, "standup")
+	assert.Empty(t, restored.Tags)
+	assert.Equal(t, restored.Version, 3)
+
+	_, _, err = service.RestoreEvent(1, saved.ID, 2, 2)
+	assert.ErrorIs(t, err, ErrVersionMismatch)
+	_, _, err = service.RestoreEvent(1, saved.ID, 7, 0)
+	assert.ErrorIs(t, err, ErrRevisionNotFound)
+	_, ok, _ = service.RestoreEvent(2, saved.ID, 2, 0)
+	assert.False(t, ok)
+
+	//удаленное событие создается заново под тем же id, версии продолжаются
+	service.DeleteEvent(1, saved.ID, time.Time{}, 0)
+	restored, ok, err = service.RestoreEvent(1, saved.ID, 0, 0)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	assert.Equal(t, restored.ID, saved.ID)
+	assert.Equal(t, restored.Version, 4)
+	event, ok := service.GetEvent(1, saved.ID)
+	assert.True(t, ok)
+	assert.Equal(t, event.Text, "standup")
+
+	history, _ := service.History(1, saved.ID)
+	assert.Equal(t, history[len(history)-1].Action, ChangeRestored)
+	assert.Nil(t, history[len(history)-1].Before)
+
+	//событие удаленного календаря восстановить нельзя
+	work, _ := service.CreateCalendar(1, "work")
+	inWork := newEvent(1, "retro", fixedNow)
+	inWork.CalendarID = work.ID
+	inWork, _ = service.SaveEvent(inWork)
+	service.DeleteCalendar(1, work.ID)
+	_, ok, err = service.RestoreEvent(1, inWork.ID, 0, 0)
+	assert.True(t, ok)
+	assert.ErrorIs(t, err, ErrCalendarNotFound)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Role роль клиента: reader только читает, editor еще и меняет свои события,
+//admin работает с событиями любого пользователя
+type Role string
+
+//Роли в порядке возрастания прав
+const (
+	RoleReader Role = "reader"
+	RoleEditor Role = "editor"
+	RoleAdmin  Role = "admin"
+)
+
+//roleLevels уровни ролей для сравнения
+var roleLevels = map[Role]int{RoleReader: 1, RoleEditor: 2, RoleAdmin: 3}
+
+//parseRole разбирает роль из конфига или токена
+func parseRole(str string) (Role, error) {
+	role := Role(strings.ToLower(str))
+	if _, ok := roleLevels[role]; !ok {
+		return "", fmt.Errorf("unknown role %q", str)
+	}
+	return role, nil
+}
+
+//allows проверяет, что у роли есть права роли required
+func (r Role) allows(required Role) bool {
+	return roleLevels[r] >= roleLevels[required]
+}
+
+//Principal клиент, подтвердивший себя ключом или токеном
+type Principal struct {
+	Name   string
+	UserID int
+	Role   Role
+}
+
+//Ошибки аутентификации
+var (
+	ErrNoCredentials  = errors.New("missing credentials")
+	ErrBadCredentials = errors.New("invalid credentials")
+	ErrTokenExpired   = errors.New("token expired")
+)
+
+//APIKey ключ доступа из конфига
+type APIKey struct {
+	Name   string
+	Key    string
+	UserID int `mapstructure:"user_id"`
+	Role   string
+}
+
+//Authenticator проверяет API ключи (заголовок X-API-Key) и подписанные HMAC-SHA256
+//bearer токены (заголовок Authorization: Bearer). Клиенты CalDAV, которые умеют только Basic,
+//передают ключ или токен паролем (имя пользователя не проверяется). Токен - JWT с алгоритмом HS256
+//и полями sub (имя), uid (id пользователя), role и exp, проверяется без внешних сервисов.
+type Authenticator struct {
+	keys   map[[sha256.Size]byte]Principal
+	secret []byte
+	now    func() time.Time
+}
+
+//NewAuthenticator конструктор для Authenticator.
+//Принимает: ключи доступа и секрет для токенов (пусто - токены не принимаются).
+//Возвращает: ссылку на Authenticator и ошибку в описании ключей.
+func NewAuthenticator(keys []APIKey, secret string) (*Authenticator, error) {
+	a := &Authenticator{keys: make(map[[sha256.Size]byte]Principal, len(keys)), secret: []byte(secret), now: time.Now}
+
+	for i, k := range keys {
+		if k.Key == "" {
+			return nil, fmt.Errorf("auth key %d: empty key", i)
+		}
+		role, err := parseRole(k.Role)
+		if err != nil {
+			return nil, fmt.Errorf("auth key %d: %w", i, err)
+		}
+		if k.UserID <= 0 && role != RoleAdmin {
+			return nil, fmt.Errorf("auth key %d: user_id is required for role %s", i, role)
+		}
+		//в памяти держим хэши: поиск по map не дает сравнивать ключ посимвольно
+		a.keys[sha256.Sum256([]byte(k.Key))] = Principal{Name: k.Name, UserID: k.UserID, Role: role}
+	}
+	return a, nil
+}
+
+//Authenticate определяет клиента по заголовкам запроса
+func (a *Authenticator) Authenticate(r *http.Request) (Principal, error) {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		p, ok := a.keys[sha256.Sum256([]byte(key))]
+		if !ok {
+			return Principal{}, ErrBadCredentials
+		}
+		return p, nil
+	}
+
+	if _, password, ok := r.BasicAuth(); ok {
+		if p, ok := a.keys[sha256.Sum256([]byte(password))]; ok {
+			return p, nil
+		}
+		return a.verifyToken(password)
+	}
+
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+		return Principal{}, ErrNoCredentials
+	}
+	return a.verifyToken(strings.TrimSpace(parts[1]))
+}
+
+//tokenHeader заголовок токена: поддерживается только HS256
+const tokenHeader = `{"alg":"HS256","typ":"JWT"}`
+
+//tokenClaims поля токена
+type tokenClaims struct {
+	Subject string `json:"sub"`
+	UserID  int    `json:"uid"`
+	Role    string `json:"role"`
+	Expires int64  `json:"exp"`
+}
+
+//IssueToken выпускает токен для клиента со сроком действия ttl
+func (a *Authenticator) IssueToken(p Principal, ttl time.Duration) (string, error) {
+	if len(a.secret) == 0 {
+		return "", errors.New("token secret is not configured")
+	}
+
+	claims, err := json.Marshal(tokenClaims{Subject: p.Name, UserID: p.UserID, Role: string(p.Role), Expires: a.now().Add(ttl).Unix()})
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString([]byte(tokenHeader)) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	return signed + "." + a.sign(signed), nil
+}
+
+//sign подписывает заголовок и поля токена
+func (a *Authenticator) sign(signed string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(signed))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+//verifyToken проверяет подпись, алгоритм и срок токена
+func (a *Authenticator) verifyToken(token string) (Principal, error) {
+	if len(a.secret) == 0 {
+		return Principal{}, ErrBadCredentials
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Principal{}, ErrBadCredentials
+	}
+	signed := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(a.sign(signed))) {
+		return Principal{}, ErrBadCredentials
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(rawHeader, &header) != nil || header.Alg != "HS256" {
+		return Principal{}, ErrBadCredentials
+	}
+
+	var claims tokenClaims
+	rawClaims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(rawClaims, &claims) != nil {
+		return Principal{}, ErrBadCredentials
+	}
+	if claims.Expires == 0 || !a.now().Before(time.Unix(claims.Expires, 0)) {
+		return Principal{}, ErrTokenExpired
+	}
+
+	role, err := parseRole(claims.Role)
+	if err != nil {
+		return Principal{}, ErrBadCredentials
+	}
+	return Principal{Name: claims.Subject, UserID: claims.UserID, Role: role}, nil
+}
+
+//principalKey ключ Principal в контексте запроса
+type principalKey struct{}
+
+//withPrincipal кладет клиента в контекст запроса
+func withPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+//principalFrom достает клиента из контекста запроса.
+//Возвращает false, если аутентификация выключена.
+func principalFrom(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+//credentialsKey ключ результата проверки учетных данных в контексте запроса
+type credentialsKey struct{}
+
+//credentials результат проверки учетных данных запроса: клиент или ошибка
+type credentials struct {
+	principal Principal
+	err       error
+}
+
+//authenticate проверяет учетные данные запроса один раз на всю цепочку middleware:
+//результат кладется в контекст, и Auth после Limit берет его оттуда, а не проверяет ключ или токен заново.
+//Возвращает запрос с результатом в контексте, клиента и ошибку проверки.
+func authenticate(auth *Authenticator, r *http.Request) (*http.Request, Principal, error) {
+	if c, ok := r.Context().Value(credentialsKey{}).(credentials); ok {
+		return r, c.principal, c.err
+	}
+	p, err := auth.Authenticate(r)
+	return r.WithContext(context.WithValue(r.Context(), credentialsKey{}, credentials{principal: p, err: err})), p, err
+}
+
+//requiredRole роль, нужная для запроса: чтение (в том числе PROPFIND и REPORT CalDAV) - reader,
+//изменения - editor
+func requiredRole(method string) Role {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, davPropfind, davReport:
+		return RoleReader
+	default:
+		return RoleEditor
+	}
+}
+
+//Auth middleware аутентификации и проверки роли.
+//Без Authenticator пропускает запросы как есть. Пути из public доступны без учетных данных.
+//Клиент кладется в контекст запроса; какой пользователь ему доступен, проверяет resolveUserID.
+func Auth(auth *Authenticator, public map[string]bool, next http.Handler) http.Handler {
+	if auth == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if public[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		r, p, err := authenticate(auth, r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dev11"`)
+			if strings.HasPrefix(r.URL.Path, davPath) {
+				w.Header().Add("WWW-Authenticate", `Basic realm="dev11"`)
+			}
+			writeJSONMessage(w, http.StatusUnauthorized, fmt.Sprintf("Unauthorized: %s", err), true)
+			return
+		}
+
+		if required := requiredRole(r.Method); !p.Role.allows(required) {
+			writeJSONMessage(w, http.StatusForbidden, fmt.Sprintf("Forbidden: role %s is required", required), true)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), p)))
+	})
+}
+
+//resolveUserID определяет пользователя, с событиями которого работает запрос.
+//Без аутентификации user_id обязателен. Клиент с ключом или токеном по умолчанию
+//работает со своими событиями; чужой user_id разрешен только роли admin.
+//Возвращает: id пользователя, статус код ошибки и ошибку.
+func resolveUserID(r *http.Request, userIDStr string) (int, int, error) {
+	p, authenticated := principalFrom(r.Context())
+	if authenticated && userIDStr == "" && p.UserID > 0 {
+		return p.UserID, 0, nil
+	}
+
+	userID, ok := parseUserID(userIDStr)
+	if !ok {
+		return 0, http.StatusBadRequest, errors.New("Bad user_id")
+	}
+	if authenticated && userID != p.UserID && p.Role != RoleAdmin {
+		return 0, http.StatusForbidden, errors.New("Forbidden: user_id " + strconv.Itoa(userID) + " doesn't match credentials")
+	}
+	return userID, 0, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//newTestAuthenticator ключи трех ролей и секрет для токенов
+func newTestAuthenticator(t *testing.T) *Authenticator {
+	auth, err := NewAuthenticator([]APIKey{
+		{Name: "reader", Key: "reader-key", UserID: 1, Role: "reader"},
+		{Name: "editor", Key: "editor-key", UserID: 1, Role: "editor"},
+		{Name: "admin", Key: "admin-key", Role: "admin"},
+	}, "secret")
+	assert.Nil(t, err)
+	return auth
+}
+
+//doAuth выполняет запрос с заголовком учетных данных
+func doAuth(handler http.Handler, method string, target string, header string, value string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(""))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if header != "" {
+		req.Header.Set(header, value)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestNewAuthenticatorValidation(t *testing.T) {
+	_, err := NewAuthenticator([]APIKey{{Key: "k", UserID: 1, Role: "owner"}}, "")
+	assert.NotNil(t, err)
+
+	_, err = NewAuthenticator([]APIKey{{Key: "", UserID: 1, Role: "reader"}}, "")
+	assert.NotNil(t, err)
+
+	_, err = NewAuthenticator([]APIKey{{Key: "k", Role: "editor"}}, "")
+	assert.NotNil(t, err)
+}
+
+func TestTokens(t *testing.T) {
+	auth := newTestAuthenticator(t)
+	now := time.Date(2021, 12, 15, 10, 0, 0, 0, time.UTC)
+	auth.now = func() time.Time { return now }
+
+	token, err := auth.IssueToken(Principal{Name: "cli", UserID: 7, Role: RoleEditor}, time.Hour)
+	assert.Nil(t, err)
+
+	p, err := auth.verifyToken(token)
+	assert.Nil(t, err)
+	assert.Equal(t, p, Principal{Name: "cli", UserID: 7, Role: RoleEditor})
+
+	//подмена полей ломает подпись
+	parts := strings.Split(token, ".")
+	forged, _ := (&Authenticator{secret: []byte("other"), now: auth.now}).IssueToken(Principal{UserID: 7, Role: RoleAdmin}, time.Hour)
+	_, err = auth.verifyToken(parts[0] + "." + strings.Split(forged, ".")[1] + "." + parts[2])
+	assert.Equal(t, err, ErrBadCredentials)
+	_, err = auth.verifyToken(forged)
+	assert.Equal(t, err, ErrBadCredentials)
+
+	now = now.Add(2 * time.Hour)
+	_, err = auth.verifyToken(token)
+	assert.Equal(t, err, ErrTokenExpired)
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	service, _ := newTestService()
+	h := NewHandler(service)
+	h.auth = newTestAuthenticator(t)
+	handler := h.initRouts()
+
+	rec := doAuth(handler, http.MethodGet, "/events_for_day?date=15-12-2021", "", "")
+	assert.Equal(t, rec.Code, http.StatusUnauthorized)
+	assert.NotEqual(t, rec.Header().Get("WWW-Authenticate"), "")
+
+	rec = doAuth(handler, http.MethodGet, "/events_for_day?date=15-12-2021", "X-API-Key", "wrong")
+	assert.Equal(t, rec.Code, http.StatusUnauthorized)
+
+	//user_id по умолчанию берется из ключа
+	rec = doAuth(handler, http.MethodGet, "/events_for_day?date=15-12-2021", "X-API-Key", "reader-key")
+	assert.Equal(t, rec.Code, http.StatusOK)
+
+	rec = doAuth(handler, http.MethodPost, "/create_event?date=15-12-2021&text=a", "X-API-Key", "reader-key")
+	assert.Equal(t, rec.Code, http.StatusForbidden)
+
+	rec = doAuth(handler, http.MethodPost, "/create_event?date=15-12-2021&text=a", "X-API-Key", "editor-key")
+	assert.Equal(t, rec.Code, http.StatusOK)
+
+	//чужой пользователь доступен только admin
+	rec = doAuth(handler, http.MethodGet, "/events_for_day?user_id=2&date=15-12-2021", "X-API-Key", "editor-key")
+	assert.Equal(t, rec.Code, http.StatusForbidden)
+
+	rec = doAuth(handler, http.MethodGet, "/events_for_day?user_id=2&date=15-12-2021", "X-API-Key", "admin-key")
+	assert.Equal(t, rec.Code, http.StatusOK)
+
+	rec = doAuth(handler, http.MethodGet, "/events_for_day?date=15-12-2021", "X-API-Key", "admin-key")
+	assert.Equal(t, rec.Code, http.StatusBadRequest)
+
+	token, err := h.auth.IssueToken(Principal{Name: "cli", UserID: 1, Role: RoleEditor}, time.Hour)
+	assert.Nil(t, err)
+	rec = doAuth(handler, http.MethodGet, "/api/v1/events/1", "Authorization", "Bearer "+token)
+	assert.Equal(t, rec.Code, http.StatusOK)
+}
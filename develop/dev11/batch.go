@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+//Виды операций пакета
+const (
+	BatchCreate = "create"
+	BatchUpdate = "update"
+	BatchDelete = "delete"
+)
+
+//maxBatchOperations наибольшее число операций в одном пакете
+const maxBatchOperations = 100
+
+//ErrBatchSkipped операция не применена, потому что атомарный пакет отменен из-за другой операции
+var ErrBatchSkipped = errors.New("not applied: batch is rolled back")
+
+//BatchCommand операция пакета: создание события Event, изменение события ID полями Change
+//или удаление события ID. Occurrence и Version - как в ChangeEvent и DeleteEvent.
+type BatchCommand struct {
+	Kind       string
+	ID         int
+	Occurrence time.Time
+	Version    int
+	Event      Event
+	Change     EventChange
+}
+
+//BatchOutcome результат операции пакета: новое состояние события (для создания и изменения),
+//флаг наличия события у пользователя и ошибка операции
+type BatchOutcome struct {
+	Event  Event
+	Exists bool
+	Err    error
+}
+
+//failed проверяет, что операция не выполнена
+func (o BatchOutcome) failed() bool {
+	return o.Err != nil || !o.Exists
+}
+
+//runCommand выполняет операцию пакета через сервис
+func (s *Service) runCommand(userID int, cmd BatchCommand) BatchOutcome {
+	switch cmd.Kind {
+	case BatchCreate:
+		cmd.Event.UserID = userID
+		event, err := s.SaveEvent(cmd.Event)
+		return BatchOutcome{Event: event, Exists: true, Err: err}
+	case BatchUpdate:
+		event, ok, err := s.ChangeEvent(userID, cmd.ID, cmd.Occurrence, cmd.Change, cmd.Version)
+		return BatchOutcome{Event: event, Exists: ok, Err: err}
+	case BatchDelete:
+		ok, err := s.DeleteEvent(userID, cmd.ID, cmd.Occurrence, cmd.Version)
+		return BatchOutcome{Exists: ok, Err: err}
+	}
+	return BatchOutcome{Exists: true, Err: errors.New("unknown operation " + cmd.Kind)}
+}
+
+//Batch выполняет операции пакета над событиями, которые пользователь может менять, по порядку.
+//В режиме atomic операции выполняются на копии событий пользователя и владельцев календарей,
+//открытых ему на запись, с теми же проверками, что и по отдельности, и применяются к хранилищу
+//одним изменением, только если успешны все; иначе хранилище не меняется, а остальные операции
+//получают ErrBatchSkipped. Примененный пакет дает те же записи ленты и журнала аудита
+//и те же отмены приглашений, что и его операции по отдельности.
+//Без atomic каждая операция применяется независимо от остальных.
+//Возвращает: результаты операций, флаг применения пакета и ошибку хранилища
+//(ErrBatchConflict, если события изменились, пока выполнялся атомарный пакет).
+func (s *Service) Batch(userID int, commands []BatchCommand, atomic bool) ([]BatchOutcome, bool, error) {
+	outcomes := make([]BatchOutcome, len(commands))
+	if len(commands) == 0 {
+		return outcomes, true, nil
+	}
+	if !atomic {
+		for i, cmd := range commands {
+			outcomes[i] = s.runCommand(userID, cmd)
+		}
+		return outcomes, true, nil
+	}
+	//копия проверяет календари сама, поэтому блокировка держится до применения пакета к хранилищу
+	s.calendarWrites.RLock()
+	defer s.calendarWrites.RUnlock()
+
+	owners := s.writableOwners(userID)
+	ownerIDs := make([]int, 0, len(owners))
+	for ownerID := range owners {
+		ownerIDs = append(ownerIDs, ownerID)
+	}
+	events, firstID := s.storage.userSnapshot(ownerIDs...)
+	original := make(map[int]Event, len(events))
+	tx := NewEventStore()
+	for _, event := range events {
+		original[event.ID] = event
+		tx.put(event, Author{})
+	}
+	tx.nextID = firstID
+	//копия записывает изменения операций по порядку, чтобы хранилище применило их так же
+	var changes []storeChange
+	tx.Observe(func(kind string, event Event, previous *Event, by Author) {
+		changes = append(changes, storeChange{kind: kind, event: event})
+	})
+	txService := &Service{storage: tx, now: s.now, conflicts: s.conflictPolicy(), calendars: s.calendars}
+
+	for i, cmd := range commands {
+		outcomes[i] = txService.runCommand(userID, cmd)
+		if outcomes[i].failed() {
+			for j := range outcomes {
+				if j != i {
+					outcomes[j] = BatchOutcome{Exists: true, Err: ErrBatchSkipped}
+				}
+			}
+			return outcomes, false, nil
+		}
+	}
+
+	batch := storeBatch{owners: owners, firstID: firstID, changes: changes, versions: make(map[int]int)}
+	for _, c := range changes {
+		if prev, existed := original[c.event.ID]; existed {
+			batch.versions[prev.ID] = prev.Version
+		}
+	}
+
+	ids, err := s.storage.applyBatch(batch, Author{UserID: userID})
+	if err != nil {
+		return nil, false, err
+	}
+	for _, c := range remapBatch(changes, ids) {
+		if c.kind == ChangeDeleted && len(c.event.Attendees) > 0 {
+			s.cancelInvitations(c.event)
+		}
+	}
+
+	//новые события получили в хранилище другие id, чем в копии
+	for i := range outcomes {
+		outcomes[i].Event = remapEvent(outcomes[i].Event, ids)
+	}
+	return outcomes, true, nil
+}
+
+//writableOwners возвращает пользователя и владельцев календарей, открытых ему на запись
+func (s *Service) writableOwners(userID int) map[int]bool {
+	owners := map[int]bool{userID: true}
+	for _, cal := range s.calendars.Visible(userID) {
+		if cal.allows(userID, ShareWrite) {
+			owners[cal.OwnerID] = true
+		}
+	}
+	return owners
+}
+
+//remapEvent переводит id события и его пересечений из копии в хранилище
+func remapEvent(event Event, ids map[int]int) Event {
+	if id, ok := ids[event.ID]; ok {
+		event.ID = id
+	}
+	if len(event.Conflicts) > 0 {
+		conflicts := make([]int, len(event.Conflicts))
+		for i, id := range event.Conflicts {
+			if mapped, ok := ids[id]; ok {
+				id = mapped
+			}
+			conflicts[i] = id
+		}
+		event.Conflicts = conflicts
+	}
+	return event
+}
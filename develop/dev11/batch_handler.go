@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+//batchOperation элемент тела POST /batch.
+//Op - create (событие Event в формате тела POST /api/v1/events), update (событие ID, поля Changes
+//в формате тела PATCH) или delete (событие ID). Occurrence выбирает вхождение серии,
+//Version - ожидаемая версия события, как в If-Match.
+type batchOperation struct {
+	Op         string        `json:"Op"`
+	ID         int           `json:"ID"`
+	Occurrence *JSONTime     `json:"Occurrence"`
+	Version    int           `json:"Version"`
+	Event      *eventRequest `json:"Event"`
+	Changes    *eventPatch   `json:"Changes"`
+}
+
+//toCommand переводит операцию из тела запроса в BatchCommand
+func (op batchOperation) toCommand(userID int) (BatchCommand, error) {
+	cmd := BatchCommand{Kind: op.Op, ID: op.ID, Version: op.Version}
+	if op.Occurrence != nil {
+		cmd.Occurrence = time.Time(*op.Occurrence)
+	}
+	if op.Version < 0 {
+		return cmd, errors.New("bad Version")
+	}
+
+	switch op.Op {
+	case BatchCreate:
+		if op.Event == nil {
+			return cmd, errors.New("missing Event")
+		}
+		event, err := op.Event.toEvent(userID)
+		if err != nil {
+			return cmd, err
+		}
+		cmd.Event = event
+	case BatchUpdate:
+		if op.ID <= 0 {
+			return cmd, errors.New("bad ID")
+		}
+		if op.Changes == nil {
+			return cmd, errors.New("missing Changes")
+		}
+		change, err := op.Changes.toChange()
+		if err != nil {
+			return cmd, err
+		}
+		cmd.Change = change
+	case BatchDelete:
+		if op.ID <= 0 {
+			return cmd, errors.New("bad ID")
+		}
+	default:
+		return cmd, fmt.Errorf("unknown Op %q: expect create, update or delete", op.Op)
+	}
+	return cmd, nil
+}
+
+//batchResult результат операции в ответе /batch: статус код, как у отдельного запроса
+//к /api/v1/events, и новое состояние события или ошибка
+type batchResult struct {
+	Status int    `json:"Status"`
+	Event  *Event `json:"Event,omitempty"`
+	Error  string `json:"Error,omitempty"`
+}
+
+//outcomeResult переводит результат операции в batchResult
+func outcomeResult(kind string, id int, outcome BatchOutcome) batchResult {
+	switch {
+	case errors.Is(outcome.Err, ErrBatchSkipped):
+		return batchResult{Status: http.StatusFailedDependency, Error: outcome.Err.Error()}
+	case outcome.Err != nil:
+		return batchResult{Status: serviceErrorStatus(outcome.Err), Error: outcome.Err.Error()}
+	case !outcome.Exists:
+		return batchResult{Status: http.StatusNotFound, Error: fmt.Sprintf("Event with id %d doesn't exists", id)}
+	case kind == BatchCreate:
+		return batchResult{Status: http.StatusCreated, Event: &outcome.Event}
+	case kind == BatchDelete:
+		return batchResult{Status: http.StatusNoContent}
+	}
+	return batchResult{Status: http.StatusOK, Event: &outcome.Event}
+}
+
+//batch обработчик для POST /batch.
+//Тело - JSON массив операций batchOperation над событиями пользователя user_id.
+//mode=atomic (по умолчанию) применяет все операции или ни одной, mode=best_effort - каждую отдельно
+//(некорректная операция тогда получает 400, а остальные выполняются).
+//Отвечает 200 со списком результатов в порядке операций и флагом Applied; если атомарный пакет
+//отменен, статус ответа - статус первой неудавшейся операции, остальные операции получают 424.
+func (h *Handler) batch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONMessage(w, http.StatusMethodNotAllowed, fmt.Sprintf("expect method POST at /batch, got %v", r.Method), true)
+		return
+	}
+
+	query := r.URL.Query()
+
+	userID, status, err := resolveUserID(r, query.Get("user_id"))
+	if err != nil {
+		writeJSONMessage(w, status, err.Error(), true)
+		return
+	}
+
+	var atomic bool
+	switch mode := query.Get("mode"); mode {
+	case "", "atomic":
+		atomic = true
+	case "best_effort":
+	default:
+		writeJSONMessage(w, http.StatusBadRequest, "Bad mode: expect atomic or best_effort", true)
+		return
+	}
+
+	var ops []batchOperation
+	if status, err := decodeJSONBody(w, r, &ops); err != nil {
+		writeJSONMessage(w, status, err.Error(), true)
+		return
+	}
+	if len(ops) == 0 || len(ops) > maxBatchOperations {
+		writeJSONMessage(w, http.StatusBadRequest, fmt.Sprintf("Bad batch: expect 1 to %d operations", maxBatchOperations), true)
+		return
+	}
+
+	//некорректная операция отклоняет атомарный пакет целиком, а без atomic - только себя
+	results := make([]batchResult, len(ops))
+	commands := make([]BatchCommand, 0, len(ops))
+	positions := make([]int, 0, len(ops))
+	for i, op := range ops {
+		cmd, err := op.toCommand(userID)
+		if err != nil && atomic {
+			writeJSONMessage(w, http.StatusBadRequest, fmt.Sprintf("Bad operation %d: %s", i, err), true)
+			return
+		}
+		if err != nil {
+			results[i] = batchResult{Status: http.StatusBadRequest, Error: err.Error()}
+			continue
+		}
+		commands = append(commands, cmd)
+		positions = append(positions, i)
+	}
+
+	outcomes, applied, err := h.service.Batch(userID, commands, atomic)
+	if errors.Is(err, ErrBatchConflict) {
+		writeJSONMessage(w, http.StatusConflict, fmt.Sprintf("Can't apply batch: %s", err), true)
+		return
+	}
+	if err != nil {
+		writeJSONMessage(w, http.StatusServiceUnavailable, fmt.Sprintf("Can't apply batch: %s", err), true)
+		return
+	}
+
+	status = http.StatusOK
+	for i, outcome := range outcomes {
+		result := outcomeResult(commands[i].Kind, commands[i].ID, outcome)
+		if !applied && result.Status != http.StatusFailedDependency {
+			status = result.Status
+		}
+		results[positions[i]] = result
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Result  []batchResult `json:"Result"`
+		Applied bool          `json:"Applied"`
+	}{Result: results, Applied: applied})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//batchResponse тело ответа /batch
+type batchResponse struct {
+	Result  []batchResult
+	Applied bool
+}
+
+//postBatch отправляет пакет операций и разбирает ответ
+func postBatch(t *testing.T, handler http.Handler, query string, body string) (int, batchResponse) {
+	var resp batchResponse
+	code := doJSON(t, handler, http.MethodPost, "/batch?"+query, body, &resp)
+	return code, resp
+}
+
+func TestBatchAtomic(t *testing.T) {
+	service, store := newTestService()
+	handler := NewHandler(service).initRouts()
+	service.SaveEvent(newEvent(1, "old", fixedNow))
+	service.SaveEvent(newEvent(1, "gone", fixedNow))
+
+	code, resp := postBatch(t, handler, "user_id=1", `[
+		{"Op":"create","Event":{"Text":"new","Date":"2021-12-15T10:00:00Z"}},
+		{"Op":"update","ID":1,"Version":1,"Changes":{"Text":"renamed"}},
+		{"Op":"delete","ID":2}
+	]`)
+	assert.Equal(t, code, http.StatusOK)
+	assert.True(t, resp.Applied)
+	assert.Equal(t, resp.Result[0].Status, http.StatusCreated)
+	assert.Equal(t, resp.Result[0].Event.ID, 3)
+	assert.Equal(t, resp.Result[1].Status, http.StatusOK)
+	assert.Equal(t, resp.Result[1].Event.Version, 2)
+	assert.Equal(t, resp.Result[2].Status, http.StatusNoContent)
+
+	event, _ := store.Load(1)
+	assert.Equal(t, event.Text, "renamed")
+	_, ok := store.Load(2)
+	assert.False(t, ok)
+	event, _ = store.Load(3)
+	assert.Equal(t, event.Text, "new")
+
+	//ошибка в одной операции отменяет весь пакет
+	code, resp = postBatch(t, handler, "user_id=1", `[
+		{"Op":"update","ID":1,"Changes":{"Text":"again"}},
+		{"Op":"delete","ID":2}
+	]`)
+	assert.Equal(t, code, http.StatusNotFound)
+	assert.False(t, resp.Applied)
+	assert.Equal(t, resp.Result[0].Status, http.StatusFailedDependency)
+	assert.Equal(t, resp.Result[1].Status, http.StatusNotFound)
+	event, _ = store.Load(1)
+	assert.Equal(t, event.Text, "renamed")
+
+	code, resp = postBatch(t, handler, "user_id=1", `[{"Op":"update","ID":1,"Version":1,"Changes":{"Text":"stale"}}]`)
+	assert.Equal(t, code, http.StatusPreconditionFailed)
+
+	code, _ = postBatch(t, handler, "user_id=1", `[{"Op":"move","ID":1}]`)
+	assert.Equal(t, code, http.StatusBadRequest)
+}
+
+func TestBatchBestEffort(t *testing.T) {
+	service, store := newTestService()
+	handler := NewHandler(service).initRouts()
+
+	code, resp := postBatch(t, handler, "user_id=1&mode=best_effort", `[
+		{"Op":"create","Event":{"Text":"a","Date":"2021-12-15T10:00:00Z"}},
+		{"Op":"create","Event":{"Text":"no date"}},
+		{"Op":"delete","ID":7},
+		{"Op":"create","Event":{"Text":"b","Date":"2021-12-15T11:00:00Z"}}
+	]`)
+	assert.Equal(t, code, http.StatusOK)
+	assert.True(t, resp.Applied)
+	assert.Equal(t, resp.Result[0].Status, http.StatusCreated)
+	assert.Equal(t, resp.Result[1].Status, http.StatusBadRequest)
+	assert.Equal(t, resp.Result[2].Status, http.StatusNotFound)
+	assert.Equal(t, resp.Result[3].Status, http.StatusCreated)
+	assert.Equal(t, store.Len(), 2)
+}
+
+func TestApplyBatchConflict(t *testing.T) {
+	store := NewEventStore()
+	store.Save(newEvent(1, "a", fixedNow), Author{})
+
+	events, firstID := store.userSnapshot(1)
+	assert.Equal(t, len(events), 1)
+
+	//событие изменилось после копии
+	store.Change(1, 1, time.Time{}, EventChange{Text: "b"}, 0, Author{})
+	store.Save(newEvent(2, "other", fixedNow), Author{})
+
+	changed := events[0]
+	changed.Text = "c"
+	changed.Version = 2
+	_, err := store.applyBatch(storeBatch{owners: map[int]bool{1: true}, firstID: firstID,
+		changes: []storeChange{{kind: ChangeUpdated, event: changed}}, versions: map[int]int{1: 1}}, Author{})
+	assert.Equal(t, err, ErrBatchConflict)
+
+	//новые события получают свободные id, даже если хранилище успело выдать firstID
+	ids, err := store.applyBatch(storeBatch{owners: map[int]bool{1: true}, firstID: firstID,
+		changes: []storeChange{{kind: ChangeCreated, event: Event{ID: firstID, UserID: 1, Text: "new", Version: 1}}}}, Author{})
+	assert.Nil(t, err)
+	assert.Equal(t, ids[firstID], 3)
+	event, _ := store.Load(3)
+	assert.Equal(t, event.Text, "new")
+}
+
+func TestFileStoreBatchRecover(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir, 0)
+	assert.Nil(t, err)
+	service := NewService(store)
+
+	_, err = service.SaveEvent(newEvent(1, "a", fixedNow))
+	assert.Nil(t, err)
+	_, applied, err := service.Batch(1, []BatchCommand{
+		{Kind: BatchCreate, Event: newEvent(1, "b", fixedNow)},
+		{Kind: BatchDelete, ID: 1},
+	}, true)
+	assert.True(t, applied)
+	assert.Nil(t, err)
+	assert.Nil(t, store.wal.Close())
+
+	restored, err := NewFileStore(dir, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, restored.Len(), 1)
+	event, ok := restored.Load(2)
+	assert.True(t, ok)
+	assert.Equal(t, event.Text, "b")
+	assert.Equal(t, event.Version, 1)
+}
+
+func TestBatchIdempotent(t *testing.T) {
+	service, store := newTestService()
+	handler := NewHandler(service).initRouts()
+
+	post := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/batch?user_id=1", strings.NewReader(`[{"Op":"create","Event":{"Text":"a","Date":"2021-12-15T10:00:00Z"}}]`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(idempotencyHeader, "sync-1")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	assert.Equal(t, post(), http.StatusOK)
+	assert.Equal(t, post(), http.StatusOK)
+	assert.Equal(t, store.Len(), 1)
+}
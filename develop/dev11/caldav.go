@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Пространства имен XML WebDAV, CalDAV (RFC 4791) и расширений calendarserver.org (getctag)
+const (
+	nsDAV       = "DAV:"
+	nsCalDAV    = "urn:ietf:params:xml:ns:caldav"
+	nsCalServer = "http://calendarserver.org/ns/"
+)
+
+//Методы WebDAV, которых нет в net/http
+const (
+	davPropfind = "PROPFIND"
+	davReport   = "REPORT"
+)
+
+//davPath корень дерева CalDAV:
+//principals/{user}/ - пользователь, calendars/{user}/ - его календари,
+//calendars/{user}/{default|id}/ - коллекция календаря, calendars/{user}/{coll}/{UID}.ics - событие
+const davPath = "/dav/"
+
+//davWellKnownPath адрес обнаружения сервера CalDAV (RFC 6764)
+const davWellKnownPath = "/.well-known/caldav"
+
+//davDefaultCollection имя коллекции календаря пользователя по умолчанию
+const davDefaultCollection = "default"
+
+//maxDAVBodySize максимальный размер тела запроса CalDAV: XML запроса или .ics события
+const maxDAVBodySize = 1 << 20 //1 MB
+
+//davOpenRange на сколько вперед от начала проверяются серии в промежутке time-range без конца
+const davOpenRange = 10 * 365 * 24 * time.Hour
+
+//davMaxTime конец промежутка time-range без конца для одиночных событий
+var davMaxTime = time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC)
+
+//DAVCollection коллекция CalDAV: календарь пользователя по умолчанию или именованный календарь, который он видит.
+//Writable - можно ли пользователю менять события коллекции.
+type DAVCollection struct {
+	OwnerID    int
+	CalendarID int
+	Name       string
+	Writable   bool
+}
+
+//segment имя коллекции в пути
+func (c DAVCollection) segment() string {
+	if c.CalendarID == 0 {
+		return davDefaultCollection
+	}
+	return strconv.Itoa(c.CalendarID)
+}
+
+//DAVCollections выдает коллекции CalDAV пользователя: календарь по умолчанию и календари, которые он видит, в порядке id
+func (s *Service) DAVCollections(userID int) []DAVCollection {
+	collections := []DAVCollection{{OwnerID: userID, Name: "Default", Writable: true}}
+	for _, cal := range s.calendars.Visible(userID) {
+		collections = append(collections, DAVCollection{OwnerID: cal.OwnerID, CalendarID: cal.ID, Name: cal.Name,
+			Writable: cal.allows(userID, ShareWrite)})
+	}
+	return collections
+}
+
+//DAVCollection выдает коллекцию пользователя по имени из пути: default или id календаря, который он видит
+func (s *Service) DAVCollection(userID int, segment string) (DAVCollection, bool) {
+	if segment == davDefaultCollection {
+		return DAVCollection{OwnerID: userID, Name: "Default", Writable: true}, true
+	}
+	id, err := strconv.Atoi(segment)
+	if id <= 0 || err != nil {
+		return DAVCollection{}, false
+	}
+	cal, ok := s.GetCalendar(userID, id)
+	if !ok {
+		return DAVCollection{}, false
+	}
+	return DAVCollection{OwnerID: cal.OwnerID, CalendarID: cal.ID, Name: cal.Name, Writable: cal.allows(userID, ShareWrite)}, true
+}
+
+//DAVEvents выдает события коллекции сериями, в порядке id
+func (s *Service) DAVEvents(c DAVCollection) ([]Event, error) {
+	events, err := s.storage.getAll(c.OwnerID)
+	if err != nil {
+		return nil, err
+	}
+	return inCalendars(events, map[int]bool{c.CalendarID: true}), nil
+}
+
+//davResourceName имя ресурса события в коллекции: UID и .ics
+func davResourceName(event Event) string {
+	return icalUID(event) + ".ics"
+}
+
+//findResource ищет событие коллекции по имени ресурса
+func findResource(events []Event, name string) (Event, bool) {
+	for _, event := range events {
+		if davResourceName(event) == name {
+			return event, true
+		}
+	}
+	return Event{}, false
+}
+
+//davCTag строит getctag коллекции по id и версиям ее событий: меняется при любом изменении,
+//добавлении и удалении события. События должны идти в порядке id.
+func davCTag(events []Event) string {
+	h := fnv.New64a()
+	for _, event := range events {
+		fmt.Fprintf(h, "%d:%d;", event.ID, event.Version)
+	}
+	return fmt.Sprintf(`"%x"`, h.Sum64())
+}
+
+//Пути ресурсов дерева CalDAV
+func davPrincipalHref(userID int) string {
+	return fmt.Sprintf("%sprincipals/%d/", davPath, userID)
+}
+
+func davHomeHref(userID int) string {
+	return fmt.Sprintf("%scalendars/%d/", davPath, userID)
+}
+
+func davCollectionHref(userID int, c DAVCollection) string {
+	return davHomeHref(userID) + c.segment() + "/"
+}
+
+func davEventHref(userID int, c DAVCollection, event Event) string {
+	return davCollectionHref(userID, c) + url.PathEscape(davResourceName(event))
+}
+
+//davName имя элемента XML запроса
+type davName struct {
+	XMLName xml.Name
+}
+
+//davPropNames список запрошенных свойств: содержимое DAV:prop
+type davPropNames struct {
+	Names []davName `xml:",any"`
+}
+
+//davPropfindRequest тело PROPFIND. Пустое тело равносильно allprop.
+type davPropfindRequest struct {
+	XMLName  xml.Name      `xml:"DAV: propfind"`
+	AllProp  *struct{}     `xml:"DAV: allprop"`
+	PropName *struct{}     `xml:"DAV: propname"`
+	Prop     *davPropNames `xml:"DAV: prop"`
+}
+
+//davTimeRange промежуток CALDAV:time-range в UTC (20060102T150405Z); пустая граница - без ограничения
+type davTimeRange struct {
+	Start string `xml:"start,attr"`
+	End   string `xml:"end,attr"`
+}
+
+//davCompFilter фильтр компонента CALDAV:comp-filter
+type davCompFilter struct {
+	Name      string          `xml:"name,attr"`
+	TimeRange *davTimeRange   `xml:"urn:ietf:params:xml:ns:caldav time-range"`
+	Filters   []davCompFilter `xml:"urn:ietf:params:xml:ns:caldav comp-filter"`
+}
+
+//davReportRequest тело REPORT: calendar-query (Filter) или calendar-multiget (Hrefs)
+type davReportRequest struct {
+	XMLName xml.Name
+	Prop    *davPropNames  `xml:"DAV: prop"`
+	Hrefs   []string       `xml:"DAV: href"`
+	Filter  *davCompFilter `xml:"urn:ietf:params:xml:ns:caldav filter>comp-filter"`
+}
+
+//parseDAVTime разбирает границу time-range; пустая строка - нулевое время
+func parseDAVTime(str string) (time.Time, error) {
+	if str == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(icalUTC, str)
+}
+
+//matches проверяет событие фильтром VCALENDAR calendar-query.
+//Все события - VEVENT: фильтр других компонентов не проходит ни одно,
+//у VEVENT проверяется только time-range (серия подходит, если в промежуток попадает ее вхождение).
+func (f davCompFilter) matches(event Event) (bool, error) {
+	if f.Name != "VCALENDAR" {
+		return false, nil
+	}
+	for _, comp := range f.Filters {
+		if comp.Name != "VEVENT" {
+			return false, nil
+		}
+		if comp.TimeRange == nil {
+			continue
+		}
+		start, err := parseDAVTime(comp.TimeRange.Start)
+		if err != nil {
+			return false, fmt.Errorf("bad time-range start: %w", err)
+		}
+		end, err := parseDAVTime(comp.TimeRange.End)
+		if err != nil {
+			return false, fmt.Errorf("bad time-range end: %w", err)
+		}
+		switch {
+		case start.IsZero() && end.IsZero():
+			continue
+		case event.Recurrence == nil:
+			if end.IsZero() {
+				end = davMaxTime
+			}
+			if !event.overlaps(start, end) {
+				return false, nil
+			}
+		default:
+			if end.IsZero() {
+				end = start.Add(davOpenRange)
+			}
+			if len(expand(event, start, end)) == 0 {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+//davProp свойство ресурса: имя и готовое XML содержимое
+type davProp struct {
+	Name  xml.Name
+	Value string
+}
+
+//davResponse ответ multistatus об одном ресурсе: найденные и отсутствующие свойства
+//или, если Status не 0, только статус (ресурса нет)
+type davResponse struct {
+	Href    string
+	Found   []davProp
+	Missing []xml.Name
+	Status  int
+}
+
+//davPrefixes префиксы пространств имен в ответах
+var davPrefixes = map[string]string{nsDAV: "D", nsCalDAV: "C", nsCalServer: "CS"}
+
+//writeDAVElement пишет пустой или с содержимым элемент; элемент неизвестного пространства имен
+//объявляет его пространством по умолчанию
+func writeDAVElement(b *strings.Builder, name xml.Name, value string) {
+	tag, attrs := name.Local, ""
+	if prefix, ok := davPrefixes[name.Space]; ok {
+		tag = prefix + ":" + name.Local
+	} else if name.Space != "" {
+		var escaped strings.Builder
+		xml.EscapeText(&escaped, []byte(name.Space))
+		attrs = ` xmlns="` + escaped.String() + `"`
+	}
+	if value == "" {
+		fmt.Fprintf(b, "<%s%s/>", tag, attrs)
+		return
+	}
+	fmt.Fprintf(b, "<%s%s>%s</%s>", tag, attrs, value, tag)
+}
+
+//davText экранирует текст для содержимого элемента
+func davText(text string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(text))
+	return b.String()
+}
+
+//davHref элемент DAV:href
+func davHref(href string) string {
+	return "<D:href>" + davText(href) + "</D:href>"
+}
+
+//writeMultistatus записывает ответ 207 Multi-Status
+func writeMultistatus(w http.ResponseWriter, responses []davResponse) {
+	var b strings.Builder
+	b.WriteString(xml.Header)
+	b.WriteString(`<D:multistatus xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav" xmlns:CS="http://calendarserver.org/ns/">`)
+	for _, resp := range responses {
+		b.WriteString("<D:response>" + davHref(resp.Href))
+		if resp.Status != 0 {
+			fmt.Fprintf(&b, "<D:status>HTTP/1.1 %d %s</D:status>", resp.Status, http.StatusText(resp.Status))
+		}
+		if len(resp.Found) > 0 {
+			b.WriteString("<D:propstat><D:prop>")
+			for _, prop := range resp.Found {
+				writeDAVElement(&b, prop.Name, prop.Value)
+			}
+			b.WriteString("</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat>")
+		}
+		if len(resp.Missing) > 0 {
+			b.WriteString("<D:propstat><D:prop>")
+			for _, name := range resp.Missing {
+				writeDAVElement(&b, name, "")
+			}
+			b.WriteString("</D:prop><D:status>HTTP/1.1 404 Not Found</D:status></D:propstat>")
+		}
+		b.WriteString("</D:response>")
+	}
+	b.WriteString("</D:multistatus>")
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	w.Write([]byte(b.String()))
+}
+
+//selectProps отбирает свойства ресурса для ответа.
+//names - запрошенные свойства (nil - все, кроме calendar-data), namesOnly - ответ на propname.
+func selectProps(href string, props []davProp, names []xml.Name, namesOnly bool) davResponse {
+	resp := davResponse{Href: href}
+	if names == nil {
+		for _, prop := range props {
+			if prop.Name == (xml.Name{Space: nsCalDAV, Local: "calendar-data"}) {
+				continue
+			}
+			if namesOnly {
+				prop.Value = ""
+			}
+			resp.Found = append(resp.Found, prop)
+		}
+		return resp
+	}
+
+	for _, name := range names {
+		found := false
+		for _, prop := range props {
+			if prop.Name == name {
+				resp.Found = append(resp.Found, prop)
+				found = true
+				break
+			}
+		}
+		if !found {
+			resp.Missing = append(resp.Missing, name)
+		}
+	}
+	return resp
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//Виды ресурсов дерева CalDAV
+const (
+	davRoot = iota
+	davPrincipal
+	davHome
+	davCollection
+	davObject
+)
+
+//davAllow методы, которые принимает ресурс каждого вида
+var davAllow = map[int][]string{
+	davRoot:       {http.MethodOptions, davPropfind},
+	davPrincipal:  {http.MethodOptions, davPropfind},
+	davHome:       {http.MethodOptions, davPropfind},
+	davCollection: {http.MethodOptions, http.MethodGet, http.MethodHead, davPropfind, davReport},
+	davObject:     {http.MethodOptions, http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, davPropfind},
+}
+
+//davTarget ресурс, к которому обращается запрос CalDAV: вид, пользователь из пути,
+//коллекция и имя ресурса события
+type davTarget struct {
+	kind       int
+	userID     int
+	collection DAVCollection
+	name       string
+}
+
+//Имена свойств WebDAV и CalDAV
+var (
+	propResourceType     = xml.Name{Space: nsDAV, Local: "resourcetype"}
+	propDisplayName      = xml.Name{Space: nsDAV, Local: "displayname"}
+	propCurrentPrincipal = xml.Name{Space: nsDAV, Local: "current-user-principal"}
+	propPrincipalURL     = xml.Name{Space: nsDAV, Local: "principal-URL"}
+	propOwner            = xml.Name{Space: nsDAV, Local: "owner"}
+	propPrivileges       = xml.Name{Space: nsDAV, Local: "current-user-privilege-set"}
+	propReports          = xml.Name{Space: nsDAV, Local: "supported-report-set"}
+	propETag             = xml.Name{Space: nsDAV, Local: "getetag"}
+	propContentType      = xml.Name{Space: nsDAV, Local: "getcontenttype"}
+	propHomeSet          = xml.Name{Space: nsCalDAV, Local: "calendar-home-set"}
+	propComponents       = xml.Name{Space: nsCalDAV, Local: "supported-calendar-component-set"}
+	propCalendarData     = xml.Name{Space: nsCalDAV, Local: "calendar-data"}
+	propCTag             = xml.Name{Space: nsCalServer, Local: "getctag"}
+)
+
+//davMethodNotAllowed отвечает 405 со списком методов ресурса
+func davMethodNotAllowed(w http.ResponseWriter, r *http.Request, kind int) {
+	w.Header().Set("Allow", strings.Join(davAllow[kind], ", "))
+	writeJSONMessage(w, http.StatusMethodNotAllowed, fmt.Sprintf("expect method %s at %s, got %v", strings.Join(davAllow[kind], ", "), r.URL.Path, r.Method), true)
+}
+
+//parseDAVTarget разбирает путь запроса под davPath и проверяет доступ к пользователю из пути.
+//Возвращает: ресурс, статус код ошибки (404 для неизвестного пути или чужой коллекции) и ошибку.
+func (h *Handler) parseDAVTarget(r *http.Request) (davTarget, int, error) {
+	notFound := fmt.Errorf("Unknown resource %s", r.URL.Path)
+
+	var segments []string
+	for _, segment := range strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), davPath), "/") {
+		if segment == "" {
+			continue
+		}
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			return davTarget{}, http.StatusNotFound, notFound
+		}
+		segments = append(segments, unescaped)
+	}
+	if len(segments) == 0 {
+		return davTarget{kind: davRoot}, 0, nil
+	}
+
+	switch {
+	case segments[0] == "principals" && len(segments) == 2:
+	case segments[0] == "calendars" && len(segments) >= 2 && len(segments) <= 4:
+	default:
+		return davTarget{}, http.StatusNotFound, notFound
+	}
+
+	userID, status, err := resolveUserID(r, segments[1])
+	if err != nil {
+		if status == http.StatusBadRequest {
+			return davTarget{}, http.StatusNotFound, notFound
+		}
+		return davTarget{}, status, err
+	}
+
+	target := davTarget{kind: davPrincipal, userID: userID}
+	if segments[0] == "principals" {
+		return target, 0, nil
+	}
+
+	target.kind = davHome
+	if len(segments) == 2 {
+		return target, 0, nil
+	}
+
+	var ok bool
+	if target.collection, ok = h.service.DAVCollection(userID, segments[2]); !ok {
+		return davTarget{}, http.StatusNotFound, fmt.Errorf("Calendar %s doesn't exists", segments[2])
+	}
+	target.kind = davCollection
+	if len(segments) == 3 {
+		return target, 0, nil
+	}
+
+	if !strings.HasSuffix(segments[3], ".ics") {
+		return davTarget{}, http.StatusNotFound, notFound
+	}
+	target.kind, target.name = davObject, segments[3]
+	return target, 0, nil
+}
+
+//davCurrentUser пользователь запроса для current-user-principal: из учетных данных,
+//а без аутентификации - пользователь из пути (0 - неизвестен)
+func davCurrentUser(r *http.Request, userID int) int {
+	if p, ok := principalFrom(r.Context()); ok && p.UserID > 0 {
+		return p.UserID
+	}
+	return userID
+}
+
+//principalProps свойства ресурса, общие для всех видов: current-user-principal
+func principalProps(r *http.Request, userID int) []davProp {
+	current := davCurrentUser(r, userID)
+	if current == 0 {
+		return nil
+	}
+	return []davProp{{Name: propCurrentPrincipal, Value: davHref(davPrincipalHref(current))}}
+}
+
+//collectionProps свойства коллекции календаря
+func collectionProps(r *http.Request, userID int, c DAVCollection, events []Event) []davProp {
+	privileges := "<D:privilege><D:read/></D:privilege>"
+	if c.Writable {
+		privileges += "<D:privilege><D:write-content/></D:privilege><D:privilege><D:bind/></D:privilege><D:privilege><D:unbind/></D:privilege>"
+	}
+	ctag := davCTag(events)
+
+	return append(principalProps(r, userID),
+		davProp{Name: propResourceType, Value: "<D:collection/><C:calendar/>"},
+		davProp{Name: propDisplayName, Value: davText(c.Name)},
+		davProp{Name: propOwner, Value: davHref(davPrincipalHref(c.OwnerID))},
+		davProp{Name: propPrivileges, Value: privileges},
+		davProp{Name: propReports, Value: "<D:supported-report><D:report><C:calendar-query/></D:report></D:supported-report>" +
+			"<D:supported-report><D:report><C:calendar-multiget/></D:report></D:supported-report>"},
+		davProp{Name: propComponents, Value: `<C:comp name="VEVENT"/>`},
+		davProp{Name: propCTag, Value: davText(ctag)},
+		davProp{Name: propETag, Value: davText(ctag)},
+	)
+}
+
+//eventProps свойства ресурса события; calendar-data - событие с исключениями в VCALENDAR
+func eventProps(event Event) []davProp {
+	var data strings.Builder
+	encodeCalendar(&data, []Event{event}, time.Now())
+
+	return []davProp{
+		{Name: propResourceType},
+		{Name: propETag, Value: davText(eventETag(event))},
+		{Name: propContentType, Value: "text/calendar; charset=utf-8; component=VEVENT"},
+		{Name: propCalendarData, Value: davText(data.String())},
+	}
+}
+
+//readDAVBody читает тело запроса CalDAV не больше maxDAVBodySize.
+//Возвращает: тело, статус код ошибки (413 для слишком большого тела) и ошибку.
+func readDAVBody(w http.ResponseWriter, r *http.Request) ([]byte, int, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxDAVBodySize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, http.StatusRequestEntityTooLarge, errors.New("Request body is too large")
+	}
+	if err != nil {
+		return nil, http.StatusBadRequest, errors.New("Can't read request body")
+	}
+	return body, 0, nil
+}
+
+//propNames имена запрошенных свойств
+func (p *davPropNames) propNames() []xml.Name {
+	names := make([]xml.Name, 0, len(p.Names))
+	for _, n := range p.Names {
+		names = append(names, n.XMLName)
+	}
+	return names
+}
+
+//dav обработчик дерева CalDAV под /dav/ (RFC 4791, подмножество для синхронизации клиентов):
+//OPTIONS, PROPFIND с Depth 0 или 1, REPORT calendar-query и calendar-multiget на коллекции,
+//GET коллекции или события, PUT и DELETE событий .ics с ETag, If-Match и If-None-Match.
+//Пользователь задается в пути вместо user_id; клиенту без доступа к нему ответ как для user_id.
+func (h *Handler) dav(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("DAV", "1, 3, calendar-access")
+
+	target, status, err := h.parseDAVTarget(r)
+	if err != nil {
+		writeJSONMessage(w, status, err.Error(), true)
+		return
+	}
+
+	allowed := false
+	for _, method := range davAllow[target.kind] {
+		allowed = allowed || method == r.Method
+	}
+	if !allowed {
+		davMethodNotAllowed(w, r, target.kind)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("Allow", strings.Join(davAllow[target.kind], ", "))
+		w.WriteHeader(http.StatusOK)
+	case davPropfind:
+		h.davPropfind(w, r, target)
+	case davReport:
+		h.davReport(w, r, target)
+	case http.MethodGet, http.MethodHead:
+		h.davGet(w, r, target)
+	case http.MethodPut:
+		h.davPut(w, r, target)
+	case http.MethodDelete:
+		h.davDelete(w, r, target)
+	}
+}
+
+//davPropfind отвечает на PROPFIND: свойства ресурса и, при Depth 1 (и infinity),
+//его непосредственных потомков - коллекций календарей или событий коллекции
+func (h *Handler) davPropfind(w http.ResponseWriter, r *http.Request, t davTarget) {
+	body, status, err := readDAVBody(w, r)
+	if err != nil {
+		writeJSONMessage(w, status, err.Error(), true)
+		return
+	}
+
+	var names []xml.Name
+	namesOnly := false
+	if len(bytes.TrimSpace(body)) > 0 {
+		var req davPropfindRequest
+		if err := xml.Unmarshal(body, &req); err != nil {
+			writeJSONMessage(w, http.StatusBadRequest, fmt.Sprintf("Bad PROPFIND body: %s", err), true)
+			return
+		}
+		if req.Prop != nil {
+			names = req.Prop.propNames()
+		}
+		namesOnly = req.PropName != nil
+	}
+	depth := r.Header.Get("Depth") != "0"
+
+	var responses []davResponse
+	add := func(href string, props []davProp) {
+		responses = append(responses, selectProps(href, props, names, namesOnly))
+	}
+
+	switch t.kind {
+	case davRoot:
+		add(davPath, append(principalProps(r, 0), davProp{Name: propResourceType, Value: "<D:collection/>"}))
+
+	case davPrincipal:
+		add(davPrincipalHref(t.userID), append(principalProps(r, t.userID),
+			davProp{Name: propResourceType, Value: "<D:principal/>"},
+			davProp{Name: propDisplayName, Value: fmt.Sprintf("User %d", t.userID)},
+			davProp{Name: propPrincipalURL, Value: davHref(davPrincipalHref(t.userID))},
+			davProp{Name: propHomeSet, Value: davHref(davHomeHref(t.userID))},
+		))
+
+	case davHome:
+		add(davHomeHref(t.userID), append(principalProps(r, t.userID),
+			davProp{Name: propResourceType, Value: "<D:collection/>"},
+			davProp{Name: propOwner, Value: davHref(davPrincipalHref(t.userID))},
+		))
+		if !depth {
+			break
+		}
+		for _, c := range h.service.DAVCollections(t.userID) {
+			events, err := h.service.DAVEvents(c)
+			if err != nil {
+				writeJSONMessage(w, http.StatusServiceUnavailable, fmt.Sprintf("Can't get events: %s", err), true)
+				return
+			}
+			add(davCollectionHref(t.userID, c), collectionProps(r, t.userID, c, events))
+		}
+
+	case davCollection, davObject:
+		events, err := h.service.DAVEvents(t.collection)
+		if err != nil {
+			writeJSONMessage(w, http.StatusServiceUnavailable, fmt.Sprintf("Can't get events: %s", err), true)
+			return
+		}
+
+		if t.kind == davObject {
+			event, ok := findResource(events, t.name)
+			if !ok {
+				writeJSONMessage(w, http.StatusNotFound, fmt.Sprintf("Event %s doesn't exists", t.name), true)
+				return
+			}
+			add(davEventHref(t.userID, t.collection, event), eventProps(event))
+			break
+		}
+
+		add(davCollectionHref(t.userID, t.collection), collectionProps(r, t.userID, t.collection, events))
+		if !depth {
+			break
+		}
+		for _, event := range events {
+			add(davEventHref(t.userID, t.collection, event), eventProps(event))
+		}
+	}
+
+	writeMultistatus(w, responses)
+}
+
+//davReport отвечает на REPORT коллекции: calendar-query - события, проходящие фильтр,
+//calendar-multiget - события по списку href (отсутствующие - со статусом 404)
+func (h *Handler) davReport(w http.ResponseWriter, r *http.Request, t davTarget) {
+	body, status, err := readDAVBody(w, r)
+	if err != nil {
+		writeJSONMessage(w, status, err.Error(), true)
+		return
+	}
+
+	var req davReportRequest
+	if err := xml.Unmarshal(body, &req); err != nil {
+		writeJSONMessage(w, http.StatusBadRequest, fmt.Sprintf("Bad REPORT body: %s", err), true)
+		return
+	}
+	if req.XMLName.Space != nsCalDAV || (req.XMLName.Local != "calendar-query" && req.XMLName.Local != "calendar-multiget") {
+		writeJSONMessage(w, http.StatusForbidden, fmt.Sprintf("Unsupported report %s", req.XMLName.Local), true)
+		return
+	}
+	names := []xml.Name{propETag}
+	if req.Prop != nil {
+		names = req.Prop.propNames()
+	}
+
+	events, err := h.service.DAVEvents(t.collection)
+	if err != nil {
+		writeJSONMessage(w, http.StatusServiceUnavailable, fmt.Sprintf("Can't get events: %s", err), true)
+		return
+	}
+
+	responses := make([]davResponse, 0)
+	if req.XMLName.Local == "calendar-query" {
+		for _, event := range events {
+			if req.Filter != nil {
+				ok, err := req.Filter.matches(event)
+				if err != nil {
+					writeJSONMessage(w, http.StatusBadRequest, err.Error(), true)
+					return
+				}
+				if !ok {
+					continue
+				}
+			}
+			responses = append(responses, selectProps(davEventHref(t.userID, t.collection, event), eventProps(event), names, false))
+		}
+		writeMultistatus(w, responses)
+		return
+	}
+
+	collectionHref := davCollectionHref(t.userID, t.collection)
+	for _, href := range req.Hrefs {
+		href = strings.TrimSpace(href)
+		var event Event
+		ok := false
+		if u, err := url.Parse(href); err == nil && strings.HasPrefix(u.EscapedPath(), collectionHref) {
+			if name, err := url.PathUnescape(strings.TrimPrefix(u.EscapedPath(), collectionHref)); err == nil {
+				event, ok = findResource(events, name)
+			}
+		}
+		if !ok {
+			responses = append(responses, davResponse{Href: href, Status: http.StatusNotFound})
+			continue
+		}
+		responses = append(responses, selectProps(href, eventProps(event), names, false))
+	}
+	writeMultistatus(w, responses)
+}
+
+//davGet выгружает событие или всю коллекцию в iCalendar
+func (h *Handler) davGet(w http.ResponseWriter, r *http.Request, t davTarget) {
+	events, err := h.service.DAVEvents(t.collection)
+	if err != nil {
+		writeJSONMessage(w, http.StatusServiceUnavailable, fmt.Sprintf("Can't get events: %s", err), true)
+		return
+	}
+
+	if t.kind == davObject {
+		event, ok := findResource(events, t.name)
+		if !ok {
+			writeJSONMessage(w, http.StatusNotFound, fmt.Sprintf("Event %s doesn't exists", t.name), true)
+			return
+		}
+		events = []Event{event}
+		w.Header().Set("ETag", eventETag(event))
+	} else {
+		w.Header().Set("ETag", davCTag(events))
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	encodeCalendar(w, events, time.Now())
+}
+
+//davPut создает или заменяет событие из тела text/calendar с одним VEVENT (и его измененными вхождениями).
+//Имя ресурса - UID события и .ics. Напоминания и теги задаются через API и при замене сохраняются.
+//Отвечает 201 для нового события, 204 для замененного, с ETag новой версии.
+func (h *Handler) davPut(w http.ResponseWriter, r *http.Request, t davTarget) {
+	if !t.collection.Writable {
+		writeJSONMessage(w, http.StatusForbidden, fmt.Sprintf("Calendar %s is read-only", t.collection.segment()), true)
+		return
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "text/calendar" {
+		writeJSONMessage(w, http.StatusUnsupportedMediaType, "expect Content-Type text/calendar", true)
+		return
+	}
+
+	body, status, err := readDAVBody(w, r)
+	if err != nil {
+		writeJSONMessage(w, status, err.Error(), true)
+		return
+	}
+	entries, err := decodeCalendar(bytes.NewReader(body))
+	if err != nil {
+		writeJSONMessage(w, http.StatusBadRequest, fmt.Sprintf("Bad calendar: %s", err), true)
+		return
+	}
+	if len(entries) != 1 {
+		writeJSONMessage(w, http.StatusBadRequest, fmt.Sprintf("Bad calendar: expect one event, got %d", len(entries)), true)
+		return
+	}
+	entry := entries[0]
+	if entry.Err != nil {
+		writeJSONMessage(w, http.StatusBadRequest, fmt.Sprintf("Bad event: %s", entry.Err), true)
+		return
+	}
+	if entry.UID == "" || entry.UID+".ics" != t.name {
+		writeJSONMessage(w, http.StatusBadRequest, "Bad event: resource name must be its UID with .ics", true)
+		return
+	}
+
+	version, ok := parseIfMatch(r.Header)
+	if !ok {
+		writeJSONMessage(w, http.StatusBadRequest, "Bad If-Match", true)
+		return
+	}
+
+	events, err := h.service.DAVEvents(t.collection)
+	if err != nil {
+		writeJSONMessage(w, http.StatusServiceUnavailable, fmt.Sprintf("Can't get events: %s", err), true)
+		return
+	}
+	existing, exists := findResource(events, t.name)
+	if exists && r.Header.Get("If-None-Match") == "*" {
+		writeJSONMessage(w, http.StatusPreconditionFailed, fmt.Sprintf("Event %s already exists", t.name), true)
+		return
+	}
+	if !exists && r.Header.Get("If-Match") != "" {
+		writeJSONMessage(w, http.StatusPreconditionFailed, fmt.Sprintf("Event %s doesn't exists", t.name), true)
+		return
+	}
+
+	event := entry.Event
+	event.UserID, event.CalendarID, event.UID = t.userID, t.collection.CalendarID, entry.UID
+	if !exists {
+		saved, err := h.service.SaveEvent(event)
+		if err != nil {
+			writeJSONMessage(w, serviceErrorStatus(err), fmt.Sprintf("Can't save event: %s", err), true)
+			return
+		}
+		w.Header().Set("ETag", eventETag(saved))
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	event.Reminders, event.Tags = existing.Reminders, existing.Tags
+	replaced, isExists, err := h.service.ReplaceEvent(t.userID, existing.ID, event, version)
+	if err != nil {
+		writeJSONMessage(w, serviceErrorStatus(err), fmt.Sprintf("Can't replace event: %s", err), true)
+		return
+	}
+	if !isExists {
+		writeJSONMessage(w, http.StatusNotFound, fmt.Sprintf("Event %s doesn't exists", t.name), true)
+		return
+	}
+	w.Header().Set("ETag", eventETag(replaced))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//davDelete удаляет событие целиком, с проверкой If-Match
+func (h *Handler) davDelete(w http.ResponseWriter, r *http.Request, t davTarget) {
+	if !t.collection.Writable {
+		writeJSONMessage(w, http.StatusForbidden, fmt.Sprintf("Calendar %s is read-only", t.collection.segment()), true)
+		return
+	}
+
+	version, ok := parseIfMatch(r.Header)
+	if !ok {
+		writeJSONMessage(w, http.StatusBadRequest, "Bad If-Match", true)
+		return
+	}
+
+	events, err := h.service.DAVEvents(t.collection)
+	if err != nil {
+		writeJSONMessage(w, http.StatusServiceUnavailable, fmt.Sprintf("Can't get events: %s", err), true)
+		return
+	}
+	event, ok := findResource(events, t.name)
+	if !ok {
+		writeJSONMessage(w, http.StatusNotFound, fmt.Sprintf("Event %s doesn't exists", t.name), true)
+		return
+	}
+
+	isExists, err := h.service.DeleteEvent(t.userID, event.ID, time.Time{}, version)
+	if err != nil {
+		writeJSONMessage(w, serviceErrorStatus(err), fmt.Sprintf("Can't delete event: %s", err), true)
+		return
+	}
+	if !isExists {
+		writeJSONMessage(w, http.StatusNotFound, fmt.Sprintf("Event %s doesn't exists", t.name), true)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//davWellKnown перенаправляет обнаружение сервера CalDAV на корень дерева
+func (h *Handler) davWellKnown(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, davPath, http.StatusMovedPermanently)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//davRequest выполняет запрос CalDAV с телом и заголовками
+func davRequest(handler http.Handler, method string, target string, body string, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+//davEvent .ics с одним событием UID: ежедневная серия из трех вхождений с 15.12.2021
+func davEvent(uid string, summary string) string {
+	return "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nBEGIN:VEVENT\r\nUID:" + uid + "\r\n" +
+		"DTSTART:20211215T100000Z\r\nDTEND:20211215T110000Z\r\nSUMMARY:" + summary + "\r\n" +
+		"RRULE:FREQ=DAILY;COUNT=3\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+}
+
+const davQuery = `<?xml version="1.0"?>
+<c:calendar-query xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav">
+  <d:prop><d:getetag/><c:calendar-data/></d:prop>
+  <c:filter><c:comp-filter name="VCALENDAR"><c:comp-filter name="VEVENT">
+    <c:time-range start="%s" end="%s"/>
+  </c:comp-filter></c:comp-filter></c:filter>
+</c:calendar-query>`
+
+func TestDAVDiscovery(t *testing.T) {
+	service, _ := newTestService()
+	service.CreateCalendar(2, "team")
+	service.ShareCalendar(2, 1, 1, ShareRead)
+	handler := NewHandler(service).initRouts()
+
+	rec := davRequest(handler, http.MethodOptions, "/dav/", "", nil)
+	assert.Equal(t, rec.Code, http.StatusOK)
+	assert.Contains(t, rec.Header().Get("DAV"), "calendar-access")
+
+	rec = davRequest(handler, davPropfind, "/dav/principals/1/",
+		`<d:propfind xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav"><d:prop><c:calendar-home-set/><d:foo/></d:prop></d:propfind>`,
+		map[string]string{"Depth": "0"})
+	assert.Equal(t, rec.Code, http.StatusMultiStatus)
+	assert.Contains(t, rec.Body.String(), "<C:calendar-home-set><D:href>/dav/calendars/1/</D:href></C:calendar-home-set>")
+	assert.Contains(t, rec.Body.String(), "<D:foo/></D:prop><D:status>HTTP/1.1 404 Not Found</D:status>")
+
+	//в домашней коллекции - календарь по умолчанию и открытый пользователю только на чтение
+	rec = davRequest(handler, davPropfind, "/dav/calendars/1/", "", map[string]string{"Depth": "1"})
+	assert.Equal(t, rec.Code, http.StatusMultiStatus)
+	body := rec.Body.String()
+	assert.Contains(t, body, "<D:href>/dav/calendars/1/default/</D:href>")
+	assert.Contains(t, body, "<D:href>/dav/calendars/1/1/</D:href>")
+	assert.Contains(t, body, "<D:displayname>team</D:displayname>")
+	assert.Equal(t, strings.Count(body, "<D:write-content/>"), 1)
+	assert.Equal(t, strings.Count(body, "<CS:getctag>"), 2)
+
+	rec = davRequest(handler, davPropfind, "/dav/calendars/1/2/", "", nil)
+	assert.Equal(t, rec.Code, http.StatusNotFound)
+	rec = davRequest(handler, davPropfind, "/dav/calendars/1/default/", "<propfind", nil)
+	assert.Equal(t, rec.Code, http.StatusBadRequest)
+	rec = davRequest(handler, http.MethodPut, "/dav/calendars/1/", "", nil)
+	assert.Equal(t, rec.Code, http.StatusMethodNotAllowed)
+	assert.Equal(t, rec.Header().Get("Allow"), "OPTIONS, PROPFIND")
+
+	rec = davRequest(handler, http.MethodGet, davWellKnownPath, "", nil)
+	assert.Equal(t, rec.Code, http.StatusMovedPermanently)
+	assert.Equal(t, rec.Header().Get("Location"), davPath)
+}
+
+func TestDAVSync(t *testing.T) {
+	service, _ := newTestService()
+	handler := NewHandler(service).initRouts()
+	ics := map[string]string{"Content-Type": "text/calendar; charset=utf-8"}
+	const href = "/dav/calendars/1/default/abc-1.ics"
+
+	ctag := func() string {
+		events, _ := service.DAVEvents(DAVCollection{OwnerID: 1})
+		return davCTag(events)
+	}
+	empty := ctag()
+
+	rec := davRequest(handler, http.MethodPut, href, davEvent("abc-1", "standup"), map[string]string{
+		"Content-Type": "text/calendar", "If-None-Match": "*"})
+	assert.Equal(t, rec.Code, http.StatusCreated)
+	assert.Equal(t, rec.Header().Get("ETag"), `"1"`)
+	assert.NotEqual(t, ctag(), empty)
+
+	//событие из CalDAV видно в обычных выдачах
+	result, _ := service.GetDay(1, day(2021, 12, 16))
+	assert.Equal(t, len(result), 1)
+	assert.Equal(t, result[0].UID, "abc-1")
+
+	rec = davRequest(handler, http.MethodPut, href, davEvent("abc-1", "standup"), map[string]string{
+		"Content-Type": "text/calendar", "If-None-Match": "*"})
+	assert.Equal(t, rec.Code, http.StatusPreconditionFailed)
+	rec = davRequest(handler, http.MethodPut, "/dav/calendars/1/default/other.ics", davEvent("abc-1", "standup"), ics)
+	assert.Equal(t, rec.Code, http.StatusBadRequest)
+	rec = davRequest(handler, http.MethodPut, "/dav/calendars/1/default/new.ics", davEvent("new", "x"), map[string]string{
+		"Content-Type": "text/calendar", "If-Match": `"1"`})
+	assert.Equal(t, rec.Code, http.StatusPreconditionFailed)
+	rec = davRequest(handler, http.MethodPut, href, davEvent("abc-1", "standup"), nil)
+	assert.Equal(t, rec.Code, http.StatusUnsupportedMediaType)
+
+	rec = davRequest(handler, davReport, "/dav/calendars/1/default/", strings.Replace(strings.Replace(davQuery,
+		"%s", "20211217T000000Z", 1), "%s", "20211218T000000Z", 1), nil)
+	assert.Equal(t, rec.Code, http.StatusMultiStatus)
+	assert.Contains(t, rec.Body.String(), "<D:href>/dav/calendars/1/default/abc-1.ics</D:href>")
+	assert.Contains(t, rec.Body.String(), "UID:abc-1")
+
+	//после последнего вхождения серия не попадает в промежуток
+	rec = davRequest(handler, davReport, "/dav/calendars/1/default/", strings.Replace(strings.Replace(davQuery,
+		"%s", "20211218T000000Z", 1), "%s", "20211219T000000Z", 1), nil)
+	assert.NotContains(t, rec.Body.String(), "<D:response>")
+
+	rec = davRequest(handler, davReport, "/dav/calendars/1/default/", `<c:calendar-multiget xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav">
+		<d:prop><d:getetag/></d:prop><d:href>`+href+`</d:href><d:href>/dav/calendars/1/default/gone.ics</d:href></c:calendar-multiget>`, nil)
+	assert.Equal(t, rec.Code, http.StatusMultiStatus)
+	assert.Contains(t, rec.Body.String(), `<D:getetag>&#34;1&#34;</D:getetag>`)
+	assert.Contains(t, rec.Body.String(), "<D:href>/dav/calendars/1/default/gone.ics</D:href><D:status>HTTP/1.1 404 Not Found</D:status>")
+
+	rec = davRequest(handler, davReport, "/dav/calendars/1/default/", `<d:sync-collection xmlns:d="DAV:"/>`, nil)
+	assert.Equal(t, rec.Code, http.StatusForbidden)
+
+	//замена из CalDAV сохраняет теги, заданные через API
+	service.ChangeEvent(1, 1, time.Time{}, EventChange{Tags: []string{"work"}}, 0)
+	rec = davRequest(handler, http.MethodPut, href, davEvent("abc-1", "daily standup"), map[string]string{
+		"Content-Type": "text/calendar", "If-Match": `"1"`})
+	assert.Equal(t, rec.Code, http.StatusPreconditionFailed)
+	rec = davRequest(handler, http.MethodPut, href, davEvent("abc-1", "daily standup"), map[string]string{
+		"Content-Type": "text/calendar", "If-Match": `"2"`})
+	assert.Equal(t, rec.Code, http.StatusNoContent)
+	assert.Equal(t, rec.Header().Get("ETag"), `"3"`)
+	event, _ := service.GetEvent(1, 1)
+	assert.Equal(t, event.Text, "daily standup")
+	assert.Equal(t, event.Tags, []string{"work"})
+
+	rec = davRequest(handler, http.MethodGet, href, "", nil)
+	assert.Equal(t, rec.Code, http.StatusOK)
+	assert.Equal(t, rec.Header().Get("ETag"), `"3"`)
+	assert.Contains(t, rec.Body.String(), "SUMMARY:daily standup\r\n")
+
+	rec = davRequest(handler, http.MethodDelete, href, "", nil)
+	assert.Equal(t, rec.Code, http.StatusNoContent)
+	rec = davRequest(handler, http.MethodGet, href, "", nil)
+	assert.Equal(t, rec.Code, http.StatusNotFound)
+	assert.Equal(t, ctag(), empty)
+}
+
+func TestDAVSharedCalendar(t *testing.T) {
+	service, _ := newTestService()
+	team, _ := service.CreateCalendar(2, "team")
+	service.ShareCalendar(2, team.ID, 1, ShareRead)
+	service.ShareCalendar(2, team.ID, 3, ShareWrite)
+	handler := NewHandler(service).initRouts()
+	ics := map[string]string{"Content-Type": "text/calendar"}
+
+	//пишущий создает событие в чужом календаре, читающий видит его, но не может менять
+	rec := davRequest(handler, http.MethodPut, "/dav/calendars/3/1/team-1.ics", davEvent("team-1", "sync"), ics)
+	assert.Equal(t, rec.Code, http.StatusCreated)
+	event, ok := service.GetEvent(2, 1)
+	assert.True(t, ok)
+	assert.Equal(t, event.CalendarID, team.ID)
+
+	rec = davRequest(handler, http.MethodGet, "/dav/calendars/1/1/team-1.ics", "", nil)
+	assert.Equal(t, rec.Code, http.StatusOK)
+	rec = davRequest(handler, http.MethodPut, "/dav/calendars/1/1/team-1.ics", davEvent("team-1", "mine"), ics)
+	assert.Equal(t, rec.Code, http.StatusForbidden)
+	rec = davRequest(handler, http.MethodDelete, "/dav/calendars/1/1/team-1.ics", "", nil)
+	assert.Equal(t, rec.Code, http.StatusForbidden)
+
+	//в календаре по умолчанию владельца события общего календаря нет
+	rec = davRequest(handler, http.MethodGet, "/dav/calendars/2/default/team-1.ics", "", nil)
+	assert.Equal(t, rec.Code, http.StatusNotFound)
+}
+
+func TestDAVAuth(t *testing.T) {
+	service, _ := newTestService()
+	h := NewHandler(service)
+	h.auth = newTestAuthenticator(t)
+	handler := h.initRouts()
+	basic := func(password string) map[string]string {
+		return map[string]string{"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte("any:"+password))}
+	}
+
+	rec := davRequest(handler, davPropfind, "/dav/", "", nil)
+	assert.Equal(t, rec.Code, http.StatusUnauthorized)
+	assert.Equal(t, rec.Header().Values("WWW-Authenticate"), []string{`Bearer realm="dev11"`, `Basic realm="dev11"`})
+
+	//ключ в пароле Basic; PROPFIND - чтение
+	rec = davRequest(handler, davPropfind, "/dav/", "", basic("reader-key"))
+	assert.Equal(t, rec.Code, http.StatusMultiStatus)
+	assert.Contains(t, rec.Body.String(), "<D:current-user-principal><D:href>/dav/principals/1/</D:href></D:current-user-principal>")
+
+	rec = davRequest(handler, http.MethodPut, "/dav/calendars/1/default/a.ics", davEvent("a", "x"),
+		map[string]string{"Content-Type": "text/calendar", "Authorization": basic("reader-key")["Authorization"]})
+	assert.Equal(t, rec.Code, http.StatusForbidden)
+
+	rec = davRequest(handler, davPropfind, "/dav/calendars/2/", "", basic("editor-key"))
+	assert.Equal(t, rec.Code, http.StatusForbidden)
+
+	token, _ := h.auth.IssueToken(Principal{Name: "phone", UserID: 1, Role: RoleEditor}, time.Hour)
+	rec = davRequest(handler, davPropfind, "/dav/calendars/1/", "", basic(token))
+	assert.Equal(t, rec.Code, http.StatusMultiStatus)
+
+	rec = davRequest(handler, davPropfind, "/dav/", "", basic("wrong"))
+	assert.Equal(t, rec.Code, http.StatusUnauthorized)
+
+	rec = davRequest(handler, http.MethodGet, davWellKnownPath, "", nil)
+	assert.Equal(t, rec.Code, http.StatusMovedPermanently)
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Уровни доступа к календарю, которым поделились
+const (
+	ShareRead  = "read"
+	ShareWrite = "write"
+)
+
+//maxCalendarName наибольшая длина имени календаря в символах
+const maxCalendarName = 100
+
+//Share доступ пользователя к чужому календарю
+type Share struct {
+	UserID int    `json:"UserID"`
+	Level  string `json:"Level"`
+}
+
+//Calendar именованный календарь пользователя OwnerID, которому принадлежат события.
+//События без календаря (CalendarID 0) лежат в календаре владельца по умолчанию,
+//которым нельзя поделиться. Shares - пользователи, которым открыт календарь, по возрастанию id.
+type Calendar struct {
+	ID      int     `json:"ID"`
+	OwnerID int     `json:"OwnerID"`
+	Name    string  `json:"Name"`
+	Shares  []Share `json:"Shares,omitempty"`
+}
+
+//ErrCalendarNotFound календаря нет или он недоступен пользователю на нужном уровне
+var ErrCalendarNotFound = errors.New("calendar not found")
+
+//ErrCalendarExists у владельца уже есть календарь с таким именем
+var ErrCalendarExists = errors.New("calendar with this name already exists")
+
+//ErrCalendarOwner календарь нельзя открыть его владельцу
+var ErrCalendarOwner = errors.New("calendar can't be shared with its owner")
+
+//parseShareLevel разбирает уровень доступа: read или write
+func parseShareLevel(str string) (string, error) {
+	switch level := strings.ToLower(str); level {
+	case ShareRead, ShareWrite:
+		return level, nil
+	}
+	return "", fmt.Errorf("unknown share level %q: expect read or write", str)
+}
+
+//normalizeCalendarName обрезает пробелы и проверяет имя календаря
+func normalizeCalendarName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", errors.New("empty calendar name")
+	}
+	if len([]rune(name)) > maxCalendarName {
+		return "", fmt.Errorf("calendar name is longer than %d characters", maxCalendarName)
+	}
+	return name, nil
+}
+
+//allows проверяет, что пользователь может работать с календарем на уровне level:
+//владелец - на любом, остальные - по доступу; доступ на запись включает чтение
+func (c Calendar) allows(userID int, level string) bool {
+	if c.OwnerID == userID {
+		return true
+	}
+	for _, share := range c.Shares {
+		if share.UserID == userID {
+			return level == ShareRead || share.Level == ShareWrite
+		}
+	}
+	return false
+}
+
+//calendarState содержимое файла календарей
+type calendarState struct {
+	NextID    int        `json:"NextID"`
+	Calendars []Calendar `json:"Calendars"`
+}
+
+//CalendarStore хранилище календарей. Календарей немного, поэтому при path
+//после каждого изменения все они атомарно переписываются в файл.
+//Календари из deleting удаляются прямо сейчас: для всех, кроме Delete, их уже нет.
+type CalendarStore struct {
+	mutex    sync.RWMutex
+	m        map[int]Calendar
+	deleting map[int]bool
+	nextID   int
+	path     string
+}
+
+//NewCalendarStore конструктор для CalendarStore.
+//Принимает путь к файлу календарей (пусто - только в памяти) и загружает календари из него.
+//Возвращает: ссылку на CalendarStore и ошибку загрузки.
+func NewCalendarStore(path string) (*CalendarStore, error) {
+	store := &CalendarStore{m: make(map[int]Calendar), deleting: make(map[int]bool), nextID: 1, path: path}
+	if path == "" {
+		return store, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state calendarState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("bad calendars file %s: %w", path, err)
+	}
+	for _, cal := range state.Calendars {
+		store.m[cal.ID] = cal
+	}
+	if state.NextID > store.nextID {
+		store.nextID = state.NextID
+	}
+	return store, nil
+}
+
+//save переписывает файл календарей. Вызывается под store.mutex.
+func (store *CalendarStore) save() error {
+	if store.path == "" {
+		return nil
+	}
+	state := calendarState{NextID: store.nextID, Calendars: make([]Calendar, 0, len(store.m))}
+	for _, cal := range store.m {
+		state.Calendars = append(state.Calendars, cal)
+	}
+	sort.Slice(state.Calendars, func(i, j int) bool { return state.Calendars[i].ID < state.Calendars[j].ID })
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(store.path, data)
+}
+
+//commit кладет календарь и сохраняет файл; при ошибке записи восстанавливает прежнее состояние.
+//Вызывается под store.mutex.
+func (store *CalendarStore) commit(cal Calendar) error {
+	old, existed := store.m[cal.ID]
+	store.m[cal.ID] = cal
+	if err := store.save(); err != nil {
+		if existed {
+			store.m[cal.ID] = old
+		} else {
+			delete(store.m, cal.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+//nameTaken проверяет, есть ли у владельца другой календарь с именем name (без учета регистра).
+//Вызывается под store.mutex.
+func (store *CalendarStore) nameTaken(ownerID int, id int, name string) bool {
+	for _, cal := range store.m {
+		if cal.OwnerID == ownerID && cal.ID != id && strings.EqualFold(cal.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+//Create создает календарь владельца ownerID с именем name.
+//Конкурентно безопасный метод.
+func (store *CalendarStore) Create(ownerID int, name string) (Calendar, error) {
+	name, err := normalizeCalendarName(name)
+	if err != nil {
+		return Calendar{}, err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.nameTaken(ownerID, 0, name) {
+		return Calendar{}, ErrCalendarExists
+	}
+	cal := Calendar{ID: store.nextID, OwnerID: ownerID, Name: name}
+	store.nextID++
+	if err := store.commit(cal); err != nil {
+		store.nextID--
+		return Calendar{}, err
+	}
+	return cal, nil
+}
+
+//Load получает календарь по id.
+//Конкурентно безопасный метод.
+func (store *CalendarStore) Load(id int) (Calendar, bool) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	cal, ok := store.m[id]
+	if store.deleting[id] {
+		return Calendar{}, false
+	}
+	return cal, ok
+}
+
+//Visible возвращает календари, доступные пользователю на чтение: свои и открытые ему, в порядке id.
+//Конкурентно безопасный метод.
+func (store *CalendarStore) Visible(userID int) []Calendar {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	result := make([]Calendar, 0)
+	for _, cal := range store.m {
+		if cal.allows(userID, ShareRead) && !store.deleting[cal.ID] {
+			result = append(result, cal)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
+
+//Rename меняет имя календаря владельца ownerID.
+//Возвращает новое состояние календаря, флаг наличия календаря у владельца и ошибку.
+//Конкурентно безопасный метод.
+func (store *CalendarStore) Rename(ownerID int, id int, name string) (Calendar, bool, error) {
+	name, err := normalizeCalendarName(name)
+	if err != nil {
+		return Calendar{}, true, err
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	cal, ok := store.m[id]
+	if !ok || cal.OwnerID != ownerID || store.deleting[id] {
+		return Calendar{}, false, nil
+	}
+	if store.nameTaken(ownerID, id, name) {
+		return Calendar{}, true, ErrCalendarExists
+	}
+	cal.Name = name
+	if err := store.commit(cal); err != nil {
+		return Calendar{}, true, err
+	}
+	return cal, true, nil
+}
+
+//Share открывает календарь владельца ownerID пользователю userID на уровне level
+//или, если level пустой, закрывает доступ.
+//Возвращает новое состояние календаря, флаг наличия календаря у владельца и ошибку.
+//Конкурентно безопасный метод.
+func (store *CalendarStore) Share(ownerID int, id int, userID int, level string) (Calendar, bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	cal, ok := store.m[id]
+	if !ok || cal.OwnerID != ownerID || store.deleting[id] {
+		return Calendar{}, false, nil
+	}
+	if userID == ownerID {
+		return Calendar{}, true, ErrCalendarOwner
+	}
+
+	shares := make([]Share, 0, len(cal.Shares)+1)
+	for _, share := range cal.Shares {
+		if share.UserID != userID {
+			shares = append(shares, share)
+		}
+	}
+	if level != "" {
+		shares = append(shares, Share{UserID: userID, Level: level})
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].UserID < shares[j].UserID })
+	cal.Shares = shares
+	if len(cal.Shares) == 0 {
+		cal.Shares = nil
+	}
+
+	if err := store.commit(cal); err != nil {
+		return Calendar{}, true, err
+	}
+	return cal, true, nil
+}
+
+//beginDelete помечает календарь владельца ownerID удаляемым: с этого момента Load и Visible его не видят,
+//так что записи в него отклоняются, пока удаляются его события.
+//Возвращает флаг наличия календаря у владельца (удаляемый уже нет).
+//Конкурентно безопасный метод.
+func (store *CalendarStore) beginDelete(ownerID int, id int) bool {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	cal, ok := store.m[id]
+	if !ok || cal.OwnerID != ownerID || store.deleting[id] {
+		return false
+	}
+	store.deleting[id] = true
+	return true
+}
+
+//cancelDelete снимает пометку beginDelete, если события календаря удалить не удалось.
+//Конкурентно безопасный метод.
+func (store *CalendarStore) cancelDelete(id int) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.deleting, id)
+}
+
+//Delete удаляет календарь владельца ownerID, в том числе помеченный beginDelete.
+//Возвращает флаг наличия календаря у владельца и ошибку записи.
+//Конкурентно безопасный метод.
+func (store *CalendarStore) Delete(ownerID int, id int) (bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	cal, ok := store.m[id]
+	if !ok || cal.OwnerID != ownerID {
+		return false, nil
+	}
+	delete(store.m, id)
+	if err := store.save(); err != nil {
+		store.m[id] = cal
+		return true, err
+	}
+	delete(store.deleting, id)
+	return true, nil
+}
+
+//ErrOccurrenceCalendar календарь нельзя поменять у одного вхождения серии
+var ErrOccurrenceCalendar = errors.New("calendar can't be changed for a single occurrence")
+
+//CreateCalendar создает календарь пользователя с именем name
+func (s *Service) CreateCalendar(ownerID int, name string) (Calendar, error) {
+	return s.calendars.Create(ownerID, name)
+}
+
+//GetCalendars выдает календари, которые видит пользователь: свои и открытые ему
+func (s *Service) GetCalendars(userID int) []Calendar {
+	return s.calendars.Visible(userID)
+}
+
+//GetCalendar выдает календарь по id, если пользователь его видит
+func (s *Service) GetCalendar(userID int, id int) (Calendar, bool) {
+	cal, ok := s.calendars.Load(id)
+	if !ok || !cal.allows(userID, ShareRead) {
+		return Calendar{}, false
+	}
+	return cal, true
+}
+
+//RenameCalendar меняет имя календаря владельца.
+//Возвращает новое состояние календаря, флаг наличия календаря у владельца и ошибку.
+func (s *Service) RenameCalendar(ownerID int, id int, name string) (Calendar, bool, error) {
+	return s.calendars.Rename(ownerID, id, name)
+}
+
+//ShareCalendar открывает календарь владельца пользователю userID на уровне level (пусто - закрывает).
+//Возвращает новое состояние календаря, флаг наличия календаря у владельца и ошибку.
+func (s *Service) ShareCalendar(ownerID int, id int, userID int, level string) (Calendar, bool, error) {
+	return s.calendars.Share(ownerID, id, userID, level)
+}
+
+//calendarSweepAttempts сколько раз DeleteCalendar пробует удалить события календаря,
+//если их меняют одновременно с удалением
+const calendarSweepAttempts = 3
+
+//DeleteCalendar удаляет календарь владельца вместе с его событиями.
+//Сначала календарь помечается удаляемым, и новые записи в него получают ErrCalendarNotFound;
+//затем его события удаляются одним пакетом хранилища, и только потом удаляется сам календарь.
+//Если события удалить не удалось, пометка снимается и календарь остается как был.
+//Возвращает флаг наличия календаря у владельца и ошибку удаления
+//(ErrBatchConflict, если события календаря все время менялись во время удаления).
+func (s *Service) DeleteCalendar(ownerID int, id int) (bool, error) {
+	if !s.calendars.beginDelete(ownerID, id) {
+		return false, nil
+	}
+	//записи, проверившие календарь до пометки, доходят до хранилища раньше выборки событий,
+	//а новые календарь уже не находят: после очистки в нем ничего не появится
+	s.calendarWrites.Lock()
+	s.calendarWrites.Unlock()
+	if err := s.sweepCalendar(ownerID, id); err != nil {
+		s.calendars.cancelDelete(id)
+		return true, err
+	}
+	return s.calendars.Delete(ownerID, id)
+}
+
+//sweepCalendar удаляет события календаря id пакетами, пока они не кончатся:
+//пакет не применяется, если событие календаря изменили после выборки, и выборка повторяется.
+//Участники удаленных событий получают отмену, как при удалении события.
+func (s *Service) sweepCalendar(ownerID int, id int) error {
+	for attempt := 0; attempt < calendarSweepAttempts; attempt++ {
+		events, err := s.storage.getAll(ownerID)
+		if err != nil {
+			return err
+		}
+		batch := storeBatch{owners: map[int]bool{ownerID: true}, versions: make(map[int]int)}
+		for _, event := range events {
+			if event.CalendarID == id {
+				batch.changes = append(batch.changes, storeChange{kind: ChangeDeleted, event: event})
+				batch.versions[event.ID] = event.Version
+			}
+		}
+		if len(batch.changes) == 0 {
+			return nil
+		}
+		_, err = s.storage.applyBatch(batch, Author{UserID: ownerID})
+		if errors.Is(err, ErrBatchConflict) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, c := range batch.changes {
+			if len(c.event.Attendees) > 0 {
+				s.cancelInvitations(c.event)
+			}
+		}
+	}
+	return ErrBatchConflict
+}
+
+//sharedCalendars возвращает чужие календари, открытые пользователю: id календарей по владельцам
+func (s *Service) sharedCalendars(userID int) map[int]map[int]bool {
+	shared := make(map[int]map[int]bool)
+	for _, cal := range s.calendars.Visible(userID) {
+		if cal.OwnerID == userID {
+			continue
+		}
+		if shared[cal.OwnerID] == nil {
+			shared[cal.OwnerID] = make(map[int]bool)
+		}
+		shared[cal.OwnerID][cal.ID] = true
+	}
+	return shared
+}
+
+//inCalendars отбирает события, лежащие в календарях calendarIDs
+func inCalendars(events []Event, calendarIDs map[int]bool) []Event {
+	result := make([]Event, 0, len(events))
+	for _, event := range events {
+		if calendarIDs[event.CalendarID] {
+			result = append(result, event)
+		}
+	}
+	return result
+}
+
+//uniqueEvents убирает повторы событий (и вхождений серий), попавших в выдачу из разных источников
+func uniqueEvents(events []Event) []Event {
+	type key struct {
+		id         int
+		occurrence time.Time
+	}
+	seen := make(map[key]bool, len(events))
+	result := events[:0]
+	for _, event := range events {
+		k := key{id: event.ID}
+		if event.Occurrence != nil {
+			k.occurrence = time.Time(*event.Occurrence)
+		}
+		if !seen[k] {
+			seen[k] = true
+			result = append(result, event)
+		}
+	}
+	return result
+}
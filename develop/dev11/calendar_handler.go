@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//apiCalendarsPath путь ресурса календарей REST API
+const apiCalendarsPath = "/api/v1/calendars"
+
+//calendarRequest тело POST и PATCH запросов к /api/v1/calendars
+type calendarRequest struct {
+	Name string `json:"Name"`
+}
+
+//shareRequest тело PUT запроса к /api/v1/calendars/{id}/shares/{user_id}
+type shareRequest struct {
+	Level string `json:"Level"`
+}
+
+//writeJSONCalendar записывает в http.ResponseWriter один Calendar
+//в JSON формате с соответствующим хедером.
+//Принимает: статус код результата и календарь.
+func writeJSONCalendar(w http.ResponseWriter, status int, cal Calendar) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	data := struct {
+		Calendar Calendar `json:"Result"`
+	}{Calendar: cal}
+	json.NewEncoder(w).Encode(data)
+}
+
+//calendarErrorStatus выбирает статус ответа на ошибку календаря:
+//400 для некорректного имени, уровня или получателя, 409 для занятого имени, иначе 503
+func calendarErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrCalendarExists):
+		return http.StatusConflict
+	case errors.Is(err, ErrCalendarOwner):
+		return http.StatusBadRequest
+	}
+	return http.StatusServiceUnavailable
+}
+
+//apiCalendars обработчик коллекции /api/v1/calendars:
+//GET - календари, которые видит пользователь (свои и открытые ему),
+//POST - создание календаря из JSON тела calendarRequest, отвечает 201 с созданным Calendar.
+func (h *Handler) apiCalendars(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		writeJSONMessage(w, http.StatusMethodNotAllowed, fmt.Sprintf("expect method GET or POST at %s, got %v", apiCalendarsPath, r.Method), true)
+		return
+	}
+
+	userID, status, err := resolveUserID(r, r.URL.Query().Get("user_id"))
+	if err != nil {
+		writeJSONMessage(w, status, err.Error(), true)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Calendars []Calendar `json:"Result"`
+		}{Calendars: h.service.GetCalendars(userID)})
+		return
+	}
+
+	var req calendarRequest
+	if status, err := decodeJSONBody(w, r, &req); err != nil {
+		writeJSONMessage(w, status, err.Error(), true)
+		return
+	}
+	if _, err := normalizeCalendarName(req.Name); err != nil {
+		writeJSONMessage(w, http.StatusBadRequest, err.Error(), true)
+		return
+	}
+
+	cal, err := h.service.CreateCalendar(userID, req.Name)
+	if err != nil {
+		writeJSONMessage(w, calendarErrorStatus(err), fmt.Sprintf("Can't create calendar: %s", err), true)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("%s/%d", apiCalendarsPath, cal.ID))
+	writeJSONCalendar(w, http.StatusCreated, cal)
+}
+
+//apiCalendar обработчик ресурсов /api/v1/calendars/{id}:
+//GET - календарь, PATCH - переименование телом calendarRequest,
+//DELETE - удаление календаря вместе с его событиями.
+//Ресурс /api/v1/calendars/{id}/shares/{user_id} обрабатывает apiCalendarShare.
+//Менять календарь может только владелец.
+func (h *Handler) apiCalendar(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, apiCalendarsPath+"/"), "/")
+	id, err := strconv.Atoi(parts[0])
+	if id <= 0 || err != nil || (len(parts) != 1 && (len(parts) != 3 || parts[1] != "shares")) {
+		writeJSONMessage(w, http.StatusNotFound, fmt.Sprintf("Unknown resource %s", r.URL.Path), true)
+		return
+	}
+
+	userID, status, err := resolveUserID(r, r.URL.Query().Get("user_id"))
+	if err != nil {
+		writeJSONMessage(w, status, err.Error(), true)
+		return
+	}
+
+	if len(parts) == 3 {
+		h.apiCalendarShare(w, r, userID, id, parts[2])
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		cal, ok := h.service.GetCalendar(userID, id)
+		writeCalendarResult(w, id, cal, ok, nil, "")
+
+	case http.MethodPatch:
+		var req calendarRequest
+		if status, err := decodeJSONBody(w, r, &req); err != nil {
+			writeJSONMessage(w, status, err.Error(), true)
+			return
+		}
+		if _, err := normalizeCalendarName(req.Name); err != nil {
+			writeJSONMessage(w, http.StatusBadRequest, err.Error(), true)
+			return
+		}
+		cal, isExists, err := h.service.RenameCalendar(userID, id, req.Name)
+		writeCalendarResult(w, id, cal, isExists, err, "Can't rename calendar")
+
+	case http.MethodDelete:
+		isExists, err := h.service.DeleteCalendar(userID, id)
+		if err == nil && isExists {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeCalendarResult(w, id, Calendar{}, isExists, err, "Can't delete calendar")
+
+	default:
+		w.Header().Set("Allow", "GET, PATCH, DELETE")
+		writeJSONMessage(w, http.StatusMethodNotAllowed, fmt.Sprintf("expect method GET, PATCH or DELETE at %s/{id}, got %v", apiCalendarsPath, r.Method), true)
+	}
+}
+
+//apiCalendarShare обработчик ресурса /api/v1/calendars/{id}/shares/{user_id}:
+//PUT - открыть календарь пользователю на уровне из тела shareRequest, DELETE - закрыть.
+//Отвечает календарем с новым списком доступа.
+func (h *Handler) apiCalendarShare(w http.ResponseWriter, r *http.Request, ownerID int, id int, userIDStr string) {
+	shareWith, ok := parseUserID(userIDStr)
+	if !ok {
+		writeJSONMessage(w, http.StatusNotFound, fmt.Sprintf("Unknown resource %s", r.URL.Path), true)
+		return
+	}
+
+	var level string
+	switch r.Method {
+	case http.MethodPut:
+		var req shareRequest
+		if status, err := decodeJSONBody(w, r, &req); err != nil {
+			writeJSONMessage(w, status, err.Error(), true)
+			return
+		}
+		var err error
+		if level, err = parseShareLevel(req.Level); err != nil {
+			writeJSONMessage(w, http.StatusBadRequest, err.Error(), true)
+			return
+		}
+	case http.MethodDelete:
+	default:
+		w.Header().Set("Allow", "PUT, DELETE")
+		writeJSONMessage(w, http.StatusMethodNotAllowed, fmt.Sprintf("expect method PUT or DELETE at %s/{id}/shares/{user_id}, got %v", apiCalendarsPath, r.Method), true)
+		return
+	}
+
+	cal, isExists, err := h.service.ShareCalendar(ownerID, id, shareWith, level)
+	writeCalendarResult(w, id, cal, isExists, err, "Can't share calendar")
+}
+
+//writeCalendarResult отвечает на запрос к календарю: ошибкой по calendarErrorStatus,
+//404 для календаря, которого нет у пользователя, иначе 200 с календарем
+func writeCalendarResult(w http.ResponseWriter, id int, cal Calendar, isExists bool, err error, errPrefix string) {
+	if err != nil {
+		writeJSONMessage(w, calendarErrorStatus(err), fmt.Sprintf("%s: %s", errPrefix, err), true)
+		return
+	}
+
+	if !isExists {
+		writeJSONMessage(w, http.StatusNotFound, fmt.Sprintf("Calendar with id %d doesn't exists", id), true)
+		return
+	}
+
+	writeJSONCalendar(w, http.StatusOK, cal)
+}
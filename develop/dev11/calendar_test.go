@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCalendarStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "calendars", "calendars.json")
+	store, err := NewCalendarStore(path)
+	assert.Nil(t, err)
+
+	work, err := store.Create(1, " Work ")
+	assert.Nil(t, err)
+	assert.Equal(t, work, Calendar{ID: 1, OwnerID: 1, Name: "Work"})
+
+	_, err = store.Create(1, "work")
+	assert.ErrorIs(t, err, ErrCalendarExists)
+	_, err = store.Create(1, " ")
+	assert.NotNil(t, err)
+	home, err := store.Create(2, "work")
+	assert.Nil(t, err)
+	assert.Equal(t, home.ID, 2)
+
+	renamed, ok, err := store.Rename(1, work.ID, "Office")
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	assert.Equal(t, renamed.Name, "Office")
+	_, ok, _ = store.Rename(2, work.ID, "Mine")
+	assert.False(t, ok)
+
+	shared, ok, err := store.Share(1, work.ID, 3, ShareWrite)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	store.Share(1, work.ID, 2, ShareRead)
+	shared, _, _ = store.Share(1, work.ID, 3, ShareRead)
+	assert.Equal(t, shared.Shares, []Share{{UserID: 2, Level: ShareRead}, {UserID: 3, Level: ShareRead}})
+	_, _, err = store.Share(1, work.ID, 1, ShareRead)
+	assert.ErrorIs(t, err, ErrCalendarOwner)
+
+	assert.Equal(t, len(store.Visible(2)), 2)
+	assert.Equal(t, len(store.Visible(4)), 0)
+
+	//календари переживают перезапуск, а id не используются повторно
+	ok, err = store.Delete(2, home.ID)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	reopened, err := NewCalendarStore(path)
+	assert.Nil(t, err)
+	loaded, ok := reopened.Load(work.ID)
+	assert.True(t, ok)
+	assert.Equal(t, loaded, shared)
+	_, ok = reopened.Load(home.ID)
+	assert.False(t, ok)
+	created, _ := reopened.Create(2, "home")
+	assert.Equal(t, created.ID, 3)
+}
+
+func TestSharedCalendarAccess(t *testing.T) {
+	service, _ := newTestService()
+	work, _ := service.CreateCalendar(1, "work")
+	service.ShareCalendar(1, work.ID, 2, ShareRead)
+	service.ShareCalendar(1, work.ID, 3, ShareWrite)
+
+	shared := newEvent(1, "standup", fixedNow)
+	shared.CalendarID = work.ID
+	shared, err := service.SaveEvent(shared)
+	assert.Nil(t, err)
+	private, _ := service.SaveEvent(newEvent(1, "dentist", fixedNow))
+	service.SaveEvent(newEvent(2, "lunch", fixedNow))
+
+	//читатель видит события открытого календаря вместе со своими, но не календарь по умолчанию владельца
+	result, err := service.GetDay(2, time.Time{})
+	assert.Nil(t, err)
+	assert.Equal(t, len(result), 2)
+	assert.Equal(t, result[0].ID, shared.ID)
+	assert.Equal(t, result[1].Text, "lunch")
+	_, ok := service.GetEvent(2, shared.ID)
+	assert.True(t, ok)
+	_, ok = service.GetEvent(2, private.ID)
+	assert.False(t, ok)
+
+	all, err := service.GetAll(2)
+	assert.Nil(t, err)
+	assert.Equal(t, len(all), 2)
+
+	//занятость считается только по своим событиям
+	fb, err := service.FreeBusy(2, day(2021, 12, 15), day(2021, 12, 16), 0)
+	assert.Nil(t, err)
+	assert.Equal(t, len(fb.Busy), 0)
+
+	//читатель не может менять события, писатель может, а владелец события не меняется
+	_, ok, err = service.ChangeEvent(2, shared.ID, time.Time{}, EventChange{Text: "mine"}, 0)
+	assert.False(t, ok)
+	assert.Nil(t, err)
+	changed, ok, err := service.ChangeEvent(3, shared.ID, time.Time{}, EventChange{Text: "daily"}, 0)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	assert.Equal(t, changed.UserID, 1)
+	assert.Equal(t, changed.Text, "daily")
+
+	//писатель создает события в чужом календаре от имени владельца
+	added := newEvent(3, "retro", fixedNow)
+	added.CalendarID = work.ID
+	added, err = service.SaveEvent(added)
+	assert.Nil(t, err)
+	assert.Equal(t, added.UserID, 1)
+
+	bad := newEvent(2, "spam", fixedNow)
+	bad.CalendarID = work.ID
+	_, err = service.SaveEvent(bad)
+	assert.ErrorIs(t, err, ErrCalendarNotFound)
+
+	//писатель не может перенести событие в календарь по умолчанию владельца или в свой
+	mine, _ := service.CreateCalendar(3, "mine")
+	_, _, err = service.ChangeEvent(3, shared.ID, time.Time{}, EventChange{CalendarID: mine.ID}, 0)
+	assert.ErrorIs(t, err, ErrCalendarNotFound)
+
+	//после закрытия доступа события пропадают из выдачи
+	service.ShareCalendar(1, work.ID, 2, "")
+	result, _ = service.GetDay(2, time.Time{})
+	assert.Equal(t, len(result), 1)
+
+	ok, err = service.DeleteEvent(3, added.ID, time.Time{}, 0)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+}
+
+func TestDeleteCalendar(t *testing.T) {
+	service, _ := newTestService()
+	work, _ := service.CreateCalendar(1, "work")
+	inWork := newEvent(1, "standup", fixedNow)
+	inWork.CalendarID = work.ID
+	service.SaveEvent(inWork)
+	service.SaveEvent(inWork)
+	kept, _ := service.SaveEvent(newEvent(1, "dentist", fixedNow))
+
+	ok, err := service.DeleteCalendar(2, work.ID)
+	assert.False(t, ok)
+	assert.Nil(t, err)
+
+	//пока события удаляются, записи в календарь отклоняются
+	assert.True(t, service.calendars.beginDelete(1, work.ID))
+	_, err = service.SaveEvent(inWork)
+	assert.ErrorIs(t, err, ErrCalendarNotFound)
+	assert.Empty(t, service.GetCalendars(1))
+	assert.False(t, service.calendars.beginDelete(1, work.ID))
+	service.calendars.cancelDelete(work.ID)
+	_, err = service.SaveEvent(inWork)
+	assert.Nil(t, err)
+
+	ok, err = service.DeleteCalendar(1, work.ID)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	all, _ := service.GetAll(1)
+	assert.Equal(t, len(all), 1)
+	assert.Equal(t, all[0].ID, kept.ID)
+	assert.Empty(t, service.GetCalendars(1))
+}
+
+func TestDeleteCalendarPendingWrite(t *testing.T) {
+	service, store := newTestService()
+	work, _ := service.CreateCalendar(1, "work")
+	inWork := newEvent(1, "standup", fixedNow)
+	inWork.CalendarID = work.ID
+
+	//запись проверила календарь до пометки, а до хранилища дошла уже после нее
+	service.calendarWrites.RLock()
+	done := make(chan error)
+	go func() {
+		_, err := service.DeleteCalendar(1, work.ID)
+		done <- err
+	}()
+	assert.Eventually(t, func() bool { return len(service.GetCalendars(1)) == 0 }, time.Second, time.Millisecond)
+	store.Save(inWork, Author{UserID: 1})
+	service.calendarWrites.RUnlock()
+
+	//удаление дождалось записи, и событие не осталось без календаря
+	assert.Nil(t, <-done)
+	all, _ := service.GetAll(1)
+	assert.Empty(t, all)
+	_, err := service.SaveEvent(inWork)
+	assert.ErrorIs(t, err, ErrCalendarNotFound)
+}
+
+func TestDeleteCalendarCancels(t *testing.T) {
+	service, outbox := newInvitationService()
+	work, _ := service.CreateCalendar(1, "work")
+	inWork := newEvent(1, "standup", fixedNow)
+	inWork.CalendarID = work.ID
+	standup, _ := service.SaveEvent(inWork)
+	service.Invite(1, standup.ID, []int{2, 3})
+	service.Respond(3, standup.ID, StatusDeclined)
+	service.SaveEvent(inWork)
+	outbox.take()
+
+	//участники удаленных вместе с календарем событий получают отмену, отказавшиеся - нет
+	ok, err := service.DeleteCalendar(1, work.ID)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	messages := outbox.take()
+	assert.Equal(t, len(messages), 1)
+	assert.Equal(t, messages[0].Method, MethodCancel)
+	assert.Equal(t, messages[0].EventID, standup.ID)
+	assert.Equal(t, messages[0].Recipient, 2)
+}
+
+func TestDeleteCalendarFailed(t *testing.T) {
+	store, err := NewFileStore(t.TempDir(), 100)
+	assert.Nil(t, err)
+	service := NewService(store)
+	work, _ := service.CreateCalendar(1, "work")
+	inWork := newEvent(1, "standup", fixedNow)
+	inWork.CalendarID = work.ID
+	service.SaveEvent(inWork)
+	store.Close()
+
+	//события не удалились - календарь остается и снова принимает записи
+	ok, err := service.DeleteCalendar(1, work.ID)
+	assert.True(t, ok)
+	assert.ErrorIs(t, err, ErrClosed)
+	_, ok = service.GetCalendar(1, work.ID)
+	assert.True(t, ok)
+	assert.Nil(t, service.checkCalendar(1, 1, work.ID))
+}
+
+func TestBatchSharedCalendars(t *testing.T) {
+	//пакет в обоих режимах работает со всеми календарями, открытыми пользователю на запись
+	run := func(atomic bool) ([]BatchOutcome, []string, []ITIPMessage, []string) {
+		service, outbox := newInvitationService()
+		work, _ := service.CreateCalendar(1, "work")
+		service.ShareCalendar(1, work.ID, 2, ShareWrite)
+		standup := newEvent(1, "standup", fixedNow)
+		standup.CalendarID = work.ID
+		standup, _ = service.SaveEvent(standup)
+		service.Invite(1, standup.ID, []int{3})
+		outbox.take()
+
+		retro := newEvent(2, "retro", fixedNow)
+		retro.CalendarID = work.ID
+		outcomes, applied, err := service.Batch(2, []BatchCommand{
+			{Kind: BatchCreate, Event: retro},
+			{Kind: BatchUpdate, ID: standup.ID, Change: EventChange{Text: "daily"}},
+			{Kind: BatchDelete, ID: standup.ID, Version: 3},
+		}, atomic)
+		assert.Nil(t, err)
+		assert.True(t, applied)
+
+		all, _ := service.GetAll(1)
+		history, _ := service.History(1, standup.ID)
+		actions := []string{}
+		for _, entry := range history {
+			actions = append(actions, fmt.Sprintf("%s by %d", entry.Action, entry.Actor))
+		}
+		return outcomes, eventTexts(all), outbox.take(), actions
+	}
+
+	outcomes, texts, messages, actions := run(true)
+	assert.Equal(t, outcomes[0].Event.UserID, 1)
+	assert.Equal(t, outcomes[1].Event.Text, "daily")
+	assert.Equal(t, texts, []string{"retro"})
+	assert.Equal(t, len(messages), 1)
+	assert.Equal(t, messages[0].Method, MethodCancel)
+	assert.Equal(t, actions, []string{"created by 1", "updated by 1", "updated by 2", "deleted by 2"})
+
+	bestOutcomes, bestTexts, bestMessages, bestActions := run(false)
+	assert.Equal(t, outcomes, bestOutcomes)
+	assert.Equal(t, texts, bestTexts)
+	assert.Equal(t, messages, bestMessages)
+	assert.Equal(t, actions, bestActions)
+
+	//в календарь, открытый только на чтение, пакет писать не может
+	service, _ := newTestService()
+	home, _ := service.CreateCalendar(1, "home")
+	service.ShareCalendar(1, home.ID, 2, ShareRead)
+	event := newEvent(2, "dinner", fixedNow)
+	event.CalendarID = home.ID
+	outcomes, applied, err := service.Batch(2, []BatchCommand{{Kind: BatchCreate, Event: event}}, true)
+	assert.Nil(t, err)
+	assert.False(t, applied)
+	assert.ErrorIs(t, outcomes[0].Err, ErrCalendarNotFound)
+}
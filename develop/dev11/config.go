@@ -0,0 +1,433 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+//envPrefix префикс переменных окружения, переопределяющих конфиг:
+//ключ server.write_timeout задается переменной DEV11_SERVER_WRITE_TIMEOUT
+const envPrefix = "DEV11"
+
+//ServerConfig настройки http.Server. Меняются только перезапуском.
+type ServerConfig struct {
+	ReadTimeout       time.Duration `mapstructure:"read_timeout"`
+	ReadHeaderTimeout time.Duration `mapstructure:"read_header_timeout"`
+	WriteTimeout      time.Duration `mapstructure:"write_timeout"`
+	IdleTimeout       time.Duration `mapstructure:"idle_timeout"`
+	MaxHeaderBytes    int           `mapstructure:"max_header_bytes"`
+	DrainDelay        time.Duration `mapstructure:"drain_delay"`
+	ShutdownTimeout   time.Duration `mapstructure:"shutdown_timeout"`
+}
+
+//StorageConfig хранилище событий: memory или file (журнал и снимки в каталоге Path)
+type StorageConfig struct {
+	Type          string
+	Path          string
+	SnapshotEvery int `mapstructure:"snapshot_every"`
+}
+
+//LogConfig журнал: уровень debug | info | warn | error
+type LogConfig struct {
+	Level string
+}
+
+//CORSConfig источники, которым браузер разрешит запросы к API ("*" - любым)
+type CORSConfig struct {
+	Origins []string
+}
+
+//RemindersConfig планировщик напоминаний
+type RemindersConfig struct {
+	Interval time.Duration
+	Lookback time.Duration
+	State    string
+	Sinks    []sinkConfig
+}
+
+//InvitationsConfig ящики исходящих сообщений iTIP участникам событий
+//и файл Queue очереди их доставки (пусто - только в памяти). Меняется только перезапуском.
+type InvitationsConfig struct {
+	Outbox []sinkConfig
+	Queue  string
+}
+
+//CalendarsConfig именованные календари: файл Path, пусто - только в памяти. Меняется только перезапуском.
+type CalendarsConfig struct {
+	Path string
+}
+
+//AuditConfig журнал аудита изменений событий: файл Path, пусто - только в памяти.
+//Файл допустим только при storage.type file. Меняется только перезапуском.
+type AuditConfig struct {
+	Path string
+}
+
+//RetentionConfig фоновая уборка: раз в Interval из корзины удаляются события, пролежавшие в ней дольше Trash (0 - хранить всегда),
+//из журнала аудита - записи старше Audit (по умолчанию 0 - хранить всегда), а при ArchiveAfter больше 0 события,
+//закончившиеся раньше чем ArchiveAfter назад, переносятся JSON строками в файл Archive. Меняется только перезапуском.
+type RetentionConfig struct {
+	Interval     time.Duration
+	Trash        time.Duration
+	Audit        time.Duration
+	ArchiveAfter time.Duration `mapstructure:"archive_after"`
+	Archive      string
+}
+
+//IdempotencyConfig хранение ответов на запросы с Idempotency-Key
+type IdempotencyConfig struct {
+	TTL time.Duration
+}
+
+//RateLimitConfig ограничение частоты запросов
+type RateLimitConfig struct {
+	Enabled bool
+	Rate    float64
+	Burst   int
+	Routes  []RouteLimit
+}
+
+//AuthConfig аутентификация. Меняется только перезапуском.
+type AuthConfig struct {
+	Enabled     bool
+	TokenSecret string `mapstructure:"token_secret"`
+	Keys        []APIKey
+}
+
+//Config конфигурация сервиса из config.yaml и переменных окружения
+type Config struct {
+	Port        string
+	Server      ServerConfig
+	Storage     StorageConfig
+	Log         LogConfig
+	CORS        CORSConfig
+	Conflicts   string
+	Reminders   RemindersConfig
+	Invitations InvitationsConfig
+	Calendars   CalendarsConfig
+	Audit       AuditConfig
+	Retention   RetentionConfig
+	Idempotency IdempotencyConfig
+	RateLimit   RateLimitConfig `mapstructure:"rate_limit"`
+	Auth        AuthConfig
+}
+
+//setConfigDefaults задает значения по умолчанию. Переменные окружения
+//подхватываются только для известных viper ключей, поэтому по умолчанию задан каждый скалярный ключ.
+func setConfigDefaults(v *viper.Viper) {
+	v.SetDefault("port", "3000")
+	v.SetDefault("server.read_timeout", 10*time.Second)
+	v.SetDefault("server.read_header_timeout", 5*time.Second)
+	v.SetDefault("server.write_timeout", 10*time.Second)
+	v.SetDefault("server.idle_timeout", 60*time.Second)
+	v.SetDefault("server.max_header_bytes", 1<<20)
+	v.SetDefault("server.drain_delay", 0)
+	v.SetDefault("server.shutdown_timeout", 15*time.Second)
+	v.SetDefault("storage.type", "memory")
+	v.SetDefault("storage.path", "./data")
+	v.SetDefault("storage.snapshot_every", 100)
+	v.SetDefault("log.level", "info")
+	v.SetDefault("cors.origins", []string{})
+	v.SetDefault("conflicts", string(ConflictAllow))
+	v.SetDefault("reminders.interval", 30*time.Second)
+	v.SetDefault("reminders.lookback", 24*time.Hour)
+	v.SetDefault("reminders.state", "")
+	v.SetDefault("invitations.queue", "")
+	v.SetDefault("calendars.path", "")
+	v.SetDefault("audit.path", "")
+	v.SetDefault("retention.interval", time.Hour)
+	v.SetDefault("retention.trash", 30*24*time.Hour)
+	v.SetDefault("retention.audit", 0)
+	v.SetDefault("retention.archive_after", 0)
+	v.SetDefault("retention.archive", "")
+	v.SetDefault("idempotency.ttl", defaultIdempotencyTTL)
+	v.SetDefault("rate_limit.enabled", false)
+	v.SetDefault("rate_limit.rate", 0)
+	v.SetDefault("rate_limit.burst", 0)
+	v.SetDefault("auth.enabled", false)
+	v.SetDefault("auth.token_secret", "")
+}
+
+//newConfigViper настраивает viper: config.yaml из текущего каталога и переменные окружения DEV11_*
+func newConfigViper() *viper.Viper {
+	v := viper.New()
+	v.AddConfigPath(".")
+	v.SetConfigName("config")
+	v.SetEnvPrefix(envPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+	setConfigDefaults(v)
+	return v
+}
+
+//readConfig читает файл конфига; без файла используются значения по умолчанию и окружение
+func readConfig(v *viper.Viper) error {
+	if err := v.ReadInConfig(); err != nil {
+		var notFound viper.ConfigFileNotFoundError
+		if errors.As(err, &notFound) {
+			return nil
+		}
+		return fmt.Errorf("read config: %w", err)
+	}
+	return nil
+}
+
+//decodeConfig разбирает и проверяет конфиг из viper
+func decodeConfig(v *viper.Viper) (Config, error) {
+	var cfg Config
+	if err := v.Unmarshal(&cfg); err != nil {
+		return Config{}, fmt.Errorf("decode config: %w", err)
+	}
+	//список из переменной окружения viper делит по запятым, пробелы вокруг убираем
+	for i, origin := range cfg.CORS.Origins {
+		cfg.CORS.Origins[i] = strings.TrimSpace(origin)
+	}
+
+	if err := cfg.validate(); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+//parseLogLevel разбирает уровень журнала
+func parseLogLevel(str string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(str)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q: expect debug, info, warn or error", str)
+	}
+	return level, nil
+}
+
+//validate проверяет конфиг целиком и возвращает все найденные ошибки сразу,
+//каждую с ключом конфига, к которому она относится
+func (c Config) validate() error {
+	var errs []error
+	fail := func(key string, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("config %s: %s", key, fmt.Sprintf(format, args...)))
+	}
+
+	if port, err := strconv.Atoi(c.Port); err != nil || port <= 0 || port > 65535 {
+		fail("port", "expect number from 1 to 65535, got %q", c.Port)
+	}
+
+	timeouts := map[string]time.Duration{
+		"server.read_timeout":        c.Server.ReadTimeout,
+		"server.read_header_timeout": c.Server.ReadHeaderTimeout,
+		"server.write_timeout":       c.Server.WriteTimeout,
+		"server.idle_timeout":        c.Server.IdleTimeout,
+	}
+	for _, key := range []string{"server.read_timeout", "server.read_header_timeout", "server.write_timeout", "server.idle_timeout"} {
+		if timeouts[key] < 0 {
+			fail(key, "must not be negative, got %s", timeouts[key])
+		}
+	}
+	if c.Server.MaxHeaderBytes <= 0 {
+		fail("server.max_header_bytes", "must be positive, got %d", c.Server.MaxHeaderBytes)
+	}
+	if c.Server.DrainDelay < 0 {
+		fail("server.drain_delay", "must not be negative, got %s", c.Server.DrainDelay)
+	}
+	if c.Server.ShutdownTimeout <= 0 {
+		fail("server.shutdown_timeout", "must be positive, got %s", c.Server.ShutdownTimeout)
+	}
+
+	switch c.Storage.Type {
+	case "memory":
+	case "file":
+		if c.Storage.Path == "" {
+			fail("storage.path", "is required for file storage")
+		}
+		if c.Storage.SnapshotEvery < 0 {
+			fail("storage.snapshot_every", "must not be negative, got %d", c.Storage.SnapshotEvery)
+		}
+	default:
+		fail("storage.type", "expect memory or file, got %q", c.Storage.Type)
+	}
+	//в памяти номера событий после перезапуска начинаются заново, и новое событие получило бы чужую историю
+	if c.Audit.Path != "" && c.Storage.Type != "file" {
+		fail("audit.path", "requires storage.type file: event ids are reused after restart")
+	}
+
+	if _, err := parseLogLevel(c.Log.Level); err != nil {
+		fail("log.level", "%s", err)
+	}
+
+	for _, origin := range c.CORS.Origins {
+		if !validOrigin(origin) {
+			fail("cors.origins", "expect \"*\" or scheme://host[:port], got %q", origin)
+		}
+	}
+
+	if _, err := parseConflictPolicy(c.Conflicts); err != nil {
+		fail("conflicts", "%s", err)
+	}
+
+	if c.Reminders.Interval <= 0 {
+		fail("reminders.interval", "must be positive, got %s", c.Reminders.Interval)
+	}
+	if c.Reminders.Lookback < 0 {
+		fail("reminders.lookback", "must not be negative, got %s", c.Reminders.Lookback)
+	}
+	if _, err := buildSinks(c.Reminders.Sinks); err != nil {
+		fail("reminders.sinks", "%s", err)
+	}
+	if _, err := buildOutboxes(c.Invitations.Outbox); err != nil {
+		fail("invitations.outbox", "%s", err)
+	}
+
+	if c.Retention.Interval <= 0 {
+		fail("retention.interval", "must be positive, got %s", c.Retention.Interval)
+	}
+	if c.Retention.Trash < 0 {
+		fail("retention.trash", "must not be negative, got %s", c.Retention.Trash)
+	}
+	if c.Retention.Audit < 0 {
+		fail("retention.audit", "must not be negative, got %s", c.Retention.Audit)
+	}
+	if c.Retention.ArchiveAfter < 0 {
+		fail("retention.archive_after", "must not be negative, got %s", c.Retention.ArchiveAfter)
+	}
+	if c.Retention.ArchiveAfter > 0 && c.Retention.Archive == "" {
+		fail("retention.archive", "is required when retention.archive_after is set")
+	}
+
+	if c.Idempotency.TTL <= 0 {
+		fail("idempotency.ttl", "must be positive, got %s", c.Idempotency.TTL)
+	}
+
+	if c.RateLimit.Rate < 0 || c.RateLimit.Burst < 0 {
+		fail("rate_limit", "rate and burst must not be negative")
+	}
+	for i, route := range c.RateLimit.Routes {
+		if !strings.HasPrefix(route.Path, "/") {
+			fail(fmt.Sprintf("rate_limit.routes[%d].path", i), "expect path starting with /, got %q", route.Path)
+		}
+		if route.Rate < 0 || route.Burst < 0 {
+			fail(fmt.Sprintf("rate_limit.routes[%d]", i), "rate and burst must not be negative")
+		}
+	}
+
+	if c.Auth.Enabled {
+		if _, err := NewAuthenticator(c.Auth.Keys, c.Auth.TokenSecret); err != nil {
+			fail("auth.keys", "%s", err)
+		}
+		if len(c.Auth.Keys) == 0 && c.Auth.TokenSecret == "" {
+			fail("auth", "enabled without keys and token_secret: every request would be rejected")
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+//validOrigin проверяет источник CORS: "*" или схема с хостом без пути
+func validOrigin(origin string) bool {
+	if origin == "*" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" &&
+		(u.Path == "" || u.Path == "/") && u.RawQuery == "" && u.Fragment == ""
+}
+
+//restartOnly описывает настройки из old, которые отличаются в cfg, но применяются только перезапуском
+func restartOnly(old Config, cfg Config) []string {
+	var keys []string
+	if old.Port != cfg.Port {
+		keys = append(keys, "port")
+	}
+	if old.Server != cfg.Server {
+		keys = append(keys, "server")
+	}
+	if old.Storage != cfg.Storage {
+		keys = append(keys, "storage")
+	}
+	if fmt.Sprint(old.Reminders) != fmt.Sprint(cfg.Reminders) {
+		keys = append(keys, "reminders")
+	}
+	if fmt.Sprint(old.Invitations) != fmt.Sprint(cfg.Invitations) {
+		keys = append(keys, "invitations")
+	}
+	if old.Calendars != cfg.Calendars {
+		keys = append(keys, "calendars")
+	}
+	if old.Audit != cfg.Audit {
+		keys = append(keys, "audit")
+	}
+	if old.Retention != cfg.Retention {
+		keys = append(keys, "retention")
+	}
+	if fmt.Sprint(old.Auth) != fmt.Sprint(cfg.Auth) {
+		keys = append(keys, "auth")
+	}
+	return keys
+}
+
+//rateLimits ограничения частоты запросов из конфига; выключенное ограничение - нулевые лимиты
+func (c RateLimitConfig) rateLimits() (RateLimit, []RouteLimit) {
+	if !c.Enabled {
+		return RateLimit{}, nil
+	}
+	return RateLimit{Rate: c.Rate, Burst: c.Burst}, c.Routes
+}
+
+//RuntimeConfig настройки, которые применяются без перезапуска сервера:
+//уровень журнала, источники CORS, политика пересечений, ограничение частоты запросов
+//и время хранения ответов на запросы с Idempotency-Key
+type RuntimeConfig struct {
+	mutex       sync.Mutex
+	current     Config
+	logLevel    *slog.LevelVar
+	cors        *CORSPolicy
+	service     *Service
+	limiter     *RateLimiter
+	idempotency *IdempotencyStore
+}
+
+//Apply применяет настройки из cfg, которые меняются на лету.
+//Возвращает: ключи, изменение которых вступит в силу только после перезапуска.
+//cfg должен быть проверен decodeConfig.
+func (rc *RuntimeConfig) Apply(cfg Config) []string {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	level, _ := parseLogLevel(cfg.Log.Level)
+	rc.logLevel.Set(level)
+	rc.cors.SetOrigins(cfg.CORS.Origins)
+	policy, _ := parseConflictPolicy(cfg.Conflicts)
+	rc.service.SetConflictPolicy(policy)
+	rc.limiter.SetLimits(cfg.RateLimit.rateLimits())
+	rc.idempotency.SetTTL(cfg.Idempotency.TTL)
+
+	pending := restartOnly(rc.current, cfg)
+	//для сравнения остаются значения, с которыми запущен сервер
+	rc.current.Log, rc.current.CORS, rc.current.Conflicts = cfg.Log, cfg.CORS, cfg.Conflicts
+	rc.current.RateLimit, rc.current.Idempotency = cfg.RateLimit, cfg.Idempotency
+	return pending
+}
+
+//watchConfig следит за файлом конфига и применяет изменения через rc.
+//Конфиг с ошибками не применяется целиком: сервис продолжает работать с прежними настройками.
+func watchConfig(v *viper.Viper, rc *RuntimeConfig, logger *slog.Logger) {
+	v.OnConfigChange(func(e fsnotify.Event) {
+		cfg, err := decodeConfig(v)
+		if err != nil {
+			logger.Error("config reload rejected", "file", e.Name, "error", err.Error())
+			return
+		}
+		pending := rc.Apply(cfg)
+		logger.Info("config reloaded", "file", e.Name)
+		if len(pending) > 0 {
+			logger.Warn("config changes require restart", "keys", pending)
+		}
+	})
+	v.WatchConfig()
+}
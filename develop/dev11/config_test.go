@@ -0,0 +1,189 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+//testConfigViper viper с конфигом из строки YAML
+func testConfigViper(t *testing.T, yaml string) *viper.Viper {
+	v := newConfigViper()
+	v.SetConfigType("yaml")
+	if err := v.ReadConfig(strings.NewReader(yaml)); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestDecodeConfigDefaults(t *testing.T) {
+	cfg, err := decodeConfig(testConfigViper(t, `port: "8080"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, cfg.Port, "8080")
+	assert.Equal(t, cfg.Server.WriteTimeout, 10*time.Second)
+	assert.Equal(t, cfg.Server.ShutdownTimeout, 15*time.Second)
+	assert.Equal(t, cfg.Server.MaxHeaderBytes, 1<<20)
+	assert.Equal(t, cfg.Storage.Type, "memory")
+	assert.Equal(t, cfg.Log.Level, "info")
+	assert.Equal(t, cfg.Conflicts, string(ConflictAllow))
+	assert.Equal(t, cfg.Idempotency.TTL, defaultIdempotencyTTL)
+	assert.Equal(t, cfg.Retention.Trash, 30*24*time.Hour)
+	assert.Equal(t, cfg.Retention.Audit, time.Duration(0))
+	assert.Empty(t, cfg.CORS.Origins)
+}
+
+func TestDecodeConfigEnv(t *testing.T) {
+	t.Setenv("DEV11_PORT", "9090")
+	t.Setenv("DEV11_SERVER_WRITE_TIMEOUT", "30s")
+	t.Setenv("DEV11_LOG_LEVEL", "debug")
+	t.Setenv("DEV11_CORS_ORIGINS", "https://a.example.com, https://b.example.com")
+
+	cfg, err := decodeConfig(testConfigViper(t, `
+port: "8080"
+server:
+  write_timeout: "5s"
+log:
+  level: "warn"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, cfg.Port, "9090")
+	assert.Equal(t, cfg.Server.WriteTimeout, 30*time.Second)
+	assert.Equal(t, cfg.Log.Level, "debug")
+	assert.Equal(t, cfg.CORS.Origins, []string{"https://a.example.com", "https://b.example.com"})
+}
+
+func TestDecodeConfigValidation(t *testing.T) {
+	_, err := decodeConfig(testConfigViper(t, `
+port: "http"
+server:
+  shutdown_timeout: "0s"
+storage:
+  type: "redis"
+audit:
+  path: "audit.jsonl"
+log:
+  level: "loud"
+cors:
+  origins: ["example.com"]
+conflicts: "ignore"
+reminders:
+  sinks:
+    - type: "webhook"
+rate_limit:
+  routes:
+    - path: "create_event"
+      rate: 1
+retention:
+  trash: "-1h"
+  archive_after: "8760h"
+`))
+	if !assert.Error(t, err) {
+		return
+	}
+
+	//все ошибки сразу, каждая с ключом конфига
+	for _, key := range []string{"port", "server.shutdown_timeout", "storage.type", "audit.path", "log.level",
+		"cors.origins", "conflicts", "reminders.sinks", "rate_limit.routes[0].path", "retention.trash", "retention.archive"} {
+		assert.Contains(t, err.Error(), "config "+key+":")
+	}
+}
+
+//testRuntimeConfig RuntimeConfig над свежими компонентами
+func testRuntimeConfig(t *testing.T, cfg Config) *RuntimeConfig {
+	service, _ := newTestService()
+	return &RuntimeConfig{
+		current:     cfg,
+		logLevel:    new(slog.LevelVar),
+		cors:        NewCORSPolicy(nil),
+		service:     service,
+		limiter:     NewRateLimiter(RateLimit{}, nil),
+		idempotency: NewIdempotencyStore(0),
+	}
+}
+
+func TestRuntimeConfigApply(t *testing.T) {
+	old, err := decodeConfig(testConfigViper(t, `port: "3000"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := testRuntimeConfig(t, old)
+
+	cfg, err := decodeConfig(testConfigViper(t, `
+port: "4000"
+log:
+  level: "debug"
+cors:
+  origins: ["https://app.example.com"]
+conflicts: "reject"
+idempotency:
+  ttl: "1h"
+rate_limit:
+  enabled: true
+  rate: 1
+  burst: 1
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending := rc.Apply(cfg)
+	assert.Equal(t, pending, []string{"port"})
+	assert.Equal(t, rc.logLevel.Level(), slog.LevelDebug)
+	assert.True(t, rc.cors.allowed("https://app.example.com"))
+	assert.Equal(t, rc.service.conflictPolicy(), ConflictReject)
+	assert.Equal(t, rc.idempotency.ttl, time.Hour)
+	ok, _ := rc.limiter.Allow("a", "/x")
+	assert.True(t, ok)
+	ok, _ = rc.limiter.Allow("a", "/x")
+	assert.False(t, ok)
+
+	//порт по-прежнему ждет перезапуска
+	assert.Equal(t, rc.Apply(cfg), []string{"port"})
+}
+
+func TestWatchConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("log:\n  level: \"info\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	v := newConfigViper()
+	v.SetConfigFile(path)
+	if err := readConfig(v); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := decodeConfig(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := testRuntimeConfig(t, cfg)
+	rc.Apply(cfg)
+	watchConfig(v, rc, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	//конфиг с ошибкой не применяется
+	if err := os.WriteFile(path, []byte("log:\n  level: \"loud\"\nconflicts: \"reject\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, rc.service.conflictPolicy(), ConflictAllow)
+
+	if err := os.WriteFile(path, []byte("log:\n  level: \"error\"\nconflicts: \"flag\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	assert.Eventually(t, func() bool {
+		return rc.service.conflictPolicy() == ConflictFlag && rc.logLevel.Level() == slog.LevelError
+	}, 2*time.Second, 10*time.Millisecond)
+}
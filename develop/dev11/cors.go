@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+//Заголовки CORS ответов
+const (
+	corsAllowMethods  = "GET, POST, PUT, PATCH, DELETE"
+	corsAllowHeaders  = "Authorization, Content-Type, If-Match, Idempotency-Key, Last-Event-ID, X-API-Key, X-Request-ID"
+	corsExposeHeaders = "ETag, Location, Retry-After, Idempotent-Replayed, X-Request-ID"
+	corsMaxAge        = "600"
+)
+
+//CORSPolicy источники, которым разрешены запросы из браузера.
+//Список меняется на лету при перезагрузке конфига.
+type CORSPolicy struct {
+	mutex     sync.RWMutex
+	origins   map[string]bool
+	anyOrigin bool
+}
+
+//NewCORSPolicy конструктор для CORSPolicy
+func NewCORSPolicy(origins []string) *CORSPolicy {
+	c := &CORSPolicy{}
+	c.SetOrigins(origins)
+	return c
+}
+
+//SetOrigins заменяет список разрешенных источников ("*" - любой)
+func (c *CORSPolicy) SetOrigins(origins []string) {
+	allowed := make(map[string]bool, len(origins))
+	anyOrigin := false
+	for _, origin := range origins {
+		if origin == "*" {
+			anyOrigin = true
+		}
+		allowed[strings.TrimSuffix(strings.ToLower(origin), "/")] = true
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.origins, c.anyOrigin = allowed, anyOrigin
+}
+
+//allowed проверяет, разрешен ли источник
+func (c *CORSPolicy) allowed(origin string) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.anyOrigin || c.origins[strings.ToLower(origin)]
+}
+
+//CORS middleware CORS: разрешенному источнику возвращает Access-Control-Allow-Origin,
+//на предварительный запрос OPTIONS отвечает сам, до аутентификации (браузер шлет его без учетных данных).
+//Запросы без Origin и от других источников проходят без заголовков CORS.
+//Без CORSPolicy пропускает запросы как есть.
+func CORS(policy *CORSPolicy, next http.Handler) http.Handler {
+	if policy == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		if !policy.allowed(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
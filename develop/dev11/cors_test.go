@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCORS(t *testing.T) {
+	service, _ := newTestService()
+	h := NewHandler(service)
+	h.auth = newTestAuthenticator(t)
+	h.cors = NewCORSPolicy([]string{"https://app.example.com"})
+	handler := h.initRouts()
+
+	//предварительный запрос проходит без учетных данных
+	req := httptest.NewRequest(http.MethodOptions, "/api/v1/events", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPatch)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, rec.Code, http.StatusNoContent)
+	assert.Equal(t, rec.Header().Get("Access-Control-Allow-Origin"), "https://app.example.com")
+	assert.Contains(t, rec.Header().Get("Access-Control-Allow-Methods"), http.MethodPatch)
+	assert.Contains(t, rec.Header().Get("Access-Control-Allow-Headers"), "If-Match")
+
+	//обычный запрос от разрешенного источника по-прежнему требует учетных данных
+	req = httptest.NewRequest(http.MethodGet, "/events_for_day?user_id=1&date=15-12-2021", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, rec.Code, http.StatusUnauthorized)
+	assert.Equal(t, rec.Header().Get("Access-Control-Allow-Origin"), "https://app.example.com")
+	assert.Contains(t, rec.Header().Get("Access-Control-Expose-Headers"), "ETag")
+
+	//чужой источник не получает заголовков CORS
+	req = httptest.NewRequest(http.MethodOptions, "/api/v1/events", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, rec.Header().Get("Vary"), "Origin")
+
+	//список меняется на лету
+	h.cors.SetOrigins([]string{"*"})
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, rec.Code, http.StatusNoContent)
+	assert.Equal(t, rec.Header().Get("Access-Control-Allow-Origin"), "https://evil.example.com")
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Виды изменений событий в ленте
+const (
+	ChangeCreated = "created"
+	ChangeUpdated = "updated"
+	ChangeDeleted = "deleted"
+)
+
+const (
+	//feedHistory сколько последних изменений брокер хранит для возобновления по Last-Event-ID
+	feedHistory = 1024
+	//feedBuffer сколько изменений может ждать отправки одному подписчику
+	feedBuffer = 64
+)
+
+//Notice изменение события в ленте.
+//ID - курсор вида "<эпоха>-<номер>": эпоха меняется при перезапуске процесса,
+//поэтому курсор от предыдущего запуска не совпадет ни с одним изменением.
+type Notice struct {
+	ID       string `json:"ID"`
+	Kind     string `json:"Kind"`
+	Event    Event  `json:"Event"`
+	seq      uint64
+	previous *Event
+}
+
+//FeedFilter фильтр подписки: события владельца, пересекающиеся с [Start, End].
+//Нулевые границы не ограничивают ленту.
+type FeedFilter struct {
+	UserID int
+	Start  time.Time
+	End    time.Time
+}
+
+//matches проверяет, относится ли изменение к подписке.
+//Изменение подходит, если в промежуток попадает новое или прежнее состояние события,
+//так что перенос события из промежутка тоже приходит подписчику.
+func (f FeedFilter) matches(n Notice) bool {
+	if n.Event.UserID != f.UserID {
+		return false
+	}
+	if f.Start.IsZero() && f.End.IsZero() {
+		return true
+	}
+	if f.inRange(n.Event) {
+		return true
+	}
+	return n.previous != nil && f.inRange(*n.previous)
+}
+
+//inRange проверяет, пересекается ли событие или одно из вхождений серии с промежутком фильтра
+func (f FeedFilter) inRange(event Event) bool {
+	start, end := f.Start, f.End
+	if end.IsZero() {
+		end = maxTime
+	}
+	if event.Recurrence != nil {
+		return len(expand(event, start, end)) > 0
+	}
+	return event.overlaps(start, end)
+}
+
+//maxTime верхняя граница для фильтров без окончания
+var maxTime = time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+
+//Subscription подписка на ленту изменений.
+//Канал C закрывается при отписке, остановке брокера или если подписчик не успевает
+//забирать изменения; после этого клиент переподключается со своим курсором.
+type Subscription struct {
+	C      chan Notice
+	filter FeedFilter
+	closed bool
+}
+
+//Broker рассылает изменения хранилища подписчикам и хранит последние из них для возобновления
+type Broker struct {
+	mutex   sync.Mutex
+	epoch   string
+	seq     uint64
+	history []Notice
+	subs    map[*Subscription]struct{}
+	closed  bool
+}
+
+//NewBroker конструктор для Broker
+func NewBroker() *Broker {
+	return &Broker{
+		epoch: strconv.FormatInt(time.Now().UnixNano(), 36),
+		subs:  make(map[*Subscription]struct{}),
+	}
+}
+
+//Publish рассылает изменение события подписчикам. Вызывается наблюдателем хранилища Service.observe.
+//Не блокируется: подписчик с переполненным буфером отключается.
+func (b *Broker) Publish(kind string, event Event, previous *Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.seq++
+	n := Notice{ID: fmt.Sprintf("%s-%d", b.epoch, b.seq), Kind: kind, Event: event, seq: b.seq, previous: previous}
+
+	b.history = append(b.history, n)
+	if len(b.history) > feedHistory {
+		b.history = b.history[len(b.history)-feedHistory:]
+	}
+
+	for sub := range b.subs {
+		if !sub.filter.matches(n) {
+			continue
+		}
+		select {
+		case sub.C <- n:
+		default:
+			b.unsubscribe(sub)
+		}
+	}
+}
+
+//Subscribe подписывает на изменения, подходящие под фильтр.
+//Если передан курсор lastID, возвращает пропущенные после него изменения;
+//resumed = false, если курсор устарел или от другого запуска и пропущенное восстановить нельзя.
+func (b *Broker) Subscribe(filter FeedFilter, lastID string) (sub *Subscription, backlog []Notice, resumed bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	sub = &Subscription{C: make(chan Notice, feedBuffer), filter: filter}
+	if b.closed {
+		sub.closed = true
+		close(sub.C)
+		return sub, nil, false
+	}
+	b.subs[sub] = struct{}{}
+
+	if lastID == "" {
+		return sub, nil, true
+	}
+
+	seq, ok := b.parseID(lastID)
+	//курсор старше хранимой истории
+	if !ok || seq > b.seq || (len(b.history) > 0 && seq+1 < b.history[0].seq) {
+		return sub, nil, false
+	}
+
+	for _, n := range b.history {
+		if n.seq > seq && filter.matches(n) {
+			backlog = append(backlog, n)
+		}
+	}
+	return sub, backlog, true
+}
+
+//parseID разбирает курсор; курсор от другого запуска не подходит
+func (b *Broker) parseID(id string) (uint64, bool) {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 || parts[0] != b.epoch {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(parts[1], 10, 64)
+	return seq, err == nil
+}
+
+//Unsubscribe отменяет подписку и закрывает ее канал
+func (b *Broker) Unsubscribe(sub *Subscription) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.unsubscribe(sub)
+}
+
+//unsubscribe отменяет подписку. Вызывается под b.mutex.
+func (b *Broker) unsubscribe(sub *Subscription) {
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	delete(b.subs, sub)
+	close(sub.C)
+}
+
+//Close отключает всех подписчиков, чтобы долгие соединения не держали остановку сервера
+func (b *Broker) Close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.closed = true
+	for sub := range b.subs {
+		b.unsubscribe(sub)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+//feedHeartbeat период комментариев-пингов, по которым прокси не закрывают молчащее соединение
+const feedHeartbeat = 15 * time.Second
+
+//noticeReset сообщение о том, что курсор устарел и клиенту нужно перечитать события целиком
+const noticeReset = "reset"
+
+//parseFeedFilter разбирает фильтр ленты пользователя из queryString: необязательные
+//from и to в форматах parseEventTime в зоне tz (дата без времени в to включает весь день).
+func parseFeedFilter(userID int, query url.Values) (FeedFilter, error) {
+	filter := FeedFilter{UserID: userID}
+
+	loc, ok := parseLocation(query.Get("tz"))
+	if !ok {
+		return FeedFilter{}, fmt.Errorf("Bad tz")
+	}
+
+	var err error
+	if str := query.Get("from"); str != "" {
+		if filter.Start, _, err = parseEventTime(str, loc); err != nil {
+			return FeedFilter{}, fmt.Errorf("Bad from")
+		}
+	}
+	if str := query.Get("to"); str != "" {
+		var dateOnly bool
+		if filter.End, dateOnly, err = parseEventTime(str, loc); err != nil {
+			return FeedFilter{}, fmt.Errorf("Bad to")
+		}
+		if dateOnly {
+			_, filter.End = dayBounds(filter.End)
+		}
+		if filter.End.Before(filter.Start) {
+			return FeedFilter{}, fmt.Errorf("Bad to")
+		}
+	}
+	return filter, nil
+}
+
+//eventsStream обработчик для GET /events/stream - лента изменений событий пользователя.
+//По умолчанию отдает Server-Sent Events, при запросе Upgrade: websocket - сообщения WebSocket.
+//Курсор последнего полученного изменения передается заголовком Last-Event-ID
+//или параметром last_event_id (браузерный WebSocket не умеет ставить заголовки).
+//Если курсор устарел, первым приходит сообщение reset.
+func (h *Handler) eventsStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONMessage(w, http.StatusMethodNotAllowed, fmt.Sprintf("expect method Get at /events/stream, got %v", r.Method), true)
+		return
+	}
+
+	userID, status, err := resolveUserID(r, r.URL.Query().Get("user_id"))
+	if err != nil {
+		writeJSONMessage(w, status, err.Error(), true)
+		return
+	}
+
+	filter, err := parseFeedFilter(userID, r.URL.Query())
+	if err != nil {
+		writeJSONMessage(w, http.StatusBadRequest, err.Error(), true)
+		return
+	}
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+
+	if isWebSocket(r) {
+		h.streamWebSocket(w, r, filter, lastID)
+		return
+	}
+	h.streamSSE(w, r, filter, lastID)
+}
+
+//streamSSE отдает ленту в формате text/event-stream
+func (h *Handler) streamSSE(w http.ResponseWriter, r *http.Request, filter FeedFilter, lastID string) {
+	rc := http.NewResponseController(w)
+	//лента живет дольше WriteTimeout сервера
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		writeJSONMessage(w, http.StatusInternalServerError, "Streaming is not supported", true)
+		return
+	}
+
+	sub, backlog, resumed := h.service.Subscribe(filter, lastID)
+	defer h.service.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if !resumed {
+		fmt.Fprintf(w, "event: %s\ndata: {}\n\n", noticeReset)
+	}
+	for _, n := range backlog {
+		writeSSENotice(w, n)
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(feedHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case n, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			writeSSENotice(w, n)
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+//writeSSENotice записывает изменение событием SSE: id - курсор, event - вид изменения
+func writeSSENotice(w http.ResponseWriter, n Notice) {
+	data, _ := json.Marshal(n)
+	fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", n.ID, n.Kind, data)
+}
+
+//streamWebSocket отдает ленту сообщениями WebSocket: каждое изменение - JSON Notice,
+//устаревший курсор - сообщение {"Kind":"reset"}
+func (h *Handler) streamWebSocket(w http.ResponseWriter, r *http.Request, filter FeedFilter, lastID string) {
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+
+	sub, backlog, resumed := h.service.Subscribe(filter, lastID)
+	defer h.service.Unsubscribe(sub)
+
+	if !resumed {
+		if ws.WriteText([]byte(`{"Kind":"`+noticeReset+`"}`)) != nil {
+			return
+		}
+	}
+	for _, n := range backlog {
+		data, _ := json.Marshal(n)
+		if ws.WriteText(data) != nil {
+			return
+		}
+	}
+
+	for {
+		select {
+		case <-ws.Closed():
+			return
+		case n, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(n)
+			if ws.WriteText(data) != nil {
+				return
+			}
+		}
+	}
+}
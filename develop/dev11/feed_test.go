@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBrokerFilterAndResume(t *testing.T) {
+	service, store := newTestService()
+	filter := FeedFilter{UserID: 1, Start: day(2021, 12, 15), End: day(2021, 12, 16)}
+
+	sub, backlog, resumed := service.Subscribe(filter, "")
+	assert.True(t, resumed)
+	assert.Equal(t, len(backlog), 0)
+
+	store.Save(newEvent(1, "in range", day(2021, 12, 15)), Author{})
+	store.Save(newEvent(1, "out of range", day(2021, 12, 20)), Author{})
+	store.Save(newEvent(2, "other user", day(2021, 12, 15)), Author{})
+	//перенос из промежутка тоже приходит подписчику
+	store.Change(1, 1, time.Time{}, EventChange{Date: day(2021, 12, 25)}, 0, Author{})
+	store.Delete(1, 2, time.Time{}, 0, Author{})
+
+	first := <-sub.C
+	assert.Equal(t, first.Kind, ChangeCreated)
+	assert.Equal(t, first.Event.Text, "in range")
+	second := <-sub.C
+	assert.Equal(t, second.Kind, ChangeUpdated)
+	assert.Equal(t, len(sub.C), 0)
+	service.Unsubscribe(sub)
+
+	resumedSub, backlog, resumed := service.Subscribe(FeedFilter{UserID: 1}, first.ID)
+	assert.True(t, resumed)
+	assert.Equal(t, len(backlog), 3)
+	assert.Equal(t, backlog[2].Kind, ChangeDeleted)
+	service.Unsubscribe(resumedSub)
+
+	_, _, resumed = service.Subscribe(FeedFilter{UserID: 1}, "stale-1")
+	assert.False(t, resumed)
+
+	service.CloseFeed()
+	_, ok := <-resumedSub.C
+	assert.False(t, ok)
+}
+
+func TestEventsStreamSSE(t *testing.T) {
+	service, store := newTestService()
+	server := httptest.NewServer(NewHandler(service).initRouts())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/events/stream?user_id=1")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, resp.Header.Get("Content-Type"), "text/event-stream")
+
+	store.Save(newEvent(1, "123", fixedNow), Author{})
+
+	reader := bufio.NewReader(resp.Body)
+	lines := make([]string, 0)
+	for len(lines) < 3 {
+		line, err := reader.ReadString('\n')
+		assert.Nil(t, err)
+		lines = append(lines, strings.TrimSpace(line))
+	}
+	assert.True(t, strings.HasPrefix(lines[0], "id: "))
+	assert.Equal(t, lines[1], "event: created")
+
+	var n Notice
+	assert.Nil(t, json.Unmarshal([]byte(strings.TrimPrefix(lines[2], "data: ")), &n))
+	assert.Equal(t, n.Event.ID, 1)
+}
+
+func TestEventsStreamWebSocket(t *testing.T) {
+	service, store := newTestService()
+	server := httptest.NewServer(NewHandler(service).initRouts())
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	conn.Write([]byte("GET /events/stream?user_id=1&last_event_id=stale-1 HTTP/1.1\r\nHost: test\r\n" +
+		"Connection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"))
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusSwitchingProtocols)
+	assert.Equal(t, resp.Header.Get("Sec-WebSocket-Accept"), "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=")
+
+	//readText читает текстовый кадр сервера (без маски)
+	readText := func() string {
+		head := make([]byte, 2)
+		_, err := io.ReadFull(reader, head)
+		assert.Nil(t, err)
+		assert.Equal(t, head[0], byte(0x80|wsText))
+		length := int(head[1])
+		if length == 126 {
+			ext := make([]byte, 2)
+			io.ReadFull(reader, ext)
+			length = int(binary.BigEndian.Uint16(ext))
+		}
+		payload := make([]byte, length)
+		_, err = io.ReadFull(reader, payload)
+		assert.Nil(t, err)
+		return string(payload)
+	}
+
+	assert.Equal(t, readText(), `{"Kind":"reset"}`)
+
+	store.Save(newEvent(1, "123", fixedNow), Author{})
+	var n Notice
+	assert.Nil(t, json.Unmarshal([]byte(readText()), &n))
+	assert.Equal(t, n.Kind, ChangeCreated)
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	walFileName      = "wal.log"
+	snapshotFileName = "snapshot.json"
+
+	opPut     = "put"
+	opDelete  = "delete"
+	opBatch   = "batch"
+	opPurge   = "purge"
+	opExpunge = "expunge"
+)
+
+//walRecord запись журнала: операция и данные для нее.
+//Пакет (opBatch) пишется одной записью: события Events кладутся, события с id из IDs удаляются.
+//Time у opDelete и opBatch - время удаления, с которым события попадают в корзину
+//(записи без него, сделанные до появления корзины, удаляют безвозвратно),
+//у opPurge - граница очистки корзины. opExpunge безвозвратно удаляет события IDs, перенесенные в архив.
+type walRecord struct {
+	Op     string    `json:"Op"`
+	ID     int       `json:"ID,omitempty"`
+	Event  *Event    `json:"Event,omitempty"`
+	Events []Event   `json:"Events,omitempty"`
+	IDs    []int     `json:"IDs,omitempty"`
+	Time   *JSONTime `json:"Time,omitempty"`
+}
+
+//time время записи; нулевое, если его нет
+func (rec walRecord) time() time.Time {
+	if rec.Time == nil {
+		return time.Time{}
+	}
+	return time.Time(*rec.Time)
+}
+
+//ErrClosed хранилище закрыто и больше не принимает изменений
+var ErrClosed = errors.New("file store is closed")
+
+//snapshot снимок состояния хранилища
+type snapshot struct {
+	NextID int       `json:"NextID"`
+	Events []Event   `json:"Events"`
+	Trash  []Trashed `json:"Trash,omitempty"`
+}
+
+//FileStore хранилище событий с сохранением на диск.
+//Данные держатся в памяти во встроенном EventStore, каждое изменение
+//перед применением дописывается в журнал (write-ahead log), а через каждые
+//snapshotEvery записей состояние сбрасывается в снимок и журнал обнуляется.
+type FileStore struct {
+	*EventStore
+	dir           string
+	wal           *os.File
+	mutex         sync.Mutex
+	snapshotEvery int
+	walRecords    int
+	closed        bool
+}
+
+//NewFileStore конструктор для FileStore.
+//Принимает: директорию для файлов хранилища и количество записей журнала между снимками
+//(0 и меньше - снимок только при закрытии).
+//Восстанавливает события и nextID из снимка и журнала.
+//Возвращает: ссылку на FileStore и ошибку восстановления.
+func NewFileStore(dir string, snapshotEvery int) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	fs := &FileStore{EventStore: NewEventStore(), dir: dir, snapshotEvery: snapshotEvery}
+
+	if err := fs.loadSnapshot(); err != nil {
+		return nil, err
+	}
+
+	wal, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fs.wal = wal
+
+	if err := fs.replay(); err != nil {
+		wal.Close()
+		return nil, err
+	}
+
+	return fs, nil
+}
+
+//loadSnapshot загружает снимок, если он есть
+func (fs *FileStore) loadSnapshot() error {
+	data, err := os.ReadFile(filepath.Join(fs.dir, snapshotFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("bad snapshot: %w", err)
+	}
+
+	for _, event := range snap.Events {
+		fs.EventStore.put(event, Author{})
+	}
+	for _, t := range snap.Trash {
+		fs.EventStore.putTrashed(t)
+	}
+	if snap.NextID > fs.EventStore.peekID() {
+		fs.EventStore.nextID = snap.NextID
+	}
+
+	return nil
+}
+
+//replay применяет записи журнала поверх снимка.
+//Недописанная последняя строка (падение во время записи) отрезается.
+func (fs *FileStore) replay() error {
+	reader := bufio.NewReader(fs.wal)
+	var offset int64
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				if err := fs.wal.Truncate(offset); err != nil {
+					return err
+				}
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		var rec walRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return fmt.Errorf("bad wal record at offset %d: %w", offset, err)
+		}
+		fs.apply(rec, Author{})
+
+		offset += int64(len(line))
+		fs.walRecords++
+	}
+
+	_, err := fs.wal.Seek(offset, io.SeekStart)
+	return err
+}
+
+//apply применяет запись журнала к данным в памяти от имени by
+func (fs *FileStore) apply(rec walRecord, by Author) {
+	switch rec.Op {
+	case opPut:
+		if rec.Event != nil {
+			fs.EventStore.put(*rec.Event, by)
+		}
+	case opDelete:
+		fs.EventStore.remove(rec.ID, rec.time(), by)
+	case opBatch:
+		fs.EventStore.putBatch(rec.Events, rec.IDs, rec.time(), by)
+	case opPurge:
+		fs.EventStore.purgeTrash(rec.time())
+	case opExpunge:
+		fs.EventStore.putBatch(nil, rec.IDs, time.Time{}, by)
+	}
+}
+
+//appendLog дописывает запись в журнал и сбрасывает ее на диск
+func (fs *FileStore) appendLog(rec walRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fs.wal.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := fs.wal.Sync(); err != nil {
+		return err
+	}
+
+	fs.walRecords++
+	return nil
+}
+
+//commit пишет запись в журнал, применяет ее от имени by и при необходимости делает снимок.
+//Вызывается под fs.mutex.
+func (fs *FileStore) commit(rec walRecord, by Author) error {
+	if err := fs.appendLog(rec); err != nil {
+		return err
+	}
+	fs.apply(rec, by)
+	return fs.compact()
+}
+
+//compact делает снимок, если в журнале накопилось snapshotEvery записей.
+//Вызывается под fs.mutex.
+func (fs *FileStore) compact() error {
+	if fs.snapshotEvery > 0 && fs.walRecords >= fs.snapshotEvery {
+		return fs.writeSnapshot()
+	}
+	return nil
+}
+
+//writeSnapshot сохраняет текущее состояние в снимок и обнуляет журнал.
+//Снимок пишется во временный файл и атомарно переименовывается;
+//если упасть до обнуления журнала, повторное применение записей ничего не испортит.
+//Вызывается под fs.mutex.
+func (fs *FileStore) writeSnapshot() error {
+	fs.EventStore.mutex.RLock()
+	snap := snapshot{NextID: fs.EventStore.nextID, Events: make([]Event, 0, len(fs.EventStore.m))}
+	for _, v := range fs.EventStore.m {
+		snap.Events = append(snap.Events, v)
+	}
+	for _, t := range fs.EventStore.trash {
+		snap.Trash = append(snap.Trash, t)
+	}
+	fs.EventStore.mutex.RUnlock()
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(filepath.Join(fs.dir, snapshotFileName), data); err != nil {
+		return err
+	}
+
+	if err := fs.wal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := fs.wal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	fs.walRecords = 0
+
+	return nil
+}
+
+//writeFileAtomic записывает файл целиком через временный файл и rename,
+//так что после сбоя на диске остается либо старое, либо новое содержимое.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+//Save сохраняет новый Event, предварительно записав его в журнал.
+//Конкурентно безопасный метод.
+func (fs *FileStore) Save(event Event, by Author) (Event, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.closed {
+		return Event{}, ErrClosed
+	}
+
+	event.ID = fs.EventStore.peekID()
+	event.Version = 1
+	if err := fs.commit(walRecord{Op: opPut, Event: &event}, by); err != nil {
+		return Event{}, err
+	}
+	return event, nil
+}
+
+//Replace заменяет Event пользователя целиком, сохраняя участников, предварительно записав его в журнал.
+//Принимает ожидаемую версию события (0 - без проверки).
+//Возвращает новое состояние события, флаг наличия у пользователя события и ошибку замены.
+//Конкурентно безопасный метод.
+func (fs *FileStore) Replace(userID int, event Event, version int, by Author) (Event, bool, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.closed {
+		return Event{}, false, ErrClosed
+	}
+
+	el, ok := fs.EventStore.Load(event.ID)
+	if !ok || el.UserID != userID {
+		return Event{}, false, nil
+	}
+	if err := matchVersion(el, version); err != nil {
+		return Event{}, true, err
+	}
+
+	event.UserID = userID
+	event.Attendees = el.Attendees
+	event.Version = el.Version + 1
+	if err := fs.commit(walRecord{Op: opPut, Event: &event}, by); err != nil {
+		return Event{}, true, err
+	}
+	return event, true, nil
+}
+
+//updateAttendees меняет участников события, предварительно записав новое состояние в журнал.
+//Возвращает новое состояние события, флаг наличия события и ошибку изменения.
+//Конкурентно безопасный метод.
+func (fs *FileStore) updateAttendees(id int, update func(event Event) ([]Attendee, error), by Author) (Event, bool, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.closed {
+		return Event{}, false, ErrClosed
+	}
+
+	el, ok := fs.EventStore.Load(id)
+	if !ok {
+		return Event{}, false, nil
+	}
+	event, err := withAttendees(el, update)
+	if err != nil {
+		return Event{}, true, err
+	}
+	if err := fs.commit(walRecord{Op: opPut, Event: &event}, by); err != nil {
+		return Event{}, true, err
+	}
+	return event, true, nil
+}
+
+//Change изменяет Event, предварительно записав новое состояние в журнал.
+//Принимает ожидаемую версию события (0 - без проверки).
+//Все изменения FileStore идут под fs.mutex, поэтому чтение и запись события атомарны.
+//Возвращает новое состояние события, флаг наличия у пользователя события и ошибку изменения.
+//Конкурентно безопасный метод.
+func (fs *FileStore) Change(userID int, id int, occurrence time.Time, change EventChange, version int, by Author) (Event, bool, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.closed {
+		return Event{}, false, ErrClosed
+	}
+
+	el, ok := fs.EventStore.Load(id)
+	if !ok || el.UserID != userID {
+		return Event{}, false, nil
+	}
+	if err := matchVersion(el, version); err != nil {
+		return Event{}, true, err
+	}
+
+	event, err := changeEvent(el, occurrence, change)
+	if err != nil {
+		return Event{}, true, err
+	}
+	event.Version = el.Version + 1
+	if err := fs.commit(walRecord{Op: opPut, Event: &event}, by); err != nil {
+		return Event{}, true, err
+	}
+	return event, true, nil
+}
+
+//Delete перемещает Event в корзину или удаляет одно вхождение серии, предварительно записав изменение в журнал.
+//Принимает ожидаемую версию события (0 - без проверки).
+//Возвращает последнее состояние удаленного события (для вхождения - новое состояние серии),
+//флаг наличия у пользователя события и ошибку удаления.
+//Конкурентно безопасный метод.
+func (fs *FileStore) Delete(userID int, id int, occurrence time.Time, version int, by Author) (Event, bool, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.closed {
+		return Event{}, false, ErrClosed
+	}
+
+	el, ok := fs.EventStore.Load(id)
+	if !ok || el.UserID != userID {
+		return Event{}, false, nil
+	}
+	if err := matchVersion(el, version); err != nil {
+		return Event{}, true, err
+	}
+
+	if !occurrence.IsZero() {
+		event, err := deleteOccurrence(el, occurrence)
+		if err != nil {
+			return Event{}, true, err
+		}
+		event.Version = el.Version + 1
+		if err := fs.commit(walRecord{Op: opPut, Event: &event}, by); err != nil {
+			return Event{}, true, err
+		}
+		return event, true, nil
+	}
+
+	deleted := JSONTime(fs.EventStore.now())
+	if err := fs.commit(walRecord{Op: opDelete, ID: id, Time: &deleted}, by); err != nil {
+		return Event{}, true, err
+	}
+	return el, true, nil
+}
+
+//Restore кладет удаленное ранее событие обратно под его id, предварительно записав его в журнал.
+//Возвращает восстановленное событие и ErrEventExists, если событие с этим id есть в хранилище.
+//Конкурентно безопасный метод.
+func (fs *FileStore) Restore(event Event, by Author) (Event, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.closed {
+		return Event{}, ErrClosed
+	}
+
+	if _, ok := fs.EventStore.Load(event.ID); ok {
+		return Event{}, ErrEventExists
+	}
+	if err := fs.commit(walRecord{Op: opPut, Event: &event}, by); err != nil {
+		return Event{}, err
+	}
+	return event, nil
+}
+
+//purgeTrash безвозвратно удаляет из корзины события, удаленные раньше before, записав очистку в журнал.
+//Возвращает число удаленных событий.
+//Конкурентно безопасный метод.
+func (fs *FileStore) purgeTrash(before time.Time) (int, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.closed {
+		return 0, ErrClosed
+	}
+
+	purged := 0
+	fs.EventStore.mutex.RLock()
+	for _, t := range fs.EventStore.trash {
+		if time.Time(t.Deleted).Before(before) {
+			purged++
+		}
+	}
+	fs.EventStore.mutex.RUnlock()
+	if purged == 0 {
+		return 0, nil
+	}
+
+	stamp := JSONTime(before)
+	if err := fs.commit(walRecord{Op: opPurge, Time: &stamp}, Author{}); err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
+
+//expunge безвозвратно удаляет события, не менявшиеся с выборки events, записав удаление в журнал.
+//Возвращает удаленные события.
+//Конкурентно безопасный метод.
+func (fs *FileStore) expunge(events []Event, by Author) ([]Event, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.closed {
+		return nil, ErrClosed
+	}
+
+	//изменения FileStore идут только под fs.mutex, так что проверенные события не изменятся до удаления
+	fs.EventStore.mutex.RLock()
+	removed := fs.EventStore.unchanged(events)
+	fs.EventStore.mutex.RUnlock()
+	if len(removed) == 0 {
+		return removed, nil
+	}
+
+	ids := make([]int, 0, len(removed))
+	for _, event := range removed {
+		ids = append(ids, event.ID)
+	}
+	if err := fs.commit(walRecord{Op: opExpunge, IDs: ids}, by); err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
+
+//applyBatch атомарно применяет пакет, записав его в журнал одной записью:
+//после сбоя пакет восстанавливается целиком или не восстанавливается вовсе.
+//В памяти изменения применяются по порядку операций, как в EventStore.
+//Возвращает соответствие id новых событий в копии и в хранилище.
+//Конкурентно безопасный метод.
+func (fs *FileStore) applyBatch(batch storeBatch, by Author) (map[int]int, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.closed {
+		return nil, ErrClosed
+	}
+
+	//изменения FileStore идут только под fs.mutex, так что после проверки состояние не изменится
+	fs.EventStore.mutex.RLock()
+	ids, err := fs.EventStore.checkBatch(batch)
+	fs.EventStore.mutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	changes := remapBatch(batch.changes, ids)
+	puts, deletes := netBatch(changes)
+	deleted := JSONTime(fs.EventStore.now())
+	if err := fs.appendLog(walRecord{Op: opBatch, Events: puts, IDs: deletes, Time: &deleted}); err != nil {
+		return nil, err
+	}
+	fs.EventStore.putChanges(changes, time.Time(deleted), by)
+	if err := fs.compact(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+//Ping проверяет, что хранилище открыто и файл журнала доступен
+func (fs *FileStore) Ping() error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.closed {
+		return ErrClosed
+	}
+	_, err := fs.wal.Stat()
+	return err
+}
+
+//Close делает итоговый снимок и закрывает журнал.
+//После закрытия все изменения хранилища, как и повторный Close, возвращают ErrClosed.
+func (fs *FileStore) Close() error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.closed {
+		return ErrClosed
+	}
+	fs.closed = true
+
+	if err := fs.writeSnapshot(); err != nil {
+		fs.wal.Close()
+		return err
+	}
+	return fs.wal.Close()
+}
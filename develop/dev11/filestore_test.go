@@ -0,0 +1,237 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileStoreRecover(t *testing.T) {
+	dir := t.TempDir()
+	date := time.Date(2021, 12, 12, 10, 30, 0, 0, time.UTC)
+
+	store, err := NewFileStore(dir, 0)
+	assert.Nil(t, err)
+	_, err = store.Save(newEvent(1, "1", date), Author{})
+	assert.Nil(t, err)
+	_, err = store.Save(newEvent(1, "2", date), Author{})
+	assert.Nil(t, err)
+	_, err = store.Save(newEvent(1, "3", date), Author{})
+	assert.Nil(t, err)
+
+	_, ok, err := store.Change(1, 2, time.Time{}, EventChange{Text: "22"}, 0, Author{})
+	assert.True(t, ok)
+	assert.Nil(t, err)
+
+	_, ok, err = store.Delete(1, 3, time.Time{}, 0, Author{})
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	assert.Nil(t, store.wal.Close())
+
+	restored, err := NewFileStore(dir, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, len(restored.m), 2)
+	assert.Equal(t, restored.peekID(), 4)
+
+	event, ok := restored.Load(2)
+	assert.True(t, ok)
+	assert.Equal(t, event.Text, "22")
+	assert.Equal(t, event.UserID, 1)
+	assert.Equal(t, event.Version, 2)
+	assert.True(t, time.Time(event.Date).Equal(date))
+}
+
+func TestFileStoreSnapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewFileStore(dir, 2)
+	assert.Nil(t, err)
+	_, err = store.Save(newEvent(1, "1", time.Now()), Author{})
+	assert.Nil(t, err)
+	_, err = store.Save(newEvent(1, "2", time.Now()), Author{})
+	assert.Nil(t, err)
+	assert.Equal(t, store.walRecords, 0)
+	_, err = store.Save(newEvent(1, "3", time.Now()), Author{})
+	assert.Nil(t, err)
+	assert.Nil(t, store.Close())
+
+	_, err = os.Stat(filepath.Join(dir, snapshotFileName))
+	assert.Nil(t, err)
+
+	restored, err := NewFileStore(dir, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, len(restored.m), 3)
+	assert.Equal(t, restored.peekID(), 4)
+}
+
+func TestFileStoreClosed(t *testing.T) {
+	store, err := NewFileStore(t.TempDir(), 0)
+	assert.Nil(t, err)
+	saved, _ := store.Save(newEvent(1, "1", time.Now()), Author{})
+	assert.Nil(t, store.Close())
+
+	//после закрытия изменения не доходят ни до журнала, ни до памяти
+	_, err = store.Save(newEvent(1, "2", time.Now()), Author{})
+	assert.ErrorIs(t, err, ErrClosed)
+	_, _, err = store.Change(1, saved.ID, time.Time{}, EventChange{Text: "11"}, 0, Author{})
+	assert.ErrorIs(t, err, ErrClosed)
+	_, _, err = store.Delete(1, saved.ID, time.Time{}, 0, Author{})
+	assert.ErrorIs(t, err, ErrClosed)
+	_, err = store.applyBatch(storeBatch{owners: map[int]bool{1: true}, firstID: 2,
+		changes: []storeChange{{kind: ChangeCreated, event: newEvent(1, "3", time.Now())}}}, Author{})
+	assert.ErrorIs(t, err, ErrClosed)
+	assert.ErrorIs(t, store.Ping(), ErrClosed)
+	assert.ErrorIs(t, store.Close(), ErrClosed)
+
+	event, ok := store.Load(saved.ID)
+	assert.True(t, ok)
+	assert.Equal(t, event.Text, "1")
+	assert.Equal(t, store.Len(), 1)
+}
+
+func TestFileStoreTornTail(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewFileStore(dir, 0)
+	assert.Nil(t, err)
+	_, err = store.Save(newEvent(1, "1", time.Now()), Author{})
+	assert.Nil(t, err)
+	_, err = store.wal.WriteString(`{"Op":"put","Ev`)
+	assert.Nil(t, err)
+	assert.Nil(t, store.wal.Close())
+
+	restored, err := NewFileStore(dir, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, len(restored.m), 1)
+	_, err = restored.Save(newEvent(1, "2", time.Now()), Author{})
+	assert.Nil(t, err)
+	assert.Nil(t, restored.wal.Close())
+
+	again, err := NewFileStore(dir, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, len(again.m), 2)
+}
+
+func TestFileStoreRecurrence(t *testing.T) {
+	dir := t.TempDir()
+	until := JSONTime(day(2021, 12, 10))
+
+	store, err := NewFileStore(dir, 0)
+	assert.Nil(t, err)
+	event := newEvent(1, "standup", day(2021, 12, 6))
+	event.Recurrence = &Recurrence{Freq: FreqDaily, Until: &until}
+	_, err = store.Save(event, Author{})
+	assert.Nil(t, err)
+
+	_, ok, err := store.Delete(1, 1, day(2021, 12, 8), 0, Author{})
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	assert.Nil(t, store.wal.Close())
+
+	restored, err := NewFileStore(dir, 0)
+	assert.Nil(t, err)
+
+	result, err := restored.getBetween(1, day(2021, 12, 1), day(2021, 12, 31))
+	assert.Nil(t, err)
+	assert.Equal(t, len(result), 4)
+}
+
+func TestFileStoreAttendees(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewFileStore(dir, 0)
+	assert.Nil(t, err)
+	service := NewService(store)
+	event, err := service.SaveEvent(newEvent(1, "planning", day(2021, 12, 15)))
+	assert.Nil(t, err)
+	_, _, err = service.Invite(1, event.ID, []int{2})
+	assert.Nil(t, err)
+	_, _, err = service.Respond(2, event.ID, StatusAccepted)
+	assert.Nil(t, err)
+	assert.Nil(t, store.wal.Close())
+
+	restored, err := NewFileStore(dir, 0)
+	assert.Nil(t, err)
+	result, err := restored.getAttended(2, day(2021, 12, 15), day(2021, 12, 16))
+	assert.Nil(t, err)
+	assert.Equal(t, len(result), 1)
+	assert.Equal(t, result[0].Attendees, []Attendee{{UserID: 2, Status: StatusAccepted}})
+	assert.Equal(t, result[0].Version, 3)
+}
+
+func TestFileStorePing(t *testing.T) {
+	store, err := NewFileStore(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, store.Ping())
+	assert.Nil(t, store.Close())
+	assert.Error(t, store.Ping())
+}
+
+func TestFileStoreRestore(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewFileStore(dir, 0)
+	assert.Nil(t, err)
+	saved, _ := store.Save(newEvent(1, "1", time.Now()), Author{})
+	store.Save(newEvent(1, "2", time.Now()), Author{})
+	store.Delete(1, saved.ID, time.Time{}, 0, Author{})
+
+	saved.Version = 2
+	_, err = store.Restore(saved, Author{})
+	assert.Nil(t, err)
+	_, err = store.Restore(saved, Author{})
+	assert.ErrorIs(t, err, ErrEventExists)
+	assert.Nil(t, store.wal.Close())
+
+	restored, err := NewFileStore(dir, 0)
+	assert.Nil(t, err)
+	event, ok := restored.Load(saved.ID)
+	assert.True(t, ok)
+	assert.Equal(t, event.Version, 2)
+	assert.Equal(t, restored.peekID(), 3)
+}
+
+func TestFileStoreTrash(t *testing.T) {
+	dir := t.TempDir()
+	deleted := time.Date(2021, 12, 10, 0, 0, 0, 0, time.UTC)
+	date := time.Date(2021, 12, 1, 10, 0, 0, 0, time.UTC)
+
+	store, err := NewFileStore(dir, 0)
+	assert.Nil(t, err)
+	store.EventStore.now = func() time.Time { return deleted }
+	for _, text := range []string{"1", "2", "3", "4"} {
+		store.Save(newEvent(1, text, date), Author{})
+	}
+	store.Delete(1, 1, time.Time{}, 0, Author{})
+	second, _ := store.Load(2)
+	store.applyBatch(storeBatch{owners: map[int]bool{1: true}, changes: []storeChange{{kind: ChangeDeleted, event: second}},
+		versions: map[int]int{2: 1}}, Author{})
+	purged, err := store.purgeTrash(deleted.Add(time.Second))
+	assert.Nil(t, err)
+	assert.Equal(t, purged, 2)
+	store.Delete(1, 3, time.Time{}, 0, Author{})
+	ended, err := store.getEnded(deleted)
+	assert.Nil(t, err)
+	assert.Equal(t, len(ended), 1)
+	archived, err := store.expunge(ended, Author{})
+	assert.Nil(t, err)
+	assert.Equal(t, len(archived), 1)
+	assert.Nil(t, store.wal.Close())
+
+	//корзина восстанавливается из журнала, а после снимка - из снимка
+	for i := 0; i < 2; i++ {
+		restored, err := NewFileStore(dir, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, restored.Len(), 0)
+		trash := restored.trashed(1)
+		assert.Equal(t, len(trash), 1)
+		assert.Equal(t, trash[0].Event.ID, 3)
+		assert.Equal(t, time.Time(trash[0].Deleted), deleted)
+		assert.Nil(t, restored.Close())
+	}
+}
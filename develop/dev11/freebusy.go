@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//ConflictPolicy поведение Service при сохранении события, пересекающегося с другими событиями владельца
+type ConflictPolicy string
+
+//Политики пересечений
+const (
+	//ConflictAllow пересечения не проверяются
+	ConflictAllow ConflictPolicy = "allow"
+	//ConflictFlag событие сохраняется, id пересекающихся событий возвращаются в Event.Conflicts
+	ConflictFlag ConflictPolicy = "flag"
+	//ConflictReject событие с пересечениями не сохраняется, возвращается *ConflictError
+	ConflictReject ConflictPolicy = "reject"
+)
+
+//parseConflictPolicy разбирает политику пересечений из конфига (пусто - allow)
+func parseConflictPolicy(str string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(strings.ToLower(str)); policy {
+	case "":
+		return ConflictAllow, nil
+	case ConflictAllow, ConflictFlag, ConflictReject:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown conflict policy %q", str)
+	}
+}
+
+//conflictHorizon на сколько вперед от начала проверяются вхождения повторяющегося события
+const conflictHorizon = 366 * 24 * time.Hour
+
+//ConflictError ошибка сохранения события, пересекающегося с другими событиями владельца
+type ConflictError struct {
+	Conflicts []int
+}
+
+func (e *ConflictError) Error() string {
+	ids := make([]string, 0, len(e.Conflicts))
+	for _, id := range e.Conflicts {
+		ids = append(ids, strconv.Itoa(id))
+	}
+	return fmt.Sprintf("event overlaps events %s", strings.Join(ids, ", "))
+}
+
+//Interval промежуток времени [Start, End)
+type Interval struct {
+	Start JSONTime `json:"Start"`
+	End   JSONTime `json:"End"`
+}
+
+//FreeBusy занятые промежутки и свободные окна пользователя внутри запрошенного промежутка
+type FreeBusy struct {
+	Busy []Interval `json:"Busy"`
+	Free []Interval `json:"Free"`
+}
+
+//blocksTime проверяет, занимает ли событие время в расписании.
+//События на весь день и события без длительности считаются пометками и время не занимают.
+func (e Event) blocksTime() bool {
+	return !e.AllDay && e.duration() > 0
+}
+
+//occurrences возвращает событие или вхождения серии в пределах conflictHorizon от ее начала
+func occurrences(event Event) []Event {
+	if event.Recurrence == nil {
+		return []Event{event}
+	}
+	start := time.Time(event.Date)
+	return expand(event, start, start.Add(conflictHorizon))
+}
+
+//findConflicts ищет другие события владельца, пересекающиеся с событием
+//или с одним из его вхождений, если оно повторяющееся.
+//Возвращает: отсортированные id пересекающихся событий.
+func findConflicts(storage Storage, event Event) ([]int, error) {
+	candidates := make([]Event, 0)
+	var spanStart, spanEnd time.Time
+	for _, occ := range occurrences(event) {
+		if !occ.blocksTime() {
+			continue
+		}
+		if spanStart.IsZero() || time.Time(occ.Date).Before(spanStart) {
+			spanStart = time.Time(occ.Date)
+		}
+		if time.Time(occ.End).After(spanEnd) {
+			spanEnd = time.Time(occ.End)
+		}
+		candidates = append(candidates, occ)
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	others, err := storage.getBetween(event.UserID, spanStart, spanEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[int]struct{})
+	for _, other := range others {
+		if other.ID == event.ID || !other.blocksTime() {
+			continue
+		}
+		if _, ok := found[other.ID]; ok {
+			continue
+		}
+		for _, occ := range candidates {
+			//касание границами пересечением не считается
+			if time.Time(occ.Date).Before(time.Time(other.End)) && time.Time(other.Date).Before(time.Time(occ.End)) {
+				found[other.ID] = struct{}{}
+				break
+			}
+		}
+	}
+
+	ids := make([]int, 0, len(found))
+	for id := range found {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+//freeBusy строит занятые промежутки из событий, обрезанных по [start, end),
+//и свободные окна между ними не короче minFree.
+func freeBusy(events []Event, start time.Time, end time.Time, minFree time.Duration) FreeBusy {
+	busy := make([]Interval, 0)
+	for _, event := range events {
+		if !event.blocksTime() {
+			continue
+		}
+		from, to := time.Time(event.Date), time.Time(event.End)
+		if from.Before(start) {
+			from = start
+		}
+		if to.After(end) {
+			to = end
+		}
+		if !from.Before(to) {
+			continue
+		}
+		busy = append(busy, Interval{Start: JSONTime(from.In(start.Location())), End: JSONTime(to.In(start.Location()))})
+	}
+
+	sort.Slice(busy, func(i, j int) bool { return time.Time(busy[i].Start).Before(time.Time(busy[j].Start)) })
+
+	//слияние пересекающихся и соприкасающихся промежутков
+	merged := make([]Interval, 0, len(busy))
+	for _, v := range busy {
+		last := len(merged) - 1
+		if last >= 0 && !time.Time(v.Start).After(time.Time(merged[last].End)) {
+			if time.Time(v.End).After(time.Time(merged[last].End)) {
+				merged[last].End = v.End
+			}
+			continue
+		}
+		merged = append(merged, v)
+	}
+
+	free := make([]Interval, 0)
+	cursor := start
+	for _, v := range append(merged, Interval{Start: JSONTime(end), End: JSONTime(end)}) {
+		if gap := time.Time(v.Start).Sub(cursor); gap > 0 && gap >= minFree {
+			free = append(free, Interval{Start: JSONTime(cursor), End: v.Start})
+		}
+		cursor = time.Time(v.End)
+	}
+
+	return FreeBusy{Busy: merged, Free: free}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+//writeJSONFreeBusy записывает в http.ResponseWriter занятые и свободные промежутки
+//в JSON формате с соответствующим хедером.
+//Принимает: статус код результата и FreeBusy.
+func writeJSONFreeBusy(w http.ResponseWriter, status int, fb FreeBusy) {
+	//пустые списки - [], а не null, как в описании API
+	if fb.Busy == nil {
+		fb.Busy = []Interval{}
+	}
+	if fb.Free == nil {
+		fb.Free = []Interval{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	data := struct {
+		FreeBusy FreeBusy `json:"Result"`
+	}{FreeBusy: fb}
+	json.NewEncoder(w).Encode(data)
+}
+
+//freeBusy обработчик для GET /free_busy.
+//Параметры: user_id, from и to в форматах parseEventTime в зоне tz
+//(дата без времени в to включает весь день) и min - минимальная длина свободного окна (например 30m).
+func (h *Handler) freeBusy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONMessage(w, http.StatusMethodNotAllowed, fmt.Sprintf("expect method Get at /free_busy, got %v", r.Method), true)
+		return
+	}
+
+	query := r.URL.Query()
+
+	userID, status, err := resolveUserID(r, query.Get("user_id"))
+	if err != nil {
+		writeJSONMessage(w, status, err.Error(), true)
+		return
+	}
+
+	loc, ok := parseLocation(query.Get("tz"))
+	if !ok {
+		writeJSONMessage(w, http.StatusBadRequest, "Bad tz", true)
+		return
+	}
+
+	from, _, err := parseEventTime(query.Get("from"), loc)
+	if err != nil {
+		writeJSONMessage(w, http.StatusBadRequest, "Bad from", true)
+		return
+	}
+
+	to, dateOnly, err := parseEventTime(query.Get("to"), loc)
+	if dateOnly {
+		to = to.AddDate(0, 0, 1)
+	}
+	if err != nil || !to.After(from) {
+		writeJSONMessage(w, http.StatusBadRequest, "Bad to", true)
+		return
+	}
+
+	var minFree time.Duration
+	if minStr := query.Get("min"); minStr != "" {
+		if minFree, err = time.ParseDuration(minStr); err != nil || minFree < 0 {
+			writeJSONMessage(w, http.StatusBadRequest, "Bad min", true)
+			return
+		}
+	}
+
+	result, err := h.service.FreeBusy(userID, from, to, minFree)
+
+	if err != nil {
+		writeJSONMessage(w, http.StatusServiceUnavailable, fmt.Sprintf("Can't get free/busy: %s", err), true)
+		return
+	}
+
+	writeJSONFreeBusy(w, http.StatusOK, result)
+}
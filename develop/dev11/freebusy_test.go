@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//timed событие пользователя 1 с началом в start и длительностью duration
+func timed(start time.Time, duration time.Duration) Event {
+	return Event{UserID: 1, Text: "busy", Date: JSONTime(start), End: JSONTime(start.Add(duration))}
+}
+
+func TestConflictPolicy(t *testing.T) {
+	service, _ := newTestService()
+	service.conflicts = ConflictReject
+
+	_, err := service.SaveEvent(timed(fixedNow, time.Hour))
+	assert.Nil(t, err)
+
+	//касание границами - не пересечение
+	_, err = service.SaveEvent(timed(fixedNow.Add(time.Hour), time.Hour))
+	assert.Nil(t, err)
+
+	_, err = service.SaveEvent(timed(fixedNow.Add(30*time.Minute), time.Hour))
+	assert.Equal(t, err, &ConflictError{Conflicts: []int{1, 2}})
+
+	//события на весь день время не занимают
+	allDay := timed(fixedNow, 0)
+	allDay.AllDay = true
+	_, err = service.SaveEvent(allDay)
+	assert.Nil(t, err)
+
+	_, _, err = service.ChangeEvent(1, 2, time.Time{}, EventChange{Date: fixedNow.Add(-30 * time.Minute)}, 0)
+	assert.NotNil(t, err)
+
+	service.conflicts = ConflictFlag
+	event, ok, err := service.ChangeEvent(1, 2, time.Time{}, EventChange{Date: fixedNow.Add(-30 * time.Minute)}, 0)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	assert.Equal(t, event.Conflicts, []int{1})
+
+	stored, _ := service.GetEvent(1, 2)
+	assert.Nil(t, stored.Conflicts)
+}
+
+func TestConflictRecurring(t *testing.T) {
+	service, _ := newTestService()
+	service.conflicts = ConflictReject
+
+	_, err := service.SaveEvent(timed(day(2021, 12, 20).Add(10*time.Hour), time.Hour))
+	assert.Nil(t, err)
+
+	series := timed(day(2021, 12, 6).Add(10*time.Hour), 30*time.Minute)
+	series.Recurrence = &Recurrence{Freq: FreqWeekly}
+	_, err = service.SaveEvent(series)
+	assert.Equal(t, err, &ConflictError{Conflicts: []int{1}})
+
+	series.Recurrence.Count = 2
+	_, err = service.SaveEvent(series)
+	assert.Nil(t, err)
+}
+
+func TestFreeBusy(t *testing.T) {
+	service, _ := newTestService()
+	start := day(2021, 12, 15)
+
+	service.SaveEvent(timed(start.Add(9*time.Hour), time.Hour))
+	service.SaveEvent(timed(start.Add(9*time.Hour+30*time.Minute), time.Hour))
+	service.SaveEvent(timed(start.Add(11*time.Hour), 15*time.Minute))
+	service.SaveEvent(timed(start.Add(23*time.Hour), 2*time.Hour))
+
+	fb, err := service.FreeBusy(1, start.Add(8*time.Hour), start.Add(24*time.Hour), time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, fb.Busy, []Interval{
+		{Start: JSONTime(start.Add(9 * time.Hour)), End: JSONTime(start.Add(10*time.Hour + 30*time.Minute))},
+		{Start: JSONTime(start.Add(11 * time.Hour)), End: JSONTime(start.Add(11*time.Hour + 15*time.Minute))},
+		{Start: JSONTime(start.Add(23 * time.Hour)), End: JSONTime(start.Add(24 * time.Hour))},
+	})
+	assert.Equal(t, fb.Free, []Interval{
+		{Start: JSONTime(start.Add(8 * time.Hour)), End: JSONTime(start.Add(9 * time.Hour))},
+		{Start: JSONTime(start.Add(11*time.Hour + 15*time.Minute)), End: JSONTime(start.Add(23 * time.Hour))},
+	})
+}
@@ -1,15 +1,15 @@
 module dev11
 
-go 1.17
+go 1.21
 
 require (
+	github.com/fsnotify/fsnotify v1.5.1
 	github.com/spf13/viper v1.10.1
 	github.com/stretchr/testify v1.7.0
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/fsnotify/fsnotify v1.5.1 // indirect
 	github.com/hashicorp/hcl v1.0.0 // indirect
 	github.com/magiconair/properties v1.8.5 // indirect
 	github.com/mitchellh/mapstructure v1.4.3 // indirect
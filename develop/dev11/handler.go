@@ -2,35 +2,112 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
-//Handler тип обработчика, хранящий ссылку на сервис
+//Форматы времени в параметрах запросов. Кроме них принимается RFC 3339.
+const (
+	//dateLayout дата без времени: событие на весь день, опорная дата периода
+	dateLayout = legacyDateLayout
+	//localLayout время без смещения, отсчитывается в зоне из параметра tz
+	localLayout = "2006-01-02T15:04"
+	//localSecondsLayout то же с секундами
+	localSecondsLayout = "2006-01-02T15:04:05"
+)
+
+//Handler тип обработчика, хранящий ссылку на сервис,
+//проверку учетных данных (nil - аутентификация выключена), журнал запросов, метрики,
+//ответы на запросы с Idempotency-Key, ограничение частоты запросов (nil - без ограничения),
+//источники CORS (nil - без заголовков CORS) и состояние для проверок /healthz и /readyz.
 type Handler struct {
-	service *Service
+	service     *Service
+	auth        *Authenticator
+	logger      *slog.Logger
+	metrics     *Metrics
+	idempotency *IdempotencyStore
+	limiter     *RateLimiter
+	cors        *CORSPolicy
+	health      *Health
 }
 
-//NewHandler конструктор для структуры Handler
+//NewHandler конструктор для структуры Handler.
+//Журнал запросов пишется в stderr в формате JSON.
 func NewHandler(service *Service) *Handler {
-	return &Handler{service}
+	metrics := NewMetrics()
+	metrics.Gauge("dev11_events_in_store", "Number of events in the store.", func() float64 {
+		return float64(service.CountEvents())
+	})
+
+	return &Handler{
+		service:     service,
+		logger:      slog.New(slog.NewJSONHandler(os.Stderr, nil)),
+		metrics:     metrics,
+		idempotency: NewIdempotencyStore(defaultIdempotencyTTL),
+		health:      NewHealth(),
+	}
+}
+
+//publicPaths end-point'ы, доступные без учетных данных: метрики снимает Prometheus,
+//проверки состояния - оркестратор, описание API нужно клиентам до получения ключа
+var publicPaths = map[string]bool{metricsPath: true, healthzPath: true, readyzPath: true, openAPIPath: true, davWellKnownPath: true}
+
+//route end-point и его обработчик
+type route struct {
+	pattern string
+	handler http.Handler
+}
+
+//routes end-point'ы сервиса. Каждый описан в openapi.json.
+func (h *Handler) routes() []route {
+	return []route{
+		{"/create_event", Idempotent(h.idempotency, http.HandlerFunc(h.createEvent))},
+		{"/update_event", http.HandlerFunc(h.updateEvent)},
+		{"/delete_event", http.HandlerFunc(h.deleteEvent)},
+		{"/events_for_day", http.HandlerFunc(h.eventsForDay)},
+		{"/events_for_week", http.HandlerFunc(h.eventsForWeek)},
+		{"/events_for_month", http.HandlerFunc(h.eventsForMonth)},
+		{"/events_between", http.HandlerFunc(h.eventsBetween)},
+		{"/free_busy", http.HandlerFunc(h.freeBusy)},
+		{"/events/stream", http.HandlerFunc(h.eventsStream)},
+		{"/search", http.HandlerFunc(h.search)},
+		{"/invite", http.HandlerFunc(h.invite)},
+		{"/respond", http.HandlerFunc(h.respond)},
+		{"/invitations", http.HandlerFunc(h.invitations)},
+		{"/batch", Idempotent(h.idempotency, http.HandlerFunc(h.batch))},
+		{"/export.ics", http.HandlerFunc(h.exportICal)},
+		{"/import", http.HandlerFunc(h.importICal)},
+		{apiEventsPath, Idempotent(h.idempotency, http.HandlerFunc(h.apiEvents))},
+		{apiEventsPath + "/", http.HandlerFunc(h.apiEvent)},
+		{apiCalendarsPath, http.HandlerFunc(h.apiCalendars)},
+		{apiCalendarsPath + "/", http.HandlerFunc(h.apiCalendar)},
+		{apiTrashPath, http.HandlerFunc(h.apiTrash)},
+		{apiTrashPath + "/", http.HandlerFunc(h.apiTrashed)},
+		{davPath, http.HandlerFunc(h.dav)},
+		{davWellKnownPath, http.HandlerFunc(h.davWellKnown)},
+		{metricsPath, h.metrics},
+		{healthzPath, http.HandlerFunc(h.healthz)},
+		{readyzPath, http.HandlerFunc(h.readyz)},
+		{openAPIPath, http.HandlerFunc(h.openAPI)},
+	}
 }
 
 //initRouts инициализирует end-point'ы методами обработчиками
 //Возвращает http.Handler
 func (h *Handler) initRouts() http.Handler {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/create_event", h.createEvent)
-	mux.HandleFunc("/update_event", h.updateEvent)
-	mux.HandleFunc("/delete_event", h.deleteEvent)
-	mux.HandleFunc("/events_for_day", h.eventsToday)
-	mux.HandleFunc("/events_for_week", h.eventsThisWeek)
-	mux.HandleFunc("/events_for_month", h.eventsThisMonth)
+	for _, rt := range h.routes() {
+		mux.Handle(rt.pattern, rt.handler)
+	}
 
-	handler := Logging(mux)
+	handler := RequestID(Logging(h.logger, h.metrics.Instrument(mux, CORS(h.cors, Limit(h.limiter, h.auth, mux, Auth(h.auth, publicPaths, mux))))))
 
 	return handler
 }
@@ -56,25 +133,244 @@ func writeJSONMessage(w http.ResponseWriter, status int, message string, isErr b
 	json.NewEncoder(w).Encode(data)
 }
 
-//writeJSONEvents записывает в http.ResponseWriter слайс Event
-//в JSON формате с соответствующим хедером.
-//Принимает: статус код результата, слайс Event.
-func writeJSONEvents(w http.ResponseWriter, status int, events []Event) {
+//writeJSONEvents записывает в http.ResponseWriter страницу списка Event
+//в JSON формате с соответствующим хедером: события под ключом Result,
+//общее количество - Total, курсор следующей страницы - NextCursor.
+//Принимает: статус код результата, страницу Page.
+func writeJSONEvents(w http.ResponseWriter, status int, page Page) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 
+	//пустой список - [], а не null, как в описании API
+	if page.Events == nil {
+		page.Events = []Event{}
+	}
+
 	data := struct {
-		Events []Event `json:"Result"`
-	}{Events: events}
+		Events     []Event `json:"Result"`
+		Total      int     `json:"Total"`
+		NextCursor string  `json:"NextCursor,omitempty"`
+	}{Events: page.Events, Total: page.Total, NextCursor: page.NextCursor}
 	json.NewEncoder(w).Encode(data)
 }
 
-//Logging middlware для логирования
-func Logging(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		next.ServeHTTP(w, req)
-		log.Printf("%s %s", req.Method, req.RequestURI)
-	})
+//parseUserID разбирает параметр user_id.
+//Возвращает: положительный id пользователя и флаг корректности.
+func parseUserID(userIDStr string) (int, bool) {
+	userID, err := strconv.Atoi(userIDStr)
+	if userID <= 0 || err != nil {
+		return 0, false
+	}
+	return userID, true
+}
+
+//parseLocation разбирает параметр tz - имя IANA зоны (пусто - UTC).
+//Возвращает: зону и флаг корректности.
+func parseLocation(name string) (*time.Location, bool) {
+	loc, err := loadLocation(name)
+	return loc, err == nil
+}
+
+//parseEventTime разбирает время события: RFC 3339, время без смещения (2006-01-02T15:04[:05])
+//в зоне loc или дату 02-01-2006 - полночь в зоне loc.
+//Возвращает: время в зоне loc, флаг "передана только дата" и ошибку разбора.
+func parseEventTime(str string, loc *time.Location) (time.Time, bool, error) {
+	if t, err := time.Parse(time.RFC3339, str); err == nil {
+		return t.In(loc), false, nil
+	}
+	for _, layout := range []string{localLayout, localSecondsLayout} {
+		if t, err := time.ParseInLocation(layout, str, loc); err == nil {
+			return t, false, nil
+		}
+	}
+	t, err := time.ParseInLocation(dateLayout, str, loc)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("bad time %q", str)
+	}
+	return t, true, nil
+}
+
+//parseEnd разбирает окончание события: параметр end в форматах parseEventTime
+//(дата без времени включает весь день) или duration (например 1h30m) относительно start.
+//Возвращает: окончание (нулевое, если ничего не передано) и ошибку разбора.
+func parseEnd(form url.Values, start time.Time, loc *time.Location) (time.Time, error) {
+	endStr, durationStr := form.Get("end"), form.Get("duration")
+	if endStr != "" && durationStr != "" {
+		return time.Time{}, errors.New("end and duration are mutually exclusive")
+	}
+
+	if durationStr != "" {
+		duration, err := time.ParseDuration(durationStr)
+		if err != nil || duration < 0 {
+			return time.Time{}, errors.New("bad duration")
+		}
+		return start.Add(duration), nil
+	}
+
+	if endStr == "" {
+		return time.Time{}, nil
+	}
+	end, dateOnly, err := parseEventTime(endStr, loc)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if dateOnly {
+		end = end.AddDate(0, 0, 1)
+	}
+	return end, nil
+}
+
+//parseAnchor разбирает опорную дату периода date (02-01-2006) в зоне tz.
+//Без date возвращает нулевое время в этой зоне: сервис подставит текущую дату.
+func parseAnchor(query url.Values) (time.Time, error) {
+	loc, ok := parseLocation(query.Get("tz"))
+	if !ok {
+		return time.Time{}, errors.New("Bad tz")
+	}
+
+	dateStr := query.Get("date")
+	if dateStr == "" {
+		return time.Time{}.In(loc), nil
+	}
+
+	date, err := time.ParseInLocation(dateLayout, dateStr, loc)
+	if err != nil {
+		return time.Time{}, errors.New("Bad date")
+	}
+	return date, nil
+}
+
+//parseRecurrence разбирает параметры правила повторения:
+//freq (daily|weekly|monthly|yearly), interval, count, until (в форматах parseEventTime,
+//дата без времени включает весь день) и byweekday (коды дней через запятую: MO,WE,FR).
+//Возвращает: nil, если freq не передан, иначе проверенное правило; ошибку разбора.
+func parseRecurrence(form url.Values, loc *time.Location) (*Recurrence, error) {
+	freq := form.Get("freq")
+	if freq == "" {
+		return nil, nil
+	}
+
+	rec := &Recurrence{Freq: strings.ToLower(freq)}
+
+	var err error
+	if str := form.Get("interval"); str != "" {
+		if rec.Interval, err = strconv.Atoi(str); err != nil {
+			return nil, errors.New("bad interval")
+		}
+	}
+	if str := form.Get("count"); str != "" {
+		if rec.Count, err = strconv.Atoi(str); err != nil {
+			return nil, errors.New("bad count")
+		}
+	}
+	if str := form.Get("until"); str != "" {
+		until, dateOnly, err := parseEventTime(str, loc)
+		if err != nil {
+			return nil, errors.New("bad until")
+		}
+		if dateOnly {
+			_, until = dayBounds(until)
+		}
+		jsonUntil := JSONTime(until)
+		rec.Until = &jsonUntil
+	}
+	if str := form.Get("byweekday"); str != "" {
+		for _, code := range strings.Split(str, ",") {
+			wd, ok := weekdayCodes[strings.ToUpper(strings.TrimSpace(code))]
+			if !ok {
+				return nil, fmt.Errorf("bad weekday %q", code)
+			}
+			rec.ByWeekday = append(rec.ByWeekday, wd)
+		}
+	}
+
+	if err := rec.Validate(); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+//parseReminders разбирает параметр remind - смещения напоминаний до начала события
+//через запятую (15m,1h); пустое значение убирает напоминания.
+//Возвращает: смещения, флаг наличия параметра и ошибку разбора.
+func parseReminders(form url.Values) ([]Offset, bool, error) {
+	values, ok := form["remind"]
+	if !ok {
+		return nil, false, nil
+	}
+
+	reminders := make([]Offset, 0)
+	for _, str := range strings.Split(strings.Join(values, ","), ",") {
+		if str = strings.TrimSpace(str); str == "" {
+			continue
+		}
+		d, err := time.ParseDuration(str)
+		if err != nil {
+			return nil, true, fmt.Errorf("bad reminder offset %q", str)
+		}
+		reminders = append(reminders, Offset(d))
+	}
+	if err := validateReminders(reminders); err != nil {
+		return nil, true, err
+	}
+	return reminders, true, nil
+}
+
+//parseTags разбирает параметр tags - теги через запятую (параметр можно повторять);
+//пустое значение убирает теги.
+//Возвращает: теги и флаг наличия параметра.
+func parseTags(form url.Values, key string) ([]string, bool) {
+	values, ok := form[key]
+	if !ok {
+		return nil, false
+	}
+
+	tags := make([]string, 0)
+	for _, str := range strings.Split(strings.Join(values, ","), ",") {
+		if str = strings.TrimSpace(str); str != "" {
+			tags = append(tags, str)
+		}
+	}
+	return tags, true
+}
+
+//parseOccurrence разбирает необязательный параметр occurrence - день вхождения серии
+//в форматах parseEventTime (значим только календарный день).
+//Возвращает: нулевое время, если параметр не передан; флаг корректности.
+func parseOccurrence(form url.Values) (time.Time, bool) {
+	str := form.Get("occurrence")
+	if str == "" {
+		return time.Time{}, true
+	}
+
+	occurrence, _, err := parseEventTime(str, time.UTC)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return occurrence, true
+}
+
+//parseCalendarID разбирает необязательный параметр calendar_id - id именованного календаря.
+//Возвращает: 0, если параметр не передан (календарь по умолчанию); флаг корректности.
+func parseCalendarID(form url.Values) (int, bool) {
+	str := form.Get("calendar_id")
+	if str == "" {
+		return 0, true
+	}
+
+	id, err := strconv.Atoi(str)
+	if id <= 0 || err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+//conflictsNote дополняет сообщение об успехе id пересекающихся событий (политика ConflictFlag)
+func conflictsNote(conflicts []int) string {
+	if len(conflicts) == 0 {
+		return ""
+	}
+	return ", but " + (&ConflictError{Conflicts: conflicts}).Error()
 }
 
 //createEvent обработчик для POST /create_event
@@ -84,30 +380,135 @@ func (h *Handler) createEvent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := r.ParseForm()
+	if status, err := parseForm(w, r); err != nil {
+		writeJSONMessage(w, status, err.Error(), true)
+		return
+	}
+
+	userID, status, err := resolveUserID(r, r.Form.Get("user_id"))
 	if err != nil {
-		writeJSONMessage(w, http.StatusBadRequest, "Parse params error", true)
+		writeJSONMessage(w, status, err.Error(), true)
+		return
+	}
+
+	tz := r.Form.Get("tz")
+	loc, ok := parseLocation(tz)
+	if !ok {
+		writeJSONMessage(w, http.StatusBadRequest, "Bad tz", true)
 		return
 	}
 
 	text := r.Form.Get("text")
 	dateStr := r.Form.Get("date")
 
-	date, err := time.Parse("02-01-2006", dateStr)
+	date, allDay, err := parseEventTime(dateStr, loc)
 
 	if dateStr == "" || err != nil {
 		writeJSONMessage(w, http.StatusBadRequest, "Bad date", true)
 		return
 	}
 
-	err = h.service.SaveEvent(text, date)
+	end, err := parseEnd(r.Form, date, loc)
+	if err != nil {
+		writeJSONMessage(w, http.StatusBadRequest, fmt.Sprintf("Bad end: %s", err), true)
+		return
+	}
+	if end.Before(date) && !end.IsZero() {
+		writeJSONMessage(w, http.StatusBadRequest, "Bad end: event end is before its start", true)
+		return
+	}
+
+	rec, err := parseRecurrence(r.Form, loc)
+	if err != nil {
+		writeJSONMessage(w, http.StatusBadRequest, fmt.Sprintf("Bad recurrence: %s", err), true)
+		return
+	}
+
+	reminders, _, err := parseReminders(r.Form)
+	if err != nil {
+		writeJSONMessage(w, http.StatusBadRequest, fmt.Sprintf("Bad remind: %s", err), true)
+		return
+	}
+	if len(reminders) == 0 {
+		reminders = nil
+	}
+	tags, _ := parseTags(r.Form, "tags")
+
+	calendarID, ok := parseCalendarID(r.Form)
+	if !ok {
+		writeJSONMessage(w, http.StatusBadRequest, "Bad calendar_id", true)
+		return
+	}
+
+	saved, err := h.service.SaveEvent(Event{
+		UserID:     userID,
+		CalendarID: calendarID,
+		Text:       text,
+		Date:       JSONTime(date),
+		End:        JSONTime(end),
+		TimeZone:   tz,
+		AllDay:     allDay,
+		Recurrence: rec,
+		Reminders:  reminders,
+		Tags:       tags,
+	})
 
+	var conflict *ConflictError
+	if errors.As(err, &conflict) {
+		writeJSONMessage(w, http.StatusServiceUnavailable, fmt.Sprintf("Can't save event: %s", err), true)
+		return
+	}
+	if errors.Is(err, ErrCalendarNotFound) {
+		writeJSONMessage(w, http.StatusNotFound, fmt.Sprintf("Can't save event: %s", err), true)
+		return
+	}
 	if err != nil {
 		writeJSONMessage(w, http.StatusServiceUnavailable, "Can't save event", true)
 		return
 	}
 
-	writeJSONMessage(w, http.StatusOK, "Event saved", false)
+	writeJSONMessage(w, http.StatusOK, "Event saved"+conflictsNote(saved.Conflicts), false)
+}
+
+//maxFormBodySize максимальный размер тела формы
+const maxFormBodySize = 64 << 10 //64 KB
+
+//parseForm разбирает параметры формы, ограничив тело запроса maxFormBodySize.
+//Возвращает: статус код ошибки (413 для слишком большого тела, 400 для некорректной формы) и ошибку.
+func parseForm(w http.ResponseWriter, r *http.Request) (int, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxFormBodySize)
+	if err := r.ParseForm(); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return http.StatusRequestEntityTooLarge, errors.New("Request body too large")
+		}
+		return http.StatusBadRequest, errors.New("Parse params error")
+	}
+	return 0, nil
+}
+
+//eventETag строит ETag события по его версии
+func eventETag(event Event) string {
+	return `"` + strconv.Itoa(event.Version) + `"`
+}
+
+//parseIfMatch разбирает заголовок If-Match: ETag версии события или "*".
+//Возвращает ожидаемую версию (0 - без проверки, -1 - не совпадет ни с одной версией,
+//как слабый ETag, который If-Match не принимает) и false для некорректного заголовка.
+func parseIfMatch(header http.Header) (int, bool) {
+	value := strings.TrimSpace(header.Get("If-Match"))
+	if value == "" || value == "*" {
+		return 0, true
+	}
+	if strings.HasPrefix(value, "W/") {
+		return -1, true
+	}
+
+	version, err := strconv.Atoi(strings.Trim(value, `"`))
+	if err != nil || version <= 0 || len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return 0, false
+	}
+	return version, true
 }
 
 //updateEvent обработчик для POST /update_event
@@ -117,9 +518,14 @@ func (h *Handler) updateEvent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := r.ParseForm()
+	if status, err := parseForm(w, r); err != nil {
+		writeJSONMessage(w, status, err.Error(), true)
+		return
+	}
+
+	userID, status, err := resolveUserID(r, r.Form.Get("user_id"))
 	if err != nil {
-		writeJSONMessage(w, http.StatusBadRequest, "Parse params error", true)
+		writeJSONMessage(w, status, err.Error(), true)
 		return
 	}
 
@@ -133,15 +539,69 @@ func (h *Handler) updateEvent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	date, err := time.Parse("02-01-2006", dateStr)
+	tz := r.Form.Get("tz")
+	loc, ok := parseLocation(tz)
+	if !ok {
+		writeJSONMessage(w, http.StatusBadRequest, "Bad tz", true)
+		return
+	}
+
+	change := EventChange{Text: text, TimeZone: tz}
 
-	//Если дата не была передана
-	if dateStr == "" || err != nil {
-		date = time.Time{}
+	//Если дата не была передана, время начала не меняется
+	if dateStr != "" {
+		if change.Date, _, err = parseEventTime(dateStr, loc); err != nil {
+			writeJSONMessage(w, http.StatusBadRequest, "Bad date", true)
+			return
+		}
+	}
+
+	if durationStr := r.Form.Get("duration"); durationStr != "" && r.Form.Get("end") == "" {
+		if change.Duration, err = time.ParseDuration(durationStr); err != nil || change.Duration <= 0 {
+			writeJSONMessage(w, http.StatusBadRequest, "Bad end: bad duration", true)
+			return
+		}
+	} else if change.End, err = parseEnd(r.Form, change.Date, loc); err != nil {
+		writeJSONMessage(w, http.StatusBadRequest, fmt.Sprintf("Bad end: %s", err), true)
+		return
+	}
+
+	if reminders, ok, err := parseReminders(r.Form); err != nil {
+		writeJSONMessage(w, http.StatusBadRequest, fmt.Sprintf("Bad remind: %s", err), true)
+		return
+	} else if ok {
+		change.Reminders = reminders
+	}
+	if tags, ok := parseTags(r.Form, "tags"); ok {
+		change.Tags = tags
+	}
+	if change.CalendarID, ok = parseCalendarID(r.Form); !ok {
+		writeJSONMessage(w, http.StatusBadRequest, "Bad calendar_id", true)
+		return
+	}
+
+	occurrence, ok := parseOccurrence(r.Form)
+	if !ok {
+		writeJSONMessage(w, http.StatusBadRequest, "Bad occurrence", true)
+		return
+	}
+
+	version, ok := parseIfMatch(r.Header)
+	if !ok {
+		writeJSONMessage(w, http.StatusBadRequest, "Bad If-Match", true)
+		return
 	}
 
-	isExists, err := h.service.ChangeEvent(id, text, date)
+	changed, isExists, err := h.service.ChangeEvent(userID, id, occurrence, change, version)
 
+	if errors.Is(err, ErrVersionMismatch) {
+		writeJSONMessage(w, http.StatusPreconditionFailed, fmt.Sprintf("Can't change event: %s", err), true)
+		return
+	}
+	if errors.Is(err, ErrCalendarNotFound) {
+		writeJSONMessage(w, http.StatusNotFound, fmt.Sprintf("Can't change event: %s", err), true)
+		return
+	}
 	if err != nil {
 		writeJSONMessage(w, http.StatusServiceUnavailable, fmt.Sprintf("Can't change event: %s", err), true)
 		return
@@ -152,7 +612,8 @@ func (h *Handler) updateEvent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	writeJSONMessage(w, http.StatusOK, "Event updated", false)
+	w.Header().Set("ETag", eventETag(changed))
+	writeJSONMessage(w, http.StatusOK, "Event updated"+conflictsNote(changed.Conflicts), false)
 }
 
 //deleteEvent обработчик для POST /delete_event
@@ -162,9 +623,14 @@ func (h *Handler) deleteEvent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := r.ParseForm()
+	if status, err := parseForm(w, r); err != nil {
+		writeJSONMessage(w, status, err.Error(), true)
+		return
+	}
+
+	userID, status, err := resolveUserID(r, r.Form.Get("user_id"))
 	if err != nil {
-		writeJSONMessage(w, http.StatusBadRequest, "Parse params error", true)
+		writeJSONMessage(w, status, err.Error(), true)
 		return
 	}
 
@@ -175,8 +641,24 @@ func (h *Handler) deleteEvent(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	isExists, err := h.service.DeleteEvent(id)
+	occurrence, ok := parseOccurrence(r.Form)
+	if !ok {
+		writeJSONMessage(w, http.StatusBadRequest, "Bad occurrence", true)
+		return
+	}
+
+	version, ok := parseIfMatch(r.Header)
+	if !ok {
+		writeJSONMessage(w, http.StatusBadRequest, "Bad If-Match", true)
+		return
+	}
+
+	isExists, err := h.service.DeleteEvent(userID, id, occurrence, version)
 
+	if errors.Is(err, ErrVersionMismatch) {
+		writeJSONMessage(w, http.StatusPreconditionFailed, fmt.Sprintf("Can't delete event: %s", err), true)
+		return
+	}
 	if err != nil {
 		writeJSONMessage(w, http.StatusServiceUnavailable, fmt.Sprintf("Can't delete event: %s", err), true)
 		return
@@ -191,53 +673,107 @@ func (h *Handler) deleteEvent(w http.ResponseWriter, r *http.Request) {
 	writeJSONMessage(w, http.StatusOK, "Event deleted", false)
 }
 
-//eventsToday обработчик для GET /events_for_day
-func (h *Handler) eventsToday(w http.ResponseWriter, r *http.Request) {
+//eventsForDay обработчик для GET /events_for_day
+func (h *Handler) eventsForDay(w http.ResponseWriter, r *http.Request) {
+	h.eventsForPeriod(w, r, "/events_for_day", h.service.GetDay)
+}
+
+//eventsForWeek обработчик для GET /events_for_week
+func (h *Handler) eventsForWeek(w http.ResponseWriter, r *http.Request) {
+	h.eventsForPeriod(w, r, "/events_for_week", h.service.GetWeek)
+}
+
+//eventsForMonth обработчик для GET /events_for_month
+func (h *Handler) eventsForMonth(w http.ResponseWriter, r *http.Request) {
+	h.eventsForPeriod(w, r, "/events_for_month", h.service.GetMonth)
+}
+
+//eventsForPeriod общая часть обработчиков day/week/month.
+//Принимает: путь end-point'а для сообщений об ошибке и метод сервиса,
+//выдающий события пользователя за период вокруг опорной даты.
+func (h *Handler) eventsForPeriod(w http.ResponseWriter, r *http.Request, path string,
+	get func(userID int, date time.Time) ([]Event, error)) {
 	if r.Method != http.MethodGet {
-		writeJSONMessage(w, http.StatusMethodNotAllowed, fmt.Sprintf("expect method Get at /events_for_day, got %v", r.Method), true)
+		writeJSONMessage(w, http.StatusMethodNotAllowed, fmt.Sprintf("expect method Get at %s, got %v", path, r.Method), true)
 		return
 	}
 
-	result, err := h.service.GetTodays()
+	query := r.URL.Query()
 
+	userID, status, err := resolveUserID(r, query.Get("user_id"))
 	if err != nil {
-		writeJSONMessage(w, http.StatusServiceUnavailable, fmt.Sprintf("Can't get events: %s", err), true)
+		writeJSONMessage(w, status, err.Error(), true)
 		return
 	}
 
-	writeJSONEvents(w, http.StatusOK, result)
-}
+	limit, cursor, err := parsePage(query)
+	if err != nil {
+		writeJSONMessage(w, http.StatusBadRequest, err.Error(), true)
+		return
+	}
 
-//eventsThisMonth обработчик для GET /events_for_month
-func (h *Handler) eventsThisMonth(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		writeJSONMessage(w, http.StatusMethodNotAllowed, fmt.Sprintf("expect method Get at /events_for_month, got %v", r.Method), true)
+	//Если дата не передана, сервис возьмет текущую
+	date, err := parseAnchor(query)
+	if err != nil {
+		writeJSONMessage(w, http.StatusBadRequest, err.Error(), true)
 		return
 	}
 
-	result, err := h.service.GetThisMonths()
+	result, err := get(userID, date)
 
 	if err != nil {
 		writeJSONMessage(w, http.StatusServiceUnavailable, fmt.Sprintf("Can't get events: %s", err), true)
 		return
 	}
 
-	writeJSONEvents(w, http.StatusOK, result)
+	writeJSONEvents(w, http.StatusOK, paginate(result, limit, cursor))
 }
 
-//eventsThisWeek обработчик для GET /events_for_week
-func (h *Handler) eventsThisWeek(w http.ResponseWriter, r *http.Request) {
+//eventsBetween обработчик для GET /events_between
+func (h *Handler) eventsBetween(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		writeJSONMessage(w, http.StatusMethodNotAllowed, fmt.Sprintf("expect method Get at /events_for_week, got %v", r.Method), true)
+		writeJSONMessage(w, http.StatusMethodNotAllowed, fmt.Sprintf("expect method Get at /events_between, got %v", r.Method), true)
+		return
+	}
+
+	query := r.URL.Query()
+
+	userID, status, err := resolveUserID(r, query.Get("user_id"))
+	if err != nil {
+		writeJSONMessage(w, status, err.Error(), true)
+		return
+	}
+
+	limit, cursor, err := parsePage(query)
+	if err != nil {
+		writeJSONMessage(w, http.StatusBadRequest, err.Error(), true)
+		return
+	}
+
+	loc, ok := parseLocation(query.Get("tz"))
+	if !ok {
+		writeJSONMessage(w, http.StatusBadRequest, "Bad tz", true)
+		return
+	}
+
+	from, err := time.ParseInLocation(dateLayout, query.Get("from"), loc)
+	if err != nil {
+		writeJSONMessage(w, http.StatusBadRequest, "Bad from", true)
+		return
+	}
+
+	to, err := time.ParseInLocation(dateLayout, query.Get("to"), loc)
+	if err != nil || to.Before(from) {
+		writeJSONMessage(w, http.StatusBadRequest, "Bad to", true)
 		return
 	}
 
-	result, err := h.service.GetThisWeeks()
+	result, err := h.service.GetBetween(userID, from, to)
 
 	if err != nil {
 		writeJSONMessage(w, http.StatusServiceUnavailable, fmt.Sprintf("Can't get events: %s", err), true)
 		return
 	}
 
-	writeJSONEvents(w, http.StatusOK, result)
+	writeJSONEvents(w, http.StatusOK, paginate(result, limit, cursor))
 }
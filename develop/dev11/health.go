@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+//Пути проверок состояния
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+)
+
+//ErrDraining сервис останавливается и новые запросы не принимает
+var ErrDraining = errors.New("shutting down")
+
+//Pinger хранилище, которое умеет проверить свою доступность
+type Pinger interface {
+	Ping() error
+}
+
+//readinessCheck именованная проверка готовности
+type readinessCheck struct {
+	name  string
+	check func() error
+}
+
+//Health состояние сервиса для проверок /healthz и /readyz.
+//Живость (liveness) - процесс отвечает на запросы; готовность (readiness) - сервис
+//не останавливается и все проверки, например доступность хранилища, проходят.
+type Health struct {
+	mutex    sync.RWMutex
+	draining bool
+	checks   []readinessCheck
+}
+
+//NewHealth конструктор для Health
+func NewHealth() *Health {
+	return &Health{}
+}
+
+//AddCheck добавляет проверку готовности
+func (h *Health) AddCheck(name string, check func() error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.checks = append(h.checks, readinessCheck{name: name, check: check})
+}
+
+//SetDraining переводит сервис в остановку: /readyz начинает отвечать 503,
+//чтобы балансировщик перестал присылать запросы до закрытия соединений
+func (h *Health) SetDraining() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.draining = true
+}
+
+//Ready проверяет готовность.
+//Возвращает: результат каждой проверки по имени ("ok" или текст ошибки) и ошибку, если сервис не готов.
+func (h *Health) Ready() (map[string]string, error) {
+	h.mutex.RLock()
+	draining := h.draining
+	checks := h.checks
+	h.mutex.RUnlock()
+
+	results := make(map[string]string, len(checks)+1)
+	if draining {
+		results["shutdown"] = ErrDraining.Error()
+		return results, ErrDraining
+	}
+
+	var failed []string
+	for _, c := range checks {
+		if err := c.check(); err != nil {
+			results[c.name] = err.Error()
+			failed = append(failed, c.name)
+			continue
+		}
+		results[c.name] = "ok"
+	}
+	if len(failed) > 0 {
+		return results, fmt.Errorf("checks failed: %v", failed)
+	}
+	return results, nil
+}
+
+//healthz обработчик для GET /healthz: процесс жив и обслуживает запросы
+func (h *Handler) healthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeJSONMessage(w, http.StatusMethodNotAllowed, fmt.Sprintf("expect method GET at %s, got %v", healthzPath, r.Method), true)
+		return
+	}
+	writeJSONMessage(w, http.StatusOK, "ok", false)
+}
+
+//readyz обработчик для GET /readyz.
+//Отвечает 200, если сервис готов принимать запросы, иначе 503; в Checks - результат каждой проверки.
+func (h *Handler) readyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeJSONMessage(w, http.StatusMethodNotAllowed, fmt.Sprintf("expect method GET at %s, got %v", readyzPath, r.Method), true)
+		return
+	}
+
+	results, err := h.health.Ready()
+	status := http.StatusOK
+	data := struct {
+		Result string            `json:"Result,omitempty"`
+		Error  string            `json:"Error,omitempty"`
+		Checks map[string]string `json:"Checks"`
+	}{Result: "ready", Checks: results}
+	if err != nil {
+		status = http.StatusServiceUnavailable
+		data.Result, data.Error = "", err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthProbes(t *testing.T) {
+	service, _ := newTestService()
+	h := NewHandler(service)
+	h.auth = newTestAuthenticator(t)
+	storageErr := error(nil)
+	h.health.AddCheck("storage", func() error { return storageErr })
+	handler := h.initRouts()
+
+	var ready struct {
+		Result string            `json:"Result"`
+		Error  string            `json:"Error"`
+		Checks map[string]string `json:"Checks"`
+	}
+
+	//проверки доступны без учетных данных
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, healthzPath, nil))
+	assert.Equal(t, rec.Code, http.StatusOK)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, readyzPath, nil))
+	assert.Equal(t, rec.Code, http.StatusOK)
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &ready))
+	assert.Equal(t, ready.Checks, map[string]string{"storage": "ok"})
+
+	storageErr = errors.New("disk is gone")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, readyzPath, nil))
+	assert.Equal(t, rec.Code, http.StatusServiceUnavailable)
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &ready))
+	assert.Equal(t, ready.Checks["storage"], "disk is gone")
+
+	//при остановке сервис не готов, но жив
+	storageErr = nil
+	h.health.SetDraining()
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, readyzPath, nil))
+	assert.Equal(t, rec.Code, http.StatusServiceUnavailable)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, healthzPath, nil))
+	assert.Equal(t, rec.Code, http.StatusOK)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, readyzPath, nil))
+	assert.Equal(t, rec.Code, http.StatusMethodNotAllowed)
+}
+
+func TestServerRunBusyPort(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+
+	server := NewServer(ServerConfig{MaxHeaderBytes: 1 << 20})
+	assert.Error(t, server.Run(port, http.NotFoundHandler()))
+}
+
+func TestServerShutdownBeforeRun(t *testing.T) {
+	server := NewServer(ServerConfig{MaxHeaderBytes: 1 << 20})
+	assert.Nil(t, server.Shutdown(context.Background()))
+	assert.Nil(t, server.Run("0", http.NotFoundHandler()))
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Форматы дат iCalendar (RFC 5545)
+const (
+	icalDate     = "20060102"
+	icalDateTime = "20060102T150405"
+	icalUTC      = "20060102T150405Z"
+)
+
+//icalMaxLine максимальная длина строки в октетах, после которой она переносится
+const icalMaxLine = 75
+
+//icalEntry результат разбора одного VEVENT: событие или ошибка
+type icalEntry struct {
+	Index int
+	UID   string
+	Event Event
+	Err   error
+}
+
+//icalWriter пишет строки iCalendar с CRLF и переносом длинных строк
+type icalWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+//line пишет строку содержимого, перенося ее по icalMaxLine октетов
+//без разрыва многобайтовых символов
+func (iw *icalWriter) line(name string, value string) {
+	if iw.err != nil {
+		return
+	}
+
+	content := name + ":" + value
+	for len(content) > icalMaxLine {
+		cut := icalMaxLine
+		for cut > 0 && !isRuneStart(content[cut]) {
+			cut--
+		}
+		iw.write(content[:cut] + "\r\n ")
+		content = content[cut:]
+	}
+	iw.write(content + "\r\n")
+}
+
+func (iw *icalWriter) write(s string) {
+	if iw.err == nil {
+		_, iw.err = iw.w.WriteString(s)
+	}
+}
+
+//isRuneStart проверяет, что байт не является продолжением UTF-8 символа
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+//icalEscape экранирует значение типа TEXT
+func icalEscape(text string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(text)
+}
+
+//icalUnescape снимает экранирование значения типа TEXT
+func icalUnescape(text string) string {
+	var b strings.Builder
+	for i := 0; i < len(text); i++ {
+		if text[i] != '\\' || i == len(text)-1 {
+			b.WriteByte(text[i])
+			continue
+		}
+		i++
+		switch text[i] {
+		case 'n', 'N':
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(text[i])
+		}
+	}
+	return b.String()
+}
+
+//icalUID строит UID события: UID клиента CalDAV или id@dev11
+func icalUID(event Event) string {
+	if event.UID != "" {
+		return event.UID
+	}
+	return fmt.Sprintf("%d@dev11", event.ID)
+}
+
+//icalTime возвращает имя свойства с параметрами и значение для времени события:
+//дату для событий на весь день, местное время с TZID для событий с зоной и UTC для остальных
+func icalTime(name string, t time.Time, event Event) (string, string) {
+	switch {
+	case event.AllDay:
+		return name + ";VALUE=DATE", t.In(event.location()).Format(icalDate)
+	case event.TimeZone == "":
+		return name, t.UTC().Format(icalUTC)
+	default:
+		return name + ";TZID=" + event.TimeZone, t.In(event.location()).Format(icalDateTime)
+	}
+}
+
+//formatRRule переводит правило повторения события в значение RRULE
+func formatRRule(event Event) string {
+	rec := event.Recurrence
+	parts := []string{"FREQ=" + strings.ToUpper(rec.Freq)}
+	if rec.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(rec.Interval))
+	}
+	if rec.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(rec.Count))
+	}
+	if rec.Until != nil {
+		until := time.Time(*rec.Until).UTC().Format(icalUTC)
+		if event.AllDay {
+			until = time.Time(*rec.Until).In(event.location()).Format(icalDate)
+		}
+		parts = append(parts, "UNTIL="+until)
+	}
+	if len(rec.ByWeekday) > 0 {
+		codes := make([]string, 0, len(rec.ByWeekday))
+		for _, wd := range rec.ByWeekday {
+			codes = append(codes, weekdayCode(wd))
+		}
+		parts = append(parts, "BYDAY="+strings.Join(codes, ","))
+	}
+	return strings.Join(parts, ";")
+}
+
+//weekdayCode возвращает код дня недели в нотации RRULE
+func weekdayCode(wd time.Weekday) string {
+	for code, v := range weekdayCodes {
+		if v == wd {
+			return code
+		}
+	}
+	return ""
+}
+
+//writeVEvent пишет один VEVENT.
+//recurrenceID - исходная дата вхождения для измененного или отдельно выгружаемого вхождения серии.
+func writeVEvent(iw *icalWriter, event Event, stamp time.Time, recurrenceID *JSONTime, withRule bool) {
+	iw.line("BEGIN", "VEVENT")
+	writeEventProps(iw, event, stamp, recurrenceID, withRule)
+	iw.line("END", "VEVENT")
+}
+
+//writeEventProps пишет свойства VEVENT; у события с участниками - еще ORGANIZER и ATTENDEE
+func writeEventProps(iw *icalWriter, event Event, stamp time.Time, recurrenceID *JSONTime, withRule bool) {
+	iw.line("UID", icalUID(event))
+	iw.line("DTSTAMP", stamp.UTC().Format(icalUTC))
+	iw.line(icalTime("DTSTART", time.Time(event.Date), event))
+	if event.duration() > 0 {
+		iw.line(icalTime("DTEND", time.Time(event.End), event))
+	}
+	if recurrenceID != nil {
+		iw.line(icalTime("RECURRENCE-ID", time.Time(*recurrenceID), event))
+	}
+	iw.line("SUMMARY", icalEscape(event.Text))
+
+	if len(event.Attendees) > 0 {
+		iw.line("ORGANIZER", userAddress(event.UserID))
+		for _, a := range event.Attendees {
+			iw.line("ATTENDEE;PARTSTAT="+partStat(a.Status), userAddress(a.UserID))
+		}
+	}
+
+	if withRule && event.Recurrence != nil {
+		iw.line("RRULE", formatRRule(event))
+		for _, ex := range event.Exceptions {
+			if ex.Deleted {
+				iw.line(icalTime("EXDATE", time.Time(ex.Date), event))
+			}
+		}
+	}
+}
+
+//encodeCalendar сериализует события в VCALENDAR.
+//Серии выгружаются с RRULE и EXDATE, измененные вхождения - отдельными VEVENT с RECURRENCE-ID.
+//Развернутые вхождения (с заполненным Occurrence) выгружаются как вхождения своей серии.
+func encodeCalendar(w io.Writer, events []Event, stamp time.Time) error {
+	iw := &icalWriter{w: bufio.NewWriter(w)}
+
+	iw.line("BEGIN", "VCALENDAR")
+	iw.line("VERSION", "2.0")
+	iw.line("PRODID", "-//dev11//calendar//RU")
+	iw.line("CALSCALE", "GREGORIAN")
+
+	for _, event := range events {
+		if event.Occurrence != nil {
+			writeVEvent(iw, event, stamp, event.Occurrence, false)
+			continue
+		}
+
+		writeVEvent(iw, event, stamp, nil, true)
+		for _, ex := range event.Exceptions {
+			if ex.Deleted {
+				continue
+			}
+			original := ex.Date
+			writeVEvent(iw, instance(event, time.Time(original), ex, true), stamp, &original, false)
+		}
+	}
+
+	iw.line("END", "VCALENDAR")
+	if iw.err != nil {
+		return iw.err
+	}
+	return iw.w.Flush()
+}
+
+//icalProperty свойство компонента: имя, параметры и значение
+type icalProperty struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+//unfoldLines читает строки содержимого, склеивая перенесенные
+func unfoldLines(r io.Reader) ([]string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+
+	lines := make([]string, 0)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+//parseProperty разбирает строку содержимого NAME;PARAM=VALUE:VALUE
+func parseProperty(line string) (icalProperty, error) {
+	inQuotes := false
+	colon := -1
+	for i := 0; i < len(line) && colon < 0; i++ {
+		switch line[i] {
+		case '"':
+			inQuotes = !inQuotes
+		case ':':
+			if !inQuotes {
+				colon = i
+			}
+		}
+	}
+	if colon < 0 {
+		return icalProperty{}, fmt.Errorf("bad content line %q", line)
+	}
+
+	parts := strings.Split(line[:colon], ";")
+	prop := icalProperty{Name: strings.ToUpper(parts[0]), Params: make(map[string]string), Value: line[colon+1:]}
+	for _, param := range parts[1:] {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) == 2 {
+			prop.Params[strings.ToUpper(kv[0])] = strings.Trim(kv[1], `"`)
+		}
+	}
+	return prop, nil
+}
+
+//parseICalTime разбирает значение DATE или DATE-TIME с учетом TZID
+func parseICalTime(prop icalProperty) (time.Time, error) {
+	value := prop.Value
+	switch {
+	case len(value) == len(icalDate):
+		return time.Parse(icalDate, value)
+	case strings.HasSuffix(value, "Z"):
+		return time.Parse(icalUTC, value)
+	default:
+		loc := time.UTC
+		if tzid, ok := prop.Params["TZID"]; ok {
+			var err error
+			if loc, err = time.LoadLocation(tzid); err != nil {
+				return time.Time{}, fmt.Errorf("unknown TZID %q", tzid)
+			}
+		}
+		return time.ParseInLocation(icalDateTime, value, loc)
+	}
+}
+
+//parseICalDuration разбирает значение типа DURATION: [+]PnW или [+]PnDTnHnMnS
+func parseICalDuration(value string) (time.Duration, error) {
+	bad := fmt.Errorf("bad DURATION %q", value)
+
+	str := strings.TrimPrefix(value, "+")
+	if !strings.HasPrefix(str, "P") || len(str) < 3 {
+		return 0, bad
+	}
+	str = str[1:]
+
+	units := map[byte]time.Duration{'W': 7 * 24 * time.Hour, 'D': 24 * time.Hour}
+	var result time.Duration
+	number := 0
+	digits := false
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		switch {
+		case c >= '0' && c <= '9':
+			number = number*10 + int(c-'0')
+			digits = true
+		case c == 'T':
+			units = map[byte]time.Duration{'H': time.Hour, 'M': time.Minute, 'S': time.Second}
+		default:
+			unit, ok := units[c]
+			if !ok || !digits {
+				return 0, bad
+			}
+			result += time.Duration(number) * unit
+			number, digits = 0, false
+		}
+	}
+	if digits {
+		return 0, bad
+	}
+	return result, nil
+}
+
+//parseRRule разбирает значение RRULE в правило повторения
+func parseRRule(value string) (*Recurrence, error) {
+	rec := &Recurrence{}
+	for _, part := range strings.Split(value, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("bad RRULE part %q", part)
+		}
+
+		var err error
+		key, val := strings.ToUpper(kv[0]), kv[1]
+		switch key {
+		case "FREQ":
+			rec.Freq = strings.ToLower(val)
+		case "INTERVAL":
+			rec.Interval, err = strconv.Atoi(val)
+		case "COUNT":
+			rec.Count, err = strconv.Atoi(val)
+		case "UNTIL":
+			var until time.Time
+			until, err = parseICalTime(icalProperty{Value: val})
+			//UNTIL-дата включает весь день
+			if len(val) == len(icalDate) {
+				_, until = dayBounds(until)
+			}
+			jsonUntil := JSONTime(until)
+			rec.Until = &jsonUntil
+		case "BYDAY":
+			for _, code := range strings.Split(val, ",") {
+				wd, ok := weekdayCodes[strings.ToUpper(code)]
+				if !ok {
+					return nil, fmt.Errorf("unsupported BYDAY %q", code)
+				}
+				rec.ByWeekday = append(rec.ByWeekday, wd)
+			}
+		case "WKST":
+		default:
+			return nil, fmt.Errorf("unsupported RRULE part %s", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad RRULE %s: %w", key, err)
+		}
+	}
+
+	if err := rec.Validate(); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+//vevent разобранный, но еще не собранный в событие VEVENT
+type vevent struct {
+	index int
+	props []icalProperty
+}
+
+//get возвращает первое свойство с именем name
+func (v vevent) get(name string) (icalProperty, bool) {
+	for _, prop := range v.props {
+		if prop.Name == name {
+			return prop, true
+		}
+	}
+	return icalProperty{}, false
+}
+
+//toEvent собирает событие из VEVENT.
+//Возвращает: событие, исходную дату вхождения из RECURRENCE-ID (нулевую для основного события) и ошибку.
+func (v vevent) toEvent() (Event, time.Time, error) {
+	var event Event
+
+	start, ok := v.get("DTSTART")
+	if !ok {
+		return event, time.Time{}, errors.New("missing DTSTART")
+	}
+	date, err := parseICalTime(start)
+	if err != nil {
+		return event, time.Time{}, fmt.Errorf("bad DTSTART: %w", err)
+	}
+	event.Date = JSONTime(date)
+	event.AllDay = start.Params["VALUE"] == "DATE" || len(start.Value) == len(icalDate)
+	event.TimeZone = start.Params["TZID"]
+
+	if prop, ok := v.get("DTEND"); ok {
+		end, err := parseICalTime(prop)
+		if err != nil {
+			return event, time.Time{}, fmt.Errorf("bad DTEND: %w", err)
+		}
+		event.End = JSONTime(end)
+	} else if prop, ok := v.get("DURATION"); ok {
+		duration, err := parseICalDuration(prop.Value)
+		if err != nil {
+			return event, time.Time{}, err
+		}
+		event.End = JSONTime(date.Add(duration))
+	}
+
+	if summary, ok := v.get("SUMMARY"); ok {
+		event.Text = icalUnescape(summary.Value)
+	}
+
+	var recurrenceID time.Time
+	if prop, ok := v.get("RECURRENCE-ID"); ok {
+		if recurrenceID, err = parseICalTime(prop); err != nil {
+			return event, time.Time{}, fmt.Errorf("bad RECURRENCE-ID: %w", err)
+		}
+		return event, recurrenceID, nil
+	}
+
+	if prop, ok := v.get("RRULE"); ok {
+		if event.Recurrence, err = parseRRule(prop.Value); err != nil {
+			return event, time.Time{}, err
+		}
+	}
+
+	for _, prop := range v.props {
+		if prop.Name != "EXDATE" {
+			continue
+		}
+		if event.Recurrence == nil {
+			return event, time.Time{}, errors.New("EXDATE without RRULE")
+		}
+		for _, value := range strings.Split(prop.Value, ",") {
+			exdate, err := parseICalTime(icalProperty{Params: prop.Params, Value: value})
+			if err != nil {
+				return event, time.Time{}, fmt.Errorf("bad EXDATE: %w", err)
+			}
+			event.Exceptions = append(event.Exceptions, Exception{Date: JSONTime(exdate), Deleted: true})
+		}
+	}
+
+	return event, time.Time{}, nil
+}
+
+//decodeCalendar разбирает VCALENDAR в события.
+//Ошибка в одном VEVENT не прерывает разбор: она возвращается в соответствующем icalEntry.
+//VEVENT с RECURRENCE-ID вливаются исключениями в серию с тем же UID.
+//Возвращает: записи по порядку VEVENT (кроме влитых) и ошибку структуры файла.
+func decodeCalendar(r io.Reader) ([]icalEntry, error) {
+	lines, err := unfoldLines(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 || !strings.EqualFold(lines[0], "BEGIN:VCALENDAR") {
+		return nil, errors.New("not a VCALENDAR")
+	}
+
+	vevents := make([]vevent, 0)
+	var current *vevent
+	depth := 0
+	for _, line := range lines {
+		prop, err := parseProperty(line)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case prop.Name == "BEGIN" && strings.EqualFold(prop.Value, "VEVENT") && depth == 1:
+			current = &vevent{index: len(vevents) + 1}
+			depth++
+		case prop.Name == "END" && strings.EqualFold(prop.Value, "VEVENT") && current != nil && depth == 2:
+			vevents = append(vevents, *current)
+			current = nil
+			depth--
+		case prop.Name == "BEGIN":
+			depth++
+		case prop.Name == "END":
+			depth--
+		case current != nil && depth == 2:
+			current.props = append(current.props, prop)
+		}
+	}
+	if depth != 0 {
+		return nil, errors.New("unbalanced BEGIN/END")
+	}
+
+	entries := make([]icalEntry, 0, len(vevents))
+	byUID := make(map[string]int)
+	overrides := make([]icalEntry, 0)
+
+	for _, v := range vevents {
+		entry := icalEntry{Index: v.index}
+		if uid, ok := v.get("UID"); ok {
+			entry.UID = uid.Value
+		}
+
+		event, recurrenceID, err := v.toEvent()
+		entry.Event = event
+		entry.Err = err
+
+		if err == nil && !recurrenceID.IsZero() {
+			entry.Event.Occurrence = new(JSONTime)
+			*entry.Event.Occurrence = JSONTime(recurrenceID)
+			overrides = append(overrides, entry)
+			continue
+		}
+		if err == nil && entry.UID != "" {
+			byUID[entry.UID] = len(entries)
+		}
+		entries = append(entries, entry)
+	}
+
+	for _, override := range overrides {
+		master, ok := byUID[override.UID]
+		if !ok || entries[master].Event.Recurrence == nil {
+			override.Err = errors.New("RECURRENCE-ID without recurring master event")
+			entries = append(entries, override)
+			continue
+		}
+		ex := Exception{Date: *override.Event.Occurrence, Text: override.Event.Text}
+		newDate := override.Event.Date
+		ex.NewDate = &newDate
+		if !time.Time(override.Event.End).IsZero() {
+			newEnd := override.Event.End
+			ex.NewEnd = &newEnd
+		}
+		entries[master].Event.Exceptions = append(entries[master].Event.Exceptions, ex)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Index < entries[j].Index })
+	return entries, nil
+}
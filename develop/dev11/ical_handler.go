@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+)
+
+//maxImportSize максимальный размер загружаемого .ics файла
+const maxImportSize = 10 << 20 //10 MB
+
+//importFailure ошибка импорта одного VEVENT.
+//Сообщение лежит под ключом Error, как в writeJSONMessage.
+type importFailure struct {
+	Entry   int    `json:"Entry"`
+	UID     string `json:"UID,omitempty"`
+	Message string `json:"Error"`
+}
+
+//writeJSONImport записывает в http.ResponseWriter итог импорта
+//в JSON формате с соответствующим хедером.
+//Принимает: статус код результата, строку итога и ошибки отдельных записей.
+func writeJSONImport(w http.ResponseWriter, status int, message string, failures []importFailure) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	data := struct {
+		Message  string          `json:"Result"`
+		Failures []importFailure `json:"Failures"`
+	}{Message: message, Failures: failures}
+	json.NewEncoder(w).Encode(data)
+}
+
+//exportICal обработчик для GET /export.ics.
+//Без параметра period выгружает все события пользователя сериями,
+//с period=day|week|month - вхождения за период вокруг опорной даты date.
+func (h *Handler) exportICal(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONMessage(w, http.StatusMethodNotAllowed, fmt.Sprintf("expect method Get at /export.ics, got %v", r.Method), true)
+		return
+	}
+
+	query := r.URL.Query()
+
+	userID, status, err := resolveUserID(r, query.Get("user_id"))
+	if err != nil {
+		writeJSONMessage(w, status, err.Error(), true)
+		return
+	}
+
+	date, err := parseAnchor(query)
+	if err != nil {
+		writeJSONMessage(w, http.StatusBadRequest, err.Error(), true)
+		return
+	}
+
+	var events []Event
+	switch period := query.Get("period"); period {
+	case "":
+		events, err = h.service.GetAll(userID)
+	case "day":
+		events, err = h.service.GetDay(userID, date)
+	case "week":
+		events, err = h.service.GetWeek(userID, date)
+	case "month":
+		events, err = h.service.GetMonth(userID, date)
+	default:
+		writeJSONMessage(w, http.StatusBadRequest, fmt.Sprintf("Bad period %q", period), true)
+		return
+	}
+
+	if err != nil {
+		writeJSONMessage(w, http.StatusServiceUnavailable, fmt.Sprintf("Can't get events: %s", err), true)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="calendar.ics"`)
+	w.WriteHeader(http.StatusOK)
+	encodeCalendar(w, events, time.Now())
+}
+
+//importICal обработчик для POST /import.
+//Файл принимается полем file в multipart/form-data или телом запроса (text/calendar),
+//user_id - параметром формы или queryString.
+//Каждый VEVENT сохраняется через Service.SaveEvent, ошибки отдельных записей
+//возвращаются списком Failures.
+func (h *Handler) importICal(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONMessage(w, http.StatusMethodNotAllowed, fmt.Sprintf("expect method POST at /import, got %v", r.Method), true)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+
+	var body io.Reader = r.Body
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		if err := r.ParseMultipartForm(maxImportSize); err != nil {
+			writeJSONMessage(w, http.StatusBadRequest, "Parse params error", true)
+			return
+		}
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			writeJSONMessage(w, http.StatusBadRequest, "Missing file", true)
+			return
+		}
+		defer file.Close()
+		body = file
+	} else if err := r.ParseForm(); err != nil {
+		writeJSONMessage(w, http.StatusBadRequest, "Parse params error", true)
+		return
+	}
+
+	userID, status, err := resolveUserID(r, r.Form.Get("user_id"))
+	if err != nil {
+		writeJSONMessage(w, status, err.Error(), true)
+		return
+	}
+
+	entries, err := decodeCalendar(body)
+	if err != nil {
+		writeJSONMessage(w, http.StatusBadRequest, fmt.Sprintf("Bad calendar: %s", err), true)
+		return
+	}
+
+	imported := 0
+	failures := make([]importFailure, 0)
+	for _, entry := range entries {
+		if entry.Err == nil {
+			entry.Event.UserID = userID
+			_, entry.Err = h.service.SaveEvent(entry.Event)
+		}
+		if entry.Err != nil {
+			failures = append(failures, importFailure{Entry: entry.Index, UID: entry.UID, Message: entry.Err.Error()})
+			continue
+		}
+		imported++
+	}
+
+	status = http.StatusOK
+	if imported == 0 && len(failures) > 0 {
+		status = http.StatusBadRequest
+	}
+	writeJSONImport(w, status, fmt.Sprintf("Imported %d of %d events", imported, len(entries)), failures)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestICalRoundTrip(t *testing.T) {
+	series := newEvent(1, "standup; daily, short", day(2021, 12, 6))
+	series.ID = 1
+	series.Recurrence = &Recurrence{Freq: FreqWeekly, Count: 10, ByWeekday: []time.Weekday{time.Monday, time.Wednesday}}
+	series, err := deleteOccurrence(series, day(2021, 12, 8))
+	assert.Nil(t, err)
+	series, err = changeOccurrence(series, day(2021, 12, 13), EventChange{Text: "moved", Date: day(2021, 12, 14)})
+	assert.Nil(t, err)
+
+	single := newEvent(1, strings.Repeat("длинный текст ", 10), day(2021, 12, 24))
+	single.ID = 2
+
+	var buf bytes.Buffer
+	assert.Nil(t, encodeCalendar(&buf, []Event{series, single}, fixedNow))
+
+	for _, line := range strings.Split(buf.String(), "\r\n") {
+		assert.LessOrEqual(t, len(line), icalMaxLine+1)
+	}
+
+	entries, err := decodeCalendar(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, len(entries), 2)
+
+	got := entries[0].Event
+	assert.Nil(t, entries[0].Err)
+	assert.Equal(t, got.Text, series.Text)
+	assert.Equal(t, got.Recurrence, series.Recurrence)
+	assert.Equal(t, len(got.Exceptions), 2)
+
+	result := expand(got, day(2021, 12, 6), day(2021, 12, 19))
+	assert.Equal(t, occurrenceDays(result), map[int]bool{6: true, 14: true, 15: true})
+
+	assert.Nil(t, entries[1].Err)
+	assert.Equal(t, entries[1].Event.Text, single.Text)
+	assert.True(t, time.Time(entries[1].Event.Date).Equal(day(2021, 12, 24)))
+}
+
+func TestICalDecodeFailures(t *testing.T) {
+	ics := strings.Join([]string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"BEGIN:VEVENT",
+		"UID:a",
+		"SUMMARY:no start",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:b",
+		"DTSTART;TZID=Europe/Moscow:20211206T100000",
+		"RRULE:FREQ=HOURLY",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:c",
+		"DTSTART:20211206T070000Z",
+		"SUMMARY:ok",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:d",
+		"RECURRENCE-ID:20211206",
+		"DTSTART:20211207",
+		"END:VEVENT",
+		"END:VCALENDAR",
+	}, "\r\n")
+
+	entries, err := decodeCalendar(strings.NewReader(ics))
+	assert.Nil(t, err)
+	assert.Equal(t, len(entries), 4)
+	assert.NotNil(t, entries[0].Err)
+	assert.NotNil(t, entries[1].Err)
+	assert.Nil(t, entries[2].Err)
+	assert.Equal(t, entries[2].Event.Text, "ok")
+	assert.NotNil(t, entries[3].Err)
+
+	_, err = decodeCalendar(strings.NewReader("BEGIN:VEVENT\r\nEND:VEVENT"))
+	assert.NotNil(t, err)
+}
+
+func TestICalTimeZones(t *testing.T) {
+	moscow, err := loadLocation("Europe/Moscow")
+	assert.Nil(t, err)
+
+	start := time.Date(2021, 12, 6, 14, 0, 0, 0, moscow)
+	event := Event{ID: 1, UserID: 1, Text: "meeting", Date: JSONTime(start), End: JSONTime(start.Add(time.Hour)),
+		TimeZone: "Europe/Moscow"}
+
+	var buf bytes.Buffer
+	assert.Nil(t, encodeCalendar(&buf, []Event{event}, fixedNow))
+	assert.Contains(t, buf.String(), "DTSTART;TZID=Europe/Moscow:20211206T140000\r\n")
+
+	entries, err := decodeCalendar(&buf)
+	assert.Nil(t, err)
+	got := entries[0].Event
+	assert.Equal(t, got.TimeZone, "Europe/Moscow")
+	assert.True(t, time.Time(got.Date).Equal(start))
+	assert.Equal(t, got.duration(), time.Hour)
+
+	duration, err := parseICalDuration("PT1H30M")
+	assert.Nil(t, err)
+	assert.Equal(t, duration, 90*time.Minute)
+
+	duration, err = parseICalDuration("P1W")
+	assert.Nil(t, err)
+	assert.Equal(t, duration, 7*24*time.Hour)
+
+	_, err = parseICalDuration("P1H")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	//idempotencyHeader заголовок с ключом идемпотентности
+	idempotencyHeader = "Idempotency-Key"
+	//maxIdempotencyKeyLength максимальная длина ключа
+	maxIdempotencyKeyLength = 255
+	//maxIdempotentBody максимальный размер тела запроса с ключом: тело целиком входит в отпечаток
+	maxIdempotentBody = 1 << 20 //1 MB
+	//defaultIdempotencyTTL сколько по умолчанию хранится ответ на запрос с ключом
+	defaultIdempotencyTTL = 24 * time.Hour
+)
+
+//Ошибки повторного использования ключа
+var (
+	ErrIdempotencyMismatch   = errors.New("Idempotency-Key was used with a different request")
+	ErrIdempotencyInProgress = errors.New("request with this Idempotency-Key is in progress")
+)
+
+//replayedHeaders заголовки исходного ответа, которые повторяются при повторе запроса
+var replayedHeaders = []string{"Content-Type", "Location", "ETag"}
+
+//idempotencyEntry запрос с ключом: отпечаток и, после завершения, ответ на него
+type idempotencyEntry struct {
+	fingerprint string
+	done        bool
+	status      int
+	header      http.Header
+	body        []byte
+	expires     time.Time
+}
+
+//IdempotencyStore хранит ответы на запросы с Idempotency-Key в течение ttl.
+//Ответы держатся в памяти: после перезапуска повтор запроса выполнится заново.
+type IdempotencyStore struct {
+	mutex     sync.Mutex
+	ttl       time.Duration
+	entries   map[string]*idempotencyEntry
+	now       func() time.Time
+	nextSweep time.Time
+}
+
+//NewIdempotencyStore конструктор для IdempotencyStore (ttl <= 0 - defaultIdempotencyTTL)
+func NewIdempotencyStore(ttl time.Duration) *IdempotencyStore {
+	if ttl <= 0 {
+		ttl = defaultIdempotencyTTL
+	}
+	return &IdempotencyStore{ttl: ttl, entries: make(map[string]*idempotencyEntry), now: time.Now}
+}
+
+//SetTTL меняет время хранения ответов на лету (ttl <= 0 - defaultIdempotencyTTL).
+//Уже сохраненные ответы хранятся до прежнего срока.
+func (s *IdempotencyStore) SetTTL(ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = defaultIdempotencyTTL
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.ttl = ttl
+}
+
+//begin регистрирует запрос с ключом.
+//Возвращает: завершенную запись, если на запрос уже ответили (ответ нужно повторить),
+//nil, если запрос нужно выполнить, и ошибку, если ключ занят другим или выполняющимся запросом.
+func (s *IdempotencyStore) begin(key string, fingerprint string) (*idempotencyEntry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+
+	entry, ok := s.entries[key]
+	if ok && now.Before(entry.expires) {
+		if entry.fingerprint != fingerprint {
+			return nil, ErrIdempotencyMismatch
+		}
+		if !entry.done {
+			return nil, ErrIdempotencyInProgress
+		}
+		return entry, nil
+	}
+
+	s.entries[key] = &idempotencyEntry{fingerprint: fingerprint, expires: now.Add(s.ttl)}
+	return nil, nil
+}
+
+//finish сохраняет ответ на запрос с ключом
+func (s *IdempotencyStore) finish(key string, status int, header http.Header, body []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry, ok := s.entries[key]
+	if !ok {
+		return
+	}
+	entry.done = true
+	entry.status = status
+	entry.header = make(http.Header)
+	for _, name := range replayedHeaders {
+		if v := header.Get(name); v != "" {
+			entry.header.Set(name, v)
+		}
+	}
+	entry.body = body
+	entry.expires = s.now().Add(s.ttl)
+}
+
+//abort освобождает ключ запроса, на который не удалось ответить, чтобы повтор выполнился заново
+func (s *IdempotencyStore) abort(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.entries, key)
+}
+
+//sweep удаляет просроченные записи не чаще раза в минуту. Вызывается под s.mutex.
+func (s *IdempotencyStore) sweep(now time.Time) {
+	if now.Before(s.nextSweep) {
+		return
+	}
+	for key, entry := range s.entries {
+		if !now.Before(entry.expires) {
+			delete(s.entries, key)
+		}
+	}
+	s.nextSweep = now.Add(time.Minute)
+}
+
+//validIdempotencyKey проверяет ключ: непустой, не длиннее maxIdempotencyKeyLength, печатный ASCII
+func validIdempotencyKey(key string) bool {
+	if key == "" || len(key) > maxIdempotencyKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < ' ' || key[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+//requestFingerprint отпечаток запроса: метод, путь, параметры, тип и тело
+func requestFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n%s\n", r.Method, r.URL.Path, r.URL.RawQuery, r.Header.Get("Content-Type"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+//captureWriter пишет ответ клиенту и сохраняет копию для повторов
+type captureWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+//WriteHeader запоминает статус код
+func (cw *captureWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+//Write пишет тело ответа и его копию
+func (cw *captureWriter) Write(data []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	cw.body.Write(data)
+	return cw.ResponseWriter.Write(data)
+}
+
+//Unwrap открывает исходный http.ResponseWriter для http.ResponseController
+func (cw *captureWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+//Idempotent middleware ключей идемпотентности для POST запросов, создающих события.
+//Запрос с заголовком Idempotency-Key выполняется один раз: повтор с тем же ключом
+//и тем же запросом в течение ttl получает сохраненный ответ (с заголовком Idempotent-Replayed),
+//тот же ключ с другим запросом - 422, пока первый запрос выполняется - 409.
+//Ключи разделены между клиентами и путями. Ответы 5xx не сохраняются, такой запрос можно повторить.
+func Idempotent(store *IdempotencyStore, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyHeader)
+		if store == nil || key == "" || r.Method != http.MethodPost {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !validIdempotencyKey(key) {
+			writeJSONMessage(w, http.StatusBadRequest, "Bad Idempotency-Key", true)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBody))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeJSONMessage(w, http.StatusRequestEntityTooLarge, "Request body is too large", true)
+				return
+			}
+			writeJSONMessage(w, http.StatusBadRequest, "Can't read request body", true)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		scope := r.URL.Path + " " + key
+		if p, ok := principalFrom(r.Context()); ok {
+			scope = p.Name + "/" + strconv.Itoa(p.UserID) + " " + scope
+		}
+
+		entry, err := store.begin(scope, requestFingerprint(r, body))
+		switch {
+		case errors.Is(err, ErrIdempotencyMismatch):
+			writeJSONMessage(w, http.StatusUnprocessableEntity, err.Error(), true)
+			return
+		case err != nil:
+			writeJSONMessage(w, http.StatusConflict, err.Error(), true)
+			return
+		case entry != nil:
+			for name, values := range entry.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(entry.status)
+			w.Write(entry.body)
+			return
+		}
+
+		cw := &captureWriter{ResponseWriter: w}
+		finished := false
+		//если обработчик упал, ключ освобождается
+		defer func() {
+			if !finished {
+				store.abort(scope)
+			}
+		}()
+
+		next.ServeHTTP(cw, r)
+
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+		if cw.status >= http.StatusInternalServerError {
+			store.abort(scope)
+		} else {
+			store.finish(scope, cw.status, w.Header(), cw.body.Bytes())
+		}
+		finished = true
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//postForm отправляет форму на /create_event с ключом идемпотентности
+func postForm(handler http.Handler, body string, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/create_event", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(idempotencyHeader, key)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCreateEventIdempotent(t *testing.T) {
+	service, store := newTestService()
+	handler := NewHandler(service).initRouts()
+
+	first := postForm(handler, "user_id=1&date=15-12-2021&text=standup", "retry-1")
+	assert.Equal(t, first.Code, http.StatusOK)
+
+	retry := postForm(handler, "user_id=1&date=15-12-2021&text=standup", "retry-1")
+	assert.Equal(t, retry.Code, http.StatusOK)
+	assert.Equal(t, retry.Body.String(), first.Body.String())
+	assert.Equal(t, retry.Header().Get("Idempotent-Replayed"), "true")
+	assert.Equal(t, store.Len(), 1)
+
+	//тот же ключ с другим запросом
+	reused := postForm(handler, "user_id=1&date=16-12-2021&text=standup", "retry-1")
+	assert.Equal(t, reused.Code, http.StatusUnprocessableEntity)
+
+	//другой ключ - новое событие
+	postForm(handler, "user_id=1&date=15-12-2021&text=standup", "retry-2")
+	assert.Equal(t, store.Len(), 2)
+
+	//ответ с ошибкой входных данных тоже повторяется
+	bad := postForm(handler, "user_id=1&text=no-date", "retry-3")
+	assert.Equal(t, bad.Code, http.StatusBadRequest)
+	assert.Equal(t, postForm(handler, "user_id=1&text=no-date", "retry-3").Header().Get("Idempotent-Replayed"), "true")
+}
+
+func TestAPICreateIdempotent(t *testing.T) {
+	service, store := newTestService()
+	handler := NewHandler(service).initRouts()
+
+	post := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/events", strings.NewReader(`{"UserID":1,"Text":"a","Date":"2021-12-15T10:00:00Z"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(idempotencyHeader, "api-1")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	first, retry := post(), post()
+	assert.Equal(t, retry.Code, http.StatusCreated)
+	assert.Equal(t, retry.Header().Get("Location"), first.Header().Get("Location"))
+	assert.Equal(t, retry.Header().Get("ETag"), first.Header().Get("ETag"))
+	assert.Equal(t, store.Len(), 1)
+}
+
+func TestIdempotencyStore(t *testing.T) {
+	store := NewIdempotencyStore(time.Hour)
+	now := time.Date(2021, 12, 15, 10, 0, 0, 0, time.UTC)
+	store.now = func() time.Time { return now }
+
+	entry, err := store.begin("k", "a")
+	assert.Nil(t, entry)
+	assert.Nil(t, err)
+
+	_, err = store.begin("k", "a")
+	assert.Equal(t, err, ErrIdempotencyInProgress)
+
+	store.finish("k", http.StatusOK, http.Header{"Content-Type": {"application/json"}, "X-Request-Id": {"1"}}, []byte("{}"))
+	entry, err = store.begin("k", "a")
+	assert.Nil(t, err)
+	assert.Equal(t, entry.status, http.StatusOK)
+	assert.Equal(t, entry.header.Get("X-Request-Id"), "")
+
+	//по истечении ttl ключ можно использовать заново
+	now = now.Add(2 * time.Hour)
+	entry, err = store.begin("k", "b")
+	assert.Nil(t, entry)
+	assert.Nil(t, err)
+
+	store.abort("k")
+	entry, err = store.begin("k", "c")
+	assert.Nil(t, entry)
+	assert.Nil(t, err)
+}
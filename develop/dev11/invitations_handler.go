@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+//parseAttendees разбирает параметр attendees - id приглашаемых пользователей через запятую
+//(параметр можно повторять). Возвращает: id без повторов в порядке перечисления и флаг корректности.
+func parseAttendees(form url.Values) ([]int, bool) {
+	seen := make(map[int]bool)
+	ids := make([]int, 0)
+	for _, str := range strings.Split(strings.Join(form["attendees"], ","), ",") {
+		if str = strings.TrimSpace(str); str == "" {
+			continue
+		}
+		id, ok := parseUserID(str)
+		if !ok {
+			return nil, false
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids, len(ids) > 0
+}
+
+//invite обработчик для POST /invite.
+//Параметры: user_id организатора, id события и attendees - id приглашаемых пользователей.
+func (h *Handler) invite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONMessage(w, http.StatusMethodNotAllowed, fmt.Sprintf("expect method POST at /invite, got %v", r.Method), true)
+		return
+	}
+
+	if status, err := parseForm(w, r); err != nil {
+		writeJSONMessage(w, status, err.Error(), true)
+		return
+	}
+
+	userID, status, err := resolveUserID(r, r.Form.Get("user_id"))
+	if err != nil {
+		writeJSONMessage(w, status, err.Error(), true)
+		return
+	}
+
+	id, err := strconv.Atoi(r.Form.Get("id"))
+	if id <= 0 || err != nil {
+		writeJSONMessage(w, http.StatusBadRequest, "Bad id", true)
+		return
+	}
+
+	attendees, ok := parseAttendees(r.Form)
+	if !ok {
+		writeJSONMessage(w, http.StatusBadRequest, "Bad attendees", true)
+		return
+	}
+
+	invited, isExists, err := h.service.Invite(userID, id, attendees)
+
+	if err != nil {
+		writeJSONMessage(w, invitationErrorStatus(err), fmt.Sprintf("Can't invite: %s", err), true)
+		return
+	}
+
+	if !isExists {
+		writeJSONMessage(w, http.StatusNotFound, fmt.Sprintf("Event with id %d doesn't exists", id), true)
+		return
+	}
+
+	w.Header().Set("ETag", eventETag(invited))
+	writeJSONMessage(w, http.StatusOK, "Attendees invited", false)
+}
+
+//respond обработчик для POST /respond.
+//Параметры: user_id участника, id события и status - accepted, declined или tentative.
+func (h *Handler) respond(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONMessage(w, http.StatusMethodNotAllowed, fmt.Sprintf("expect method POST at /respond, got %v", r.Method), true)
+		return
+	}
+
+	if status, err := parseForm(w, r); err != nil {
+		writeJSONMessage(w, status, err.Error(), true)
+		return
+	}
+
+	userID, status, err := resolveUserID(r, r.Form.Get("user_id"))
+	if err != nil {
+		writeJSONMessage(w, status, err.Error(), true)
+		return
+	}
+
+	id, err := strconv.Atoi(r.Form.Get("id"))
+	if id <= 0 || err != nil {
+		writeJSONMessage(w, http.StatusBadRequest, "Bad id", true)
+		return
+	}
+
+	response, err := parseResponse(r.Form.Get("status"))
+	if err != nil {
+		writeJSONMessage(w, http.StatusBadRequest, fmt.Sprintf("Bad status: %s", err), true)
+		return
+	}
+
+	_, isExists, err := h.service.Respond(userID, id, response)
+
+	if err != nil {
+		writeJSONMessage(w, invitationErrorStatus(err), fmt.Sprintf("Can't respond: %s", err), true)
+		return
+	}
+
+	if !isExists {
+		writeJSONMessage(w, http.StatusNotFound, fmt.Sprintf("Event with id %d doesn't exists", id), true)
+		return
+	}
+
+	writeJSONMessage(w, http.StatusOK, "Response saved", false)
+}
+
+//invitationErrorStatus выбирает статус ответа на ошибку приглашения:
+//400 для приглашения организатора и ответа неприглашенного, иначе 503
+func invitationErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrInviteOrganizer), errors.Is(err, ErrNotInvited):
+		return http.StatusBadRequest
+	}
+	return http.StatusServiceUnavailable
+}
+
+//invitations обработчик для GET /invitations: приглашения пользователя user_id без ответа
+func (h *Handler) invitations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONMessage(w, http.StatusMethodNotAllowed, fmt.Sprintf("expect method Get at /invitations, got %v", r.Method), true)
+		return
+	}
+
+	query := r.URL.Query()
+
+	userID, status, err := resolveUserID(r, query.Get("user_id"))
+	if err != nil {
+		writeJSONMessage(w, status, err.Error(), true)
+		return
+	}
+
+	limit, cursor, err := parsePage(query)
+	if err != nil {
+		writeJSONMessage(w, http.StatusBadRequest, err.Error(), true)
+		return
+	}
+
+	result, err := h.service.Invitations(userID)
+
+	if err != nil {
+		writeJSONMessage(w, http.StatusServiceUnavailable, fmt.Sprintf("Can't get invitations: %s", err), true)
+		return
+	}
+
+	writeJSONEvents(w, http.StatusOK, paginate(result, limit, cursor))
+}
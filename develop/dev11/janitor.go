@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+//Janitor фоновая уборка хранилища.
+//Каждый interval безвозвратно удаляет из корзины события, пролежавшие в ней дольше trash (0 - хранить всегда),
+//из журнала аудита - записи старше audit (0 - хранить всегда), и, если archiveAfter больше 0, переносит в файл archivePath события, закончившиеся раньше чем archiveAfter назад.
+//Событие удаляется из хранилища только после того, как дописано в архив, и только если не изменилось
+//за это время; иначе оно остается в хранилище и попадет в архив повторно следующим проходом.
+type Janitor struct {
+	service      *Service
+	interval     time.Duration
+	trash        time.Duration
+	audit        time.Duration
+	archiveAfter time.Duration
+	archivePath  string
+	now          func() time.Time
+	cancel       context.CancelFunc
+	done         chan struct{}
+}
+
+//NewJanitor конструктор для Janitor.
+//Принимает: сервис и настройки уборки из конфига.
+//Возвращает: ссылку на Janitor и ошибку настроек.
+func NewJanitor(service *Service, cfg RetentionConfig) (*Janitor, error) {
+	if cfg.Interval <= 0 {
+		return nil, errors.New("retention interval must be positive")
+	}
+	if cfg.ArchiveAfter > 0 {
+		if cfg.Archive == "" {
+			return nil, errors.New("retention archive path is required to archive events")
+		}
+		if err := os.MkdirAll(filepath.Dir(cfg.Archive), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &Janitor{
+		service:      service,
+		interval:     cfg.Interval,
+		trash:        cfg.Trash,
+		audit:        cfg.Audit,
+		archiveAfter: cfg.ArchiveAfter,
+		archivePath:  cfg.Archive,
+		now:          time.Now,
+	}, nil
+}
+
+//Start запускает уборку в отдельной горутине
+func (j *Janitor) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	j.cancel = cancel
+	j.done = make(chan struct{})
+
+	go func() {
+		defer close(j.done)
+		ticker := time.NewTicker(j.interval)
+		defer ticker.Stop()
+
+		for {
+			if err := j.Sweep(); err != nil {
+				log.Printf("retention: %s", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+//Stop останавливает уборку и дожидается завершения текущего прохода
+func (j *Janitor) Stop() {
+	if j.cancel == nil {
+		return
+	}
+	j.cancel()
+	<-j.done
+}
+
+//Sweep выполняет один проход уборки: очищает корзину и журнал аудита от того, что старше
+//их сроков хранения, и переносит закончившиеся события в архив. Ошибка очистки не мешает архивации.
+func (j *Janitor) Sweep() error {
+	now := j.now()
+
+	var purgeErr error
+	if j.trash > 0 {
+		purged, err := j.service.PurgeTrash(now.Add(-j.trash))
+		if err != nil {
+			purgeErr = err
+		} else if purged > 0 {
+			log.Printf("retention: purged %d events from trash", purged)
+		}
+	}
+	if j.audit > 0 {
+		pruned, err := j.service.PruneAudit(now.Add(-j.audit))
+		if err != nil {
+			if purgeErr == nil {
+				purgeErr = err
+			}
+		} else if pruned > 0 {
+			log.Printf("retention: pruned %d audit entries", pruned)
+		}
+	}
+
+	if j.archiveAfter > 0 {
+		archived, err := j.service.ArchiveEnded(now.Add(-j.archiveAfter), j.writeArchive)
+		if err != nil {
+			return err
+		}
+		if len(archived) > 0 {
+			log.Printf("retention: archived %d events to %s", len(archived), j.archivePath)
+		}
+	}
+	return purgeErr
+}
+
+//writeArchive дописывает события JSON строками в файл архива одной записью с одним fsync.
+//Вызывается без блокировки хранилища; проходы уборки идут по одному, так что записи в файл не пересекаются.
+func (j *Janitor) writeArchive(events []Event) error {
+	var data bytes.Buffer
+	encoder := json.NewEncoder(&data)
+	for _, event := range events {
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(j.archivePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+//PurgeTrash безвозвратно удаляет из корзины события, удаленные раньше before.
+//Возвращает число удаленных событий.
+func (s *Service) PurgeTrash(before time.Time) (int, error) {
+	return s.storage.purgeTrash(before)
+}
+
+//PruneAudit удаляет из журнала аудита записи, сделанные раньше before.
+//Возвращает число удаленных записей.
+func (s *Service) PruneAudit(before time.Time) (int, error) {
+	return s.audit.Prune(before)
+}
+
+//ArchiveEnded переносит события, закончившиеся раньше before, в архив через save.
+//Хранилище не блокируется, пока работает save: события выбираются, записываются в архив
+//и затем удаляются из хранилища, если не изменились с выборки.
+//Журнал аудита получает перенос от имени системы (Actor 0).
+//Возвращает удаленные из хранилища события.
+func (s *Service) ArchiveEnded(before time.Time, save func(events []Event) error) ([]Event, error) {
+	events, err := s.storage.getEnded(before)
+	if err != nil || len(events) == 0 {
+		return nil, err
+	}
+	if err := save(events); err != nil {
+		return nil, err
+	}
+	return s.storage.expunge(events, Author{Action: ChangeArchived})
+}
@@ -2,10 +2,16 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -48,28 +54,237 @@ Web-сервер должен запускаться на порту указа
 конфиге и выводить в лог каждый обработанный запрос.
 */
 
-//инициализируем конфиг
-func init() {
-	viper.AddConfigPath(".")
-	viper.SetConfigName("config")
-	if err := viper.ReadInConfig(); err != nil {
-		log.Fatal(err)
+//loadConfig читает config.yaml и переменные окружения DEV11_*
+func loadConfig() (*viper.Viper, Config, error) {
+	v := newConfigViper()
+	if err := readConfig(v); err != nil {
+		return nil, Config{}, err
+	}
+	cfg, err := decodeConfig(v)
+	if err != nil {
+		return nil, Config{}, err
+	}
+	return v, cfg, nil
+}
+
+//newStorage создает хранилище событий, выбранное в конфиге (storage.type)
+func newStorage(cfg StorageConfig) (Storage, error) {
+	switch cfg.Type {
+	case "", "memory":
+		return NewEventStore(), nil
+	case "file":
+		return NewFileStore(cfg.Path, cfg.SnapshotEvery)
+	default:
+		return nil, fmt.Errorf("unknown storage type %q", cfg.Type)
 	}
 }
 
+//sinkConfig описание приемника напоминаний в конфиге
+type sinkConfig struct {
+	Type string
+	URL  string
+	Path string
+}
+
+//buildSinks создает приемники напоминаний по описаниям из конфига
+func buildSinks(configs []sinkConfig) ([]Sink, error) {
+	sinks := make([]Sink, 0, len(configs))
+	for _, c := range configs {
+		switch c.Type {
+		case "log":
+			sinks = append(sinks, LogSink{})
+		case "webhook":
+			if c.URL == "" {
+				return nil, errors.New("webhook sink requires url")
+			}
+			sinks = append(sinks, NewWebhookSink(c.URL))
+		case "file":
+			if c.Path == "" {
+				return nil, errors.New("file sink requires path")
+			}
+			sinks = append(sinks, NewFileSink(c.Path))
+		default:
+			return nil, fmt.Errorf("unknown reminder sink type %q", c.Type)
+		}
+	}
+	return sinks, nil
+}
+
+//buildOutboxes создает ящики исходящих сообщений iTIP по описаниям из конфига
+func buildOutboxes(configs []sinkConfig) ([]Outbox, error) {
+	outboxes := make([]Outbox, 0, len(configs))
+	for _, c := range configs {
+		switch c.Type {
+		case "log":
+			outboxes = append(outboxes, LogOutbox{})
+		case "webhook":
+			if c.URL == "" {
+				return nil, errors.New("webhook outbox requires url")
+			}
+			outboxes = append(outboxes, NewWebhookOutbox(c.URL))
+		case "file":
+			if c.Path == "" {
+				return nil, errors.New("file outbox requires path")
+			}
+			outboxes = append(outboxes, NewFileOutbox(c.Path))
+		default:
+			return nil, fmt.Errorf("unknown outbox type %q", c.Type)
+		}
+	}
+	return outboxes, nil
+}
+
+func newScheduler(storage Storage, cfg RemindersConfig) (*Scheduler, error) {
+	sinks, err := buildSinks(cfg.Sinks)
+	if err != nil {
+		return nil, err
+	}
+	return NewScheduler(storage, sinks, cfg.Interval, cfg.Lookback, cfg.State)
+}
+
+func newAuthenticator(cfg AuthConfig) (*Authenticator, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	return NewAuthenticator(cfg.Keys, cfg.TokenSecret)
+}
+
+//issueToken выпускает bearer токен: dev11 token -user 1 -role editor -ttl 24h
+func issueToken(args []string) error {
+	flags := flag.NewFlagSet("token", flag.ExitOnError)
+	userID := flags.Int("user", 0, "user id")
+	roleStr := flags.String("role", string(RoleReader), "reader | editor | admin")
+	name := flags.String("name", "", "token subject")
+	ttl := flags.Duration("ttl", 24*time.Hour, "token lifetime")
+	flags.Parse(args)
+
+	role, err := parseRole(*roleStr)
+	if err != nil {
+		return err
+	}
+	_, cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	auth, err := NewAuthenticator(nil, cfg.Auth.TokenSecret)
+	if err != nil {
+		return err
+	}
+	token, err := auth.IssueToken(Principal{Name: *name, UserID: *userID, Role: role}, *ttl)
+	if err != nil {
+		return err
+	}
+	fmt.Println(token)
+	return nil
+}
+
 func main() {
-	port := viper.GetString("port")
+	if len(os.Args) > 1 && os.Args[1] == "token" {
+		if err := issueToken(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	server := NewServer()
-	storage := NewEventStore()
+	v, cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	logLevel := new(slog.LevelVar)
+	logger := slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+	slog.SetDefault(logger)
+
+	server := NewServer(cfg.Server)
+	storage, err := newStorage(cfg.Storage)
+	if err != nil {
+		log.Fatal(err)
+	}
 	service := NewService(storage)
+	outboxes, err := buildOutboxes(cfg.Invitations.Outbox)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if service.outbox, err = NewOutboxQueue(outboxes, cfg.Invitations.Queue); err != nil {
+		log.Fatal(err)
+	}
+	if service.calendars, err = NewCalendarStore(cfg.Calendars.Path); err != nil {
+		log.Fatal(err)
+	}
+	if service.audit, err = NewAuditLog(cfg.Audit.Path); err != nil {
+		log.Fatal(err)
+	}
 	handler := NewHandler(service)
+	handler.logger = logger
+	if handler.auth, err = newAuthenticator(cfg.Auth); err != nil {
+		log.Fatal(err)
+	}
+	handler.limiter = NewRateLimiter(cfg.RateLimit.rateLimits())
+	handler.cors = NewCORSPolicy(cfg.CORS.Origins)
+
+	settings := &RuntimeConfig{
+		current:     cfg,
+		logLevel:    logLevel,
+		cors:        handler.cors,
+		service:     service,
+		limiter:     handler.limiter,
+		idempotency: handler.idempotency,
+	}
+	settings.Apply(cfg)
+	watchConfig(v, settings, logger)
+
+	scheduler, err := newScheduler(storage, cfg.Reminders)
+	if err != nil {
+		log.Fatal(err)
+	}
+	janitor, err := NewJanitor(service, cfg.Retention)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if pinger, ok := storage.(Pinger); ok {
+		handler.health.AddCheck("storage", pinger.Ping)
+	}
 
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 
-	go server.Run(port, handler.initRouts())
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.Run(cfg.Port, handler.initRouts())
+	}()
+	scheduler.Start()
+	janitor.Start()
+	service.outbox.Start()
+
+	exitCode := 0
+	select {
+	case sig := <-done:
+		logger.Info("shutting down", "signal", sig.String())
+		//балансировщик видит неготовность и перестает слать запросы, пока порт еще открыт
+		handler.health.SetDraining()
+		time.Sleep(cfg.Server.DrainDelay)
+	case err := <-serverErr:
+		logger.Error("server failed", "error", err.Error())
+		exitCode = 1
+	}
 
-	<-done
-	server.Shutdown(context.Background())
+	service.CloseFeed()
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Error("shutdown timed out, connections closed", "error", err.Error())
+		exitCode = 1
+	}
+	cancel()
+	scheduler.Stop()
+	janitor.Stop()
+	service.outbox.Stop()
+
+	if closer, ok := storage.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			logger.Error("storage close failed", "error", err.Error())
+			exitCode = 1
+		}
+	}
+	os.Exit(exitCode)
 }
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//metricsPath end-point метрик
+const metricsPath = "/metrics"
+
+//latencyBuckets верхние границы корзин гистограммы длительности запросов, в секундах
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+//knownMethods методы, которые попадают в метки как есть; остальные считаются как OTHER,
+//чтобы клиент не мог раздуть число рядов
+var knownMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodPut: true,
+	http.MethodPatch: true, http.MethodDelete: true, http.MethodOptions: true,
+}
+
+//requestKey ряд счетчика запросов
+type requestKey struct {
+	route  string
+	method string
+	code   int
+}
+
+//histogram гистограмма длительностей: counts[i] - запросы не дольше latencyBuckets[i]
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+//observe добавляет длительность в гистограмму
+func (h *histogram) observe(seconds float64) {
+	for i, le := range latencyBuckets {
+		if seconds <= le {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+//gauge показатель, значение которого берется в момент чтения метрик
+type gauge struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+//Metrics метрики сервиса в текстовом формате Prometheus:
+//счетчик запросов по маршруту, методу и статусу, гистограмма длительности по маршруту
+//и показатели, зарегистрированные через Gauge
+type Metrics struct {
+	mutex     sync.Mutex
+	requests  map[requestKey]uint64
+	durations map[string]*histogram
+	gauges    []gauge
+}
+
+//NewMetrics конструктор для Metrics
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests:  make(map[requestKey]uint64),
+		durations: make(map[string]*histogram),
+	}
+}
+
+//Gauge регистрирует показатель, вычисляемый при каждом чтении метрик
+func (m *Metrics) Gauge(name string, help string, value func() float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.gauges = append(m.gauges, gauge{name: name, help: help, value: value})
+}
+
+//Observe учитывает завершенный запрос
+func (m *Metrics) Observe(route string, method string, code int, duration time.Duration) {
+	if !knownMethods[method] {
+		method = "OTHER"
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.requests[requestKey{route: route, method: method, code: code}]++
+	h, ok := m.durations[route]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.durations[route] = h
+	}
+	h.observe(duration.Seconds())
+}
+
+//Instrument middleware метрик. Маршрут берется из шаблона mux, под которым
+//зарегистрирован обработчик (например /api/v1/events/), а не из пути запроса,
+//поэтому id в пути не плодят новые ряды.
+func (m *Metrics) Instrument(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := recorderFor(w)
+		next.ServeHTTP(rec, r)
+
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+		m.Observe(route, r.Method, rec.Status(), time.Since(start))
+	})
+}
+
+//ServeHTTP отдает метрики для GET /metrics
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONMessage(w, http.StatusMethodNotAllowed, fmt.Sprintf("expect method GET at %s, got %v", metricsPath, r.Method), true)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+//WriteTo записывает метрики в текстовом формате Prometheus, ряды отсортированы
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mutex.Lock()
+	keys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].code < keys[j].code
+	})
+	routes := make([]string, 0, len(m.durations))
+	for route := range m.durations {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	var b strings.Builder
+	b.WriteString("# HELP dev11_http_requests_total Number of HTTP requests by route, method and status code.\n")
+	b.WriteString("# TYPE dev11_http_requests_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(&b, "dev11_http_requests_total{route=%s,method=%s,code=\"%d\"} %d\n",
+			labelValue(key.route), labelValue(key.method), key.code, m.requests[key])
+	}
+
+	b.WriteString("# HELP dev11_http_request_duration_seconds HTTP request latency by route.\n")
+	b.WriteString("# TYPE dev11_http_request_duration_seconds histogram\n")
+	for _, route := range routes {
+		h := m.durations[route]
+		for i, le := range latencyBuckets {
+			fmt.Fprintf(&b, "dev11_http_request_duration_seconds_bucket{route=%s,le=\"%s\"} %d\n",
+				labelValue(route), strconv.FormatFloat(le, 'g', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(&b, "dev11_http_request_duration_seconds_bucket{route=%s,le=\"+Inf\"} %d\n", labelValue(route), h.count)
+		fmt.Fprintf(&b, "dev11_http_request_duration_seconds_sum{route=%s} %s\n", labelValue(route), strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(&b, "dev11_http_request_duration_seconds_count{route=%s} %d\n", labelValue(route), h.count)
+	}
+	gauges := append([]gauge{}, m.gauges...)
+	m.mutex.Unlock()
+
+	//показатели вычисляются без блокировки метрик: они сами берут блокировки хранилища
+	for _, g := range gauges {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, strconv.FormatFloat(g.value(), 'g', -1, 64))
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+//labelValue экранирует значение метки: обратная косая черта, кавычка и перевод строки
+func labelValue(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestIDAndAccessLog(t *testing.T) {
+	service, _ := newTestService()
+	h := NewHandler(service)
+	var logs bytes.Buffer
+	h.logger = slog.New(slog.NewJSONHandler(&logs, nil))
+	handler := h.initRouts()
+
+	req := httptest.NewRequest(http.MethodGet, "/events_for_day?user_id=1&date=15-12-2021", nil)
+	req.Header.Set(requestIDHeader, "trace-42")
+	req.RemoteAddr = "10.0.0.1:5000"
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, rec.Header().Get(requestIDHeader), "trace-42")
+
+	var entry struct {
+		RequestID  string  `json:"request_id"`
+		Method     string  `json:"method"`
+		Status     int     `json:"status"`
+		Bytes      int64   `json:"bytes"`
+		DurationMS float64 `json:"duration_ms"`
+		RemoteAddr string  `json:"remote_addr"`
+	}
+	assert.Nil(t, json.Unmarshal(logs.Bytes(), &entry))
+	assert.Equal(t, entry.RequestID, "trace-42")
+	assert.Equal(t, entry.Method, http.MethodGet)
+	assert.Equal(t, entry.Status, http.StatusOK)
+	assert.Equal(t, entry.Bytes, int64(rec.Body.Len()))
+	assert.Equal(t, entry.RemoteAddr, "10.0.0.1:5000")
+
+	//id с пробелами не принимается, вместо него генерируется новый
+	req = httptest.NewRequest(http.MethodGet, "/events_for_day?user_id=1", nil)
+	req.Header.Set(requestIDHeader, "bad id")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, len(rec.Header().Get(requestIDHeader)), 32)
+}
+
+func TestMetrics(t *testing.T) {
+	service, _ := newTestService()
+	h := NewHandler(service)
+	h.logger = slog.New(slog.NewJSONHandler(&bytes.Buffer{}, nil))
+	handler := h.initRouts()
+
+	doJSON(t, handler, http.MethodPost, "/api/v1/events", `{"UserID":1,"Text":"a","Date":"2021-12-15T10:00:00Z"}`, nil)
+	doJSON(t, handler, http.MethodGet, "/api/v1/events/1?user_id=1", "", nil)
+	doJSON(t, handler, http.MethodGet, "/api/v1/events/2?user_id=1", "", nil)
+	doJSON(t, handler, "BREW", "/nowhere", "", nil)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, metricsPath, nil))
+	assert.Equal(t, rec.Code, http.StatusOK)
+	body := rec.Body.String()
+
+	assert.True(t, strings.Contains(body, `dev11_http_requests_total{route="/api/v1/events",method="POST",code="201"} 1`))
+	assert.True(t, strings.Contains(body, `dev11_http_requests_total{route="/api/v1/events/",method="GET",code="200"} 1`))
+	assert.True(t, strings.Contains(body, `dev11_http_requests_total{route="/api/v1/events/",method="GET",code="404"} 1`))
+	assert.True(t, strings.Contains(body, `dev11_http_requests_total{route="unmatched",method="OTHER",code="404"} 1`))
+	assert.True(t, strings.Contains(body, `dev11_http_request_duration_seconds_bucket{route="/api/v1/events/",le="+Inf"} 2`))
+	assert.True(t, strings.Contains(body, `dev11_http_request_duration_seconds_count{route="/api/v1/events/"} 2`))
+	assert.True(t, strings.Contains(body, "# TYPE dev11_events_in_store gauge\ndev11_events_in_store 1\n"))
+}
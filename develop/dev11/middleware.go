@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+//requestIDHeader заголовок с id запроса: принимается от клиента или прокси, иначе генерируется
+const requestIDHeader = "X-Request-ID"
+
+//maxRequestIDLength максимальная длина принимаемого id запроса
+const maxRequestIDLength = 128
+
+//statusRecorder запоминает статус код и размер ответа для логов и метрик.
+//Flush и Hijack передаются исходному http.ResponseWriter, так что лента SSE
+//и WebSocket работают через него как раньше.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+//recorderFor оборачивает http.ResponseWriter; уже обернутый возвращает как есть
+func recorderFor(w http.ResponseWriter) *statusRecorder {
+	if rec, ok := w.(*statusRecorder); ok {
+		return rec
+	}
+	return &statusRecorder{ResponseWriter: w}
+}
+
+//WriteHeader запоминает статус код
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+//Write считает байты ответа
+func (rec *statusRecorder) Write(data []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(data)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+//FlushError отправляет буферизованные данные клиенту; ошибка значит, что клиент отключился
+func (rec *statusRecorder) FlushError() error {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return http.NewResponseController(rec.ResponseWriter).Flush()
+}
+
+//Flush то же без ошибки, для обработчиков, использующих http.Flusher
+func (rec *statusRecorder) Flush() {
+	rec.FlushError()
+}
+
+//Hijack забирает соединение; такой запрос логируется со статусом 101
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(rec.ResponseWriter).Hijack()
+	if err == nil && rec.status == 0 {
+		rec.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+//Unwrap открывает исходный http.ResponseWriter для http.ResponseController
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+//Status возвращает записанный статус код (200, если обработчик ничего не записал)
+func (rec *statusRecorder) Status() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
+
+//requestIDKey ключ id запроса в контексте
+type requestIDKey struct{}
+
+//requestIDFrom достает id запроса из контекста
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+//validRequestID проверяет id запроса от клиента: непустой, не длиннее maxRequestIDLength,
+//только печатные ASCII символы без пробелов, чтобы его можно было без экранирования писать в лог
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+//newRequestID генерирует случайный id запроса
+func newRequestID() string {
+	var buf [16]byte
+	rand.Read(buf[:])
+	return hex.EncodeToString(buf[:])
+}
+
+//RequestID middleware id запроса: берет X-Request-ID из запроса или генерирует новый,
+//кладет его в контекст и возвращает клиенту в том же заголовке
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+//Logging middleware журнала запросов: после ответа пишет JSON запись
+//с id запроса, методом, путем, статусом, размером ответа, длительностью и адресом клиента
+func Logging(logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := recorderFor(w)
+		next.ServeHTTP(rec, r)
+
+		logger.LogAttrs(r.Context(), slog.LevelInfo, "request",
+			slog.String("request_id", requestIDFrom(r.Context())),
+			slog.String("method", r.Method),
+			slog.String("uri", r.RequestURI),
+			slog.Int("status", rec.Status()),
+			slog.Int64("bytes", rec.bytes),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("remote_addr", r.RemoteAddr),
+		)
+	})
+}
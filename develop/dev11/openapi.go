@@ -0,0 +1,28 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"net/http"
+)
+
+//openAPIPath путь описания API
+const openAPIPath = "/openapi.json"
+
+//openAPISpec описание API в формате OpenAPI 3.
+//Пути описания сверяются с маршрутами из routes, а ответы обработчиков - со схемами, в openapi_test.go.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+//openAPI обработчик для GET /openapi.json
+func (h *Handler) openAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeJSONMessage(w, http.StatusMethodNotAllowed, fmt.Sprintf("expect method GET at %s, got %v", openAPIPath, r.Method), true)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(openAPISpec)
+}
@@ -0,0 +1,747 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// openAPIDoc разобранное описание API
+type openAPIDoc map[string]interface{}
+
+// loadOpenAPI разбирает встроенное описание API
+func loadOpenAPI(t *testing.T) openAPIDoc {
+	var doc openAPIDoc
+	if err := json.Unmarshal(openAPISpec, &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+// object приводит узел описания к объекту
+func object(node interface{}) map[string]interface{} {
+	m, _ := node.(map[string]interface{})
+	return m
+}
+
+// resolve раскрывает ссылку $ref вида #/components/...
+func (d openAPIDoc) resolve(node map[string]interface{}) map[string]interface{} {
+	for node != nil {
+		ref, ok := node["$ref"].(string)
+		if !ok {
+			return node
+		}
+		var target interface{} = map[string]interface{}(d)
+		for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			target = object(target)[part]
+		}
+		node = object(target)
+	}
+	return nil
+}
+
+// pathItem находит описание пути: точное или по шаблону с параметрами в {}
+func (d openAPIDoc) pathItem(path string) (string, map[string]interface{}) {
+	paths := object(d["paths"])
+	if item, ok := paths[path]; ok {
+		return path, object(item)
+	}
+	parts := strings.Split(path, "/")
+	for template, item := range paths {
+		templateParts := strings.Split(template, "/")
+		if len(templateParts) != len(parts) {
+			continue
+		}
+		matched := true
+		for i, part := range templateParts {
+			if part != parts[i] && !strings.HasPrefix(part, "{") {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return template, object(item)
+		}
+	}
+	return "", nil
+}
+
+// validate проверяет значение JSON по схеме. Поддерживается подмножество JSON Schema,
+// которое использует openapi.json: $ref, oneOf, type, format date-time, enum, required,
+// properties, additionalProperties, items, minimum/maximum, minItems/maxItems.
+// Возвращает: описания несоответствий с путем к значению.
+func (d openAPIDoc) validate(schema map[string]interface{}, value interface{}, at string) []string {
+	schema = d.resolve(schema)
+	if schema == nil {
+		return []string{at + ": unresolved schema"}
+	}
+
+	if variants, ok := schema["oneOf"].([]interface{}); ok {
+		matched := 0
+		for _, variant := range variants {
+			if len(d.validate(object(variant), value, at)) == 0 {
+				matched++
+			}
+		}
+		if matched != 1 {
+			return []string{fmt.Sprintf("%s: matches %d of oneOf schemas", at, matched)}
+		}
+		return nil
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, v := range enum {
+			if v == value {
+				found = true
+			}
+		}
+		if !found {
+			return []string{fmt.Sprintf("%s: %v is not in %v", at, value, enum)}
+		}
+	}
+
+	var errs []string
+	switch schema["type"] {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: expect object, got %T", at, value)}
+		}
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := obj[name.(string)]; !ok {
+				errs = append(errs, fmt.Sprintf("%s: missing required %s", at, name))
+			}
+		}
+		props := object(schema["properties"])
+		for name, v := range obj {
+			if prop, ok := props[name]; ok {
+				errs = append(errs, d.validate(object(prop), v, at+"."+name)...)
+				continue
+			}
+			switch extra := schema["additionalProperties"].(type) {
+			case bool:
+				if !extra {
+					errs = append(errs, fmt.Sprintf("%s: unexpected property %s", at, name))
+				}
+			case map[string]interface{}:
+				errs = append(errs, d.validate(extra, v, at+"."+name)...)
+			}
+		}
+	case "array":
+		arr, ok := value.([]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: expect array, got %T", at, value)}
+		}
+		if min, ok := schema["minItems"].(float64); ok && float64(len(arr)) < min {
+			errs = append(errs, fmt.Sprintf("%s: expect at least %v items", at, min))
+		}
+		if max, ok := schema["maxItems"].(float64); ok && float64(len(arr)) > max {
+			errs = append(errs, fmt.Sprintf("%s: expect at most %v items", at, max))
+		}
+		for i, v := range arr {
+			errs = append(errs, d.validate(object(schema["items"]), v, fmt.Sprintf("%s[%d]", at, i))...)
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return []string{fmt.Sprintf("%s: expect string, got %T", at, value)}
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, str); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: bad date-time %q", at, str))
+			}
+		}
+	case "integer", "number":
+		num, ok := value.(float64)
+		if !ok || (schema["type"] == "integer" && num != math.Trunc(num)) {
+			return []string{fmt.Sprintf("%s: expect %s, got %v", at, schema["type"], value)}
+		}
+		if min, ok := schema["minimum"].(float64); ok && num < min {
+			errs = append(errs, fmt.Sprintf("%s: %v is less than %v", at, num, min))
+		}
+		if max, ok := schema["maximum"].(float64); ok && num > max {
+			errs = append(errs, fmt.Sprintf("%s: %v is greater than %v", at, num, max))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return []string{fmt.Sprintf("%s: expect boolean, got %T", at, value)}
+		}
+	}
+	return errs
+}
+
+// checkResponse сверяет ответ с описанием операции: статус код должен быть описан,
+// тип содержимого - совпадать с описанным, а JSON тело - проходить схему.
+// Запрос к методу, которого нет в описании, должен получить 405 с телом Error.
+func (d openAPIDoc) checkResponse(t *testing.T, method string, path string, status int, header http.Header, body []byte) {
+	t.Helper()
+
+	template, item := d.pathItem(path)
+	if !assert.NotNil(t, item, "path %s is not described", path) {
+		return
+	}
+	var response map[string]interface{}
+	if op := object(item[strings.ToLower(method)]); op != nil {
+		response = d.resolve(object(object(op["responses"])[strconv.Itoa(status)]))
+		if !assert.NotNil(t, response, "%s %s: status %d is not described", method, template, status) {
+			return
+		}
+	} else {
+		assert.Equal(t, status, http.StatusMethodNotAllowed, "%s %s is not described", method, template)
+		response = d.resolve(object(object(object(d["components"])["responses"])["BadRequest"]))
+	}
+
+	content := object(response["content"])
+	if len(content) == 0 {
+		assert.Empty(t, body, "%s %s %d: body is not described", method, template, status)
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	media := object(content[mediaType])
+	if !assert.NotNil(t, media, "%s %s %d: content type %q is not described", method, template, status, mediaType) {
+		return
+	}
+	if mediaType != "application/json" {
+		return
+	}
+
+	var value interface{}
+	if !assert.Nil(t, json.Unmarshal(body, &value), "%s %s %d: bad JSON %s", method, template, status, body) {
+		return
+	}
+	errs := d.validate(object(media["schema"]), value, "body")
+	assert.Empty(t, errs, "%s %s %d: %s", method, template, status, body)
+}
+
+// contractCase запрос контрактного теста и ожидаемый статус ответа
+type contractCase struct {
+	name        string
+	method      string
+	target      string
+	contentType string
+	body        string
+	header      map[string]string
+	status      int
+}
+
+// runContract выполняет запросы по порядку и сверяет ответы с описанием API
+func runContract(t *testing.T, doc openAPIDoc, handler http.Handler, cases []contractCase) {
+	t.Helper()
+
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.target, strings.NewReader(c.body))
+		if c.contentType != "" {
+			req.Header.Set("Content-Type", c.contentType)
+		}
+		for name, value := range c.header {
+			req.Header.Set(name, value)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if !assert.Equal(t, rec.Code, c.status, "%s: %s", c.name, rec.Body.String()) {
+			continue
+		}
+		doc.checkResponse(t, c.method, req.URL.Path, rec.Code, rec.Header(), rec.Body.Bytes())
+	}
+}
+
+const formType = "application/x-www-form-urlencoded"
+
+func TestOpenAPIDocument(t *testing.T) {
+	doc := loadOpenAPI(t)
+	assert.Equal(t, doc["openapi"], "3.0.3")
+
+	//каждый путь описания - маршрут mux, и каждый маршрут описан
+	service, _ := newTestService()
+	var patterns []string
+	for _, rt := range NewHandler(service).routes() {
+		patterns = append(patterns, rt.pattern)
+	}
+	//шаблонный путь обслуживает самый длинный маршрут-поддерево (с / на конце), с которого он начинается;
+	//несколько шаблонов могут приходиться на один маршрут
+	seen := make(map[string]bool)
+	var described []string
+	for path := range object(doc["paths"]) {
+		if i := strings.Index(path, "{"); i >= 0 {
+			prefix, served := path[:i], ""
+			for _, pattern := range patterns {
+				if strings.HasSuffix(pattern, "/") && strings.HasPrefix(prefix, pattern) && len(pattern) > len(served) {
+					served = pattern
+				}
+			}
+			path = prefix
+			if served != "" {
+				path = served
+			}
+		}
+		if !seen[path] {
+			seen[path] = true
+			described = append(described, path)
+		}
+	}
+	sort.Strings(patterns)
+	sort.Strings(described)
+	assert.Equal(t, described, patterns)
+
+	//все ссылки раскрываются
+	var walk func(node interface{}, at string)
+	walk = func(node interface{}, at string) {
+		switch v := node.(type) {
+		case map[string]interface{}:
+			if ref, ok := v["$ref"].(string); ok {
+				assert.NotNil(t, doc.resolve(v), "%s: unresolved %s", at, ref)
+			}
+			for key, child := range v {
+				walk(child, at+"/"+key)
+			}
+		case []interface{}:
+			for i, child := range v {
+				walk(child, fmt.Sprintf("%s/%d", at, i))
+			}
+		}
+	}
+	walk(map[string]interface{}(doc), "#")
+}
+
+func TestOpenAPIServed(t *testing.T) {
+	service, _ := newTestService()
+	h := NewHandler(service)
+	h.auth = newTestAuthenticator(t)
+	handler := h.initRouts()
+
+	//описание доступно без учетных данных
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, openAPIPath, nil))
+	assert.Equal(t, rec.Code, http.StatusOK)
+	assert.Equal(t, rec.Header().Get("Content-Type"), "application/json")
+	assert.Equal(t, rec.Body.Bytes(), openAPISpec)
+}
+
+func TestContractFormHandlers(t *testing.T) {
+	doc := loadOpenAPI(t)
+	service, _ := newTestService()
+	service.conflicts = ConflictReject
+	handler := NewHandler(service).initRouts()
+
+	runContract(t, doc, handler, []contractCase{
+		{name: "create", method: http.MethodPost, target: "/create_event", contentType: formType,
+			body: "user_id=1&text=standup&date=2021-12-15T10:00&duration=30m&tz=Europe/Moscow&remind=15m&tags=work", status: http.StatusOK},
+		{name: "create all-day series", method: http.MethodPost, target: "/create_event", contentType: formType,
+			body: "user_id=1&text=gym&date=13-12-2021&freq=weekly&byweekday=MO,WE&count=4", status: http.StatusOK},
+		{name: "create overlap", method: http.MethodPost, target: "/create_event", contentType: formType,
+			body: "user_id=1&date=2021-12-15T10:15&duration=1h&tz=Europe/Moscow", status: http.StatusServiceUnavailable},
+		{name: "create without date", method: http.MethodPost, target: "/create_event", contentType: formType,
+			body: "user_id=1&text=x", status: http.StatusBadRequest},
+		{name: "create bad user", method: http.MethodPost, target: "/create_event", contentType: formType,
+			body: "user_id=abc&date=15-12-2021", status: http.StatusBadRequest},
+		{name: "create bad tz", method: http.MethodPost, target: "/create_event", contentType: formType,
+			body: "user_id=1&date=15-12-2021&tz=Mars/Base", status: http.StatusBadRequest},
+		{name: "create end and duration", method: http.MethodPost, target: "/create_event", contentType: formType,
+			body: "user_id=1&date=15-12-2021&end=16-12-2021&duration=1h", status: http.StatusBadRequest},
+		{name: "create end before start", method: http.MethodPost, target: "/create_event", contentType: formType,
+			body: "user_id=1&date=2021-12-15T10:00&end=2021-12-15T09:00", status: http.StatusBadRequest},
+		{name: "create bad freq", method: http.MethodPost, target: "/create_event", contentType: formType,
+			body: "user_id=1&date=15-12-2021&freq=hourly", status: http.StatusBadRequest},
+		{name: "create bad remind", method: http.MethodPost, target: "/create_event", contentType: formType,
+			body: "user_id=1&date=15-12-2021&remind=soon", status: http.StatusBadRequest},
+		{name: "create too large", method: http.MethodPost, target: "/create_event", contentType: formType,
+			body: "user_id=1&date=15-12-2021&text=" + strings.Repeat("a", maxFormBodySize), status: http.StatusRequestEntityTooLarge},
+		{name: "create by GET", method: http.MethodGet, target: "/create_event", status: http.StatusMethodNotAllowed},
+
+		{name: "update", method: http.MethodPost, target: "/update_event", contentType: formType,
+			body: "user_id=1&id=1&text=daily standup", header: map[string]string{"If-Match": `"1"`}, status: http.StatusOK},
+		{name: "update stale", method: http.MethodPost, target: "/update_event", contentType: formType,
+			body: "user_id=1&id=1&text=late", header: map[string]string{"If-Match": `"1"`}, status: http.StatusPreconditionFailed},
+		{name: "update bad If-Match", method: http.MethodPost, target: "/update_event", contentType: formType,
+			body: "user_id=1&id=1&text=late", header: map[string]string{"If-Match": "2"}, status: http.StatusBadRequest},
+		{name: "update occurrence", method: http.MethodPost, target: "/update_event", contentType: formType,
+			body: "user_id=1&id=2&text=gym late&occurrence=15-12-2021", status: http.StatusOK},
+		{name: "update bad occurrence", method: http.MethodPost, target: "/update_event", contentType: formType,
+			body: "user_id=1&id=2&occurrence=soon", status: http.StatusBadRequest},
+		{name: "update missing", method: http.MethodPost, target: "/update_event", contentType: formType,
+			body: "user_id=1&id=99&text=x", status: http.StatusBadRequest},
+		{name: "update bad id", method: http.MethodPost, target: "/update_event", contentType: formType,
+			body: "user_id=1&id=x", status: http.StatusBadRequest},
+		{name: "update bad date", method: http.MethodPost, target: "/update_event", contentType: formType,
+			body: "user_id=1&id=1&date=tomorrow", status: http.StatusBadRequest},
+		{name: "update bad duration", method: http.MethodPost, target: "/update_event", contentType: formType,
+			body: "user_id=1&id=1&duration=-1h", status: http.StatusBadRequest},
+		{name: "update by GET", method: http.MethodGet, target: "/update_event", status: http.StatusMethodNotAllowed},
+
+		{name: "day", method: http.MethodGet, target: "/events_for_day?user_id=1&date=15-12-2021", status: http.StatusOK},
+		{name: "day page", method: http.MethodGet, target: "/events_for_day?user_id=1&date=15-12-2021&limit=1", status: http.StatusOK},
+		{name: "day today", method: http.MethodGet, target: "/events_for_day?user_id=1&tz=Europe/Moscow", status: http.StatusOK},
+		{name: "day empty", method: http.MethodGet, target: "/events_for_day?user_id=2&date=15-12-2021", status: http.StatusOK},
+		{name: "day bad date", method: http.MethodGet, target: "/events_for_day?user_id=1&date=2021-12-15", status: http.StatusBadRequest},
+		{name: "day bad limit", method: http.MethodGet, target: "/events_for_day?user_id=1&limit=0", status: http.StatusBadRequest},
+		{name: "day bad cursor", method: http.MethodGet, target: "/events_for_day?user_id=1&cursor=!", status: http.StatusBadRequest},
+		{name: "day by POST", method: http.MethodPost, target: "/events_for_day", status: http.StatusMethodNotAllowed},
+		{name: "week", method: http.MethodGet, target: "/events_for_week?user_id=1&date=15-12-2021", status: http.StatusOK},
+		{name: "week bad user", method: http.MethodGet, target: "/events_for_week?user_id=0", status: http.StatusBadRequest},
+		{name: "week bad tz", method: http.MethodGet, target: "/events_for_week?user_id=1&tz=Nowhere", status: http.StatusBadRequest},
+		{name: "month", method: http.MethodGet, target: "/events_for_month?user_id=1&date=15-12-2021", status: http.StatusOK},
+		{name: "month bad date", method: http.MethodGet, target: "/events_for_month?user_id=1&date=december", status: http.StatusBadRequest},
+		{name: "between", method: http.MethodGet, target: "/events_between?user_id=1&from=01-12-2021&to=31-12-2021", status: http.StatusOK},
+		{name: "between bad from", method: http.MethodGet, target: "/events_between?user_id=1&from=x&to=31-12-2021", status: http.StatusBadRequest},
+		{name: "between reversed", method: http.MethodGet, target: "/events_between?user_id=1&from=31-12-2021&to=01-12-2021", status: http.StatusBadRequest},
+		{name: "between by POST", method: http.MethodPost, target: "/events_between", status: http.StatusMethodNotAllowed},
+
+		{name: "delete stale", method: http.MethodPost, target: "/delete_event", contentType: formType,
+			body: "user_id=1&id=1", header: map[string]string{"If-Match": `"1"`}, status: http.StatusPreconditionFailed},
+		{name: "delete occurrence", method: http.MethodPost, target: "/delete_event", contentType: formType,
+			body: "user_id=1&id=2&occurrence=20-12-2021", status: http.StatusOK},
+		{name: "delete", method: http.MethodPost, target: "/delete_event", contentType: formType,
+			body: "user_id=1&id=1", header: map[string]string{"If-Match": `"2"`}, status: http.StatusOK},
+		{name: "delete again", method: http.MethodPost, target: "/delete_event", contentType: formType,
+			body: "user_id=1&id=1", status: http.StatusBadRequest},
+		{name: "delete bad id", method: http.MethodPost, target: "/delete_event", contentType: formType,
+			body: "user_id=1&id=-1", status: http.StatusBadRequest},
+		{name: "delete bad occurrence", method: http.MethodPost, target: "/delete_event", contentType: formType,
+			body: "user_id=1&id=2&occurrence=x", status: http.StatusBadRequest},
+		{name: "delete by GET", method: http.MethodGet, target: "/delete_event", status: http.StatusMethodNotAllowed},
+	})
+}
+
+func TestContractAPIHandlers(t *testing.T) {
+	doc := loadOpenAPI(t)
+	service, _ := newTestService()
+	service.conflicts = ConflictReject
+	handler := NewHandler(service).initRouts()
+	const jsonType = "application/json"
+
+	runContract(t, doc, handler, []contractCase{
+		{name: "create", method: http.MethodPost, target: "/api/v1/events", contentType: jsonType,
+			body:   `{"UserID":1,"Text":"review","Date":"2021-12-15T10:00:00Z","Duration":"1h","Reminders":["15m"],"Tags":["work"]}`,
+			status: http.StatusCreated},
+		{name: "create series", method: http.MethodPost, target: "/api/v1/events?user_id=1", contentType: jsonType,
+			body:   `{"Text":"gym","Date":"2021-12-13T18:00:00Z","Duration":"1h","Recurrence":{"Freq":"weekly","ByWeekday":[1,3],"Count":4}}`,
+			status: http.StatusCreated},
+		{name: "create overlap", method: http.MethodPost, target: "/api/v1/events", contentType: jsonType,
+			body: `{"UserID":1,"Date":"2021-12-15T10:30:00Z","Duration":"1h"}`, status: http.StatusConflict},
+		{name: "create without Date", method: http.MethodPost, target: "/api/v1/events", contentType: jsonType,
+			body: `{"UserID":1}`, status: http.StatusBadRequest},
+		{name: "create form", method: http.MethodPost, target: "/api/v1/events", contentType: formType,
+			body: "user_id=1", status: http.StatusUnsupportedMediaType},
+		{name: "create bad JSON", method: http.MethodPost, target: "/api/v1/events", contentType: jsonType,
+			body: `{"UserID":`, status: http.StatusBadRequest},
+		{name: "list", method: http.MethodGet, target: "/api/v1/events?user_id=1", status: http.StatusOK},
+		{name: "list week", method: http.MethodGet, target: "/api/v1/events?user_id=1&period=week&date=15-12-2021", status: http.StatusOK},
+		{name: "list range", method: http.MethodGet, target: "/api/v1/events?user_id=1&from=2021-12-13T00:00:00Z&to=20-12-2021", status: http.StatusOK},
+		{name: "list bad period", method: http.MethodGet, target: "/api/v1/events?user_id=1&period=year", status: http.StatusBadRequest},
+		{name: "list by DELETE", method: http.MethodDelete, target: "/api/v1/events", status: http.StatusMethodNotAllowed},
+		{name: "get", method: http.MethodGet, target: "/api/v1/events/1?user_id=1", status: http.StatusOK},
+		{name: "get missing", method: http.MethodGet, target: "/api/v1/events/99?user_id=1", status: http.StatusNotFound},
+		{name: "get other user", method: http.MethodGet, target: "/api/v1/events/1?user_id=2", status: http.StatusNotFound},
+		{name: "patch", method: http.MethodPatch, target: "/api/v1/events/1?user_id=1", contentType: jsonType,
+			body: `{"Text":"code review"}`, header: map[string]string{"If-Match": `"1"`}, status: http.StatusOK},
+		{name: "patch stale", method: http.MethodPatch, target: "/api/v1/events/1?user_id=1", contentType: jsonType,
+			body: `{"Text":"late"}`, header: map[string]string{"If-Match": `"1"`}, status: http.StatusPreconditionFailed},
+		{name: "patch occurrence", method: http.MethodPatch, target: "/api/v1/events/2?user_id=1&occurrence=15-12-2021", contentType: jsonType,
+			body: `{"Text":"gym late"}`, status: http.StatusOK},
+		{name: "patch bad body", method: http.MethodPatch, target: "/api/v1/events/1?user_id=1", contentType: jsonType,
+			body: `{"Duration":"forever"}`, status: http.StatusBadRequest},
+		{name: "put", method: http.MethodPut, target: "/api/v1/events/1?user_id=1", contentType: jsonType,
+			body: `{"Text":"review","Date":"2021-12-16T10:00:00Z","Duration":"2h"}`, status: http.StatusOK},
+		{name: "put missing", method: http.MethodPut, target: "/api/v1/events/99?user_id=1", contentType: jsonType,
+			body: `{"Date":"2021-12-16T10:00:00Z"}`, status: http.StatusNotFound},
+		{name: "delete occurrence", method: http.MethodDelete, target: "/api/v1/events/2?user_id=1&occurrence=20-12-2021", status: http.StatusNoContent},
+		{name: "delete", method: http.MethodDelete, target: "/api/v1/events/1?user_id=1", status: http.StatusNoContent},
+		{name: "delete missing", method: http.MethodDelete, target: "/api/v1/events/1?user_id=1", status: http.StatusNotFound},
+		{name: "bad id", method: http.MethodGet, target: "/api/v1/events/abc?user_id=1", status: http.StatusNotFound},
+		{name: "item by POST", method: http.MethodPost, target: "/api/v1/events/2?user_id=1", status: http.StatusMethodNotAllowed},
+
+		{name: "batch", method: http.MethodPost, target: "/batch?user_id=1", contentType: jsonType,
+			body:   `[{"Op":"create","Event":{"Date":"2021-12-17T09:00:00Z","Duration":"1h"}},{"Op":"update","ID":2,"Changes":{"Text":"swim"}}]`,
+			status: http.StatusOK},
+		{name: "batch rolled back", method: http.MethodPost, target: "/batch?user_id=1", contentType: jsonType,
+			body: `[{"Op":"create","Event":{"Date":"2021-12-18T09:00:00Z"}},{"Op":"delete","ID":99}]`, status: http.StatusNotFound},
+		{name: "batch best effort", method: http.MethodPost, target: "/batch?user_id=1&mode=best_effort", contentType: jsonType,
+			body: `[{"Op":"delete","ID":99},{"Op":"rename"}]`, status: http.StatusOK},
+		{name: "batch bad op", method: http.MethodPost, target: "/batch?user_id=1", contentType: jsonType,
+			body: `[{"Op":"rename"}]`, status: http.StatusBadRequest},
+		{name: "batch empty", method: http.MethodPost, target: "/batch?user_id=1", contentType: jsonType,
+			body: `[]`, status: http.StatusBadRequest},
+		{name: "batch by GET", method: http.MethodGet, target: "/batch", status: http.StatusMethodNotAllowed},
+
+		{name: "free busy", method: http.MethodGet, target: "/free_busy?user_id=1&from=13-12-2021&to=19-12-2021&min=30m", status: http.StatusOK},
+		{name: "free busy empty", method: http.MethodGet, target: "/free_busy?user_id=5&from=13-12-2021&to=13-12-2021", status: http.StatusOK},
+		{name: "free busy bad to", method: http.MethodGet, target: "/free_busy?user_id=1&from=13-12-2021", status: http.StatusBadRequest},
+		{name: "search", method: http.MethodGet, target: "/search?user_id=1&q=swim", status: http.StatusOK},
+		{name: "search empty query", method: http.MethodGet, target: "/search?user_id=1", status: http.StatusBadRequest},
+		{name: "export", method: http.MethodGet, target: "/export.ics?user_id=1", status: http.StatusOK},
+		{name: "export bad period", method: http.MethodGet, target: "/export.ics?user_id=1&period=year", status: http.StatusBadRequest},
+		{name: "import", method: http.MethodPost, target: "/import?user_id=3", contentType: "text/calendar",
+			body:   "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:a\r\nDTSTART:20211220T100000Z\r\nSUMMARY:imported\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n",
+			status: http.StatusOK},
+		{name: "import nothing valid", method: http.MethodPost, target: "/import?user_id=3", contentType: "text/calendar",
+			body:   "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:b\r\nSUMMARY:no start\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n",
+			status: http.StatusBadRequest},
+		{name: "import bad calendar", method: http.MethodPost, target: "/import?user_id=3", contentType: "text/calendar",
+			body: "hello", status: http.StatusBadRequest},
+		{name: "stream bad user", method: http.MethodGet, target: "/events/stream?user_id=x", status: http.StatusBadRequest},
+		{name: "stream bad tz", method: http.MethodGet, target: "/events/stream?user_id=1&tz=x", status: http.StatusBadRequest},
+		{name: "metrics", method: http.MethodGet, target: "/metrics", status: http.StatusOK},
+		{name: "healthz", method: http.MethodGet, target: "/healthz", status: http.StatusOK},
+		{name: "readyz", method: http.MethodGet, target: "/readyz", status: http.StatusOK},
+		{name: "openapi", method: http.MethodGet, target: "/openapi.json", status: http.StatusOK},
+		{name: "openapi by POST", method: http.MethodPost, target: "/openapi.json", status: http.StatusMethodNotAllowed},
+	})
+}
+
+func TestContractInvitations(t *testing.T) {
+	doc := loadOpenAPI(t)
+	service, store := newTestService()
+	store.Save(newEvent(1, "planning", fixedNow), Author{})
+	handler := NewHandler(service).initRouts()
+
+	runContract(t, doc, handler, []contractCase{
+		{name: "invite", method: http.MethodPost, target: "/invite", contentType: formType,
+			body: "user_id=1&id=1&attendees=2,3", status: http.StatusOK},
+		{name: "invite organizer", method: http.MethodPost, target: "/invite", contentType: formType,
+			body: "user_id=1&id=1&attendees=1", status: http.StatusBadRequest},
+		{name: "invite foreign event", method: http.MethodPost, target: "/invite", contentType: formType,
+			body: "user_id=2&id=1&attendees=3", status: http.StatusNotFound},
+		{name: "invite missing event", method: http.MethodPost, target: "/invite", contentType: formType,
+			body: "user_id=1&id=9&attendees=3", status: http.StatusNotFound},
+		{name: "invite bad attendees", method: http.MethodPost, target: "/invite", contentType: formType,
+			body: "user_id=1&id=1&attendees=2,x", status: http.StatusBadRequest},
+		{name: "invite nobody", method: http.MethodPost, target: "/invite", contentType: formType,
+			body: "user_id=1&id=1", status: http.StatusBadRequest},
+		{name: "invite by GET", method: http.MethodGet, target: "/invite", status: http.StatusMethodNotAllowed},
+
+		{name: "invitations", method: http.MethodGet, target: "/invitations?user_id=2", status: http.StatusOK},
+		{name: "invitations bad user", method: http.MethodGet, target: "/invitations?user_id=x", status: http.StatusBadRequest},
+		{name: "invitations by POST", method: http.MethodPost, target: "/invitations", status: http.StatusMethodNotAllowed},
+
+		{name: "respond", method: http.MethodPost, target: "/respond", contentType: formType,
+			body: "user_id=2&id=1&status=accepted", status: http.StatusOK},
+		{name: "respond not invited", method: http.MethodPost, target: "/respond", contentType: formType,
+			body: "user_id=4&id=1&status=accepted", status: http.StatusBadRequest},
+		{name: "respond missing event", method: http.MethodPost, target: "/respond", contentType: formType,
+			body: "user_id=2&id=9&status=accepted", status: http.StatusNotFound},
+		{name: "respond bad status", method: http.MethodPost, target: "/respond", contentType: formType,
+			body: "user_id=2&id=1&status=maybe", status: http.StatusBadRequest},
+		{name: "respond by GET", method: http.MethodGet, target: "/respond", status: http.StatusMethodNotAllowed},
+
+		{name: "attendee day", method: http.MethodGet, target: "/events_for_day?user_id=2&date=15-12-2021", status: http.StatusOK},
+		{name: "invitations answered", method: http.MethodGet, target: "/invitations?user_id=2", status: http.StatusOK},
+	})
+
+	event, _ := service.GetEvent(1, 1)
+	assert.Equal(t, event.Attendees, []Attendee{{UserID: 2, Status: StatusAccepted}, {UserID: 3, Status: StatusNeedsAction}})
+}
+
+func TestContractCalendars(t *testing.T) {
+	doc := loadOpenAPI(t)
+	service, _ := newTestService()
+	handler := NewHandler(service).initRouts()
+	const jsonType = "application/json"
+
+	runContract(t, doc, handler, []contractCase{
+		{name: "create", method: http.MethodPost, target: "/api/v1/calendars?user_id=1", contentType: jsonType,
+			body: `{"Name":"work"}`, status: http.StatusCreated},
+		{name: "create taken name", method: http.MethodPost, target: "/api/v1/calendars?user_id=1", contentType: jsonType,
+			body: `{"Name":"Work"}`, status: http.StatusConflict},
+		{name: "create empty name", method: http.MethodPost, target: "/api/v1/calendars?user_id=1", contentType: jsonType,
+			body: `{"Name":""}`, status: http.StatusBadRequest},
+		{name: "create form", method: http.MethodPost, target: "/api/v1/calendars?user_id=1", contentType: formType,
+			body: "Name=work", status: http.StatusUnsupportedMediaType},
+		{name: "collection by PUT", method: http.MethodPut, target: "/api/v1/calendars?user_id=1", status: http.StatusMethodNotAllowed},
+
+		{name: "share read", method: http.MethodPut, target: "/api/v1/calendars/1/shares/2?user_id=1", contentType: jsonType,
+			body: `{"Level":"read"}`, status: http.StatusOK},
+		{name: "share bad level", method: http.MethodPut, target: "/api/v1/calendars/1/shares/2?user_id=1", contentType: jsonType,
+			body: `{"Level":"admin"}`, status: http.StatusBadRequest},
+		{name: "share with owner", method: http.MethodPut, target: "/api/v1/calendars/1/shares/1?user_id=1", contentType: jsonType,
+			body: `{"Level":"write"}`, status: http.StatusBadRequest},
+		{name: "share foreign", method: http.MethodPut, target: "/api/v1/calendars/1/shares/3?user_id=2", contentType: jsonType,
+			body: `{"Level":"write"}`, status: http.StatusNotFound},
+		{name: "share by GET", method: http.MethodGet, target: "/api/v1/calendars/1/shares/2?user_id=1", status: http.StatusMethodNotAllowed},
+
+		{name: "event in calendar", method: http.MethodPost, target: "/create_event", contentType: formType,
+			body: "user_id=1&date=15-12-2021&text=standup&calendar_id=1", status: http.StatusOK},
+		{name: "event in foreign calendar", method: http.MethodPost, target: "/create_event", contentType: formType,
+			body: "user_id=2&date=15-12-2021&calendar_id=1", status: http.StatusNotFound},
+		{name: "event bad calendar", method: http.MethodPost, target: "/create_event", contentType: formType,
+			body: "user_id=1&date=15-12-2021&calendar_id=x", status: http.StatusBadRequest},
+		{name: "shared day", method: http.MethodGet, target: "/events_for_day?user_id=2&date=15-12-2021", status: http.StatusOK},
+		{name: "shared event", method: http.MethodGet, target: "/api/v1/events/1?user_id=2", status: http.StatusOK},
+		{name: "reader can't patch", method: http.MethodPatch, target: "/api/v1/events/1?user_id=2", contentType: jsonType,
+			body: `{"Text":"mine"}`, status: http.StatusNotFound},
+
+		{name: "list shared", method: http.MethodGet, target: "/api/v1/calendars?user_id=2", status: http.StatusOK},
+		{name: "get shared", method: http.MethodGet, target: "/api/v1/calendars/1?user_id=2", status: http.StatusOK},
+		{name: "get hidden", method: http.MethodGet, target: "/api/v1/calendars/1?user_id=3", status: http.StatusNotFound},
+		{name: "rename", method: http.MethodPatch, target: "/api/v1/calendars/1?user_id=1", contentType: jsonType,
+			body: `{"Name":"office"}`, status: http.StatusOK},
+		{name: "rename by reader", method: http.MethodPatch, target: "/api/v1/calendars/1?user_id=2", contentType: jsonType,
+			body: `{"Name":"mine"}`, status: http.StatusNotFound},
+		{name: "unshare", method: http.MethodDelete, target: "/api/v1/calendars/1/shares/2?user_id=1", status: http.StatusOK},
+		{name: "calendar by POST", method: http.MethodPost, target: "/api/v1/calendars/1?user_id=1", status: http.StatusMethodNotAllowed},
+		{name: "delete", method: http.MethodDelete, target: "/api/v1/calendars/1?user_id=1", status: http.StatusNoContent},
+		{name: "delete again", method: http.MethodDelete, target: "/api/v1/calendars/1?user_id=1", status: http.StatusNotFound},
+		{name: "event in deleted calendar", method: http.MethodPost, target: "/create_event", contentType: formType,
+			body: "user_id=1&date=15-12-2021&calendar_id=1", status: http.StatusNotFound},
+		{name: "api event in deleted calendar", method: http.MethodPost, target: "/api/v1/events?user_id=1", contentType: jsonType,
+			body: `{"Date":"2021-12-15T10:00:00Z","CalendarID":1}`, status: http.StatusNotFound},
+	})
+
+	_, ok := service.GetEvent(1, 1)
+	assert.False(t, ok)
+}
+
+func TestContractHistory(t *testing.T) {
+	doc := loadOpenAPI(t)
+	service, _ := newTestService()
+	handler := NewHandler(service).initRouts()
+	const jsonType = "application/json"
+
+	runContract(t, doc, handler, []contractCase{
+		{name: "create", method: http.MethodPost, target: "/api/v1/events?user_id=1", contentType: jsonType,
+			body: `{"Text":"standup","Date":"2021-12-15T10:00:00Z"}`, status: http.StatusCreated},
+		{name: "change", method: http.MethodPatch, target: "/api/v1/events/1?user_id=1", contentType: jsonType,
+			body: `{"Text":"daily"}`, status: http.StatusOK},
+		{name: "history", method: http.MethodGet, target: "/api/v1/events/1/history?user_id=1", status: http.StatusOK},
+		{name: "foreign history", method: http.MethodGet, target: "/api/v1/events/1/history?user_id=2", status: http.StatusNotFound},
+		{name: "history by POST", method: http.MethodPost, target: "/api/v1/events/1/history?user_id=1", status: http.StatusMethodNotAllowed},
+		{name: "undo stale", method: http.MethodPost, target: "/api/v1/events/1/restore?user_id=1",
+			header: map[string]string{"If-Match": `"1"`}, status: http.StatusPreconditionFailed},
+		{name: "undo", method: http.MethodPost, target: "/api/v1/events/1/restore?user_id=1", status: http.StatusOK},
+		{name: "unknown revision", method: http.MethodPost, target: "/api/v1/events/1/restore?user_id=1&revision=9", status: http.StatusNotFound},
+		{name: "bad revision", method: http.MethodPost, target: "/api/v1/events/1/restore?user_id=1&revision=x", status: http.StatusBadRequest},
+		{name: "delete", method: http.MethodDelete, target: "/api/v1/events/1?user_id=1", status: http.StatusNoContent},
+		{name: "restore deleted", method: http.MethodPost, target: "/api/v1/events/1/restore?user_id=1&revision=2", status: http.StatusOK},
+		{name: "restored", method: http.MethodGet, target: "/api/v1/events/1?user_id=1", status: http.StatusOK},
+		{name: "restore by GET", method: http.MethodGet, target: "/api/v1/events/1/restore?user_id=1", status: http.StatusMethodNotAllowed},
+	})
+}
+
+func TestContractTrash(t *testing.T) {
+	doc := loadOpenAPI(t)
+	service, _ := newTestService()
+	handler := NewHandler(service).initRouts()
+
+	runContract(t, doc, handler, []contractCase{
+		{name: "create", method: http.MethodPost, target: "/api/v1/events?user_id=1", contentType: "application/json",
+			body: `{"Text":"standup","Date":"2021-12-15T10:00:00Z"}`, status: http.StatusCreated},
+		{name: "delete", method: http.MethodDelete, target: "/api/v1/events/1?user_id=1", status: http.StatusNoContent},
+		{name: "trash", method: http.MethodGet, target: "/api/v1/trash?user_id=1", status: http.StatusOK},
+		{name: "trash by POST", method: http.MethodPost, target: "/api/v1/trash?user_id=1", status: http.StatusMethodNotAllowed},
+		{name: "foreign restore", method: http.MethodPost, target: "/api/v1/trash/1/restore?user_id=2", status: http.StatusNotFound},
+		{name: "restore by GET", method: http.MethodGet, target: "/api/v1/trash/1/restore?user_id=1", status: http.StatusMethodNotAllowed},
+		{name: "restore", method: http.MethodPost, target: "/api/v1/trash/1/restore?user_id=1", status: http.StatusOK},
+		{name: "restore again", method: http.MethodPost, target: "/api/v1/trash/1/restore?user_id=1", status: http.StatusNotFound},
+		{name: "restored", method: http.MethodGet, target: "/api/v1/events/1?user_id=1", status: http.StatusOK},
+	})
+}
+
+func TestContractCalDAV(t *testing.T) {
+	doc := loadOpenAPI(t)
+	service, _ := newTestService()
+	handler := NewHandler(service).initRouts()
+	const ics = "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nBEGIN:VEVENT\r\nUID:abc\r\nDTSTART:20211215T100000Z\r\n" +
+		"SUMMARY:standup\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"
+
+	runContract(t, doc, handler, []contractCase{
+		{name: "options", method: http.MethodOptions, target: "/dav/", status: http.StatusOK},
+		{name: "well-known", method: http.MethodGet, target: "/.well-known/caldav", status: http.StatusMovedPermanently},
+		{name: "put new", method: http.MethodPut, target: "/dav/calendars/1/default/abc.ics", contentType: "text/calendar",
+			body: ics, status: http.StatusCreated},
+		{name: "put replace", method: http.MethodPut, target: "/dav/calendars/1/default/abc.ics", contentType: "text/calendar",
+			body: ics, status: http.StatusNoContent},
+		{name: "put only new", method: http.MethodPut, target: "/dav/calendars/1/default/abc.ics", contentType: "text/calendar",
+			body: ics, header: map[string]string{"If-None-Match": "*"}, status: http.StatusPreconditionFailed},
+		{name: "put other uid", method: http.MethodPut, target: "/dav/calendars/1/default/xyz.ics", contentType: "text/calendar",
+			body: ics, status: http.StatusBadRequest},
+		{name: "put json", method: http.MethodPut, target: "/dav/calendars/1/default/abc.ics", contentType: "application/json",
+			body: "{}", status: http.StatusUnsupportedMediaType},
+		{name: "get event", method: http.MethodGet, target: "/dav/calendars/1/default/abc.ics", status: http.StatusOK},
+		{name: "get collection", method: http.MethodGet, target: "/dav/calendars/1/default/", status: http.StatusOK},
+		{name: "unknown collection", method: http.MethodGet, target: "/dav/calendars/1/5/abc.ics", status: http.StatusNotFound},
+		{name: "delete", method: http.MethodDelete, target: "/dav/calendars/1/default/abc.ics", status: http.StatusNoContent},
+		{name: "get deleted", method: http.MethodGet, target: "/dav/calendars/1/default/abc.ics", status: http.StatusNotFound},
+	})
+}
+
+func TestContractImportMultipart(t *testing.T) {
+	doc := loadOpenAPI(t)
+	service, _ := newTestService()
+	handler := NewHandler(service).initRouts()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("user_id", "1")
+	file, _ := form.CreateFormFile("file", "calendar.ics")
+	file.Write([]byte("BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:a\r\nDTSTART:20211220T100000Z\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n"))
+	form.Close()
+
+	runContract(t, doc, handler, []contractCase{
+		{name: "import multipart", method: http.MethodPost, target: "/import", contentType: form.FormDataContentType(),
+			body: body.String(), status: http.StatusOK},
+		{name: "import multipart without file", method: http.MethodPost, target: "/import", contentType: "multipart/form-data; boundary=x",
+			body: "--x--\r\n", status: http.StatusBadRequest},
+	})
+}
+
+func TestContractMiddleware(t *testing.T) {
+	doc := loadOpenAPI(t)
+	service, _ := newTestService()
+	h := NewHandler(service)
+	h.auth = newTestAuthenticator(t)
+	h.limiter = NewRateLimiter(RateLimit{}, []RouteLimit{{Path: "/search", Rate: 0.001, Burst: 1}})
+	handler := h.initRouts()
+	reader := map[string]string{"X-API-Key": "reader-key"}
+
+	runContract(t, doc, handler, []contractCase{
+		{name: "no credentials", method: http.MethodGet, target: "/events_for_day?user_id=1", status: http.StatusUnauthorized},
+		{name: "bad key", method: http.MethodGet, target: "/api/v1/events", header: map[string]string{"X-API-Key": "nope"}, status: http.StatusUnauthorized},
+		{name: "reader writes", method: http.MethodPost, target: "/create_event", contentType: formType,
+			body: "date=15-12-2021", header: reader, status: http.StatusForbidden},
+		{name: "other user", method: http.MethodGet, target: "/events_for_week?user_id=2", header: reader, status: http.StatusForbidden},
+		{name: "own events", method: http.MethodGet, target: "/events_for_week", header: reader, status: http.StatusOK},
+		{name: "search", method: http.MethodGet, target: "/search?q=x", header: reader, status: http.StatusOK},
+		{name: "search limited", method: http.MethodGet, target: "/search?q=x", header: reader, status: http.StatusTooManyRequests},
+		{name: "public readyz", method: http.MethodGet, target: "/readyz", status: http.StatusOK},
+	})
+
+	h.health.SetDraining()
+	runContract(t, doc, handler, []contractCase{
+		{name: "draining", method: http.MethodGet, target: "/readyz", status: http.StatusServiceUnavailable},
+	})
+}
+
+func TestContractStream(t *testing.T) {
+	doc := loadOpenAPI(t)
+	service, _ := newTestService()
+	server := httptest.NewServer(NewHandler(service).initRouts())
+	defer server.Close()
+	defer service.CloseFeed()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/events/stream?user_id=1", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	doc.checkResponse(t, http.MethodGet, "/events/stream", resp.StatusCode, resp.Header, nil)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+)
+
+//Outbox ящик исходящих сообщений iTIP: приглашений, ответов на них и отмен.
+//Доставку получателю (почтой или другим календарем) выполняет внешний обработчик.
+type Outbox interface {
+	//Name имя ящика для лога
+	Name() string
+	//Post передает сообщение в ящик
+	Post(ctx context.Context, m ITIPMessage) error
+}
+
+//LogOutbox ящик, пишущий сообщения в лог
+type LogOutbox struct{}
+
+//Name имя ящика
+func (LogOutbox) Name() string {
+	return "log"
+}
+
+//Post пишет сообщение в лог
+func (LogOutbox) Post(ctx context.Context, m ITIPMessage) error {
+	log.Printf("itip: %s event %d from %s to %s", m.Method, m.EventID, m.From, m.To)
+	return nil
+}
+
+//WebhookOutbox ящик, отправляющий сообщения POST запросом с JSON телом.
+//Ключ сообщения передается в Idempotency-Key.
+type WebhookOutbox struct {
+	url    string
+	client *http.Client
+}
+
+//NewWebhookOutbox конструктор для WebhookOutbox
+func NewWebhookOutbox(url string) *WebhookOutbox {
+	return &WebhookOutbox{url: url, client: &http.Client{}}
+}
+
+//Name имя ящика
+func (o *WebhookOutbox) Name() string {
+	return "webhook:" + o.url
+}
+
+//Post отправляет сообщение на url ящика
+func (o *WebhookOutbox) Post(ctx context.Context, m ITIPMessage) error {
+	return postJSON(ctx, o.client, o.url, m.Key, m)
+}
+
+//FileOutbox ящик, дописывающий сообщения JSON строками в файл-очередь
+type FileOutbox struct {
+	path  string
+	mutex sync.Mutex
+}
+
+//NewFileOutbox конструктор для FileOutbox
+func NewFileOutbox(path string) *FileOutbox {
+	return &FileOutbox{path: path}
+}
+
+//Name имя ящика
+func (o *FileOutbox) Name() string {
+	return "file:" + o.path
+}
+
+//Post дописывает сообщение в файл
+func (o *FileOutbox) Post(ctx context.Context, m ITIPMessage) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return appendJSONLine(o.path, m)
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	//outboxTimeout время на доставку одного сообщения iTIP в один ящик исходящих
+	outboxTimeout = 10 * time.Second
+	//outboxRetryMin задержка перед первым повтором неудавшейся доставки, дальше она удваивается
+	outboxRetryMin = 5 * time.Second
+	//outboxRetryMax наибольшая задержка между повторами
+	outboxRetryMax = time.Hour
+	//outboxMaxAttempts после стольких неудачных попыток сообщение выбрасывается из очереди
+	outboxMaxAttempts = 20
+)
+
+//queuedMessage сообщение iTIP в очереди одного ящика: число неудачных попыток и время следующей
+type queuedMessage struct {
+	Outbox   string      `json:"Outbox"`
+	Message  ITIPMessage `json:"Message"`
+	Attempts int         `json:"Attempts"`
+	Next     JSONTime    `json:"Next"`
+}
+
+//OutboxQueue очередь доставки сообщений iTIP в ящики исходящих.
+//Запрос только ставит сообщения в очередь, доставляет их фоновая горутина: в каждый ящик по порядку,
+//неудавшаяся доставка повторяется с удвоением задержки от outboxRetryMin до outboxRetryMax,
+//а следующие сообщения ящика ждут ее, чтобы отмена не обогнала приглашение.
+//Доставка "хотя бы один раз": очередь переписывается в statePath при каждом изменении,
+//так что после сбоя недоставленные сообщения отправляются снова.
+type OutboxQueue struct {
+	mutex     sync.Mutex
+	sending   sync.Mutex
+	outboxes  []Outbox
+	pending   []queuedMessage
+	statePath string
+	now       func() time.Time
+	wake      chan struct{}
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+//NewOutboxQueue конструктор для OutboxQueue.
+//Принимает: ящики исходящих и файл очереди (пусто - очередь только в памяти).
+//Сообщения из файла для ящиков, которых больше нет в конфиге, выбрасываются.
+//Возвращает: ссылку на OutboxQueue и ошибку чтения очереди.
+func NewOutboxQueue(outboxes []Outbox, statePath string) (*OutboxQueue, error) {
+	q := &OutboxQueue{outboxes: outboxes, statePath: statePath, now: time.Now, wake: make(chan struct{}, 1)}
+	if statePath == "" {
+		return q, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(statePath), 0755); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []queuedMessage
+	if err := json.Unmarshal(data, &pending); err != nil {
+		return nil, fmt.Errorf("bad outbox queue %s: %w", statePath, err)
+	}
+	for _, m := range pending {
+		if q.outbox(m.Outbox) == nil {
+			log.Printf("invitations: %s: %s: outbox is not configured, message dropped", m.Outbox, m.Message.Key)
+			continue
+		}
+		q.pending = append(q.pending, m)
+	}
+	return q, nil
+}
+
+//outbox ищет ящик по имени
+func (q *OutboxQueue) outbox(name string) Outbox {
+	for _, outbox := range q.outboxes {
+		if outbox.Name() == name {
+			return outbox
+		}
+	}
+	return nil
+}
+
+//Enqueue ставит сообщения в очередь каждого ящика и будит доставку.
+//Ошибка записи файла очереди только пишется в лог: сообщения остаются в памяти.
+//Конкурентно безопасный метод.
+func (q *OutboxQueue) Enqueue(messages []ITIPMessage) {
+	if len(messages) == 0 || len(q.outboxes) == 0 {
+		return
+	}
+
+	q.mutex.Lock()
+	now := JSONTime(q.now())
+	for _, m := range messages {
+		for _, outbox := range q.outboxes {
+			q.pending = append(q.pending, queuedMessage{Outbox: outbox.Name(), Message: m, Next: now})
+		}
+	}
+	err := q.saveState()
+	q.mutex.Unlock()
+	if err != nil {
+		log.Printf("invitations: %s", err)
+	}
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+//Len количество сообщений, ждущих доставки во все ящики
+func (q *OutboxQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return len(q.pending)
+}
+
+//Start запускает доставку в отдельной горутине
+func (q *OutboxQueue) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	q.cancel = cancel
+	q.done = make(chan struct{})
+
+	go func() {
+		defer close(q.done)
+		for {
+			wait := outboxRetryMax
+			if next := q.deliverDue(ctx); !next.IsZero() {
+				wait = next.Sub(q.now())
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-q.wake:
+			case <-timer.C:
+			}
+			timer.Stop()
+		}
+	}()
+}
+
+//Stop останавливает доставку и дожидается завершения текущей попытки.
+//Недоставленные сообщения остаются в файле очереди до следующего запуска.
+func (q *OutboxQueue) Stop() {
+	if q.cancel == nil {
+		return
+	}
+	q.cancel()
+	<-q.done
+}
+
+//deliverDue доставляет сообщения, время которых наступило: в каждый ящик по порядку до первой неудачи.
+//Возвращает время, когда в очереди наступит следующее сообщение (нулевое, если очередь пуста).
+func (q *OutboxQueue) deliverDue(ctx context.Context) time.Time {
+	q.sending.Lock()
+	defer q.sending.Unlock()
+
+	for _, outbox := range q.outboxes {
+		for ctx.Err() == nil {
+			m, ok := q.head(outbox.Name())
+			if !ok || time.Time(m.Next).After(q.now()) {
+				break
+			}
+
+			sendCtx, cancel := context.WithTimeout(ctx, outboxTimeout)
+			err := outbox.Post(sendCtx, m.Message)
+			cancel()
+			if err != nil {
+				log.Printf("invitations: %s: %s: attempt %d: %s", outbox.Name(), m.Message.Key, m.Attempts+1, err)
+			}
+			if !q.settle(m, err) {
+				break
+			}
+		}
+	}
+	return q.nextDue()
+}
+
+//head первое сообщение в очереди ящика
+func (q *OutboxQueue) head(name string) (queuedMessage, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for _, m := range q.pending {
+		if m.Outbox == name {
+			return m, true
+		}
+	}
+	return queuedMessage{}, false
+}
+
+//settle убирает из очереди доставленное сообщение или откладывает недоставленное
+//с удвоенной задержкой; после outboxMaxAttempts неудач сообщение выбрасывается.
+//Возвращает, можно ли сразу переходить к следующему сообщению ящика.
+func (q *OutboxQueue) settle(m queuedMessage, sendErr error) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	i := 0
+	for i < len(q.pending) && (q.pending[i].Outbox != m.Outbox || q.pending[i].Message.Key != m.Message.Key) {
+		i++
+	}
+	if i == len(q.pending) {
+		return true
+	}
+
+	m.Attempts++
+	done := sendErr == nil || m.Attempts >= outboxMaxAttempts
+	if done {
+		if sendErr != nil {
+			log.Printf("invitations: %s: %s: dropped after %d attempts", m.Outbox, m.Message.Key, m.Attempts)
+		}
+		q.pending = append(q.pending[:i], q.pending[i+1:]...)
+	} else {
+		m.Next = JSONTime(q.now().Add(retryDelay(m.Attempts)))
+		q.pending[i] = m
+	}
+	if err := q.saveState(); err != nil {
+		log.Printf("invitations: %s", err)
+	}
+	return done
+}
+
+//retryDelay задержка перед повтором после attempts неудачных попыток
+func retryDelay(attempts int) time.Duration {
+	delay := outboxRetryMin
+	for i := 1; i < attempts && delay < outboxRetryMax; i++ {
+		delay *= 2
+	}
+	if delay > outboxRetryMax {
+		delay = outboxRetryMax
+	}
+	return delay
+}
+
+//nextDue самое раннее время следующей попытки среди первых сообщений ящиков
+func (q *OutboxQueue) nextDue() time.Time {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var next time.Time
+	seen := make(map[string]bool)
+	for _, m := range q.pending {
+		if seen[m.Outbox] {
+			continue
+		}
+		seen[m.Outbox] = true
+		if next.IsZero() || time.Time(m.Next).Before(next) {
+			next = time.Time(m.Next)
+		}
+	}
+	return next
+}
+
+//saveState переписывает файл очереди. Вызывается под q.mutex.
+func (q *OutboxQueue) saveState() error {
+	if q.statePath == "" {
+		return nil
+	}
+	pending := q.pending
+	if pending == nil {
+		pending = []queuedMessage{}
+	}
+	data, err := json.Marshal(pending)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(q.statePath, data)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func messageKeys(messages []ITIPMessage) []string {
+	keys := []string{}
+	for _, m := range messages {
+		keys = append(keys, m.Key)
+	}
+	return keys
+}
+
+func TestOutboxQueueRetry(t *testing.T) {
+	outbox := &memoryOutbox{fail: errors.New("unavailable")}
+	queue, err := NewOutboxQueue([]Outbox{outbox}, "")
+	assert.Nil(t, err)
+	now := fixedNow
+	queue.now = func() time.Time { return now }
+
+	queue.Enqueue([]ITIPMessage{{Key: "invite"}, {Key: "cancel"}})
+	next := queue.deliverDue(context.Background())
+	assert.Equal(t, next, now.Add(outboxRetryMin))
+	assert.Equal(t, queue.Len(), 2)
+
+	//до срока повтора доставка не пробуется, задержка растет вдвое
+	now = now.Add(outboxRetryMin - time.Second)
+	assert.Equal(t, queue.deliverDue(context.Background()), fixedNow.Add(outboxRetryMin))
+	now = fixedNow.Add(outboxRetryMin)
+	assert.Equal(t, queue.deliverDue(context.Background()), now.Add(2*outboxRetryMin))
+	assert.Equal(t, retryDelay(outboxMaxAttempts), outboxRetryMax)
+
+	//после восстановления ящика сообщения уходят по порядку
+	outbox.fail = nil
+	now = now.Add(2 * outboxRetryMin)
+	assert.True(t, queue.deliverDue(context.Background()).IsZero())
+	assert.Equal(t, messageKeys(outbox.take()), []string{"invite", "cancel"})
+	assert.Equal(t, queue.Len(), 0)
+}
+
+func TestOutboxQueueGiveUp(t *testing.T) {
+	outbox := &memoryOutbox{fail: errors.New("unavailable")}
+	queue, _ := NewOutboxQueue([]Outbox{outbox}, "")
+	now := fixedNow
+	queue.now = func() time.Time { return now }
+
+	queue.Enqueue([]ITIPMessage{{Key: "invite"}})
+	for i := 0; i < outboxMaxAttempts; i++ {
+		queue.deliverDue(context.Background())
+		now = now.Add(outboxRetryMax)
+	}
+	assert.Equal(t, queue.Len(), 0)
+}
+
+func TestOutboxQueueState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue", "outbox.json")
+	down := &memoryOutbox{fail: errors.New("unavailable")}
+	queue, err := NewOutboxQueue([]Outbox{down}, path)
+	assert.Nil(t, err)
+	queue.Enqueue([]ITIPMessage{{Key: "invite"}, {Key: "reply"}})
+	queue.deliverDue(context.Background())
+
+	//недоставленное переживает перезапуск вместе со счетчиком попыток
+	up := &memoryOutbox{}
+	queue, err = NewOutboxQueue([]Outbox{up}, path)
+	assert.Nil(t, err)
+	assert.Equal(t, queue.Len(), 2)
+	assert.Equal(t, queue.pending[0].Attempts, 1)
+	queue.now = func() time.Time { return time.Now().Add(outboxRetryMin) }
+	queue.deliverDue(context.Background())
+	assert.Equal(t, messageKeys(up.take()), []string{"invite", "reply"})
+
+	queue, _ = NewOutboxQueue([]Outbox{up}, path)
+	assert.Equal(t, queue.Len(), 0)
+}
+
+func TestOutboxQueueStart(t *testing.T) {
+	outbox := &memoryOutbox{}
+	queue, _ := NewOutboxQueue([]Outbox{outbox}, "")
+	queue.Start()
+	queue.Enqueue([]ITIPMessage{{Key: "invite"}})
+
+	assert.Eventually(t, func() bool { return queue.Len() == 0 }, time.Second, 10*time.Millisecond)
+	queue.Stop()
+	assert.Equal(t, messageKeys(outbox.take()), []string{"invite"})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	//defaultPageLimit размер страницы списка по умолчанию
+	defaultPageLimit = 100
+	//maxPageLimit наибольший допустимый размер страницы
+	maxPageLimit = 1000
+)
+
+//Page страница списка событий.
+//Total - сколько всего событий подходит под запрос, NextCursor - курсор следующей страницы
+//(пусто на последней странице).
+type Page struct {
+	Events     []Event
+	Total      int
+	NextCursor string
+}
+
+//pageCursor позиция в списке: начало и id последнего выданного события
+type pageCursor struct {
+	date time.Time
+	id   int
+}
+
+//String кодирует курсор для передачи клиенту
+func (c pageCursor) String() string {
+	raw := fmt.Sprintf("%d.%d", c.date.UnixNano(), c.id)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+//parseCursor разбирает курсор из параметра cursor (пусто - с начала списка)
+func parseCursor(str string) (*pageCursor, error) {
+	if str == "" {
+		return nil, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(str)
+	if err != nil {
+		return nil, errors.New("bad cursor")
+	}
+	parts := strings.SplitN(string(raw), ".", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("bad cursor")
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("bad cursor")
+	}
+	id, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, errors.New("bad cursor")
+	}
+	return &pageCursor{date: time.Unix(0, nanos), id: id}, nil
+}
+
+//parsePage разбирает параметры страницы: limit (по умолчанию defaultPageLimit,
+//не больше maxPageLimit) и cursor из NextCursor предыдущей страницы.
+func parsePage(query url.Values) (int, *pageCursor, error) {
+	limit := defaultPageLimit
+	if str := query.Get("limit"); str != "" {
+		var err error
+		if limit, err = strconv.Atoi(str); err != nil || limit <= 0 || limit > maxPageLimit {
+			return 0, nil, errors.New("Bad limit")
+		}
+	}
+
+	cursor, err := parseCursor(query.Get("cursor"))
+	if err != nil {
+		return 0, nil, errors.New("Bad cursor")
+	}
+	return limit, cursor, nil
+}
+
+//eventLess порядок списков: по началу, затем по id
+func eventLess(a Event, b Event) bool {
+	if !time.Time(a.Date).Equal(time.Time(b.Date)) {
+		return time.Time(a.Date).Before(time.Time(b.Date))
+	}
+	return a.ID < b.ID
+}
+
+//sortEvents сортирует события по началу, затем по id
+func sortEvents(events []Event) {
+	sort.SliceStable(events, func(i, j int) bool { return eventLess(events[i], events[j]) })
+}
+
+//paginate сортирует список и выдает его страницу после курсора.
+//Курсор привязан к позиции, а не к номеру, поэтому добавление и удаление
+//событий между запросами не сдвигает следующие страницы.
+func paginate(events []Event, limit int, cursor *pageCursor) Page {
+	sortEvents(events)
+
+	start := 0
+	if cursor != nil {
+		after := Event{ID: cursor.id, Date: JSONTime(cursor.date)}
+		start = sort.Search(len(events), func(i int) bool { return eventLess(after, events[i]) })
+	}
+
+	end := start + limit
+	if end > len(events) {
+		end = len(events)
+	}
+
+	page := Page{Events: events[start:end], Total: len(events)}
+	if end < len(events) {
+		last := events[end-1]
+		page.NextCursor = pageCursor{date: time.Time(last.Date), id: last.ID}.String()
+	}
+	return page
+}
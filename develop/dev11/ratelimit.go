@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//RateLimit ограничение частоты запросов: Rate запросов в секунду в среднем
+//и до Burst запросов подряд. Rate <= 0 - без ограничения.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+//RouteLimit ограничение для end-point'а из конфига
+type RouteLimit struct {
+	Path  string
+	Rate  float64
+	Burst int
+}
+
+//bucketKey корзина токенов клиента на маршруте
+type bucketKey struct {
+	client string
+	route  string
+}
+
+//tokenBucket корзина токенов: пополняется со скоростью Rate до Burst,
+//каждый запрос забирает один токен
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+//RateLimiter ограничивает частоту запросов каждого клиента к каждому маршруту.
+//Ограничение маршрута берется из routes, для остальных маршрутов - defaultLimit.
+type RateLimiter struct {
+	mutex        sync.Mutex
+	defaultLimit RateLimit
+	routes       map[string]RateLimit
+	buckets      map[bucketKey]*tokenBucket
+	now          func() time.Time
+	nextSweep    time.Time
+}
+
+//NewRateLimiter конструктор для RateLimiter.
+//Принимает: ограничение по умолчанию и ограничения отдельных end-point'ов.
+func NewRateLimiter(defaultLimit RateLimit, routes []RouteLimit) *RateLimiter {
+	l := &RateLimiter{buckets: make(map[bucketKey]*tokenBucket), now: time.Now}
+	l.SetLimits(defaultLimit, routes)
+	return l
+}
+
+//SetLimits меняет ограничения на лету. Накопленные корзины клиентов сохраняются:
+//при новом Burst их запас обрезается по нему при следующем запросе.
+func (l *RateLimiter) SetLimits(defaultLimit RateLimit, routes []RouteLimit) {
+	limits := make(map[string]RateLimit, len(routes))
+	for _, route := range routes {
+		limits[route.Path] = RateLimit{Rate: route.Rate, Burst: route.Burst}
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.defaultLimit = defaultLimit
+	l.routes = limits
+}
+
+//limitFor ограничение маршрута. Вызывается под l.mutex.
+func (l *RateLimiter) limitFor(route string) RateLimit {
+	if limit, ok := l.routes[route]; ok {
+		return limit
+	}
+	return l.defaultLimit
+}
+
+//Allow забирает токен клиента на маршруте.
+//Возвращает: разрешен ли запрос и, если нет, через сколько появится следующий токен.
+func (l *RateLimiter) Allow(client string, route string) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	limit := l.limitFor(route)
+	if limit.Rate <= 0 {
+		return true, 0
+	}
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+
+	now := l.now()
+	l.sweep(now)
+
+	key := bucketKey{client: client, route: route}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+//sweep раз в минуту удаляет корзины, которые успели наполниться: они ничем
+//не отличаются от новых, так что память не растет с числом разовых клиентов.
+//Вызывается под l.mutex.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Before(l.nextSweep) {
+		return
+	}
+	for key, b := range l.buckets {
+		limit := l.limitFor(key.route)
+		if b.tokens+now.Sub(b.last).Seconds()*limit.Rate >= float64(limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+	l.nextSweep = now.Add(time.Minute)
+}
+
+//rateLimitClient клиент для ограничения: клиент с верными учетными данными - по имени и id,
+//остальные, в том числе с неверными ключом или токеном, - по IP адресу соединения
+//(X-Forwarded-For не учитывается: его подделывает кто угодно).
+//Возвращает запрос с результатом проверки учетных данных в контексте для Auth и ключ клиента.
+func rateLimitClient(auth *Authenticator, r *http.Request) (*http.Request, string) {
+	if auth != nil {
+		var p Principal
+		var err error
+		if r, p, err = authenticate(auth, r); err == nil {
+			return r, "principal:" + p.Name + "/" + strconv.Itoa(p.UserID)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return r, "ip:" + host
+}
+
+//Limit middleware ограничения частоты запросов. Маршрут берется из шаблона mux,
+//как в метриках. Клиент, исчерпавший лимит, получает 429 с заголовком Retry-After.
+//Стоит перед Auth, чтобы перебор ключей и токенов тоже упирался в лимит своего IP адреса.
+//Без RateLimiter пропускает запросы как есть.
+func Limit(limiter *RateLimiter, auth *Authenticator, mux *http.ServeMux, next http.Handler) http.Handler {
+	if limiter == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+
+		var client string
+		r, client = rateLimitClient(auth, r)
+		allowed, retryAfter := limiter.Allow(client, route)
+		if !allowed {
+			seconds := int(math.Ceil(retryAfter.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			writeJSONMessage(w, http.StatusTooManyRequests, fmt.Sprintf("Too many requests, retry after %d s", seconds), true)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	limiter := NewRateLimiter(RateLimit{Rate: 1, Burst: 2}, []RouteLimit{{Path: "/free", Rate: 0}})
+	now := time.Date(2021, 12, 15, 10, 0, 0, 0, time.UTC)
+	limiter.now = func() time.Time { return now }
+
+	ok, _ := limiter.Allow("a", "/x")
+	assert.True(t, ok)
+	ok, _ = limiter.Allow("a", "/x")
+	assert.True(t, ok)
+	ok, retry := limiter.Allow("a", "/x")
+	assert.False(t, ok)
+	assert.Equal(t, retry, time.Second)
+
+	//другой клиент и другой маршрут со своими корзинами
+	ok, _ = limiter.Allow("b", "/x")
+	assert.True(t, ok)
+	ok, _ = limiter.Allow("a", "/y")
+	assert.True(t, ok)
+	for i := 0; i < 10; i++ {
+		ok, _ = limiter.Allow("a", "/free")
+		assert.True(t, ok)
+	}
+
+	now = now.Add(1500 * time.Millisecond)
+	ok, _ = limiter.Allow("a", "/x")
+	assert.True(t, ok)
+	ok, retry = limiter.Allow("a", "/x")
+	assert.False(t, ok)
+	assert.Equal(t, retry, 500*time.Millisecond)
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	service, _ := newTestService()
+	h := NewHandler(service)
+	h.limiter = NewRateLimiter(RateLimit{}, []RouteLimit{{Path: "/events_for_day", Rate: 0.5, Burst: 1}})
+	handler := h.initRouts()
+
+	get := func(remote string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/events_for_day?user_id=1", nil)
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, get("10.0.0.1:1000").Code, http.StatusOK)
+	//другой порт того же адреса - тот же клиент
+	rec := get("10.0.0.1:2000")
+	assert.Equal(t, rec.Code, http.StatusTooManyRequests)
+	assert.Equal(t, rec.Header().Get("Retry-After"), "2")
+	assert.Equal(t, get("10.0.0.2:1000").Code, http.StatusOK)
+}
+
+func TestRateLimitUnauthorized(t *testing.T) {
+	service, _ := newTestService()
+	h := NewHandler(service)
+	h.auth = newTestAuthenticator(t)
+	h.limiter = NewRateLimiter(RateLimit{Rate: 0.1, Burst: 3}, nil)
+	handler := h.initRouts()
+
+	//перебор ключей упирается в лимит адреса, а не получает 401 без конца
+	codes := []int{}
+	for i := 0; i < 5; i++ {
+		codes = append(codes, doAuth(handler, http.MethodGet, "/events_for_day", "X-API-Key", "guess-"+strconv.Itoa(i)).Code)
+	}
+	assert.Equal(t, codes, []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusUnauthorized,
+		http.StatusTooManyRequests, http.StatusTooManyRequests})
+
+	//клиент с верным ключом считается отдельно от своего адреса
+	rec := doAuth(handler, http.MethodGet, "/events_for_day", "X-API-Key", "reader-key")
+	assert.Equal(t, rec.Code, http.StatusOK)
+}
+
+func TestRateLimitAuthenticatesOnce(t *testing.T) {
+	service, _ := newTestService()
+	h := NewHandler(service)
+	h.auth = newTestAuthenticator(t)
+	h.limiter = NewRateLimiter(RateLimit{Rate: 10, Burst: 10}, nil)
+	handler := h.initRouts()
+	token, _ := h.auth.IssueToken(Principal{Name: "app", UserID: 1, Role: RoleReader}, time.Hour)
+
+	//Limit и Auth проверяют токен один раз на запрос
+	checks := 0
+	h.auth.now = func() time.Time {
+		checks++
+		return time.Now()
+	}
+	rec := doAuth(handler, http.MethodGet, "/events_for_day", "Authorization", "Bearer "+token)
+	assert.Equal(t, rec.Code, http.StatusOK)
+	assert.Equal(t, checks, 1)
+}
+
+func TestFormBodyLimit(t *testing.T) {
+	service, _ := newTestService()
+	handler := NewHandler(service).initRouts()
+
+	body := "user_id=1&date=15-12-2021&text=" + strings.Repeat("a", maxFormBodySize)
+	req := httptest.NewRequest(http.MethodPost, "/create_event", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, rec.Code, http.StatusRequestEntityTooLarge)
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+//Частоты повторения события
+const (
+	FreqDaily   = "daily"
+	FreqWeekly  = "weekly"
+	FreqMonthly = "monthly"
+	FreqYearly  = "yearly"
+)
+
+//weekdayCodes коды дней недели в нотации RRULE
+var weekdayCodes = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+//maxOccurrenceSteps ограничение на число шагов при разворачивании серии,
+//чтобы бесконечное правило не зациклило запрос
+const maxOccurrenceSteps = 100000
+
+var (
+	//ErrNotRecurring событие не является повторяющимся
+	ErrNotRecurring = errors.New("event is not recurring")
+	//ErrNoOccurrence у серии нет вхождения в указанный день
+	ErrNoOccurrence = errors.New("no occurrence at this date")
+)
+
+//Recurrence правило повторения события, подмножество RRULE из RFC 5545.
+//ByWeekday для daily фильтрует дни, для weekly задает дни недели,
+//для monthly - все такие дни недели в месяце; для yearly не используется.
+//Until - последний момент, в который может начаться вхождение (включительно).
+//Вхождения строятся в зоне события, поэтому время суток сохраняется при переходе на летнее время.
+type Recurrence struct {
+	Freq      string         `json:"Freq"`
+	Interval  int            `json:"Interval,omitempty"`
+	Count     int            `json:"Count,omitempty"`
+	Until     *JSONTime      `json:"Until,omitempty"`
+	ByWeekday []time.Weekday `json:"ByWeekday,omitempty"`
+}
+
+//Exception исключение для одного вхождения повторяющегося события.
+//Date - исходное время начала вхождения, по которому оно ищется в серии.
+type Exception struct {
+	Date    JSONTime  `json:"Date"`
+	Deleted bool      `json:"Deleted,omitempty"`
+	NewDate *JSONTime `json:"NewDate,omitempty"`
+	NewEnd  *JSONTime `json:"NewEnd,omitempty"`
+	Text    string    `json:"Text,omitempty"`
+}
+
+//ErrOccurrenceZone зону нельзя поменять у одного вхождения серии
+var ErrOccurrenceZone = errors.New("time zone can't be changed for a single occurrence")
+
+//ErrOccurrenceReminders напоминания нельзя поменять у одного вхождения серии
+var ErrOccurrenceReminders = errors.New("reminders can't be changed for a single occurrence")
+
+//Validate проверяет корректность правила
+func (r *Recurrence) Validate() error {
+	switch r.Freq {
+	case FreqDaily, FreqWeekly, FreqMonthly:
+	case FreqYearly:
+		if len(r.ByWeekday) > 0 {
+			return errors.New("by-weekday is not supported for yearly recurrence")
+		}
+	default:
+		return fmt.Errorf("unknown frequency %q", r.Freq)
+	}
+
+	if r.Interval < 0 {
+		return errors.New("interval must be positive")
+	}
+	if r.Count < 0 {
+		return errors.New("count must be positive")
+	}
+	if r.Count > 0 && r.Until != nil {
+		return errors.New("count and until are mutually exclusive")
+	}
+	for _, wd := range r.ByWeekday {
+		if wd < time.Sunday || wd > time.Saturday {
+			return fmt.Errorf("bad weekday %d", wd)
+		}
+	}
+
+	return nil
+}
+
+//interval возвращает шаг правила (по умолчанию 1)
+func (r *Recurrence) interval() int {
+	if r.Interval <= 0 {
+		return 1
+	}
+	return r.Interval
+}
+
+//hasWeekday проверяет, входит ли день недели в ByWeekday
+func (r *Recurrence) hasWeekday(wd time.Weekday) bool {
+	for _, v := range r.ByWeekday {
+		if v == wd {
+			return true
+		}
+	}
+	return false
+}
+
+//each перебирает исходные даты вхождений серии, начинающейся в dtstart, по порядку
+//до конца серии или до времени end. Перебор прекращается, если yield вернул false.
+func (r *Recurrence) each(dtstart time.Time, end time.Time, yield func(time.Time) bool) {
+	limit := end
+	if r.Until != nil && time.Time(*r.Until).Before(limit) {
+		limit = time.Time(*r.Until)
+	}
+
+	count := 0
+	//emit отдает очередное вхождение, возвращает false, когда перебор пора заканчивать
+	emit := func(t time.Time) bool {
+		if t.Before(dtstart) {
+			return true
+		}
+		if t.After(limit) {
+			return false
+		}
+		count++
+		if !yield(t) {
+			return false
+		}
+		return r.Count == 0 || count < r.Count
+	}
+
+	step := r.interval()
+	for k := 0; k < maxOccurrenceSteps; k++ {
+		var next bool
+		switch r.Freq {
+		case FreqDaily:
+			t := dtstart.AddDate(0, 0, k*step)
+			if t.After(limit) {
+				return
+			}
+			next = true
+			if len(r.ByWeekday) == 0 || r.hasWeekday(t.Weekday()) {
+				next = emit(t)
+			}
+		case FreqWeekly:
+			next = r.eachInWeek(dtstart, k*step, emit)
+		case FreqMonthly:
+			next = r.eachInMonth(dtstart, k*step, emit)
+		case FreqYearly:
+			t := time.Date(dtstart.Year()+k*step, dtstart.Month(), dtstart.Day(),
+				dtstart.Hour(), dtstart.Minute(), dtstart.Second(), dtstart.Nanosecond(), dtstart.Location())
+			if t.After(limit) {
+				return
+			}
+			next = true
+			//29 февраля в невисокосный год пропускается
+			if t.Day() == dtstart.Day() {
+				next = emit(t)
+			}
+		default:
+			return
+		}
+		if !next {
+			return
+		}
+	}
+}
+
+//eachInWeek отдает вхождения недели, отстоящей от недели dtstart на weeks недель
+func (r *Recurrence) eachInWeek(dtstart time.Time, weeks int, emit func(time.Time) bool) bool {
+	days := r.ByWeekday
+	if len(days) == 0 {
+		days = []time.Weekday{dtstart.Weekday()}
+	}
+
+	//дни недели по порядку начиная с понедельника
+	offsets := make([]int, 0, len(days))
+	for _, wd := range days {
+		offsets = append(offsets, (int(wd)+6)%7)
+	}
+	sort.Ints(offsets)
+
+	monday := dtstart.AddDate(0, 0, -((int(dtstart.Weekday())+6)%7)+weeks*7)
+	for _, offset := range offsets {
+		if !emit(monday.AddDate(0, 0, offset)) {
+			return false
+		}
+	}
+	return true
+}
+
+//eachInMonth отдает вхождения месяца, отстоящего от месяца dtstart на months месяцев
+func (r *Recurrence) eachInMonth(dtstart time.Time, months int, emit func(time.Time) bool) bool {
+	first := time.Date(dtstart.Year(), dtstart.Month()+time.Month(months), 1,
+		dtstart.Hour(), dtstart.Minute(), dtstart.Second(), dtstart.Nanosecond(), dtstart.Location())
+
+	if len(r.ByWeekday) == 0 {
+		t := first.AddDate(0, 0, dtstart.Day()-1)
+		//дни, которых нет в месяце (31-е, 30 февраля), пропускаются
+		if t.Month() != first.Month() {
+			return true
+		}
+		return emit(t)
+	}
+
+	for t := first; t.Month() == first.Month(); t = t.AddDate(0, 0, 1) {
+		if r.hasWeekday(t.Weekday()) && !emit(t) {
+			return false
+		}
+	}
+	return true
+}
+
+//findException ищет исключение для исходной даты вхождения
+func findException(event Event, original time.Time) (Exception, bool) {
+	for _, ex := range event.Exceptions {
+		if time.Time(ex.Date).Equal(original) {
+			return ex, true
+		}
+	}
+	return Exception{}, false
+}
+
+//instance строит конкретное вхождение серии с учетом исключения.
+//Вхождение длится столько же, сколько серия, если в исключении не задано другое окончание.
+func instance(event Event, original time.Time, ex Exception, hasEx bool) Event {
+	duration := event.duration()
+	occurrence := JSONTime(original)
+	event.Occurrence = &occurrence
+	event.Exceptions = nil
+	event.Date = JSONTime(original)
+	event.End = JSONTime(original.Add(duration))
+
+	if hasEx {
+		if ex.NewDate != nil {
+			event.Date = *ex.NewDate
+			event.End = JSONTime(time.Time(*ex.NewDate).Add(duration))
+		}
+		if ex.NewEnd != nil {
+			event.End = *ex.NewEnd
+		}
+		if ex.Text != "" {
+			event.Text = ex.Text
+		}
+	}
+	return event
+}
+
+//expand разворачивает повторяющееся событие во вхождения, пересекающиеся с промежутком [start, end].
+//Удаленные вхождения пропускаются, измененные берутся с новыми временем и текстом.
+func expand(event Event, start time.Time, end time.Time) []Event {
+	if start.After(end) {
+		start, end = end, start
+	}
+
+	result := make([]Event, 0)
+	dtstart := time.Time(event.Date).In(event.location())
+
+	event.Recurrence.each(dtstart, end, func(original time.Time) bool {
+		ex, hasEx := findException(event, original)
+		if hasEx && ex.Deleted {
+			return true
+		}
+
+		inst := instance(event, original, ex, hasEx)
+		if inst.overlaps(start, end) {
+			result = append(result, inst)
+		}
+		return true
+	})
+
+	//вхождения, перенесенные в промежуток из-за его правой границы
+	for _, ex := range event.Exceptions {
+		original := time.Time(ex.Date)
+		if ex.Deleted || ex.NewDate == nil || !original.After(end) {
+			continue
+		}
+		if inst := instance(event, original, ex, true); inst.overlaps(start, end) {
+			result = append(result, inst)
+		}
+	}
+
+	return result
+}
+
+//findOccurrence ищет исходное время вхождения серии, начинающегося в календарный день date.
+//День берется так, как он записан в date, и отсчитывается в зоне события.
+func findOccurrence(event Event, date time.Time) (time.Time, error) {
+	if event.Recurrence == nil {
+		return time.Time{}, ErrNotRecurring
+	}
+
+	loc := event.location()
+	year, month, d := date.Date()
+	dayStart, dayEnd := dayBounds(time.Date(year, month, d, 0, 0, 0, 0, loc))
+	var found time.Time
+	event.Recurrence.each(time.Time(event.Date).In(loc), dayEnd, func(original time.Time) bool {
+		if !original.Before(dayStart) {
+			found = original
+			return false
+		}
+		return true
+	})
+
+	if found.IsZero() {
+		return time.Time{}, ErrNoOccurrence
+	}
+	return found, nil
+}
+
+//withException возвращает копию серии, в которой исключение для вхождения дня occurrence
+//заменено результатом change от предыдущего исключения (или пустого, если его не было).
+//Удаленное вхождение изменить нельзя.
+func withException(event Event, occurrence time.Time, change func(prev Exception) Exception) (Event, error) {
+	original, err := findOccurrence(event, occurrence)
+	if err != nil {
+		return event, err
+	}
+
+	prev, _ := findException(event, original)
+	if prev.Deleted {
+		return event, ErrNoOccurrence
+	}
+	ex := change(prev)
+	ex.Date = JSONTime(original)
+
+	exceptions := make([]Exception, 0, len(event.Exceptions)+1)
+	for _, v := range event.Exceptions {
+		if !time.Time(v.Date).Equal(original) {
+			exceptions = append(exceptions, v)
+		}
+	}
+	event.Exceptions = append(exceptions, ex)
+
+	return event, nil
+}
+
+//changeOccurrence возвращает серию с измененным вхождением дня occurrence.
+//Пустые поля изменений означают "оставить как было".
+func changeOccurrence(event Event, occurrence time.Time, change EventChange) (Event, error) {
+	if change.TimeZone != "" {
+		return event, ErrOccurrenceZone
+	}
+	if change.Reminders != nil {
+		return event, ErrOccurrenceReminders
+	}
+	if change.Tags != nil {
+		return event, ErrOccurrenceTags
+	}
+	if change.CalendarID != 0 {
+		return event, ErrOccurrenceCalendar
+	}
+
+	loc := event.location()
+	changed, err := withException(event, occurrence, func(ex Exception) Exception {
+		if change.Text != "" {
+			ex.Text = change.Text
+		}
+		if !change.Date.IsZero() {
+			newDate := JSONTime(change.Date.In(loc))
+			ex.NewDate = &newDate
+		}
+		if !change.End.IsZero() {
+			newEnd := JSONTime(change.End.In(loc))
+			ex.NewEnd = &newEnd
+		}
+		return ex
+	})
+	if err != nil {
+		return event, err
+	}
+
+	//проверяем получившееся вхождение целиком
+	ex := &changed.Exceptions[len(changed.Exceptions)-1]
+	inst := instance(changed, time.Time(ex.Date), *ex, true)
+	if change.Duration > 0 {
+		newEnd := JSONTime(time.Time(inst.Date).Add(change.Duration))
+		ex.NewEnd = &newEnd
+		inst.End = newEnd
+	}
+	if time.Time(inst.End).Before(time.Time(inst.Date)) {
+		return event, ErrEndBeforeStart
+	}
+	return changed, nil
+}
+
+//deleteOccurrence возвращает серию с удаленным вхождением дня occurrence
+func deleteOccurrence(event Event, occurrence time.Time) (Event, error) {
+	return withException(event, occurrence, func(Exception) Exception {
+		return Exception{Deleted: true}
+	})
+}
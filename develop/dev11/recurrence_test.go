@@ -0,0 +1,114 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//occurrenceDays собирает дни месяца у вхождений из выдачи
+func occurrenceDays(events []Event) map[int]bool {
+	days := make(map[int]bool)
+	for _, event := range events {
+		days[time.Time(event.Date).Day()] = true
+	}
+	return days
+}
+
+func TestRecurrenceValidate(t *testing.T) {
+	assert.Nil(t, (&Recurrence{Freq: FreqWeekly, ByWeekday: []time.Weekday{time.Monday}}).Validate())
+	assert.NotNil(t, (&Recurrence{Freq: "hourly"}).Validate())
+	assert.NotNil(t, (&Recurrence{Freq: FreqYearly, ByWeekday: []time.Weekday{time.Monday}}).Validate())
+
+	until := JSONTime(day(2021, 12, 31))
+	assert.NotNil(t, (&Recurrence{Freq: FreqDaily, Count: 3, Until: &until}).Validate())
+}
+
+func TestExpandWeeklyByWeekday(t *testing.T) {
+	//с понедельника 6 декабря по понедельникам и средам
+	event := newEvent(1, "standup", day(2021, 12, 6))
+	event.Recurrence = &Recurrence{Freq: FreqWeekly, ByWeekday: []time.Weekday{time.Wednesday, time.Monday}}
+
+	result := expand(event, day(2021, 12, 1), day(2021, 12, 19))
+	assert.Equal(t, len(result), 4)
+	assert.Equal(t, occurrenceDays(result), map[int]bool{6: true, 8: true, 13: true, 15: true})
+	assert.NotNil(t, result[0].Occurrence)
+}
+
+func TestExpandIntervalCountUntil(t *testing.T) {
+	event := newEvent(1, "123", day(2021, 12, 1))
+	event.Recurrence = &Recurrence{Freq: FreqDaily, Interval: 2, Count: 3}
+
+	result := expand(event, day(2021, 12, 1), day(2021, 12, 31))
+	assert.Equal(t, occurrenceDays(result), map[int]bool{1: true, 3: true, 5: true})
+
+	until := JSONTime(day(2021, 12, 7))
+	event.Recurrence = &Recurrence{Freq: FreqDaily, Interval: 3, Until: &until}
+
+	result = expand(event, day(2021, 12, 1), day(2021, 12, 31))
+	assert.Equal(t, occurrenceDays(result), map[int]bool{1: true, 4: true, 7: true})
+}
+
+func TestExpandMonthlySkipsShortMonths(t *testing.T) {
+	event := newEvent(1, "review", day(2021, 1, 31))
+	event.Recurrence = &Recurrence{Freq: FreqMonthly}
+
+	result := expand(event, day(2021, 1, 1), day(2021, 6, 30))
+	months := make([]time.Month, 0)
+	for _, v := range result {
+		months = append(months, time.Time(v.Date).Month())
+	}
+	assert.Equal(t, months, []time.Month{time.January, time.March, time.May})
+}
+
+func TestOccurrenceExceptions(t *testing.T) {
+	store := NewEventStore()
+	event := newEvent(1, "standup", day(2021, 12, 6))
+	event.Recurrence = &Recurrence{Freq: FreqDaily, Count: 5}
+	store.Save(event, Author{})
+
+	_, ok, err := store.Delete(1, 1, day(2021, 12, 7), 0, Author{})
+	assert.True(t, ok)
+	assert.Nil(t, err)
+
+	_, ok, err = store.Change(1, 1, day(2021, 12, 8), EventChange{Text: "moved", Date: day(2021, 12, 20)}, 0, Author{})
+	assert.True(t, ok)
+	assert.Nil(t, err)
+
+	_, ok, err = store.Change(1, 1, day(2021, 12, 8), EventChange{Text: "moved again"}, 0, Author{})
+	assert.True(t, ok)
+	assert.Nil(t, err)
+
+	result, err := store.getBetween(1, day(2021, 12, 6), day(2021, 12, 10))
+	assert.Nil(t, err)
+	assert.Equal(t, occurrenceDays(result), map[int]bool{6: true, 9: true, 10: true})
+
+	result, err = store.getBetween(1, day(2021, 12, 20), day(2021, 12, 20))
+	assert.Nil(t, err)
+	assert.Equal(t, len(result), 1)
+	assert.Equal(t, result[0].Text, "moved again")
+	assert.True(t, time.Time(*result[0].Occurrence).Equal(day(2021, 12, 8)))
+
+	_, _, err = store.Change(1, 1, day(2021, 12, 7), EventChange{Text: "deleted"}, 0, Author{})
+	assert.Equal(t, err, ErrNoOccurrence)
+
+	_, _, err = store.Delete(1, 1, day(2021, 12, 11), 0, Author{})
+	assert.Equal(t, err, ErrNoOccurrence)
+}
+
+func TestExpandKeepsLocalTimeAcrossDST(t *testing.T) {
+	berlin, err := loadLocation("Europe/Berlin")
+	assert.Nil(t, err)
+
+	start := time.Date(2021, 3, 26, 9, 0, 0, 0, berlin)
+	event := Event{UserID: 1, Date: JSONTime(start.UTC()), End: JSONTime(start.Add(15 * time.Minute).UTC()),
+		TimeZone: "Europe/Berlin", Recurrence: &Recurrence{Freq: FreqDaily, Count: 4}}
+
+	result := expand(event, start, start.AddDate(0, 0, 7))
+	assert.Equal(t, len(result), 4)
+	for _, v := range result {
+		assert.Equal(t, time.Time(v.Date).In(berlin).Hour(), 9)
+		assert.Equal(t, v.duration(), 15*time.Minute)
+	}
+}
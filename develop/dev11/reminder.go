@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+//maxReminderOffset самое раннее напоминание - за неделю до начала события
+const maxReminderOffset = 7 * 24 * time.Hour
+
+//sendTimeout время на доставку одного напоминания в один приемник
+const sendTimeout = 10 * time.Second
+
+//Offset за сколько до начала события присылать напоминание.
+//В JSON - строка в формате time.ParseDuration: "15m", "1h30m".
+type Offset time.Duration
+
+//MarshalJSON записывает смещение строкой длительности
+func (o Offset) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(o).String())
+}
+
+//UnmarshalJSON разбирает смещение из строки длительности
+func (o *Offset) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+	d, err := time.ParseDuration(str)
+	if err != nil {
+		return fmt.Errorf("bad reminder offset %q", str)
+	}
+	*o = Offset(d)
+	return nil
+}
+
+//validateReminders проверяет, что напоминания приходят не позже начала события и не раньше чем за неделю
+func validateReminders(reminders []Offset) error {
+	for _, o := range reminders {
+		if o < 0 || time.Duration(o) > maxReminderOffset {
+			return fmt.Errorf("reminder offset %s is out of range [0, %s]", time.Duration(o), maxReminderOffset)
+		}
+	}
+	return nil
+}
+
+//Notification напоминание о вхождении события, отправляемое в приемники.
+//Key однозначно определяет напоминание: id события, начало вхождения и смещение.
+//Перенос события дает новые напоминания, изменение текста - нет.
+type Notification struct {
+	Key     string   `json:"Key"`
+	EventID int      `json:"EventID"`
+	UserID  int      `json:"UserID"`
+	Text    string   `json:"Text"`
+	Start   JSONTime `json:"Start"`
+	Before  Offset   `json:"Before"`
+	Due     JSONTime `json:"Due"`
+}
+
+//Sink приемник напоминаний
+type Sink interface {
+	//Name имя приемника, под которым учитывается доставка
+	Name() string
+	//Send доставляет напоминание; ошибка означает, что доставку нужно повторить
+	Send(ctx context.Context, n Notification) error
+}
+
+//Scheduler фоновая рассылка напоминаний.
+//Каждый interval ищет напоминания, срок которых наступил за последние lookback,
+//и отправляет в каждый приемник те, что он еще не подтвердил.
+//Доставка "хотя бы один раз": отметка о доставке пишется в statePath только после
+//успешной отправки, так что после сбоя напоминание в пределах lookback будет отправлено повторно.
+type Scheduler struct {
+	storage   Storage
+	sinks     []Sink
+	interval  time.Duration
+	lookback  time.Duration
+	statePath string
+	now       func() time.Time
+	delivered map[string]time.Time
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+//NewScheduler конструктор для Scheduler.
+//Принимает: хранилище событий, приемники, период проверки, окно досылки пропущенных
+//напоминаний и файл с отметками о доставке (пусто - отметки только в памяти).
+//Возвращает: ссылку на Scheduler и ошибку чтения отметок.
+func NewScheduler(storage Storage, sinks []Sink, interval time.Duration, lookback time.Duration, statePath string) (*Scheduler, error) {
+	if interval <= 0 {
+		return nil, errors.New("reminder interval must be positive")
+	}
+	if lookback < interval {
+		lookback = interval
+	}
+
+	s := &Scheduler{
+		storage:   storage,
+		sinks:     sinks,
+		interval:  interval,
+		lookback:  lookback,
+		statePath: statePath,
+		now:       time.Now,
+		delivered: make(map[string]time.Time),
+	}
+
+	if statePath == "" {
+		return s, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(statePath), 0755); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.delivered); err != nil {
+		return nil, fmt.Errorf("bad reminder state %s: %w", statePath, err)
+	}
+	return s, nil
+}
+
+//Start запускает рассылку в отдельной горутине
+func (s *Scheduler) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.done = make(chan struct{})
+
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			if err := s.fire(ctx); err != nil {
+				log.Printf("reminders: %s", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+//Stop останавливает рассылку и дожидается завершения текущей проверки
+func (s *Scheduler) Stop() {
+	if s.cancel == nil {
+		return
+	}
+	s.cancel()
+	<-s.done
+}
+
+//due возвращает напоминания, срок которых наступил в промежутке (now - lookback, now]
+func (s *Scheduler) due(now time.Time) ([]Notification, error) {
+	events, err := s.storage.scanBetween(now.Add(-s.lookback), now.Add(maxReminderOffset))
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]Notification, 0)
+	for _, event := range events {
+		start := time.Time(event.Date)
+		for _, before := range event.Reminders {
+			due := start.Add(-time.Duration(before))
+			if due.After(now) || !due.After(now.Add(-s.lookback)) {
+				continue
+			}
+			result = append(result, Notification{
+				Key:     fmt.Sprintf("%d/%s/%s", event.ID, start.UTC().Format(time.RFC3339), time.Duration(before)),
+				EventID: event.ID,
+				UserID:  event.UserID,
+				Text:    event.Text,
+				Start:   event.Date,
+				Before:  before,
+				Due:     JSONTime(due),
+			})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return time.Time(result[i].Due).Before(time.Time(result[j].Due)) })
+	return result, nil
+}
+
+//fire отправляет наступившие напоминания во все приемники, которые их еще не подтвердили.
+//Неудачные отправки повторяются на следующей проверке.
+func (s *Scheduler) fire(ctx context.Context) error {
+	now := s.now()
+	notifications, err := s.due(now)
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	for _, n := range notifications {
+		for _, sink := range s.sinks {
+			key := sink.Name() + "|" + n.Key
+			if _, ok := s.delivered[key]; ok {
+				continue
+			}
+			if ctx.Err() != nil {
+				return s.saveState(changed)
+			}
+
+			sendCtx, cancel := context.WithTimeout(ctx, sendTimeout)
+			err := sink.Send(sendCtx, n)
+			cancel()
+			if err != nil {
+				log.Printf("reminders: %s: %s: %s", sink.Name(), n.Key, err)
+				continue
+			}
+			s.delivered[key] = time.Time(n.Due)
+			changed = true
+		}
+	}
+
+	//отметки старше окна досылки больше не нужны
+	for key, due := range s.delivered {
+		if !due.After(now.Add(-s.lookback)) {
+			delete(s.delivered, key)
+			changed = true
+		}
+	}
+
+	return s.saveState(changed)
+}
+
+//saveState сохраняет отметки о доставке, если они изменились
+func (s *Scheduler) saveState(changed bool) error {
+	if !changed || s.statePath == "" {
+		return nil
+	}
+	data, err := json.Marshal(s.delivered)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.statePath, data)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+//LogSink приемник, пишущий напоминания в лог
+type LogSink struct{}
+
+//Name имя приемника
+func (LogSink) Name() string {
+	return "log"
+}
+
+//Send пишет напоминание в лог
+func (LogSink) Send(ctx context.Context, n Notification) error {
+	log.Printf("reminder: user %d, event %d %q starts at %s", n.UserID, n.EventID, n.Text, time.Time(n.Start).Format(time.RFC3339))
+	return nil
+}
+
+//WebhookSink приемник, отправляющий напоминания POST запросом с JSON телом.
+//Доставка подтверждается любым 2xx ответом.
+type WebhookSink struct {
+	url    string
+	client *http.Client
+}
+
+//NewWebhookSink конструктор для WebhookSink
+func NewWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{url: url, client: &http.Client{}}
+}
+
+//Name имя приемника
+func (s *WebhookSink) Name() string {
+	return "webhook:" + s.url
+}
+
+//Send отправляет напоминание на url приемника
+func (s *WebhookSink) Send(ctx context.Context, n Notification) error {
+	return postJSON(ctx, s.client, s.url, n.Key, n)
+}
+
+//postJSON отправляет v POST запросом с JSON телом и ключом идемпотентности key.
+//Доставка подтверждается любым 2xx ответом.
+func postJSON(ctx context.Context, client *http.Client, url string, key string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", key)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
+
+//FileSink приемник, дописывающий напоминания JSON строками в файл-очередь,
+//который разбирает внешний обработчик. Запись подтверждается после fsync.
+type FileSink struct {
+	path  string
+	mutex sync.Mutex
+}
+
+//NewFileSink конструктор для FileSink
+func NewFileSink(path string) *FileSink {
+	return &FileSink{path: path}
+}
+
+//Name имя приемника
+func (s *FileSink) Name() string {
+	return "file:" + s.path
+}
+
+//Send дописывает напоминание в файл
+func (s *FileSink) Send(ctx context.Context, n Notification) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return appendJSONLine(s.path, n)
+}
+
+//appendJSONLine дописывает v JSON строкой в файл path и сбрасывает его на диск.
+//Запись в один файл должна идти под блокировкой вызывающего.
+func appendJSONLine(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//memorySink приемник для тестов: запоминает доставленные напоминания,
+//первые fail отправок завершаются ошибкой
+type memorySink struct {
+	fail int
+	sent []Notification
+}
+
+func (s *memorySink) Name() string {
+	return "memory"
+}
+
+func (s *memorySink) Send(ctx context.Context, n Notification) error {
+	if s.fail > 0 {
+		s.fail--
+		return errors.New("unavailable")
+	}
+	s.sent = append(s.sent, n)
+	return nil
+}
+
+func TestSchedulerAtLeastOnce(t *testing.T) {
+	store := NewEventStore()
+	event := newEvent(1, "standup", fixedNow.Add(10*time.Minute))
+	event.Reminders = []Offset{Offset(15 * time.Minute), Offset(5 * time.Minute)}
+	event.Recurrence = &Recurrence{Freq: FreqDaily}
+	store.Save(event, Author{})
+
+	state := filepath.Join(t.TempDir(), "reminders.json")
+	sink := &memorySink{fail: 1}
+	scheduler, err := NewScheduler(store, []Sink{sink}, time.Minute, time.Hour, state)
+	assert.Nil(t, err)
+	scheduler.now = func() time.Time { return fixedNow }
+
+	//первая отправка падает и повторяется на следующей проверке
+	assert.Nil(t, scheduler.fire(context.Background()))
+	assert.Equal(t, len(sink.sent), 0)
+	assert.Nil(t, scheduler.fire(context.Background()))
+	assert.Equal(t, len(sink.sent), 1)
+	assert.Equal(t, time.Duration(sink.sent[0].Before), 15*time.Minute)
+
+	//после перезапуска доставленное не повторяется, наступившее - досылается
+	restarted, err := NewScheduler(store, []Sink{sink}, time.Minute, time.Hour, state)
+	assert.Nil(t, err)
+	restarted.now = func() time.Time { return fixedNow.Add(30 * time.Minute) }
+	assert.Nil(t, restarted.fire(context.Background()))
+	assert.Equal(t, len(sink.sent), 2)
+	assert.Equal(t, time.Duration(sink.sent[1].Before), 5*time.Minute)
+
+	//следующее вхождение серии
+	restarted.now = func() time.Time { return fixedNow.Add(24*time.Hour - 5*time.Minute) }
+	assert.Nil(t, restarted.fire(context.Background()))
+	assert.Equal(t, len(sink.sent), 3)
+	assert.True(t, time.Time(sink.sent[2].Start).Equal(fixedNow.Add(24*time.Hour+10*time.Minute)))
+}
+
+func TestValidateReminders(t *testing.T) {
+	assert.Nil(t, validateReminders([]Offset{0, Offset(time.Hour)}))
+	assert.NotNil(t, validateReminders([]Offset{Offset(-time.Minute)}))
+	assert.NotNil(t, validateReminders([]Offset{Offset(8 * 24 * time.Hour)}))
+
+	service, _ := newTestService()
+	_, err := service.SaveEvent(Event{UserID: 1, Date: JSONTime(fixedNow), Reminders: []Offset{Offset(-time.Minute)}})
+	assert.NotNil(t, err)
+}
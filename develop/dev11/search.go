@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+//maxTagLength максимальная длина тега
+const maxTagLength = 32
+
+//ErrEmptyQuery в поисковом запросе нет ни слов, ни тегов
+var ErrEmptyQuery = errors.New("empty search query")
+
+//ErrOccurrenceTags теги нельзя поменять у одного вхождения серии
+var ErrOccurrenceTags = errors.New("tags can't be changed for a single occurrence")
+
+//tokenize разбивает текст на слова для поиска: буквы и цифры в нижнем регистре
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+//normalizeTags приводит теги к нижнему регистру, убирает повторы и сортирует.
+//Возвращает ошибку для пустого, слишком длинного тега или тега с запятой.
+func normalizeTags(tags []string) ([]string, error) {
+	if len(tags) == 0 {
+		return nil, nil
+	}
+
+	seen := make(map[string]struct{}, len(tags))
+	result := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || len(tag) > maxTagLength || strings.Contains(tag, ",") {
+			return nil, fmt.Errorf("bad tag %q", tag)
+		}
+		if _, ok := seen[tag]; ok {
+			continue
+		}
+		seen[tag] = struct{}{}
+		result = append(result, tag)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+//eventWords слова события для индекса: из текста серии и текстов измененных вхождений
+func eventWords(event Event) []string {
+	words := tokenize(event.Text)
+	for _, ex := range event.Exceptions {
+		words = append(words, tokenize(ex.Text)...)
+	}
+	return words
+}
+
+//invertedIndex обратный индекс: слово (или тег) - множество id событий
+type invertedIndex map[string]map[int]struct{}
+
+//add добавляет id события в списки ключей
+func (idx invertedIndex) add(keys []string, id int) {
+	for _, key := range keys {
+		ids, ok := idx[key]
+		if !ok {
+			ids = make(map[int]struct{})
+			idx[key] = ids
+		}
+		ids[id] = struct{}{}
+	}
+}
+
+//remove убирает id события из списков ключей
+func (idx invertedIndex) remove(keys []string, id int) {
+	for _, key := range keys {
+		ids := idx[key]
+		delete(ids, id)
+		if len(ids) == 0 {
+			delete(idx, key)
+		}
+	}
+}
+
+//lookup возвращает id событий, у которых есть все ключи
+func (idx invertedIndex) lookup(keys []string) map[int]struct{} {
+	//пересечение начинаем с самого короткого списка
+	sorted := append([]string{}, keys...)
+	sort.Slice(sorted, func(i, j int) bool { return len(idx[sorted[i]]) < len(idx[sorted[j]]) })
+
+	result := make(map[int]struct{})
+	for id := range idx[sorted[0]] {
+		result[id] = struct{}{}
+	}
+	for _, key := range sorted[1:] {
+		for id := range result {
+			if _, ok := idx[key][id]; !ok {
+				delete(result, id)
+			}
+		}
+	}
+	return result
+}
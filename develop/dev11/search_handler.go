@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+//search обработчик для GET /search.
+//Параметры: user_id, q - слова, которые должны быть в тексте события,
+//tag - теги, которые должны быть у события (через запятую или повтором параметра),
+//limit и cursor - страница результата.
+func (h *Handler) search(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONMessage(w, http.StatusMethodNotAllowed, fmt.Sprintf("expect method Get at /search, got %v", r.Method), true)
+		return
+	}
+
+	query := r.URL.Query()
+
+	userID, status, err := resolveUserID(r, query.Get("user_id"))
+	if err != nil {
+		writeJSONMessage(w, status, err.Error(), true)
+		return
+	}
+
+	limit, cursor, err := parsePage(query)
+	if err != nil {
+		writeJSONMessage(w, http.StatusBadRequest, err.Error(), true)
+		return
+	}
+
+	tags, _ := parseTags(query, "tag")
+	result, err := h.service.Search(userID, query.Get("q"), tags)
+
+	if errors.Is(err, ErrEmptyQuery) {
+		writeJSONMessage(w, http.StatusBadRequest, "Bad q: empty search query", true)
+		return
+	}
+	if err != nil {
+		writeJSONMessage(w, http.StatusServiceUnavailable, fmt.Sprintf("Can't search events: %s", err), true)
+		return
+	}
+
+	writeJSONEvents(w, http.StatusOK, paginate(result, limit, cursor))
+}
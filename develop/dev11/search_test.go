@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//eventTexts собирает тексты событий из выдачи
+func eventTexts(events []Event) []string {
+	texts := make([]string, 0, len(events))
+	for _, event := range events {
+		texts = append(texts, event.Text)
+	}
+	return texts
+}
+
+func TestSearchIndex(t *testing.T) {
+	service, store := newTestService()
+
+	review := newEvent(1, "Code review: backend", day(2021, 12, 2))
+	review.Tags = []string{"Work", "work", "dev"}
+	service.SaveEvent(review)
+	service.SaveEvent(newEvent(1, "Backend deploy", day(2021, 12, 1)))
+	service.SaveEvent(newEvent(2, "backend", day(2021, 12, 1)))
+
+	saved, _ := store.Load(1)
+	assert.Equal(t, saved.Tags, []string{"dev", "work"})
+
+	result, err := service.Search(1, "BACKEND", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, eventTexts(result), []string{"Backend deploy", "Code review: backend"})
+
+	result, err = service.Search(1, "backend review", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, eventTexts(result), []string{"Code review: backend"})
+
+	result, err = service.Search(1, "", []string{"work"})
+	assert.Nil(t, err)
+	assert.Equal(t, len(result), 1)
+
+	//индекс следует за изменениями и удалением
+	_, _, err = service.ChangeEvent(1, 2, time.Time{}, EventChange{Text: "Frontend deploy", Tags: []string{"work"}}, 0)
+	assert.Nil(t, err)
+	result, _ = service.Search(1, "backend", nil)
+	assert.Equal(t, eventTexts(result), []string{"Code review: backend"})
+	result, _ = service.Search(1, "deploy", []string{"work"})
+	assert.Equal(t, eventTexts(result), []string{"Frontend deploy"})
+
+	service.DeleteEvent(1, 1, time.Time{}, 0)
+	result, _ = service.Search(1, "review", nil)
+	assert.Equal(t, len(result), 0)
+
+	_, err = service.Search(1, " ,. ", nil)
+	assert.Equal(t, err, ErrEmptyQuery)
+}
+
+func TestSearchSharedCalendar(t *testing.T) {
+	service, _ := newTestService()
+	work, _ := service.CreateCalendar(1, "work")
+	service.CreateCalendar(1, "private")
+	service.ShareCalendar(1, work.ID, 2, ShareRead)
+
+	planning := newEvent(1, "Sprint planning", day(2021, 12, 2))
+	planning.CalendarID = work.ID
+	service.SaveEvent(planning)
+	secret := newEvent(1, "Sprint secret", day(2021, 12, 1))
+	secret.CalendarID = work.ID + 1
+	service.SaveEvent(secret)
+	service.SaveEvent(newEvent(1, "Sprint retro", day(2021, 12, 1)))
+	service.SaveEvent(newEvent(2, "Sprint notes", day(2021, 12, 3)))
+
+	//поиск видит те же события, что и общий список
+	result, err := service.Search(2, "sprint", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, eventTexts(result), []string{"Sprint planning", "Sprint notes"})
+	all, _ := service.GetAll(2)
+	assert.Equal(t, len(all), len(result))
+
+	result, _ = service.Search(1, "sprint", nil)
+	assert.Equal(t, len(result), 3)
+}
+
+func TestPaginate(t *testing.T) {
+	events := []Event{
+		{ID: 3, Date: JSONTime(day(2021, 12, 2))},
+		{ID: 2, Date: JSONTime(day(2021, 12, 1))},
+		{ID: 1, Date: JSONTime(day(2021, 12, 1))},
+		{ID: 4, Date: JSONTime(day(2021, 12, 3))},
+	}
+
+	page := paginate(events, 3, nil)
+	assert.Equal(t, page.Total, 4)
+	assert.Equal(t, []int{page.Events[0].ID, page.Events[1].ID, page.Events[2].ID}, []int{1, 2, 3})
+	assert.NotEqual(t, page.NextCursor, "")
+
+	cursor, err := parseCursor(page.NextCursor)
+	assert.Nil(t, err)
+	page = paginate(events, 3, cursor)
+	assert.Equal(t, len(page.Events), 1)
+	assert.Equal(t, page.Events[0].ID, 4)
+	assert.Equal(t, page.NextCursor, "")
+
+	_, err = parseCursor("???")
+	assert.NotNil(t, err)
+}
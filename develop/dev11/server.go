@@ -2,36 +2,67 @@ package main
 
 import (
 	"context"
+	"errors"
 	"net/http"
-	"time"
+	"sync"
 )
 
 //Server тип для работы с http.Server
 type Server struct {
+	mutex      sync.Mutex
 	httpServer *http.Server
+	config     ServerConfig
+	stopped    bool
 }
 
 //NewServer конструктор, возвращающий ссылку на Server
-func NewServer() *Server {
-	return &Server{}
+//Принимает: таймауты и ограничения http.Server из конфига
+func NewServer(config ServerConfig) *Server {
+	return &Server{config: config}
 }
 
 //Run запускает сервер на указанном порту
 //Принимает: строку с портом и http.Handler
-//Возвращет ошибку от ListenAndServe
+//Возвращет ошибку от ListenAndServe (например, порт занят) или nil после Shutdown
 func (s *Server) Run(port string, handler http.Handler) error {
+	s.mutex.Lock()
+	if s.stopped {
+		s.mutex.Unlock()
+		return nil
+	}
 	s.httpServer = &http.Server{
-		Addr:           ":" + port,
-		Handler:        handler,
-		MaxHeaderBytes: 1 << 20, //1 MB
-		WriteTimeout:   10 * time.Second,
-		ReadTimeout:    10 * time.Second,
+		Addr:              ":" + port,
+		Handler:           handler,
+		MaxHeaderBytes:    s.config.MaxHeaderBytes,
+		WriteTimeout:      s.config.WriteTimeout,
+		ReadTimeout:       s.config.ReadTimeout,
+		ReadHeaderTimeout: s.config.ReadHeaderTimeout,
+		IdleTimeout:       s.config.IdleTimeout,
 	}
+	httpServer := s.httpServer
+	s.mutex.Unlock()
 
-	return s.httpServer.ListenAndServe()
+	if err := httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
 }
 
-//Shutdown gracefully shutdown the server
+//Shutdown gracefully shutdown the server: перестает принимать соединения
+//и ждет завершения начатых запросов до дедлайна ctx. Если запросы не успели
+//завершиться, оставшиеся соединения закрываются принудительно, а возвращается ошибка ctx.
 func (s *Server) Shutdown(ctx context.Context) error {
-	return s.httpServer.Shutdown(ctx)
+	s.mutex.Lock()
+	s.stopped = true
+	httpServer := s.httpServer
+	s.mutex.Unlock()
+
+	if httpServer == nil {
+		return nil
+	}
+	if err := httpServer.Shutdown(ctx); err != nil {
+		httpServer.Close()
+		return err
+	}
+	return nil
 }
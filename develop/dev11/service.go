@@ -1,43 +1,470 @@
 package main
 
-import "time"
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
 
 //Service тип, реализующий прослойку между handler и storage
 type Service struct {
-	storage *EventStore
+	storage   Storage
+	now       func() time.Time
+	mutex     sync.RWMutex
+	conflicts ConflictPolicy
+	feed      *Broker
+	outbox    *OutboxQueue
+	calendars *CalendarStore
+	audit     *AuditLog
+	//calendarWrites держат на чтение записи, которые могут положить событие в календарь,
+	//от проверки календаря до записи в хранилище; DeleteCalendar дожидается их
+	calendarWrites sync.RWMutex
 }
 
-//NewService конструктор, возвращающий ссылку на Serivce
-func NewService(storage *EventStore) *Service {
-	return &Service{storage}
+//NewService конструктор, возвращающий ссылку на Serivce.
+//Текущее время берется из time.Now, в тестах часы подменяются через поле now.
+//Пересечения событий разрешены, политика меняется через поле conflicts
+//или, пока сервис работает, через SetConflictPolicy.
+//Изменения хранилища публикуются в ленту feed.
+//Сообщения iTIP участникам событий доставляет очередь поля outbox (по умолчанию без ящиков, то есть никуда).
+//Календари хранятся в памяти; сохраняемое на диск хранилище подставляется через поле calendars.
+//Изменения событий записываются в журнал аудита audit, по умолчанию тоже только в памяти.
+func NewService(storage Storage) *Service {
+	calendars, _ := NewCalendarStore("")
+	audit, _ := NewAuditLog("")
+	outbox, _ := NewOutboxQueue(nil, "")
+	s := &Service{storage: storage, now: time.Now, conflicts: ConflictAllow, feed: NewBroker(), outbox: outbox,
+		calendars: calendars, audit: audit}
+	storage.Observe(s.observe)
+	return s
 }
 
-//SaveEvent добавлет Event с переданными данными в хранилище
-func (s *Service) SaveEvent(text string, date time.Time) error {
-	return s.storage.Save(text, date)
+//observe наблюдатель хранилища: публикует изменение в ленту и записывает его в журнал аудита
+func (s *Service) observe(kind string, event Event, previous *Event, by Author) {
+	s.feed.Publish(kind, event, previous)
+	s.record(kind, event, previous, by)
 }
 
-//ChangeEvent изменяет Event из хранилища, заполняя новыми переданными данными
-func (s *Service) ChangeEvent(id int, text string, date time.Time) (bool, error) {
-	return s.storage.Change(id, text, date)
+//SetConflictPolicy меняет политику пересечений на лету
+func (s *Service) SetConflictPolicy(policy ConflictPolicy) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.conflicts = policy
+}
+
+//conflictPolicy текущая политика пересечений
+func (s *Service) conflictPolicy() ConflictPolicy {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.conflicts
+}
+
+//anchor возвращает опорную дату запроса: переданную или текущую, если она не задана.
+//Зона нулевого времени (time.Time{}.In(loc)) задает зону, в которой берется текущая дата.
+func (s *Service) anchor(date time.Time) time.Time {
+	if date.IsZero() {
+		return s.now().In(date.Location())
+	}
+	return date
+}
+
+//SaveEvent добавлет Event в хранилище.
+//У события должны быть заполнены владелец, текст и время начала; Recurrence - nil для одиночного события.
+//Время переводится в зону события; событие без окончания длится ноль времени,
+//событие на весь день - с полуночи до полуночи следующего дня.
+//Событие в календаре CalendarID, открытом автору UserID на запись, получает владельцем владельца календаря.
+//Возвращает сохраненное событие с присвоенным id.
+//Пересечения с другими событиями владельца обрабатываются по политике s.conflicts.
+func (s *Service) SaveEvent(event Event) (Event, error) {
+	s.calendarWrites.RLock()
+	defer s.calendarWrites.RUnlock()
+
+	actor := event.UserID
+	if err := prepareEvent(&event); err != nil {
+		return Event{}, err
+	}
+	if event.CalendarID != 0 {
+		cal, ok := s.calendars.Load(event.CalendarID)
+		if !ok || !cal.allows(event.UserID, ShareWrite) {
+			return Event{}, ErrCalendarNotFound
+		}
+		event.UserID = cal.OwnerID
+	}
+	conflicts, err := s.checkConflicts(event)
+	if err != nil {
+		return Event{}, err
+	}
+
+	saved, err := s.storage.Save(event, Author{UserID: actor})
+	if err != nil {
+		return Event{}, err
+	}
+	saved.Conflicts = conflicts
+	return saved, nil
+}
+
+//ReplaceEvent заменяет Event пользователя целиком новыми данными.
+//Событие проходит те же проверки, что и в SaveEvent; id и владелец берутся из аргументов.
+//Заменить можно и событие календаря, открытого пользователю на запись.
+//Календарь события меняется, только если CalendarID передан; UID без нового сохраняется.
+//Версия version - ожидаемая версия события из If-Match (0 - без проверки).
+//Возвращает новое состояние события, флаг наличия у пользователя события и ошибку замены.
+func (s *Service) ReplaceEvent(userID int, id int, event Event, version int) (Event, bool, error) {
+	s.calendarWrites.RLock()
+	defer s.calendarWrites.RUnlock()
+
+	ownerID := s.eventOwner(userID, id, ShareWrite)
+	el, ok := s.ownEvent(ownerID, id)
+	if !ok {
+		return Event{}, false, nil
+	}
+	if err := prepareEvent(&event); err != nil {
+		return Event{}, true, err
+	}
+	if event.CalendarID == 0 {
+		event.CalendarID = el.CalendarID
+	} else if err := s.checkCalendar(userID, ownerID, event.CalendarID); err != nil {
+		return Event{}, true, err
+	}
+	if event.UID == "" {
+		event.UID = el.UID
+	}
+	event.ID, event.UserID = id, ownerID
+
+	conflicts, err := s.checkConflicts(event)
+	if err != nil {
+		return Event{}, true, err
+	}
+
+	replaced, ok, err := s.storage.Replace(ownerID, event, version, Author{UserID: userID})
+	if !ok || err != nil {
+		return Event{}, ok, err
+	}
+	replaced.Conflicts = conflicts
+	return replaced, true, nil
+}
+
+//checkConflicts проверяет пересечения события с другими событиями владельца по политике s.conflicts.
+//Возвращает: id пересекающихся событий при ConflictFlag, *ConflictError при ConflictReject.
+func (s *Service) checkConflicts(event Event) ([]int, error) {
+	policy := s.conflictPolicy()
+	if policy == ConflictAllow || policy == "" {
+		return nil, nil
+	}
+
+	conflicts, err := findConflicts(s.storage, event)
+	if err != nil {
+		return nil, err
+	}
+	if len(conflicts) > 0 && policy == ConflictReject {
+		return nil, &ConflictError{Conflicts: conflicts}
+	}
+	return conflicts, nil
+}
+
+//CountEvents возвращает количество событий всех пользователей
+func (s *Service) CountEvents() int {
+	return s.storage.Len()
+}
+
+//GetEvent выдает Event по id, повторяющийся - серией, если пользователь его видит:
+//это его событие, событие календаря, открытого ему, или событие, на которое он приглашен
+func (s *Service) GetEvent(userID int, id int) (Event, bool) {
+	event, ok := s.storage.Load(id)
+	if !ok {
+		return Event{}, false
+	}
+	if _, invited := event.attendee(userID); !invited && s.eventOwner(userID, id, ShareRead) != event.UserID {
+		return Event{}, false
+	}
+	return event, true
+}
+
+//ownEvent выдает Event владельца userID по id
+func (s *Service) ownEvent(userID int, id int) (Event, bool) {
+	event, ok := s.storage.Load(id)
+	if !ok || event.UserID != userID {
+		return Event{}, false
+	}
+	return event, true
+}
+
+//eventOwner возвращает пользователя, от имени которого userID работает с событием id на уровне level:
+//владельца календаря события, если календарь открыт userID, иначе самого userID
+func (s *Service) eventOwner(userID int, id int, level string) int {
+	event, ok := s.storage.Load(id)
+	if !ok || event.UserID == userID || event.CalendarID == 0 {
+		return userID
+	}
+	cal, ok := s.calendars.Load(event.CalendarID)
+	if ok && cal.OwnerID == event.UserID && cal.allows(userID, level) {
+		return event.UserID
+	}
+	return userID
+}
+
+//checkCalendar проверяет, что пользователь userID может положить событие владельца ownerID в календарь calendarID
+func (s *Service) checkCalendar(userID int, ownerID int, calendarID int) error {
+	cal, ok := s.calendars.Load(calendarID)
+	if !ok || cal.OwnerID != ownerID || !cal.allows(userID, ShareWrite) {
+		return ErrCalendarNotFound
+	}
+	return nil
+}
+
+//prepareEvent проверяет и нормализует событие перед записью в хранилище.
+//Участники задаются только приглашениями, поэтому из данных клиента отбрасываются.
+func prepareEvent(event *Event) error {
+	if err := normalizeEvent(event); err != nil {
+		return err
+	}
+	if event.Recurrence != nil {
+		if err := event.Recurrence.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := validateReminders(event.Reminders); err != nil {
+		return err
+	}
+	tags, err := normalizeTags(event.Tags)
+	if err != nil {
+		return err
+	}
+	event.Tags = tags
+	event.Occurrence = nil
+	event.Conflicts = nil
+	event.Attendees = nil
+	return nil
+}
+
+//normalizeEvent приводит время события к его зоне и проверяет окончание
+func normalizeEvent(event *Event) error {
+	loc, err := loadLocation(event.TimeZone)
+	if err != nil {
+		return fmt.Errorf("unknown time zone %q", event.TimeZone)
+	}
+
+	start := time.Time(event.Date).In(loc)
+	end := start
+	if !time.Time(event.End).IsZero() {
+		end = time.Time(event.End).In(loc)
+	}
+	//событие на весь день занимает целые дни: окончание округляется до следующей полуночи
+	if event.AllDay {
+		start, _ = dayBounds(start)
+		if endDay, _ := dayBounds(end); !end.Equal(endDay) || !end.After(start) {
+			end = endDay.AddDate(0, 0, 1)
+		}
+	}
+	if end.Before(start) {
+		return ErrEndBeforeStart
+	}
+
+	event.Date = JSONTime(start)
+	event.End = JSONTime(end)
+	return nil
+}
+
+//ChangeEvent изменяет Event пользователя из хранилища, заполняя новыми переданными данными.
+//Если передана дата occurrence, меняется только это вхождение повторяющегося события.
+//Пересечения нового состояния с другими событиями обрабатываются по политике s.conflicts.
+//Изменить можно и событие календаря, открытого пользователю на запись.
+//Версия version - ожидаемая версия события из If-Match (0 - без проверки).
+//Возвращает новое состояние события, флаг наличия у пользователя события и ошибку изменения.
+func (s *Service) ChangeEvent(userID int, id int, occurrence time.Time, change EventChange, version int) (Event, bool, error) {
+	s.calendarWrites.RLock()
+	defer s.calendarWrites.RUnlock()
+
+	ownerID := s.eventOwner(userID, id, ShareWrite)
+	el, ok := s.ownEvent(ownerID, id)
+	if !ok {
+		return Event{}, false, nil
+	}
+	if err := matchVersion(el, version); err != nil {
+		return Event{}, true, err
+	}
+	if change.CalendarID != 0 && occurrence.IsZero() {
+		if err := s.checkCalendar(userID, ownerID, change.CalendarID); err != nil {
+			return Event{}, true, err
+		}
+	}
+	event, err := changeEvent(el, occurrence, change)
+	if err != nil {
+		return Event{}, true, err
+	}
+
+	conflicts, err := s.checkConflicts(event)
+	if err != nil {
+		return Event{}, true, err
+	}
+
+	//хранилище заново проверит версию под своей блокировкой
+	changed, ok, err := s.storage.Change(ownerID, id, occurrence, change, version, Author{UserID: userID})
+	if !ok || err != nil {
+		return Event{}, ok, err
+	}
+	changed.Conflicts = conflicts
+	return changed, true, nil
+}
+
+//GetAll выдает все Event пользователя и календарей, открытых ему, повторяющиеся - сериями, без разворачивания
+func (s *Service) GetAll(userID int) ([]Event, error) {
+	result, err := s.storage.getAll(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	shared := s.sharedCalendars(userID)
+	if len(shared) == 0 {
+		return result, nil
+	}
+	for ownerID, calendarIDs := range shared {
+		events, err := s.storage.getAll(ownerID)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, inCalendars(events, calendarIDs)...)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result, nil
+}
+
+//GetDay выдает слайс Event, которые видит пользователь, относящихся к дню опорной даты (по умолчанию сегодняшнему)
+func (s *Service) GetDay(userID int, date time.Time) ([]Event, error) {
+	start, end := dayBounds(s.anchor(date))
+	return s.between(userID, start, end, true)
+}
+
+//GetWeek выдает слайс Event, которые видит пользователь, относящихся к неделе опорной даты (по умолчанию текущей)
+func (s *Service) GetWeek(userID int, date time.Time) ([]Event, error) {
+	start, end := weekBounds(s.anchor(date))
+	return s.between(userID, start, end, true)
+}
+
+//GetMonth выдает слайс Event, которые видит пользователь, относящихся к месяцу опорной даты (по умолчанию текущему)
+func (s *Service) GetMonth(userID int, date time.Time) ([]Event, error) {
+	start, end := monthBounds(s.anchor(date))
+	return s.between(userID, start, end, true)
+}
+
+//GetBetween выдает слайс Event, которые видит пользователь, с дня from по день to включительно
+func (s *Service) GetBetween(userID int, from time.Time, to time.Time) ([]Event, error) {
+	start, _ := dayBounds(from)
+	_, end := dayBounds(to)
+	return s.between(userID, start, end, true)
+}
+
+//GetRange выдает слайс Event, которые видит пользователь, пересекающихся с промежутком [start, end]
+func (s *Service) GetRange(userID int, start time.Time, end time.Time) ([]Event, error) {
+	return s.between(userID, start, end, true)
+}
+
+//between выдает события, которые видит пользователь: свои, события, в которых он участвует
+//и не отклонил приглашение, и при withShared - события календарей, открытых ему;
+//все пересекающиеся с промежутком [start, end], по времени начала
+func (s *Service) between(userID int, start time.Time, end time.Time, withShared bool) ([]Event, error) {
+	owned, err := s.storage.getBetween(userID, start, end)
+	if err != nil {
+		return nil, err
+	}
+	attended, err := s.storage.getAttended(userID, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	var shared []Event
+	if withShared {
+		for ownerID, calendarIDs := range s.sharedCalendars(userID) {
+			events, err := s.storage.getBetween(ownerID, start, end)
+			if err != nil {
+				return nil, err
+			}
+			shared = append(shared, inCalendars(events, calendarIDs)...)
+		}
+	}
+	if len(attended) == 0 && len(shared) == 0 {
+		return owned, nil
+	}
+
+	result := uniqueEvents(append(append(owned, attended...), shared...))
+	sortEvents(result)
+	return result, nil
+}
+
+//Search ищет среди событий, которые выдает GetAll (свои и календарей, открытых пользователю),
+//события, в тексте которых есть все слова запроса query и у которых есть все теги tags.
+//Повторяющиеся события выдаются сериями.
+func (s *Service) Search(userID int, query string, tags []string) ([]Event, error) {
+	tags, err := normalizeTags(tags)
+	if err != nil {
+		return nil, err
+	}
+	words := tokenize(query)
+	if len(words) == 0 && len(tags) == 0 {
+		return nil, ErrEmptyQuery
+	}
+	result, err := s.storage.search(userID, words, tags)
+	if err != nil {
+		return nil, err
+	}
+
+	shared := s.sharedCalendars(userID)
+	if len(shared) == 0 {
+		return result, nil
+	}
+	for ownerID, calendarIDs := range shared {
+		events, err := s.storage.search(ownerID, words, tags)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, inCalendars(events, calendarIDs)...)
+	}
+	sortEvents(result)
+	return result, nil
+}
+
+//FreeBusy выдает занятые промежутки пользователя внутри [start, end)
+//и свободные окна не короче minFree. Пользователь занят и событиями, в которых участвует.
+func (s *Service) FreeBusy(userID int, start time.Time, end time.Time, minFree time.Duration) (FreeBusy, error) {
+	events, err := s.between(userID, start, end, false)
+	if err != nil {
+		return FreeBusy{}, err
+	}
+	return freeBusy(events, start, end, minFree), nil
 }
 
-//GetTodays выдает слайс Event, относящихся к сегодняшнему дню
-func (s *Service) GetTodays() ([]Event, error) {
-	return s.storage.GetTodays()
+//Subscribe подписывает на ленту изменений событий, подходящих под фильтр.
+//Курсор lastID возобновляет ленту с пропущенных изменений, если они еще хранятся.
+func (s *Service) Subscribe(filter FeedFilter, lastID string) (*Subscription, []Notice, bool) {
+	return s.feed.Subscribe(filter, lastID)
 }
 
-//GetThisWeeks выдает слайс Event, относящихся к текущей неделе
-func (s *Service) GetThisWeeks() ([]Event, error) {
-	return s.storage.GetThisWeeks()
+//Unsubscribe отменяет подписку на ленту изменений
+func (s *Service) Unsubscribe(sub *Subscription) {
+	s.feed.Unsubscribe(sub)
 }
 
-//GetThisMonths выдает слайс Event, относящихся к текущему месяцу
-func (s *Service) GetThisMonths() ([]Event, error) {
-	return s.storage.GetThisMonths()
+//CloseFeed отключает подписчиков ленты изменений перед остановкой сервера
+func (s *Service) CloseFeed() {
+	s.feed.Close()
 }
 
-//DeleteEvent удаляет Event из хранилища
-func (s *Service) DeleteEvent(id int) (bool, error) {
-	return s.storage.Delete(id)
+//DeleteEvent удаляет Event пользователя из хранилища.
+//Если передана дата occurrence, удаляется только это вхождение повторяющегося события.
+//Версия version - ожидаемая версия события из If-Match (0 - без проверки).
+//Удалить можно и событие календаря, открытого пользователю на запись.
+//Участники удаленного целиком события получают отмену (iTIP CANCEL).
+func (s *Service) DeleteEvent(userID int, id int, occurrence time.Time, version int) (bool, error) {
+	ownerID := s.eventOwner(userID, id, ShareWrite)
+	event, ok, err := s.storage.Delete(ownerID, id, occurrence, version, Author{UserID: userID})
+	if !ok || err != nil || !occurrence.IsZero() {
+		return ok, err
+	}
+	if len(event.Attendees) > 0 {
+		s.cancelInvitations(event)
+	}
+	return true, nil
 }
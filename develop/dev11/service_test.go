@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//fixedNow среда, 15 декабря 2021 года
+var fixedNow = time.Date(2021, 12, 15, 12, 0, 0, 0, time.UTC)
+
+//newTestService создает сервис над EventStore с часами, остановленными на fixedNow
+func newTestService() (*Service, *EventStore) {
+	store := NewEventStore()
+	service := NewService(store)
+	service.now = func() time.Time { return fixedNow }
+	return service, store
+}
+
+func day(year int, month time.Month, d int) time.Time {
+	return time.Date(year, month, d, 0, 0, 0, 0, time.UTC)
+}
+
+func TestGetDay(t *testing.T) {
+	service, store := newTestService()
+	store.Save(newEvent(1, "123", fixedNow), Author{})
+	store.Save(newEvent(1, "123", day(2021, 12, 15)), Author{})
+	store.Save(newEvent(1, "123", day(2021, 12, 16)), Author{})
+	store.Save(newEvent(2, "123", fixedNow), Author{})
+
+	result, err := service.GetDay(1, time.Time{})
+	assert.Nil(t, err)
+	assert.Equal(t, len(result), 2)
+
+	result, err = service.GetDay(1, day(2021, 12, 16))
+	assert.Nil(t, err)
+	assert.Equal(t, len(result), 1)
+}
+
+func TestGetWeek(t *testing.T) {
+	service, store := newTestService()
+	store.Save(newEvent(1, "123", day(2021, 12, 13)), Author{})
+	store.Save(newEvent(1, "123", day(2021, 12, 19)), Author{})
+	store.Save(newEvent(1, "123", day(2021, 12, 12)), Author{})
+	store.Save(newEvent(1, "123", day(2021, 12, 20)), Author{})
+
+	result, err := service.GetWeek(1, time.Time{})
+	assert.Nil(t, err)
+	assert.Equal(t, len(result), 2)
+
+	result, err = service.GetWeek(1, day(2021, 12, 21))
+	assert.Nil(t, err)
+	assert.Equal(t, len(result), 1)
+}
+
+func TestGetMonth(t *testing.T) {
+	service, store := newTestService()
+	store.Save(newEvent(1, "123", day(2021, 12, 1)), Author{})
+	store.Save(newEvent(1, "123", day(2021, 12, 31)), Author{})
+	store.Save(newEvent(1, "123", day(2021, 11, 30)), Author{})
+	store.Save(newEvent(1, "123", day(2022, 1, 1)), Author{})
+
+	result, err := service.GetMonth(1, time.Time{})
+	assert.Nil(t, err)
+	assert.Equal(t, len(result), 2)
+
+	result, err = service.GetMonth(1, day(2021, 11, 2))
+	assert.Nil(t, err)
+	assert.Equal(t, len(result), 1)
+}
+
+func TestGetBetweenDays(t *testing.T) {
+	service, store := newTestService()
+	store.Save(newEvent(1, "123", day(2021, 3, 1)), Author{})
+	store.Save(newEvent(1, "123", time.Date(2021, 3, 31, 23, 0, 0, 0, time.UTC)), Author{})
+	store.Save(newEvent(1, "123", day(2021, 4, 1)), Author{})
+
+	result, err := service.GetBetween(1, day(2021, 3, 1), day(2021, 3, 31))
+	assert.Nil(t, err)
+	assert.Equal(t, len(result), 2)
+}
+
+func TestSaveEventNormalize(t *testing.T) {
+	service, store := newTestService()
+
+	saved, err := service.SaveEvent(Event{UserID: 1, Text: "holiday", Date: JSONTime(time.Date(2021, 12, 31, 15, 0, 0, 0, time.UTC)),
+		TimeZone: "Europe/Moscow", AllDay: true})
+	assert.Nil(t, err)
+	assert.Equal(t, saved.ID, 1)
+
+	event, ok := store.Load(1)
+	assert.True(t, ok)
+	assert.Equal(t, time.Time(event.Date).Format(time.RFC3339), "2021-12-31T00:00:00+03:00")
+	assert.Equal(t, time.Time(event.End).Format(time.RFC3339), "2022-01-01T00:00:00+03:00")
+
+	_, err = service.SaveEvent(Event{UserID: 1, Date: JSONTime(fixedNow), End: JSONTime(fixedNow.Add(-time.Hour))})
+	assert.Equal(t, err, ErrEndBeforeStart)
+
+	_, err = service.SaveEvent(Event{UserID: 1, Date: JSONTime(fixedNow), TimeZone: "Mars/Olympus"})
+	assert.NotNil(t, err)
+}
+
+func TestChangeEventKeepsDuration(t *testing.T) {
+	service, store := newTestService()
+	_, err := service.SaveEvent(Event{UserID: 1, Date: JSONTime(fixedNow), End: JSONTime(fixedNow.Add(time.Hour))})
+	assert.Nil(t, err)
+
+	moved := fixedNow.Add(24 * time.Hour)
+	_, ok, err := service.ChangeEvent(1, 1, time.Time{}, EventChange{Date: moved, TimeZone: "Asia/Tokyo"}, 0)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+
+	event, _ := store.Load(1)
+	assert.Equal(t, event.TimeZone, "Asia/Tokyo")
+	assert.Equal(t, time.Time(event.Date).Format(time.RFC3339), "2021-12-16T21:00:00+09:00")
+	assert.Equal(t, event.duration(), time.Hour)
+
+	_, ok, err = service.ChangeEvent(1, 1, time.Time{}, EventChange{Duration: 30 * time.Minute}, 0)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	event, _ = store.Load(1)
+	assert.Equal(t, event.duration(), 30*time.Minute)
+}
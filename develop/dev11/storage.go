@@ -1,55 +1,367 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 )
 
+//legacyDateLayout формат дат без времени, в котором JSONTime маршалился раньше
+const legacyDateLayout = "02-01-2006"
+
 //JSONTime дополнительный тип на основе time.Time
 //для переопределения форматирования при маршалинге в JSON
 type JSONTime time.Time
 
-//MarshalJSON переопределяет маршалинг для типа JSONTime
+//MarshalJSON переопределяет маршалинг для типа JSONTime: RFC 3339 с долями секунды
 func (t JSONTime) MarshalJSON() ([]byte, error) {
-	stamp := fmt.Sprintf("\"%s\"", time.Time(t).Format("02-01-2006"))
+	stamp := fmt.Sprintf("\"%s\"", time.Time(t).Format(time.RFC3339Nano))
 	return []byte(stamp), nil
 }
 
-//Event структура события
+//UnmarshalJSON разбирает JSONTime из RFC 3339
+//или из устаревшего формата даты 02-01-2006 (полночь UTC)
+func (t *JSONTime) UnmarshalJSON(data []byte) error {
+	str, err := strconv.Unquote(string(data))
+	if err != nil {
+		return fmt.Errorf("bad time %s: %w", data, err)
+	}
+
+	parsed, err := time.Parse(time.RFC3339Nano, str)
+	if err != nil {
+		if parsed, err = time.Parse(legacyDateLayout, str); err != nil {
+			return fmt.Errorf("bad time %q: expect RFC 3339 or %s", str, legacyDateLayout)
+		}
+	}
+
+	*t = JSONTime(parsed)
+	return nil
+}
+
+//Event структура события.
+//Date - время начала, End - время окончания в зоне TimeZone (IANA, пусто - UTC).
+//У события на весь день (AllDay) Date - полночь в его зоне, End - полночь следующего дня.
+//У повторяющегося события есть Recurrence и, возможно, исключения для отдельных вхождений.
+//В выдаче за период серия разворачивается во вхождения, у каждого из которых
+//Occurrence - исходное время вхождения, по дню которого его можно изменить или удалить.
+//Reminders - за сколько до начала (каждого вхождения) присылать напоминания.
+//Tags - теги события в нижнем регистре, без повторов и по алфавиту.
+//Version - номер версии: 1 при создании, растет на единицу при каждом изменении, в том числе вхождения;
+//по нему строится ETag и проверяется If-Match.
+//Conflicts заполняется только в ответе на сохранение при политике ConflictFlag и не хранится.
+//Attendees - приглашенные пользователи и их ответы; меняются только через приглашения и ответы на них.
+//CalendarID - календарь владельца, которому принадлежит событие (0 - календарь по умолчанию).
+//UID - UID iCalendar, с которым событие создал клиент CalDAV (пусто - id@dev11); при замене сохраняется.
 type Event struct {
-	ID   int      `json:"ID"`
-	Date JSONTime `json:"Date"`
-	Text string   `json:"Text"`
+	ID         int         `json:"ID"`
+	UserID     int         `json:"UserID"`
+	CalendarID int         `json:"CalendarID"`
+	Date       JSONTime    `json:"Date"`
+	End        JSONTime    `json:"End"`
+	TimeZone   string      `json:"TimeZone,omitempty"`
+	AllDay     bool        `json:"AllDay,omitempty"`
+	Text       string      `json:"Text"`
+	Recurrence *Recurrence `json:"Recurrence,omitempty"`
+	Exceptions []Exception `json:"Exceptions,omitempty"`
+	Occurrence *JSONTime   `json:"Occurrence,omitempty"`
+	Reminders  []Offset    `json:"Reminders,omitempty"`
+	Tags       []string    `json:"Tags,omitempty"`
+	Version    int         `json:"Version"`
+	Conflicts  []int       `json:"Conflicts,omitempty"`
+	Attendees  []Attendee  `json:"Attendees,omitempty"`
+	UID        string      `json:"UID,omitempty"`
+}
+
+//duration возвращает длительность события (у событий без окончания - 0)
+func (e Event) duration() time.Duration {
+	if d := time.Time(e.End).Sub(time.Time(e.Date)); d > 0 {
+		return d
+	}
+	return 0
+}
+
+//location возвращает зону события (UTC, если зона не задана или неизвестна)
+func (e Event) location() *time.Location {
+	loc, err := loadLocation(e.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+//overlaps проверяет, пересекается ли событие с промежутком [start, end].
+//Событие без длительности проверяется как момент времени.
+func (e Event) overlaps(start time.Time, end time.Time) bool {
+	if e.duration() == 0 {
+		return inTimeSpan(start, end, time.Time(e.Date))
+	}
+	if start.After(end) {
+		start, end = end, start
+	}
+	return !time.Time(e.Date).After(end) && time.Time(e.End).After(start)
+}
+
+//EventChange изменения события. Пустые поля означают "оставить как было".
+//При переносе начала без нового окончания длительность события сохраняется;
+//Duration задает окончание относительно (нового) начала.
+//Reminders и Tags заменяют напоминания и теги, если не nil (пустой слайс - убрать все).
+//CalendarID переносит событие в другой календарь владельца.
+type EventChange struct {
+	Text       string
+	Date       time.Time
+	End        time.Time
+	Duration   time.Duration
+	TimeZone   string
+	Reminders  []Offset
+	Tags       []string
+	CalendarID int
+}
+
+//locations кэш загруженных зон: time.LoadLocation каждый раз читает базу зон
+var locations sync.Map
+
+//loadLocation загружает IANA зону по имени, пустое имя - UTC
+func loadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.UTC, nil
+	}
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations.Store(name, loc)
+	return loc, nil
+}
+
+//ErrEndBeforeStart окончание события раньше его начала
+var ErrEndBeforeStart = errors.New("event end is before its start")
+
+//ErrVersionMismatch событие изменилось с версии, от которой клиент строил изменение
+var ErrVersionMismatch = errors.New("event version doesn't match")
+
+//ErrBatchConflict события пакета изменились, пока пакет готовился
+var ErrBatchConflict = errors.New("events were changed concurrently, batch is not applied")
+
+//matchVersion проверяет, что событие в ожидаемой версии (0 - без проверки)
+func matchVersion(el Event, version int) error {
+	if version != 0 && el.Version != version {
+		return ErrVersionMismatch
+	}
+	return nil
+}
+
+//Storage интерфейс хранилища событий, с которым работает Service
+type Storage interface {
+	Save(event Event, by Author) (Event, error)
+	Load(id int) (Event, bool)
+	Replace(userID int, event Event, version int, by Author) (Event, bool, error)
+	Change(userID int, id int, occurrence time.Time, change EventChange, version int, by Author) (Event, bool, error)
+	Delete(userID int, id int, occurrence time.Time, version int, by Author) (Event, bool, error)
+	Restore(event Event, by Author) (Event, error)
+	trashed(userID int) []Trashed
+	loadTrashed(id int) (Trashed, bool)
+	purgeTrash(before time.Time) (int, error)
+	getEnded(before time.Time) ([]Event, error)
+	expunge(events []Event, by Author) ([]Event, error)
+	getBetween(userID int, start time.Time, end time.Time) ([]Event, error)
+	getAll(userID int) ([]Event, error)
+	getAttended(userID int, start time.Time, end time.Time) ([]Event, error)
+	getInvited(userID int) ([]Event, error)
+	updateAttendees(id int, update func(event Event) ([]Attendee, error), by Author) (Event, bool, error)
+	scanBetween(start time.Time, end time.Time) ([]Event, error)
+	search(userID int, words []string, tags []string) ([]Event, error)
+	Observe(observer Observer)
+	Len() int
+	userSnapshot(userIDs ...int) ([]Event, int)
+	applyBatch(batch storeBatch, by Author) (map[int]int, error)
 }
 
 //EventStore хранилище событий на основе map[int]Event
+//с индексами id событий по владельцу и по участникам и обратными индексами слов текста и тегов.
+//Удаленные события лежат в корзине trash и в выборки не попадают; время удаления берется из now.
 type EventStore struct {
-	m      map[int]Event
-	mutex  sync.RWMutex
-	nextID int
+	m          map[int]Event
+	byUser     map[int]map[int]struct{}
+	byAttendee map[int]map[int]struct{}
+	words      invertedIndex
+	tags       invertedIndex
+	trash      map[int]Trashed
+	mutex      sync.RWMutex
+	nextID     int
+	observer   Observer
+	now        func() time.Time
+}
+
+//Observer получает изменения хранилища: вид изменения (ChangeCreated, ChangeUpdated,
+//ChangeDeleted), новое (для удаления - последнее) состояние события, предыдущее состояние
+//и автора изменения. Вызывается под блокировкой хранилища, так что изменения приходят
+//в том порядке, в каком применялись, и не должен подолгу блокироваться.
+type Observer func(kind string, event Event, previous *Event, by Author)
+
+//Author автор изменения хранилища: пользователь, от имени которого шел запрос (0 - само приложение,
+//например фоновая уборка), и действие для журнала аудита, если оно уже вида изменения
+//(ChangeRestored, ChangeArchived; пусто - вид изменения)
+type Author struct {
+	UserID int
+	Action string
 }
 
 //NewEventStore конструктор для EventStore.
 //Возвращает: ссылку на созданный EventStore.
 func NewEventStore() *EventStore {
-	return &EventStore{m: make(map[int]Event, 0), nextID: 1}
+	return &EventStore{m: make(map[int]Event, 0), byUser: make(map[int]map[int]struct{}),
+		byAttendee: make(map[int]map[int]struct{}), words: make(invertedIndex), tags: make(invertedIndex),
+		trash: make(map[int]Trashed), nextID: 1, now: time.Now}
 }
 
 //Save сохраняет новый Event в хранилище, присваивая ему порядковый id.
-//Принимает строку текста события и время события.
-//Возвращает ошибку сохранения.
+//Принимает событие с заполненными владельцем, текстом, временем и правилом повторения.
+//Возвращает сохраненное событие с присвоенным id и ошибку сохранения.
 //Конкурентно безопасный метод.
-func (store *EventStore) Save(text string, date time.Time) error {
+func (store *EventStore) Save(event Event, by Author) (Event, error) {
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
-	event := Event{ID: store.nextID, Text: text, Date: JSONTime(date)}
+	event.ID = store.nextID
+	event.Version = 1
 
-	store.m[store.nextID] = event
+	store.set(event, by)
 	store.nextID = store.nextID + 1
 
-	return nil
+	return event, nil
+}
+
+//set кладет Event в map и индекс владельца, убирая его из корзины, и сообщает наблюдателю от имени by.
+//Вызывается под store.mutex.
+func (store *EventStore) set(event Event, by Author) {
+	delete(store.trash, event.ID)
+	old, existed := store.m[event.ID]
+	if existed && old.UserID != event.UserID {
+		store.unset(old, by)
+		existed = false
+	}
+
+	if existed {
+		store.words.remove(eventWords(old), old.ID)
+		store.tags.remove(old.Tags, old.ID)
+		store.unindexAttendees(old)
+	}
+	store.words.add(eventWords(event), event.ID)
+	store.tags.add(event.Tags, event.ID)
+	store.indexAttendees(event)
+
+	store.m[event.ID] = event
+	if store.observer != nil {
+		if existed {
+			store.observer(ChangeUpdated, event, &old, by)
+		} else {
+			store.observer(ChangeCreated, event, nil, by)
+		}
+	}
+
+	ids, ok := store.byUser[event.UserID]
+	if !ok {
+		ids = make(map[int]struct{})
+		store.byUser[event.UserID] = ids
+	}
+	ids[event.ID] = struct{}{}
+}
+
+//unset убирает Event из map и индекса владельца и сообщает наблюдателю от имени by.
+//Вызывается под store.mutex.
+func (store *EventStore) unset(event Event, by Author) {
+	delete(store.m, event.ID)
+	store.words.remove(eventWords(event), event.ID)
+	store.tags.remove(event.Tags, event.ID)
+	store.unindexAttendees(event)
+	if store.observer != nil {
+		store.observer(ChangeDeleted, event, nil, by)
+	}
+
+	ids := store.byUser[event.UserID]
+	delete(ids, event.ID)
+	if len(ids) == 0 {
+		delete(store.byUser, event.UserID)
+	}
+}
+
+//indexAttendees добавляет событие в индекс участников.
+//Вызывается под store.mutex.
+func (store *EventStore) indexAttendees(event Event) {
+	for _, a := range event.Attendees {
+		ids, ok := store.byAttendee[a.UserID]
+		if !ok {
+			ids = make(map[int]struct{})
+			store.byAttendee[a.UserID] = ids
+		}
+		ids[event.ID] = struct{}{}
+	}
+}
+
+//unindexAttendees убирает событие из индекса участников.
+//Вызывается под store.mutex.
+func (store *EventStore) unindexAttendees(event Event) {
+	for _, a := range event.Attendees {
+		ids := store.byAttendee[a.UserID]
+		delete(ids, event.ID)
+		if len(ids) == 0 {
+			delete(store.byAttendee, a.UserID)
+		}
+	}
+}
+
+//Observe подключает наблюдателя за изменениями хранилища (nil - отключить).
+//Конкурентно безопасный метод.
+func (store *EventStore) Observe(observer Observer) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.observer = observer
+}
+
+//put кладет Event в хранилище под его id, сдвигая nextID при необходимости.
+//Используется при восстановлении и в обертках над EventStore.
+//События, сохраненные до появления версий, получают версию 1.
+//Конкурентно безопасный метод.
+func (store *EventStore) put(event Event, by Author) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if event.Version == 0 {
+		event.Version = 1
+	}
+	store.set(event, by)
+	if event.ID >= store.nextID {
+		store.nextID = event.ID + 1
+	}
+}
+
+//remove удаляет Event из хранилища без проверки наличия: в корзину со временем удаления deleted
+//или, при нулевом deleted, безвозвратно.
+//Конкурентно безопасный метод.
+func (store *EventStore) remove(id int, deleted time.Time, by Author) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if event, ok := store.m[id]; ok {
+		store.discard(event, deleted, by)
+	}
+}
+
+//peekID возвращает id, который получит следующее сохраненное событие.
+//Конкурентно безопасный метод.
+func (store *EventStore) peekID() int {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	return store.nextID
 }
 
 //Load получает Event из хранилища по id
@@ -64,50 +376,169 @@ func (store *EventStore) Load(id int) (Event, bool) {
 	return event, ok
 }
 
-//Change изменяет объект, находящийся в хранилище.
-//Принимает все параметры cобытия: id, текст и время.
-//Возвращает флаг наличия события ошибку изменения.
+//Len возвращает количество событий в хранилище
+func (store *EventStore) Len() int {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	return len(store.m)
+}
+
+//Replace заменяет Event пользователя целиком, сохраняя его id, владельца и участников.
+//Принимает ожидаемую версию события (0 - без проверки).
+//Возвращает новое состояние события, флаг наличия у пользователя события
+//и ошибку замены (ErrVersionMismatch, если версия не совпала).
 //Конкурентно безопасный метод.
-func (store *EventStore) Change(id int, text string, date time.Time) (bool, error) {
+func (store *EventStore) Replace(userID int, event Event, version int, by Author) (Event, bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
 
-	var el Event
-	var ok bool
-	if el, ok = store.Load(id); !ok {
-		return false, nil
+	el, ok := store.m[event.ID]
+	if !ok || el.UserID != userID {
+		return Event{}, false, nil
 	}
-
-	if date.IsZero() {
-		date = time.Time(el.Date)
+	if err := matchVersion(el, version); err != nil {
+		return Event{}, true, err
 	}
 
-	if text == "" {
-		text = el.Text
+	event.UserID = userID
+	event.Attendees = el.Attendees
+	event.Version = el.Version + 1
+	store.set(event, by)
+	return event, true, nil
+}
+
+//updateAttendees заменяет участников события списком, который update строит по текущему состоянию
+//события под блокировкой хранилища. Ошибка update отменяет изменение.
+//Возвращает новое состояние события, флаг наличия события и ошибку изменения.
+//Конкурентно безопасный метод.
+func (store *EventStore) updateAttendees(id int, update func(event Event) ([]Attendee, error), by Author) (Event, bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	el, ok := store.m[id]
+	if !ok {
+		return Event{}, false, nil
+	}
+	event, err := withAttendees(el, update)
+	if err != nil {
+		return Event{}, true, err
 	}
+	store.set(event, by)
+	return event, true, nil
+}
 
-	event := Event{ID: id, Text: text, Date: JSONTime(date)}
+//Change изменяет объект, находящийся в хранилище.
+//Принимает id владельца, id события, изменения его полей и ожидаемую версию (0 - без проверки).
+//Если передана дата вхождения occurrence, меняется только это вхождение серии.
+//Чтение, проверка версии и запись идут под одной блокировкой,
+//так что параллельные изменения не затирают друг друга.
+//Возвращает новое состояние события, флаг наличия у пользователя события и ошибку изменения.
+//Конкурентно безопасный метод.
+func (store *EventStore) Change(userID int, id int, occurrence time.Time, change EventChange, version int, by Author) (Event, bool, error) {
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
-	store.m[id] = event
+	el, ok := store.m[id]
+	if !ok || el.UserID != userID {
+		return Event{}, false, nil
+	}
+	if err := matchVersion(el, version); err != nil {
+		return Event{}, true, err
+	}
+
+	event, err := changeEvent(el, occurrence, change)
+	if err != nil {
+		return Event{}, true, err
+	}
+	event.Version = el.Version + 1
+	store.set(event, by)
 
-	return true, nil
+	return event, true, nil
 }
 
-//GetTodays возвращает все события, запланированные на сегодня.
-//Возвращает: слайс событий и ошибку получения.
-func (store *EventStore) GetTodays() ([]Event, error) {
-	nowDay := time.Now()
+//mergeEvent накладывает изменения на существующее событие.
+//Новая зона переводит в нее время начала и окончания.
+//Событие без окончания (сохраненное до появления End) считается моментом времени.
+func mergeEvent(el Event, change EventChange) (Event, error) {
+	if time.Time(el.End).IsZero() {
+		el.End = el.Date
+	}
+
+	if change.TimeZone != "" {
+		loc, err := loadLocation(change.TimeZone)
+		if err != nil {
+			return el, err
+		}
+		el.TimeZone = change.TimeZone
+		el.Date = JSONTime(time.Time(el.Date).In(loc))
+		el.End = JSONTime(time.Time(el.End).In(loc))
+	}
+
+	if change.Text != "" {
+		el.Text = change.Text
+	}
+
+	if change.CalendarID != 0 {
+		el.CalendarID = change.CalendarID
+	}
+
+	if change.Reminders != nil {
+		if err := validateReminders(change.Reminders); err != nil {
+			return el, err
+		}
+		el.Reminders = change.Reminders
+		if len(el.Reminders) == 0 {
+			el.Reminders = nil
+		}
+	}
+
+	if change.Tags != nil {
+		tags, err := normalizeTags(change.Tags)
+		if err != nil {
+			return el, err
+		}
+		el.Tags = tags
+	}
+
+	if !change.Date.IsZero() {
+		duration := el.duration()
+		el.Date = JSONTime(change.Date.In(el.location()))
+		el.End = JSONTime(change.Date.Add(duration).In(el.location()))
+	}
+
+	if !change.End.IsZero() {
+		el.End = JSONTime(change.End.In(el.location()))
+	}
+
+	if change.Duration > 0 {
+		el.End = JSONTime(time.Time(el.Date).Add(change.Duration))
+	}
 
+	if time.Time(el.End).Before(time.Time(el.Date)) {
+		return el, ErrEndBeforeStart
+	}
+	return el, nil
+}
+
+//changeEvent изменяет всю серию или, если передана дата occurrence, одно ее вхождение
+func changeEvent(el Event, occurrence time.Time, change EventChange) (Event, error) {
+	if occurrence.IsZero() {
+		return mergeEvent(el, change)
+	}
+	return changeOccurrence(el, occurrence, change)
+}
+
+//dayBounds возвращает начало и конец дня, в который попадает переданное время.
+func dayBounds(nowDay time.Time) (time.Time, time.Time) {
 	todayStart := time.Date(nowDay.Year(), nowDay.Month(), nowDay.Day(), 0, 0, 0, 0, nowDay.Location())
 	todayEnd := todayStart.AddDate(0, 0, 1).Add(time.Nanosecond * -1)
 
-	return store.getBetween(todayStart, todayEnd)
+	return todayStart, todayEnd
 }
 
-//GetThisWeeks возвращает все события, запланированные на текущую неделю.
-//Возвращает: слайс событий и ошибку получения.
-func (store *EventStore) GetThisWeeks() ([]Event, error) {
-	nowDay := time.Now()
+//weekBounds возвращает начало и конец недели (с понедельника), в которую попадает переданное время.
+func weekBounds(nowDay time.Time) (time.Time, time.Time) {
 	firstWeekDay := nowDay
 
 	for firstWeekDay.Weekday() != time.Monday {
@@ -117,36 +548,146 @@ func (store *EventStore) GetThisWeeks() ([]Event, error) {
 		firstWeekDay.Day(), 0, 0, 0, 0, firstWeekDay.Location())
 	lastWeekDay := firstWeekDay.AddDate(0, 0, 7).Add(time.Nanosecond * -1)
 
-	return store.getBetween(firstWeekDay, lastWeekDay)
+	return firstWeekDay, lastWeekDay
 }
 
-//GetThisMonths возвращает все события, запланированные на текущий месяц.
-//Возвращает: слайс событий и ошибку получения.
-func (store *EventStore) GetThisMonths() ([]Event, error) {
-	nowDay := time.Now()
-
+//monthBounds возвращает начало и конец месяца, в который попадает переданное время.
+func monthBounds(nowDay time.Time) (time.Time, time.Time) {
 	monthStart := time.Date(nowDay.Year(), nowDay.Month(), 1, 0, 0, 0, 0, nowDay.Location())
 	monthEnd := monthStart.AddDate(0, 1, 0).Add(time.Nanosecond * -1)
 
-	return store.getBetween(monthStart, monthEnd)
+	return monthStart, monthEnd
 }
 
-//getBetween возвращает все события, запланированные в промежутке между временем cтарта и окончания
-//Принимает: время старта и время окончания.
+//getBetween возвращает все события пользователя, пересекающиеся с промежутком между временем cтарта и окончания.
+//Просматриваются только события пользователя из индекса byUser.
+//Принимает: id пользователя, время старта и время окончания.
 //Возвращает: слайс событий и ошибку получения.
 //Конкурентно безопасный метод.
-func (store *EventStore) getBetween(start time.Time, end time.Time) ([]Event, error) {
+func (store *EventStore) getBetween(userID int, start time.Time, end time.Time) ([]Event, error) {
+	result := make([]Event, 0)
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	for id := range store.byUser[userID] {
+		v := store.m[id]
+		if v.Recurrence != nil {
+			result = append(result, expand(v, start, end)...)
+			continue
+		}
+		if v.overlaps(start, end) {
+			result = append(result, v)
+		}
+	}
+	sortEvents(result)
+	return result, nil
+}
+
+//scanBetween возвращает события всех пользователей, пересекающиеся с промежутком [start, end],
+//повторяющиеся - вхождениями. Используется фоновыми задачами, а не обработчиками запросов.
+//Конкурентно безопасный метод.
+func (store *EventStore) scanBetween(start time.Time, end time.Time) ([]Event, error) {
 	result := make([]Event, 0)
 	store.mutex.RLock()
 	defer store.mutex.RUnlock()
 	for _, v := range store.m {
-		store.mutex.RUnlock()
+		if v.Recurrence != nil {
+			result = append(result, expand(v, start, end)...)
+			continue
+		}
+		if v.overlaps(start, end) {
+			result = append(result, v)
+		}
+	}
+	return result, nil
+}
+
+//search возвращает события пользователя, в тексте которых (или в тексте измененного вхождения)
+//есть все слова words и у которых есть все теги tags; серии - без разворачивания.
+//Результат отсортирован по началу, затем по id.
+//Конкурентно безопасный метод.
+func (store *EventStore) search(userID int, words []string, tags []string) ([]Event, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	var ids map[int]struct{}
+	if len(words) > 0 {
+		ids = store.words.lookup(words)
+	}
+	if len(tags) > 0 {
+		tagged := store.tags.lookup(tags)
+		if ids == nil {
+			ids = tagged
+		} else {
+			for id := range ids {
+				if _, ok := tagged[id]; !ok {
+					delete(ids, id)
+				}
+			}
+		}
+	}
 
-		if inTimeSpan(start, end, time.Time(v.Date)) {
+	result := make([]Event, 0)
+	for id := range ids {
+		if v := store.m[id]; v.UserID == userID {
+			result = append(result, v)
+		}
+	}
+	sortEvents(result)
+	return result, nil
+}
+
+//getAll возвращает все события пользователя в порядке id, серии - без разворачивания.
+//Конкурентно безопасный метод.
+func (store *EventStore) getAll(userID int) ([]Event, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	result := make([]Event, 0, len(store.byUser[userID]))
+	for id := range store.byUser[userID] {
+		result = append(result, store.m[id])
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+
+	return result, nil
+}
+
+//getAttended возвращает события, в которых пользователь участвует (и не отклонил приглашение),
+//пересекающиеся с промежутком [start, end]; повторяющиеся - вхождениями.
+//Конкурентно безопасный метод.
+func (store *EventStore) getAttended(userID int, start time.Time, end time.Time) ([]Event, error) {
+	result := make([]Event, 0)
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	for id := range store.byAttendee[userID] {
+		v := store.m[id]
+		if !v.attends(userID) {
+			continue
+		}
+		if v.Recurrence != nil {
+			result = append(result, expand(v, start, end)...)
+			continue
+		}
+		if v.overlaps(start, end) {
 			result = append(result, v)
 		}
-		store.mutex.RLock()
 	}
+	sortEvents(result)
+	return result, nil
+}
+
+//getInvited возвращает события, на которые приглашен пользователь, с любым его ответом,
+//в порядке id, серии - без разворачивания.
+//Конкурентно безопасный метод.
+func (store *EventStore) getInvited(userID int) ([]Event, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	result := make([]Event, 0, len(store.byAttendee[userID]))
+	for id := range store.byAttendee[userID] {
+		result = append(result, store.m[id])
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+
 	return result, nil
 }
 
@@ -161,18 +702,209 @@ func inTimeSpan(start, end, check time.Time) bool {
 	return !check.Before(start) && !check.After(end)
 }
 
-//Delete удаляет объект из хранилища по id.
-//Принимет: id удаляемого объекта.
-//Возвращает: булевский результат нахождения объекта и ошибку удаления.
-func (store *EventStore) Delete(id int) (bool, error) {
-	if _, ok := store.Load(id); !ok {
-		return false, nil
+//Delete удаляет объект из хранилища по id, перемещая его в корзину.
+//Принимет: id владельца, id удаляемого объекта, дату вхождения серии
+//(если она передана, удаляется только это вхождение) и ожидаемую версию (0 - без проверки).
+//Возвращает: последнее состояние удаленного события (для вхождения - новое состояние серии),
+//булевский результат нахождения объекта у пользователя и ошибку удаления.
+//Конкурентно безопасный метод.
+func (store *EventStore) Delete(userID int, id int, occurrence time.Time, version int, by Author) (Event, bool, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	el, ok := store.m[id]
+	if !ok || el.UserID != userID {
+		return Event{}, false, nil
+	}
+	if err := matchVersion(el, version); err != nil {
+		return Event{}, true, err
+	}
+
+	if !occurrence.IsZero() {
+		event, err := deleteOccurrence(el, occurrence)
+		if err != nil {
+			return Event{}, true, err
+		}
+		event.Version = el.Version + 1
+		store.set(event, by)
+		return event, true, nil
+	}
+
+	store.discard(el, store.now(), by)
+
+	return el, true, nil
+}
+
+//Restore кладет удаленное ранее событие обратно под его id и с его версией, убирая его из корзины.
+//Возвращает восстановленное событие и ErrEventExists, если событие с этим id есть в хранилище.
+//Конкурентно безопасный метод.
+func (store *EventStore) Restore(event Event, by Author) (Event, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, ok := store.m[event.ID]; ok {
+		return Event{}, ErrEventExists
+	}
+	store.set(event, by)
+	if event.ID >= store.nextID {
+		store.nextID = event.ID + 1
+	}
+	return event, nil
+}
+
+//storeBatch изменения пакета операций, применяемые к хранилищу целиком.
+//changes - изменения событий в порядке операций пакета; новые события пакета получили в копии
+//хранилища id начиная с firstID; versions - версии затронутых существующих событий на момент копии,
+//owners - владельцы, события которых были в копии.
+type storeBatch struct {
+	owners   map[int]bool
+	firstID  int
+	changes  []storeChange
+	versions map[int]int
+}
+
+//storeChange изменение события пакета: ChangeCreated или ChangeUpdated с новым состоянием события
+//или ChangeDeleted с его последним состоянием
+type storeChange struct {
+	kind  string
+	event Event
+}
+
+//userSnapshot возвращает копию событий пользователей userIDs и id, который получит следующее событие.
+//Конкурентно безопасный метод.
+func (store *EventStore) userSnapshot(userIDs ...int) ([]Event, int) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	events := make([]Event, 0)
+	for _, userID := range userIDs {
+		for id := range store.byUser[userID] {
+			events = append(events, store.m[id])
+		}
+	}
+	return events, store.nextID
+}
+
+//checkBatch проверяет, что затронутые пакетом события не менялись с момента копии,
+//и назначает новым событиям пакета id хранилища.
+//Возвращает: соответствие id из копии и id хранилища для новых событий и ErrBatchConflict.
+//Вызывается под store.mutex.
+func (store *EventStore) checkBatch(batch storeBatch) (map[int]int, error) {
+	for id, version := range batch.versions {
+		el, ok := store.m[id]
+		if !ok || !batch.owners[el.UserID] || el.Version != version {
+			return nil, ErrBatchConflict
+		}
+	}
+
+	ids := make(map[int]int)
+	next := store.nextID
+	for _, c := range batch.changes {
+		if _, ok := ids[c.event.ID]; !ok && c.kind == ChangeCreated && c.event.ID >= batch.firstID {
+			ids[c.event.ID] = next
+			next++
+		}
+	}
+	return ids, nil
+}
+
+//remapBatch переводит id новых событий пакета в id хранилища
+func remapBatch(changes []storeChange, ids map[int]int) []storeChange {
+	result := make([]storeChange, 0, len(changes))
+	for _, c := range changes {
+		if id, ok := ids[c.event.ID]; ok {
+			c.event.ID = id
+		}
+		result = append(result, c)
+	}
+	return result
+}
+
+//netBatch сводит изменения пакета к записи журнала: последние состояния затронутых событий по id
+//и id событий, удаленных в итоге. Удаленные тоже кладутся последним состоянием,
+//чтобы в корзину при восстановлении попало то же, что и при применении пакета.
+func netBatch(changes []storeChange) ([]Event, []int) {
+	last := make(map[int]storeChange, len(changes))
+	for _, c := range changes {
+		last[c.event.ID] = c
+	}
+	puts := make([]Event, 0, len(last))
+	deletes := make([]int, 0)
+	for id, c := range last {
+		puts = append(puts, c.event)
+		if c.kind == ChangeDeleted {
+			deletes = append(deletes, id)
+		}
+	}
+	sort.Slice(puts, func(i, j int) bool { return puts[i].ID < puts[j].ID })
+	sort.Ints(deletes)
+	return puts, deletes
+}
+
+//setBatch кладет и удаляет события пакета; удаленные попадают в корзину со временем deleted
+//(нулевое - удаляются безвозвратно). Вызывается под store.mutex.
+func (store *EventStore) setBatch(puts []Event, deletes []int, deleted time.Time, by Author) {
+	for _, event := range puts {
+		store.set(event, by)
+		if event.ID >= store.nextID {
+			store.nextID = event.ID + 1
+		}
+	}
+	for _, id := range deletes {
+		if event, ok := store.m[id]; ok {
+			store.discard(event, deleted, by)
+		}
+	}
+}
+
+//setChanges применяет изменения пакета по порядку, так что наблюдатель получает их так же,
+//как от отдельных операций. Удаленные попадают в корзину со временем deleted.
+//Вызывается под store.mutex.
+func (store *EventStore) setChanges(changes []storeChange, deleted time.Time, by Author) {
+	for _, c := range changes {
+		if c.kind == ChangeDeleted {
+			if event, ok := store.m[c.event.ID]; ok {
+				store.discard(event, deleted, by)
+			}
+			continue
+		}
+		store.set(c.event, by)
+		if c.event.ID >= store.nextID {
+			store.nextID = c.event.ID + 1
+		}
 	}
+}
 
+//putBatch кладет и удаляет события пакета под одной блокировкой.
+//Используется при восстановлении и для записей журнала FileStore.
+//Конкурентно безопасный метод.
+func (store *EventStore) putBatch(puts []Event, deletes []int, deleted time.Time, by Author) {
 	store.mutex.Lock()
 	defer store.mutex.Unlock()
 
-	delete(store.m, id)
+	store.setBatch(puts, deletes, deleted, by)
+}
 
-	return true, nil
+//putChanges применяет изменения пакета по порядку под одной блокировкой.
+//Конкурентно безопасный метод.
+func (store *EventStore) putChanges(changes []storeChange, deleted time.Time, by Author) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.setChanges(changes, deleted, by)
+}
+
+//applyBatch атомарно применяет пакет: либо все изменения, либо (при ErrBatchConflict) ни одного.
+//Возвращает соответствие id новых событий в копии и в хранилище.
+//Конкурентно безопасный метод.
+func (store *EventStore) applyBatch(batch storeBatch, by Author) (map[int]int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	ids, err := store.checkBatch(batch)
+	if err != nil {
+		return nil, err
+	}
+	store.setChanges(remapBatch(batch.changes, ids), store.now(), by)
+	return ids, nil
 }
@@ -1,12 +1,21 @@
 package main
 
 import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
+//newEvent собирает одиночное событие для сохранения
+func newEvent(userID int, text string, date time.Time) Event {
+	return Event{UserID: userID, Text: text, Date: JSONTime(date)}
+}
+
 func TestNewEventStore(t *testing.T) {
 	res := NewEventStore()
 	assert.NotNil(t, res)
@@ -15,15 +24,15 @@ func TestNewEventStore(t *testing.T) {
 func TestSave(t *testing.T) {
 	events := NewEventStore()
 
-	events.Save("123", time.Now())
-	events.Save("123", time.Now())
+	events.Save(newEvent(1, "123", time.Now()), Author{})
+	events.Save(newEvent(1, "123", time.Now()), Author{})
 
 	assert.Equal(t, len(events.m), 2)
 }
 
 func TestLoad(t *testing.T) {
 	events := NewEventStore()
-	events.Save("123", time.Now())
+	events.Save(newEvent(1, "123", time.Now()), Author{})
 
 	event, ok := events.Load(1)
 	assert.True(t, ok)
@@ -32,9 +41,9 @@ func TestLoad(t *testing.T) {
 
 func TestChange(t *testing.T) {
 	events := NewEventStore()
-	events.Save("123", time.Now())
+	events.Save(newEvent(1, "123", time.Now()), Author{})
 
-	ok, err := events.Change(1, "1234", time.Time{})
+	_, ok, err := events.Change(1, 1, time.Time{}, EventChange{Text: "1234"}, 0, Author{})
 	assert.True(t, ok)
 	assert.Nil(t, err)
 
@@ -43,40 +52,79 @@ func TestChange(t *testing.T) {
 	assert.Equal(t, event.Text, "1234")
 }
 
-func TestGetTodays(t *testing.T) {
+func TestChangeForeign(t *testing.T) {
 	events := NewEventStore()
-	events.Save("123", time.Now())
-	events.Save("123", time.Now())
-	events.Save("123", time.Date(2021, 12, 12, 0, 0, 0, 0, time.Now().Location()))
-	events.Save("123", time.Date(2021, 27, 12, 0, 0, 0, 0, time.Now().Location()))
+	events.Save(newEvent(1, "123", time.Now()), Author{})
 
-	result, err := events.GetTodays()
+	_, ok, err := events.Change(2, 1, time.Time{}, EventChange{Text: "1234"}, 0, Author{})
+	assert.False(t, ok)
 	assert.Nil(t, err)
-	assert.Equal(t, len(result), 2)
+
+	_, ok, err = events.Delete(2, 1, time.Time{}, 0, Author{})
+	assert.False(t, ok)
+	assert.Nil(t, err)
+
+	event, ok := events.Load(1)
+	assert.True(t, ok)
+	assert.Equal(t, event.Text, "123")
 }
 
-func TestGetThisWeeks(t *testing.T) {
+func TestDelete(t *testing.T) {
 	events := NewEventStore()
-	events.Save("123", time.Now())
-	events.Save("123", time.Now())
-	events.Save("123", time.Date(2021, 05, 12, 0, 0, 0, 0, time.Now().Location()))
-	events.Save("123", time.Date(2021, 01, 12, 0, 0, 0, 0, time.Now().Location()))
+	events.Save(newEvent(1, "123", time.Now()), Author{})
 
-	result, err := events.GetThisWeeks()
+	_, ok, err := events.Delete(1, 1, time.Time{}, 0, Author{})
+	assert.True(t, ok)
 	assert.Nil(t, err)
-	assert.Equal(t, len(result), 2)
+	assert.Equal(t, len(events.m), 0)
+	assert.Equal(t, len(events.byUser), 0)
 }
 
-func TestGetThisMonths(t *testing.T) {
+func TestChangeVersion(t *testing.T) {
 	events := NewEventStore()
-	events.Save("123", time.Now())
-	events.Save("123", time.Now())
-	events.Save("123", time.Date(2021, 05, 11, 0, 0, 0, 0, time.Now().Location()))
-	events.Save("123", time.Date(2021, 01, 11, 0, 0, 0, 0, time.Now().Location()))
+	saved, _ := events.Save(newEvent(1, "123", time.Now()), Author{})
+	assert.Equal(t, saved.Version, 1)
 
-	result, err := events.GetThisMonths()
+	changed, ok, err := events.Change(1, 1, time.Time{}, EventChange{Text: "1234"}, 1, Author{})
+	assert.True(t, ok)
 	assert.Nil(t, err)
-	assert.Equal(t, len(result), 2)
+	assert.Equal(t, changed.Version, 2)
+
+	//изменение от устаревшей версии не применяется
+	_, ok, err = events.Change(1, 1, time.Time{}, EventChange{Text: "lost"}, 1, Author{})
+	assert.True(t, ok)
+	assert.Equal(t, err, ErrVersionMismatch)
+
+	_, ok, err = events.Delete(1, 1, time.Time{}, 1, Author{})
+	assert.True(t, ok)
+	assert.Equal(t, err, ErrVersionMismatch)
+
+	event, _ := events.Load(1)
+	assert.Equal(t, event.Text, "1234")
+	assert.Equal(t, event.Version, 2)
+}
+
+func TestChangeConcurrent(t *testing.T) {
+	events := NewEventStore()
+	events.Save(newEvent(1, "0", time.Now()), Author{})
+
+	//все клиенты правят событие от версии 1: применяется ровно одно изменение
+	var wg sync.WaitGroup
+	var applied int32
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, _, err := events.Change(1, 1, time.Time{}, EventChange{Text: strconv.Itoa(i)}, 1, Author{}); err == nil {
+				atomic.AddInt32(&applied, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	event, _ := events.Load(1)
+	assert.Equal(t, applied, int32(1))
+	assert.Equal(t, event.Version, 2)
 }
 
 func TestGetBetween(t *testing.T) {
@@ -85,15 +133,35 @@ func TestGetBetween(t *testing.T) {
 	between := time.Now()
 	end := time.Now()
 
-	events.Save("123", between)
-	events.Save("123", time.Date(2021, 05, 11, 0, 0, 0, 0, time.Now().Location()))
-	events.Save("123", time.Date(2021, 01, 11, 0, 0, 0, 0, time.Now().Location()))
+	events.Save(newEvent(1, "123", between), Author{})
+	events.Save(newEvent(1, "123", time.Date(2021, 05, 11, 0, 0, 0, 0, time.Now().Location())), Author{})
+	events.Save(newEvent(1, "123", time.Date(2021, 01, 11, 0, 0, 0, 0, time.Now().Location())), Author{})
 
-	result, err := events.getBetween(start, end)
+	result, err := events.getBetween(1, start, end)
 	assert.Nil(t, err)
 	assert.Equal(t, len(result), 1)
 }
 
+func TestGetBetweenByUser(t *testing.T) {
+	events := NewEventStore()
+	now := time.Now()
+
+	events.Save(newEvent(1, "123", now), Author{})
+	events.Save(newEvent(2, "123", now), Author{})
+	events.Save(newEvent(2, "123", now), Author{})
+
+	result, err := events.getBetween(2, now, now)
+	assert.Nil(t, err)
+	assert.Equal(t, len(result), 2)
+	for _, event := range result {
+		assert.Equal(t, event.UserID, 2)
+	}
+
+	result, err = events.getBetween(3, now, now)
+	assert.Nil(t, err)
+	assert.Equal(t, len(result), 0)
+}
+
 func TestInTimeSpan(t *testing.T) {
 	start := time.Now()
 	between := time.Now()
@@ -102,3 +170,41 @@ func TestInTimeSpan(t *testing.T) {
 	result := inTimeSpan(start, end, between)
 	assert.True(t, result)
 }
+
+func TestJSONTime(t *testing.T) {
+	moscow, err := loadLocation("Europe/Moscow")
+	assert.Nil(t, err)
+	original := JSONTime(time.Date(2021, 12, 6, 14, 30, 0, 0, moscow))
+
+	data, err := json.Marshal(original)
+	assert.Nil(t, err)
+	assert.Equal(t, string(data), `"2021-12-06T14:30:00+03:00"`)
+
+	var parsed JSONTime
+	assert.Nil(t, json.Unmarshal(data, &parsed))
+	assert.True(t, time.Time(parsed).Equal(time.Time(original)))
+
+	assert.Nil(t, json.Unmarshal([]byte(`"06-12-2021"`), &parsed))
+	assert.True(t, time.Time(parsed).Equal(day(2021, 12, 6)))
+
+	assert.NotNil(t, json.Unmarshal([]byte(`"yesterday"`), &parsed))
+}
+
+func TestGetBetweenOverlap(t *testing.T) {
+	events := NewEventStore()
+	start := time.Date(2021, 12, 6, 23, 0, 0, 0, time.UTC)
+
+	event := newEvent(1, "night shift", start)
+	event.End = JSONTime(start.Add(2 * time.Hour))
+	events.Save(event, Author{})
+
+	dayStart, dayEnd := dayBounds(day(2021, 12, 7))
+	result, err := events.getBetween(1, dayStart, dayEnd)
+	assert.Nil(t, err)
+	assert.Equal(t, len(result), 1)
+
+	dayStart, dayEnd = dayBounds(day(2021, 12, 8))
+	result, err = events.getBetween(1, dayStart, dayEnd)
+	assert.Nil(t, err)
+	assert.Equal(t, len(result), 0)
+}
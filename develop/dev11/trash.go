@@ -0,0 +1,204 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+//Trashed удаленное событие в корзине: его последнее состояние и время удаления.
+//Корзина очищается фоновой уборкой (Janitor) через срок хранения.
+type Trashed struct {
+	Event   Event    `json:"Event"`
+	Deleted JSONTime `json:"Deleted"`
+}
+
+//discard убирает событие из хранилища в корзину со временем удаления deleted
+//(нулевое - безвозвратно) от имени by. Вызывается под store.mutex.
+func (store *EventStore) discard(event Event, deleted time.Time, by Author) {
+	store.unset(event, by)
+	if !deleted.IsZero() {
+		store.trash[event.ID] = Trashed{Event: event, Deleted: JSONTime(deleted)}
+	}
+}
+
+//putTrashed кладет событие в корзину при восстановлении.
+//Конкурентно безопасный метод.
+func (store *EventStore) putTrashed(t Trashed) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.trash[t.Event.ID] = t
+	if t.Event.ID >= store.nextID {
+		store.nextID = t.Event.ID + 1
+	}
+}
+
+//trashed выдает события владельца из корзины, последние удаленные первыми.
+//Конкурентно безопасный метод.
+func (store *EventStore) trashed(userID int) []Trashed {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	result := make([]Trashed, 0)
+	for _, t := range store.trash {
+		if t.Event.UserID == userID {
+			result = append(result, t)
+		}
+	}
+	sortTrashed(result)
+	return result
+}
+
+//sortTrashed сортирует события корзины: последние удаленные первыми, при равном времени - по id
+func sortTrashed(trash []Trashed) {
+	sort.Slice(trash, func(i, j int) bool {
+		a, b := time.Time(trash[i].Deleted), time.Time(trash[j].Deleted)
+		if !a.Equal(b) {
+			return a.After(b)
+		}
+		return trash[i].Event.ID < trash[j].Event.ID
+	})
+}
+
+//loadTrashed получает событие из корзины по id.
+//Конкурентно безопасный метод.
+func (store *EventStore) loadTrashed(id int) (Trashed, bool) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	t, ok := store.trash[id]
+	return t, ok
+}
+
+//purgeTrash безвозвратно удаляет из корзины события, удаленные раньше before.
+//Возвращает число удаленных событий.
+//Конкурентно безопасный метод.
+func (store *EventStore) purgeTrash(before time.Time) (int, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return store.purge(before), nil
+}
+
+//purge удаляет из корзины события, удаленные раньше before. Вызывается под store.mutex.
+func (store *EventStore) purge(before time.Time) int {
+	purged := 0
+	for id, t := range store.trash {
+		if time.Time(t.Deleted).Before(before) {
+			delete(store.trash, id)
+			purged++
+		}
+	}
+	return purged
+}
+
+//endedBefore проверяет, что событие, а у серии - все ее вхождения закончились раньше before.
+//Бесконечная серия не заканчивается никогда.
+func endedBefore(event Event, before time.Time) bool {
+	if event.Recurrence == nil {
+		return time.Time(event.End).Before(before)
+	}
+	if event.Recurrence.Count == 0 && event.Recurrence.Until == nil {
+		return false
+	}
+	return len(expand(event, before, maxTime)) == 0
+}
+
+//ended выдает события, закончившиеся раньше before, в порядке id. Вызывается под store.mutex.
+func (store *EventStore) ended(before time.Time) []Event {
+	result := make([]Event, 0)
+	for _, event := range store.m {
+		if endedBefore(event, before) {
+			result = append(result, event)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
+
+//getEnded выдает события, закончившиеся раньше before, в порядке id.
+//Конкурентно безопасный метод.
+func (store *EventStore) getEnded(before time.Time) ([]Event, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	return store.ended(before), nil
+}
+
+//unchanged отбирает события, которые лежат в хранилище в той же версии. Вызывается под store.mutex.
+func (store *EventStore) unchanged(events []Event) []Event {
+	result := make([]Event, 0, len(events))
+	for _, event := range events {
+		if el, ok := store.m[event.ID]; ok && el.Version == event.Version {
+			result = append(result, el)
+		}
+	}
+	return result
+}
+
+//expunge безвозвратно удаляет события мимо корзины от имени by, если они не менялись
+//с выборки events; изменившиеся и уже удаленные остаются как есть.
+//Возвращает удаленные события.
+//Конкурентно безопасный метод.
+func (store *EventStore) expunge(events []Event, by Author) ([]Event, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	removed := store.unchanged(events)
+	for _, event := range removed {
+		store.unset(event, by)
+	}
+	return removed, nil
+}
+
+//Trash выдает корзину пользователя: его удаленные события и удаленные события календарей,
+//открытых ему на запись, последние удаленные первыми
+func (s *Service) Trash(userID int) []Trashed {
+	result := s.storage.trashed(userID)
+	for ownerID := range s.sharedCalendars(userID) {
+		for _, t := range s.storage.trashed(ownerID) {
+			if s.canAccess(userID, t.Event, ShareWrite) {
+				result = append(result, t)
+			}
+		}
+	}
+	sortTrashed(result)
+	return result
+}
+
+//RestoreTrashed возвращает событие id из корзины в его календарь с новой версией.
+//Участники удаленного события получили отмену, поэтому восстанавливается оно без них.
+//Восстанавливать может владелец и пользователь, которому календарь события открыт на запись;
+//событие удаленного календаря восстановить нельзя (ErrCalendarNotFound).
+//Возвращает восстановленное событие, флаг наличия события в корзине пользователя и ошибку восстановления.
+func (s *Service) RestoreTrashed(userID int, id int) (Event, bool, error) {
+	s.calendarWrites.RLock()
+	defer s.calendarWrites.RUnlock()
+
+	t, ok := s.storage.loadTrashed(id)
+	if !ok || !s.canAccess(userID, t.Event, ShareWrite) {
+		return Event{}, false, nil
+	}
+
+	event := t.Event
+	if event.CalendarID != 0 {
+		if err := s.checkCalendar(userID, event.UserID, event.CalendarID); err != nil {
+			return Event{}, true, err
+		}
+	} else if userID != event.UserID {
+		return Event{}, true, ErrCalendarNotFound
+	}
+	event.Attendees = nil
+	conflicts, err := s.checkConflicts(event)
+	if err != nil {
+		return Event{}, true, err
+	}
+
+	event.Version++
+	restored, err := s.storage.Restore(event, Author{UserID: userID, Action: ChangeRestored})
+	if err != nil {
+		return Event{}, true, err
+	}
+	restored.Conflicts = conflicts
+	return restored, true, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//apiTrashPath путь корзины REST API
+const apiTrashPath = "/api/v1/trash"
+
+//apiTrash обработчик корзины /api/v1/trash:
+//GET - удаленные события пользователя и календарей, открытых ему на запись, последние удаленные первыми.
+func (h *Handler) apiTrash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeJSONMessage(w, http.StatusMethodNotAllowed, fmt.Sprintf("expect method GET at %s, got %v", apiTrashPath, r.Method), true)
+		return
+	}
+
+	userID, status, err := resolveUserID(r, r.URL.Query().Get("user_id"))
+	if err != nil {
+		writeJSONMessage(w, status, err.Error(), true)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Trash []Trashed `json:"Result"`
+	}{Trash: h.service.Trash(userID)})
+}
+
+//apiTrashed обработчик ресурса /api/v1/trash/{id}/restore:
+//POST - возврат события из корзины, отвечает восстановленным событием.
+func (h *Handler) apiTrashed(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, apiTrashPath+"/"), "/")
+	id, err := strconv.Atoi(parts[0])
+	if id <= 0 || err != nil || len(parts) != 2 || parts[1] != "restore" {
+		writeJSONMessage(w, http.StatusNotFound, fmt.Sprintf("Unknown resource %s", r.URL.Path), true)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeJSONMessage(w, http.StatusMethodNotAllowed, fmt.Sprintf("expect method POST at %s/{id}/restore, got %v", apiTrashPath, r.Method), true)
+		return
+	}
+
+	userID, status, err := resolveUserID(r, r.URL.Query().Get("user_id"))
+	if err != nil {
+		writeJSONMessage(w, status, err.Error(), true)
+		return
+	}
+
+	event, isExists, err := h.service.RestoreTrashed(userID, id)
+	if err == nil && !isExists {
+		writeJSONMessage(w, http.StatusNotFound, fmt.Sprintf("No event with id %d in trash", id), true)
+		return
+	}
+	writeAPIResult(w, id, event, isExists, err, "Can't restore event")
+}
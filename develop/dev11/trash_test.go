@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrash(t *testing.T) {
+	service, store := newTestService()
+	store.now = func() time.Time { return fixedNow }
+	work, _ := service.CreateCalendar(1, "work")
+	service.ShareCalendar(1, work.ID, 2, ShareWrite)
+	service.ShareCalendar(1, work.ID, 3, ShareRead)
+
+	own, _ := service.SaveEvent(newEvent(1, "dentist", fixedNow))
+	shared := newEvent(1, "standup", fixedNow)
+	shared.CalendarID = work.ID
+	shared, _ = service.SaveEvent(shared)
+	service.Invite(1, shared.ID, []int{4})
+
+	service.DeleteEvent(1, own.ID, time.Time{}, 0)
+	service.DeleteEvent(2, shared.ID, time.Time{}, 0)
+
+	//удаленные события пропадают из выдач, но лежат в корзине
+	result, _ := service.GetDay(1, fixedNow)
+	assert.Empty(t, result)
+	_, ok := service.GetEvent(1, own.ID)
+	assert.False(t, ok)
+	assert.Equal(t, len(service.Trash(1)), 2)
+	assert.Equal(t, time.Time(service.Trash(1)[0].Deleted), fixedNow)
+
+	//писатель видит в корзине события общего календаря, читатель - нет
+	trash := service.Trash(2)
+	assert.Equal(t, len(trash), 1)
+	assert.Equal(t, trash[0].Event.ID, shared.ID)
+	assert.Empty(t, service.Trash(3))
+	_, ok, _ = service.RestoreTrashed(3, shared.ID)
+	assert.False(t, ok)
+	_, ok, _ = service.RestoreTrashed(2, own.ID)
+	assert.False(t, ok)
+
+	restored, ok, err := service.RestoreTrashed(2, shared.ID)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	assert.Equal(t, restored.Version, shared.Version+2)
+	assert.Empty(t, restored.Attendees)
+	event, ok := service.GetEvent(3, shared.ID)
+	assert.True(t, ok)
+	assert.Equal(t, event.Text, "standup")
+	_, ok, _ = service.RestoreTrashed(2, shared.ID)
+	assert.False(t, ok)
+	history, _ := service.History(1, shared.ID)
+	assert.Equal(t, history[len(history)-1].Action, ChangeRestored)
+	assert.Equal(t, history[len(history)-1].Actor, 2)
+
+	//события удаленного календаря попадают в корзину, но вернуть их некуда
+	service.DeleteCalendar(1, work.ID)
+	assert.Equal(t, len(service.Trash(1)), 2)
+	_, ok, err = service.RestoreTrashed(1, shared.ID)
+	assert.True(t, ok)
+	assert.ErrorIs(t, err, ErrCalendarNotFound)
+
+	//восстановление по журналу аудита тоже достает событие из корзины
+	_, _, err = service.RestoreEvent(1, own.ID, 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, len(service.Trash(1)), 1)
+}
+
+func TestJanitor(t *testing.T) {
+	service, store := newTestService()
+	archive := filepath.Join(t.TempDir(), "archive", "archive.jsonl")
+	janitor, err := NewJanitor(service, RetentionConfig{Interval: time.Hour, Trash: 24 * time.Hour,
+		ArchiveAfter: 30 * 24 * time.Hour, Archive: archive})
+	assert.Nil(t, err)
+	now := day(2022, 3, 1)
+	janitor.now = func() time.Time { return now }
+
+	old, _ := service.SaveEvent(newEvent(1, "old", day(2021, 12, 1)))
+	recent, _ := service.SaveEvent(newEvent(1, "recent", day(2022, 2, 20)))
+	series := newEvent(1, "course", day(2021, 12, 1))
+	series.Recurrence = &Recurrence{Freq: "weekly", Count: 4}
+	series, _ = service.SaveEvent(series)
+	endless := newEvent(1, "gym", day(2021, 12, 1))
+	endless.Recurrence = &Recurrence{Freq: "weekly"}
+	endless, _ = service.SaveEvent(endless)
+
+	store.now = func() time.Time { return now.Add(-48 * time.Hour) }
+	gone, _ := service.SaveEvent(newEvent(1, "gone", day(2022, 2, 25)))
+	service.DeleteEvent(1, gone.ID, time.Time{}, 0)
+	store.now = func() time.Time { return now.Add(-time.Hour) }
+	kept, _ := service.SaveEvent(newEvent(1, "kept", day(2022, 2, 25)))
+	service.DeleteEvent(1, kept.ID, time.Time{}, 0)
+
+	assert.Nil(t, janitor.Sweep())
+
+	//из корзины ушло только пролежавшее дольше суток
+	trash := service.Trash(1)
+	assert.Equal(t, len(trash), 1)
+	assert.Equal(t, trash[0].Event.ID, kept.ID)
+
+	//в архив ушли закончившиеся месяц назад событие и конечная серия
+	all, _ := service.GetAll(1)
+	ids := []int{}
+	for _, event := range all {
+		ids = append(ids, event.ID)
+	}
+	assert.Equal(t, ids, []int{recent.ID, endless.ID})
+
+	data, err := os.ReadFile(archive)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Equal(t, len(lines), 2)
+	var archived Event
+	assert.Nil(t, json.Unmarshal([]byte(lines[1]), &archived))
+	assert.Equal(t, archived.ID, series.ID)
+	assert.Equal(t, archived.Recurrence.Count, 4)
+
+	//журнал аудита по умолчанию хранится всегда, перенос в архив записан от имени системы
+	history, _ := service.History(1, old.ID)
+	assert.Equal(t, len(history), 2)
+	assert.Equal(t, history[1].Action, ChangeArchived)
+	assert.Equal(t, history[1].Actor, 0)
+
+	//повторный проход ничего не меняет
+	assert.Nil(t, janitor.Sweep())
+	data, _ = os.ReadFile(archive)
+	assert.Equal(t, strings.Count(string(data), "\n"), 2)
+
+	//с retention.audit записи старше срока удаляются
+	janitor, _ = NewJanitor(service, RetentionConfig{Interval: time.Hour, Audit: 24 * time.Hour})
+	janitor.now = func() time.Time { return now }
+	assert.Nil(t, janitor.Sweep())
+	_, ok := service.History(1, old.ID)
+	assert.False(t, ok)
+
+	_, err = NewJanitor(service, RetentionConfig{Interval: time.Hour, ArchiveAfter: time.Hour})
+	assert.NotNil(t, err)
+}
+
+func TestArchiveChangedEvent(t *testing.T) {
+	service, _ := newTestService()
+	first, _ := service.SaveEvent(newEvent(1, "old", day(2021, 11, 1)))
+	second, _ := service.SaveEvent(newEvent(1, "older", day(2021, 10, 1)))
+
+	//архив пишется без блокировки хранилища: событие можно изменить, пока идет запись,
+	//и тогда оно остается в хранилище
+	archived, err := service.ArchiveEnded(day(2021, 12, 1), func(events []Event) error {
+		assert.Equal(t, len(events), 2)
+		_, _, err := service.ChangeEvent(1, second.ID, time.Time{}, EventChange{Text: "kept"}, 0)
+		return err
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, len(archived), 1)
+	assert.Equal(t, archived[0].ID, first.ID)
+	all, _ := service.GetAll(1)
+	assert.Equal(t, eventTexts(all), []string{"kept"})
+}
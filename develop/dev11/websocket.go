@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Минимальная серверная часть WebSocket (RFC 6455) для ленты изменений:
+//сервер шлет текстовые кадры, от клиента принимаются только управляющие кадры.
+
+//websocketGUID константа из RFC 6455 для вычисления Sec-WebSocket-Accept
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+//Коды операций кадров
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xA
+)
+
+//wsMaxClientFrame максимальная длина кадра от клиента: ленте от него нужны только управляющие кадры
+const wsMaxClientFrame = 4096
+
+//errWSClosed соединение закрыто клиентом
+var errWSClosed = errors.New("websocket closed")
+
+//wsConn соединение WebSocket после рукопожатия
+type wsConn struct {
+	conn   net.Conn
+	rw     *bufio.ReadWriter
+	mutex  sync.Mutex
+	closed chan struct{}
+	once   sync.Once
+}
+
+//isWebSocket проверяет, просит ли клиент перейти на WebSocket
+func isWebSocket(r *http.Request) bool {
+	return headerHasToken(r.Header, "Connection", "upgrade") && headerHasToken(r.Header, "Upgrade", "websocket")
+}
+
+//headerHasToken ищет значение в заголовке со списком через запятую
+func headerHasToken(h http.Header, name string, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//upgradeWebSocket выполняет рукопожатие и забирает соединение у http.Server.
+//Возвращает: соединение и ошибку; при ошибке ответ клиенту уже записан.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		writeJSONMessage(w, http.StatusBadRequest, "Bad websocket handshake", true)
+		return nil, errors.New("bad websocket handshake")
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		writeJSONMessage(w, http.StatusInternalServerError, "Websocket is not supported", true)
+		return nil, err
+	}
+	//дедлайны http.Server к захваченному соединению не относятся
+	conn.SetDeadline(time.Time{})
+
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	ws := &wsConn{conn: conn, rw: rw, closed: make(chan struct{})}
+	go ws.readLoop()
+	return ws, nil
+}
+
+//writeFrame отправляет кадр без маски (кадры сервера не маскируются)
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) error {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+
+	ws.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := ws.rw.Write(header); err != nil {
+		return err
+	}
+	if _, err := ws.rw.Write(payload); err != nil {
+		return err
+	}
+	return ws.rw.Flush()
+}
+
+//WriteText отправляет текстовое сообщение
+func (ws *wsConn) WriteText(data []byte) error {
+	return ws.writeFrame(wsText, data)
+}
+
+//readLoop читает кадры клиента: отвечает на ping, на close закрывает соединение.
+//Данные от клиента ленте не нужны и пропускаются.
+func (ws *wsConn) readLoop() {
+	defer ws.shutdown()
+
+	for {
+		opcode, payload, err := ws.readFrame()
+		if err != nil {
+			return
+		}
+		switch opcode {
+		case wsPing:
+			if ws.writeFrame(wsPong, payload) != nil {
+				return
+			}
+		case wsClose:
+			ws.writeFrame(wsClose, payload)
+			return
+		}
+	}
+}
+
+//readFrame читает один кадр клиента и снимает с него маску
+func (ws *wsConn) readFrame() (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(ws.rw, head[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode := head[0] & 0x0F
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7F)
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(ws.rw, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(ws.rw, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	//кадры клиента обязаны быть замаскированы
+	if !masked || length > wsMaxClientFrame {
+		return 0, nil, errWSClosed
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(ws.rw, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(ws.rw, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
+
+//Closed канал, закрывающийся при разрыве соединения
+func (ws *wsConn) Closed() <-chan struct{} {
+	return ws.closed
+}
+
+//Close отправляет кадр закрытия и закрывает соединение
+func (ws *wsConn) Close() error {
+	ws.writeFrame(wsClose, []byte{0x03, 0xE9}) //1001 going away
+	ws.shutdown()
+	return nil
+}
+
+//shutdown закрывает соединение один раз
+func (ws *wsConn) shutdown() {
+	ws.once.Do(func() {
+		close(ws.closed)
+		ws.conn.Close()
+	})
+}